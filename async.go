@@ -0,0 +1,274 @@
+package minidb
+
+import (
+	"github.com/pingcap/errors"
+	"sync/atomic"
+)
+
+// asyncPut is a write queued by PutAsync or PutSequenced.
+type asyncPut struct {
+	key []byte
+	val []byte
+	cb  func(error)
+}
+
+// asyncWriter applies the queued writes in order.
+type asyncWriter struct {
+	ch     chan *asyncPut
+	closed bool
+	done   chan struct{}
+}
+
+func (db *DB) startAsyncWriter() {
+	db.async = &asyncWriter{
+		ch:   make(chan *asyncPut, db.opt.AsyncQueueSize),
+		done: make(chan struct{}),
+	}
+	go func(aw *asyncWriter) {
+		defer close(aw.done)
+		batch := make([]*asyncPut, 0, cap(aw.ch)+1)
+		for p := range aw.ch {
+			// Take the writes queued meanwhile as well, so they share one lock acquisition
+			batch = append(batch[:0], p)
+			for n := len(aw.ch); n > 0; n-- {
+				batch = append(batch, <-aw.ch)
+			}
+			db.applyPuts(batch)
+		}
+	}(db.async)
+}
+
+// applyPuts writes the batch in order, then calls the callbacks. The entries are
+// written with a single write per log file while holding only db.writeMu, which orders them
+// against other writers, so readers are not blocked on the disk I/O. db.mu is held
+// before the write to check the quota and assign the write sequences, and after it
+// to update keyDir, so keyDir reflects the order in which entries are written.
+func (db *DB) applyPuts(batch []*asyncPut) {
+	errs := make([]error, len(batch))
+	for i, p := range batch {
+		errs[i] = db.checkKey(p.key)
+	}
+	db.writePuts(batch, errs)
+	for i, p := range batch {
+		if p.cb != nil {
+			p.cb(errs[i])
+		}
+	}
+}
+
+// writePuts writes the puts of batch which have no error yet, and records the
+// result of each in errs. They are written in runs, the active log file being
+// rotated after each like after a Put, so that a batch grows the file past
+// opt.LogFileSize by one entry at most.
+func (db *DB) writePuts(batch []*asyncPut, errs []error) {
+	for len(batch) > 0 {
+		n := db.writePutRun(batch, errs)
+		batch, errs = batch[n:], errs[n:]
+	}
+}
+
+// writePutRun writes the puts at the start of batch up to the one which fills the
+// active log file, see dbFile.rotateIfFull, rotates it if so, and returns the number
+// of puts it went through.
+func (db *DB) writePutRun(batch []*asyncPut, errs []error) int {
+	df := &db.dbFile
+	entries := make([]*Entry, len(batch))
+	var buf []byte
+
+	db.lockWrite(LockOpPutAsync)
+	defer db.writeMu.Unlock()
+	alf := df.activeLogFile()
+	offset := df.writableOffset()
+	fileEntries := atomic.LoadUint32(&df.activeEntries)
+	valueBytes := db.valueBytes
+	// vLens holds the value sizes of the keys put earlier in the run.
+	vLens := make(map[string]uint64, len(batch))
+	n := len(batch)
+	for i, p := range batch {
+		if errs[i] != nil {
+			continue
+		}
+		if alf == nil {
+			errs[i] = errors.New("Unable to find the active log file")
+			continue
+		}
+		if errs[i] = checkEntrySize(p.key, p.val); errs[i] != nil {
+			continue
+		}
+		// Check quota, an overwritten value no longer counts
+		size := valueBytes + int64(len(p.val))
+		if vLen, ok := vLens[string(p.key)]; ok {
+			size -= int64(vLen)
+		} else if old, ok := db.keyDir.get(p.key); ok {
+			size -= int64(old.vLen)
+		}
+		if db.opt.MaxTotalValueBytes > 0 && size > db.opt.MaxTotalValueBytes {
+			errs[i] = ErrQuotaExceeded
+			continue
+		}
+		e := NewEntry(p.key, p.val, Normal)
+		df.stamp(e)
+		b, err := encodeEntry(e, db.opt.Codec)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		buf = append(buf, b...)
+		fileEntries++
+		entries[i] = e
+		// The value counts compressed from now on, see putEntry.
+		valueBytes = size - int64(len(p.val)) + int64(e.vLen)
+		vLens[string(p.key)] = e.vLen
+		if offset+uint64(len(buf)) > uint64(df.opt.LogFileSize) ||
+			df.opt.MaxEntriesPerFile > 0 && fileEntries >= uint32(df.opt.MaxEntriesPerFile) {
+			n = i + 1
+			break
+		}
+	}
+	db.mu.Unlock()
+	if len(buf) == 0 {
+		return n
+	}
+
+	// Nothing but writers holding db.writeMu moves the end of the active log file,
+	// and readers only look at the entries before it.
+	if debugMode {
+		if err := alf.checkWriteOffset(df.writableOffset()); err != nil {
+			failPuts(entries, errs, err)
+			return n
+		}
+	}
+	if err := alf.writeAll(buf); err != nil {
+		failPuts(entries, errs, errors.Wrapf(err, "Error while writing log file fid %d", alf.fid))
+		return n
+	}
+
+	db.lock(LockOpPutAsync)
+	defer db.mu.Unlock()
+	last := -1
+	for i, e := range entries {
+		if e == nil {
+			continue
+		}
+		lo, err := df.appended(alf, e)
+		if err != nil {
+			failPuts(entries[i:], errs[i:], err)
+			return n
+		}
+		// Update index
+		if old, ok := db.keyDir.get(e.key); ok {
+			db.valueBytes -= int64(old.vLen)
+		}
+		db.valueBytes += int64(e.vLen)
+		db.keyDir.set(e.key, lo)
+		db.counters.puts.Add(1)
+		last = i
+	}
+	if n := db.keyDir.len(); n > db.keyDirPeak {
+		db.keyDirPeak = n
+	}
+	if last >= 0 {
+		db.waiters.notify()
+	}
+	// Like Put, the write which fills the file reports a failed rotation.
+	if err := df.rotateIfFull(alf); err != nil {
+		errs[last] = err
+	}
+	return n
+}
+
+// failPuts records err for the puts which have an entry.
+func failPuts(entries []*Entry, errs []error, err error) {
+	for i, e := range entries {
+		if e != nil {
+			errs[i] = err
+		}
+	}
+}
+
+// stopAsyncWriter stops accepting new writes and waits for the queued ones to finish.
+func (db *DB) stopAsyncWriter() {
+	db.asyncMu.Lock()
+	aw := db.async
+	if aw.closed {
+		db.asyncMu.Unlock()
+		return
+	}
+	aw.closed = true
+	close(aw.ch)
+	db.asyncMu.Unlock()
+	<-aw.done
+}
+
+// PutAsync queues a key-value pair to be written by a background goroutine, and calls cb
+// with the result of the write once it is done. Writes are applied in the order they
+// are queued. When the queue is full, PutAsync blocks until there is room, or calls cb
+// with ErrAsyncQueueFull if "opt.AsyncNonBlocking" is set. Close waits for the queued
+// writes to finish. The key and value are copied, so they can be reused after returning.
+func (db *DB) PutAsync(key, val []byte, cb func(error)) {
+	fail := func(err error) {
+		if cb != nil {
+			cb(err)
+		}
+	}
+	if err := db.writable(); err != nil {
+		fail(err)
+		return
+	}
+	if len(key) == 0 {
+		fail(ErrEmptyKey)
+		return
+	}
+	if err := checkEntrySize(key, val); err != nil {
+		fail(err)
+		return
+	}
+
+	p := &asyncPut{
+		key: append([]byte(nil), key...),
+		val: append([]byte(nil), val...),
+		cb:  cb,
+	}
+	db.asyncMu.RLock()
+	defer db.asyncMu.RUnlock()
+	if db.async.closed {
+		fail(ErrDatabaseClosed)
+		return
+	}
+	if !db.opt.AsyncNonBlocking {
+		db.async.ch <- p
+		return
+	}
+	select {
+	case db.async.ch <- p:
+	default:
+		fail(ErrAsyncQueueFull)
+	}
+}
+
+// PutSequenced writes a key-value pair through the same queue and background goroutine
+// as PutAsync, and waits for the write to finish. Writes from concurrent callers are
+// applied in the order they are queued, and those queued meanwhile are applied under a
+// single lock acquisition, which reduces lock contention among many writers. When the
+// queue is full, it blocks until there is room. It must not be called from a PutAsync
+// callback, which runs on the background goroutine.
+func (db *DB) PutSequenced(key, val []byte) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+
+	done := make(chan error, 1)
+	// The caller waits for the write, so key and value need no copy.
+	p := &asyncPut{key: key, val: val, cb: func(err error) { done <- err }}
+	db.asyncMu.RLock()
+	if db.async.closed {
+		db.asyncMu.RUnlock()
+		return ErrDatabaseClosed
+	}
+	db.async.ch <- p
+	db.asyncMu.RUnlock()
+	return <-done
+}
@@ -0,0 +1,79 @@
+package minidb
+
+import "time"
+
+// autoMergeInterval is how often the auto merger checks the dead space, replaced in tests.
+var autoMergeInterval = 10 * time.Second
+
+// autoMerger merges the database in the background, see Options.AutoMerge.
+type autoMerger struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (db *DB) startAutoMerger() {
+	if !db.opt.AutoMerge || db.readOnly {
+		return
+	}
+	db.autoMerge = &autoMerger{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func(m *autoMerger) {
+		defer close(m.done)
+		ticker := time.NewTicker(autoMergeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				db.mergeIfNeeded()
+			}
+		}
+	}(db.autoMerge)
+}
+
+// stopAutoMerger stops the auto merger and waits for it to exit, which lets a
+// merge it is running finish first.
+func (db *DB) stopAutoMerger() {
+	if db.autoMerge == nil {
+		return
+	}
+	close(db.autoMerge.stop)
+	<-db.autoMerge.done
+}
+
+// PauseMerge keeps the auto merger from starting merges until ResumeMerge is called,
+// e.g. during a burst of writes. A merge already running is not interrupted, and Merge
+// and the other manual merges still run while paused. Pausing twice is the same as
+// pausing once.
+func (db *DB) PauseMerge() {
+	db.mergePaused.Store(true)
+}
+
+// ResumeMerge lets the auto merger start merges again after PauseMerge, the next one
+// on its next check.
+func (db *DB) ResumeMerge() {
+	db.mergePaused.Store(false)
+}
+
+// mergeIfNeeded merges the database if the dead bytes of the sealed log files exceed
+// opt.MergeRatio of their size, unless a merge is running or merges are paused. The
+// active log file is left out, since a merge cannot reclaim its dead entries.
+func (db *DB) mergeIfNeeded() {
+	if db.mergePaused.Load() {
+		return
+	}
+	stats := db.stats(true)
+	if stats.TotalBytes == 0 || float64(stats.ReclaimableBytes) <= db.opt.MergeRatio*float64(stats.TotalBytes) {
+		return
+	}
+	if !db.gcLock.TryLock() {
+		return
+	}
+	defer db.gcLock.Unlock()
+	if err := db.merge(); err != nil {
+		db.opt.Logger.Errorf("Auto merge: %v", err)
+	}
+}
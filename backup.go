@@ -0,0 +1,234 @@
+package minidb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/pingcap/errors"
+	"github.com/yanghao888/minidb/fileutil"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// backupVersion is the layout of the stream written by Backup, which starts with
+// backupMagic and the version, followed by a record per live key: the uvarint lengths
+// of the key and value, then their bytes. A zero key length ends the stream.
+const backupVersion = 1
+
+var backupMagic = []byte("MDBK")
+
+// PhysicalBackup copies the log files, hint files and manifest into destDir while the
+// database stays open, so destDir can be opened as a restored database. Writes after
+// the backup starts are not included. Merge fails with ErrGcWorking during the backup.
+func (db *DB) PhysicalBackup(destDir string) error {
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+	if err := os.MkdirAll(destDir, 0700); err != nil {
+		return errors.Wrapf(err, "Unable to create dir: %q", destDir)
+	}
+	entries, err := os.ReadDir(destDir)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to read dir: %q", destDir)
+	}
+	if len(entries) > 0 {
+		return errors.Errorf("Backup dir is not empty: %q", destDir)
+	}
+
+	// Hold gcLock so that sealed files are not rewritten during copying.
+	db.gcLock.Lock()
+	defer db.gcLock.Unlock()
+	// The database may be closed while waiting.
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+
+	// Snapshot the files, the active file only grows so copying up to
+	// its current end offset is enough.
+	db.rlock(LockOpMaintenance)
+	files := make([]*logFile, len(db.dbFile.files))
+	copy(files, db.dbFile.files)
+	endOffset := int64(db.dbFile.writableOffset())
+	db.mu.RUnlock()
+
+	for i, lf := range files {
+		n := int64(-1)
+		if i == len(files)-1 {
+			n = endOffset
+		}
+		if err = copyFile(lf.path, filepath.Join(destDir, filepath.Base(lf.path)), n); err != nil {
+			return err
+		}
+		idxFilePath := indexFilePath(db.opt.Dir, lf.fid)
+		if _, err = os.Stat(idxFilePath); err == nil {
+			if err = copyFile(idxFilePath, filepath.Join(destDir, filepath.Base(idxFilePath)), -1); err != nil {
+				return err
+			}
+		}
+	}
+	if err = copyFile(filepath.Join(db.opt.Dir, manifestFile), filepath.Join(destDir, manifestFile), -1); err != nil {
+		return err
+	}
+	return syncDir(destDir)
+}
+
+// copyFile copies the first n bytes of src into a new file dst, or the whole file if n < 0.
+func copyFile(src, dst string, n int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to open file: %q", src)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to create file: %q", dst)
+	}
+	if n < 0 {
+		_, err = io.Copy(out, in)
+	} else {
+		_, err = io.CopyN(out, in, n)
+	}
+	if err != nil {
+		out.Close()
+		return errors.Wrapf(err, "Unable to copy file %q to %q", src, dst)
+	}
+	if err = fileutil.Fsync(out); err != nil {
+		out.Close()
+		return errors.Wrapf(err, "Unable to sync file: %q", dst)
+	}
+	return errors.Wrapf(out.Close(), "Unable to close file: %q", dst)
+}
+
+// Backup writes every live key and value to w, which Restore reads back into another
+// database. Unlike PhysicalBackup, only the live pairs are written, in no particular
+// order, so dead entries take no room. The pairs are read under the read lock, which
+// makes the backup consistent, so writes wait until it is done, a slow w included.
+// Expired keys are left out, and the others are restored without their expiry.
+func (db *DB) Backup(w io.Writer) error {
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.Write(backupMagic)
+	bw.WriteByte(backupVersion)
+	if err := db.rlockOpen(LockOpScan); err != nil {
+		return err
+	}
+	defer db.mu.RUnlock()
+	now := nowFunc().UnixNano()
+	var lenBuf [2 * binary.MaxVarintLen64]byte
+	var err error
+	db.keyDir.forEach(func(key string, lo *logOffset) bool {
+		var e *Entry
+		if e, err = db.dbFile.Read(lo); err != nil {
+			return false
+		}
+		if e.expired(now) {
+			return true
+		}
+		n := binary.PutUvarint(lenBuf[:], uint64(len(key)))
+		n += binary.PutUvarint(lenBuf[n:], uint64(len(e.value)))
+		bw.Write(lenBuf[:n])
+		bw.WriteString(key)
+		_, err = bw.Write(e.value)
+		return err == nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "Unable to write backup")
+	}
+	bw.WriteByte(0)
+	return errors.Wrap(bw.Flush(), "Unable to write backup")
+}
+
+// Restore puts the pairs written by Backup, read from r, into the database, which must
+// hold no keys. Pairs are written in batches, like those of ImportFrom, and a failure
+// keeps the pairs written before it.
+func (db *DB) Restore(r io.Reader) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	db.rlock(LockOpScan)
+	n := db.keyDir.len()
+	db.mu.RUnlock()
+	if n > 0 {
+		return errors.Errorf("Unable to restore into %q holding %d keys", db.opt.Dir, n)
+	}
+
+	br := bufio.NewReaderSize(r, importReadSize)
+	header := make([]byte, len(backupMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return errors.Wrap(err, "Unable to read backup header")
+	}
+	if !bytes.Equal(header[:len(backupMagic)], backupMagic) {
+		return errors.New("Invalid backup header")
+	}
+	if header[len(backupMagic)] != backupVersion {
+		return errors.Errorf("Unsupported backup version: %d", header[len(backupMagic)])
+	}
+
+	var (
+		batch []*asyncPut
+		size  int
+	)
+	flush := func() error {
+		errs := make([]error, len(batch))
+		for i, p := range batch {
+			errs[i] = db.checkKey(p.key)
+		}
+		db.writePuts(batch, errs)
+		for _, err := range errs {
+			if err != nil {
+				return errors.Wrap(err, "Unable to restore backup")
+			}
+		}
+		batch, size = batch[:0], 0
+		return nil
+	}
+	for {
+		kLen, err := binary.ReadUvarint(br)
+		if err != nil {
+			return errors.Wrap(unexpectedEOF(err), "Unable to read backup")
+		}
+		if kLen == 0 {
+			break
+		}
+		vLen, err := binary.ReadUvarint(br)
+		if err != nil {
+			return errors.Wrap(unexpectedEOF(err), "Unable to read backup")
+		}
+		if kLen > maxEntrySize || vLen > maxEntrySize-kLen {
+			return ErrEntryTooLarge
+		}
+		buf := make([]byte, kLen+vLen)
+		if _, err = io.ReadFull(br, buf); err != nil {
+			return errors.Wrap(unexpectedEOF(err), "Unable to read backup")
+		}
+		batch = append(batch, &asyncPut{key: buf[:kLen], val: buf[kLen:]})
+		if size += len(buf); size >= importBatchBytes {
+			if err = flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if _, err := br.ReadByte(); err == nil {
+		return errors.New("Unexpected data after the end of backup")
+	} else if err != io.EOF {
+		return errors.Wrap(err, "Unable to read backup")
+	}
+	return nil
+}
+
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF, as a backup must not end
+// before its end mark.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
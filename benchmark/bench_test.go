@@ -10,6 +10,7 @@ import (
 	"math/rand"
 	"os"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -86,3 +87,60 @@ func BenchmarkDB_Get(b *testing.B) {
 		}
 	})
 }
+
+func BenchmarkDB_PutSyncMode(b *testing.B) {
+	for _, mode := range []struct {
+		name string
+		mode minidb.SyncMode
+	}{{"SyncDefault", minidb.SyncDefault}, {"SyncData", minidb.SyncData}, {"SyncFull", minidb.SyncFull}} {
+		b.Run(mode.name, func(b *testing.B) {
+			opts := minidb.DefaultOptions(*flagDir)
+			// The smallest log files make the sync on rollover frequent
+			opts.LogFileSize = 1 << 20
+			opts.SyncMode = mode.mode
+			db, err := minidb.Open(opts)
+			if !assert.NoError(b, err) {
+				return
+			}
+			defer os.RemoveAll(*flagDir)
+			defer db.Close()
+
+			b.ResetTimer()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				err := db.Put(getKey(i), getValue())
+				assert.NoError(b, err)
+			}
+		})
+	}
+}
+
+func BenchmarkDB_ConcurrentPut(b *testing.B) {
+	const writers = 8
+	for _, bench := range []struct {
+		name string
+		put  func(db *minidb.DB, key, val []byte) error
+	}{
+		{"Put", (*minidb.DB).Put},
+		{"PutSequenced", (*minidb.DB).PutSequenced},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			runBench(b, func(b *testing.B, db *minidb.DB) {
+				val := getValue()
+				b.ResetTimer()
+				b.ReportAllocs()
+				var wg sync.WaitGroup
+				for w := 0; w < writers; w++ {
+					wg.Add(1)
+					go func(w int) {
+						defer wg.Done()
+						for i := w; i < b.N; i += writers {
+							assert.NoError(b, bench.put(db, getKey(i), val))
+						}
+					}(w)
+				}
+				wg.Wait()
+			})
+		})
+	}
+}
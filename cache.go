@@ -0,0 +1,107 @@
+package minidb
+
+import (
+	"container/list"
+	"sync"
+)
+
+// valueCache keeps the entries most recently read by Get in memory, evicting the least
+// recently used ones past its capacity, see Options.CacheSize. An entry is cached along
+// with the logOffset of keyDir it was read from, and only served while keyDir still
+// holds that logOffset, so a write of the key by any means makes it miss. A nil
+// valueCache caches nothing.
+type valueCache struct {
+	mu       sync.Mutex
+	capacity int
+	size     int // Bytes of the cached keys and values.
+	lru      *list.List
+	items    map[string]*list.Element
+}
+
+// cacheItem is an element of valueCache.lru.
+type cacheItem struct {
+	key string
+	lo  *logOffset
+	e   *Entry
+}
+
+func newValueCache(capacity int) *valueCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &valueCache{capacity: capacity, lru: list.New(), items: make(map[string]*list.Element)}
+}
+
+// get returns a copy of the cached entry of key if it was read from lo, or nil.
+func (c *valueCache) get(key []byte, lo *logOffset) *Entry {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[string(key)]
+	if !ok {
+		return nil
+	}
+	item := el.Value.(*cacheItem)
+	if item.lo != lo {
+		c.removeElement(el)
+		return nil
+	}
+	c.lru.MoveToFront(el)
+	return item.e.clone()
+}
+
+// add caches a copy of the entry of key read from lo, unless it is larger than the
+// whole cache.
+func (c *valueCache) add(key []byte, lo *logOffset, e *Entry) {
+	if c == nil {
+		return
+	}
+	size := len(key) + len(e.value)
+	if size > c.capacity {
+		return
+	}
+	e = e.clone()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[string(key)]; ok {
+		c.removeElement(el)
+	}
+	c.items[string(key)] = c.lru.PushFront(&cacheItem{key: string(key), lo: lo, e: e})
+	c.size += size
+	for c.size > c.capacity {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// remove drops the cached entry of key, if any.
+func (c *valueCache) remove(key []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[string(key)]; ok {
+		c.removeElement(el)
+	}
+}
+
+// clear drops every cached entry.
+func (c *valueCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.items = make(map[string]*list.Element)
+	c.size = 0
+}
+
+// removeElement drops el, the caller must hold c.mu.
+func (c *valueCache) removeElement(el *list.Element) {
+	item := c.lru.Remove(el).(*cacheItem)
+	delete(c.items, item.key)
+	c.size -= len(item.key) + len(item.e.value)
+}
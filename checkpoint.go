@@ -0,0 +1,150 @@
+package minidb
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pingcap/errors"
+	"os"
+)
+
+const checkpointFileNameSuffix = ".ckpt"
+
+func checkpointFilePath(dirPath string, fid uint32) string {
+	return fmt.Sprintf("%s%s%06d%s", dirPath, string(os.PathSeparator), fid, checkpointFileNameSuffix)
+}
+
+// activeCheckpoint collects the indexes of the entries written into the active log file,
+// and appends them to its checkpoint file in batches. The checkpoint file has the same
+// layout as hint file.
+type activeCheckpoint struct {
+	fd *os.File
+	// buf holds the encoded indexes not appended yet.
+	buf []byte
+	// pending is the size of the entries whose indexes are in buf.
+	pending uint64
+}
+
+// addCheckpoint records the index of e just written into alf, and appends the recorded
+// indexes to the checkpoint file once opt.ActiveCheckpointBytes of entries are recorded.
+func (df *dbFile) addCheckpoint(alf *logFile, e *Entry) error {
+	idx := &Index{entryExt: e.entryExt, mark: e.mark, fid: alf.fid, offset: df.writableOffset(), kLen: uint32(len(e.key)), key: e.key}
+	// A tombstone referring to an entry carries its key in memory, which the index stores.
+	// The checksum covers the entry, not the index.
+	idx.flags &^= flagRef | flagChecksum
+	if e.mark == Normal {
+		idx.flags |= flagValueSize
+		idx.valueSize = e.vLen
+	}
+	buf, err := encodeIndex(idx)
+	if err != nil {
+		return err
+	}
+	ckpt := &df.ckpt
+	ckpt.buf = append(ckpt.buf, buf...)
+	ckpt.pending += e.Size()
+	if ckpt.pending < uint64(df.opt.ActiveCheckpointBytes) {
+		return nil
+	}
+	return df.flushCheckpoint(alf)
+}
+
+// flushCheckpoint appends the recorded indexes to the checkpoint file of alf. The log
+// file is synced first, so that the checkpoint never covers entries lost by a crash.
+func (df *dbFile) flushCheckpoint(alf *logFile) error {
+	ckpt := &df.ckpt
+	if len(ckpt.buf) == 0 {
+		return nil
+	}
+	if err := syncFile(alf.fd, df.opt.SyncMode); err != nil {
+		return errors.Wrapf(err, "Unable to sync log file: %q", alf.path)
+	}
+	path := checkpointFilePath(df.dirPath, alf.fid)
+	if ckpt.fd == nil {
+		fd, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to open file: %q", path)
+		}
+		ckpt.fd = fd
+	}
+	if _, err := ckpt.fd.Write(ckpt.buf); err != nil {
+		return errors.Wrapf(err, "Unable to write file: %q", path)
+	}
+	ckpt.buf = ckpt.buf[:0]
+	ckpt.pending = 0
+	return nil
+}
+
+// dropCheckpoint removes the checkpoint of the log file fid once it is sealed.
+func (df *dbFile) dropCheckpoint(fid uint32) error {
+	ckpt := &df.ckpt
+	if ckpt.fd != nil {
+		ckpt.fd.Close()
+		ckpt.fd = nil
+	}
+	ckpt.buf = ckpt.buf[:0]
+	ckpt.pending = 0
+	path := checkpointFilePath(df.dirPath, fid)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Unable to remove file: %q", path)
+	}
+	return nil
+}
+
+// closeCheckpoint appends the remaining indexes and closes the checkpoint file.
+func (df *dbFile) closeCheckpoint() error {
+	var err error
+	if alf := df.activeLogFile(); alf != nil && df.opt.ActiveCheckpointBytes > 0 {
+		err = df.flushCheckpoint(alf)
+	}
+	if fd := df.ckpt.fd; fd != nil {
+		if closeErr := fd.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		df.ckpt.fd = nil
+	}
+	return err
+}
+
+// replayCheckpoint calls fn for the indexes in the checkpoint of the active log file,
+// and returns the offset to replay the rest of the log file from. An unusable
+// checkpoint is ignored, so the whole log file is replayed.
+func (df *dbFile) replayCheckpoint(lf *logFile, fn replayFn) (uint64, error) {
+	path := checkpointFilePath(df.dirPath, lf.fid)
+	if _, err := os.Stat(path); err != nil {
+		return 0, nil
+	}
+	hf := &hintFile{fid: lf.fid, path: path}
+	if err := hf.openReadOnly(); err != nil {
+		return 0, err
+	}
+	// The last indexes may be cut short by a crash, the ones before are still valid.
+	idxs, err := hf.readAll()
+	hf.fd.Close()
+	if err != nil && errors.Cause(err) != errInvalidHint {
+		df.opt.Logger.Warnf("Ignoring checkpoint %q: %v", path, err)
+		return 0, nil
+	}
+	if len(idxs) == 0 {
+		return 0, nil
+	}
+
+	// Make sure the log file still holds the last checkpointed entry.
+	last := idxs[len(idxs)-1]
+	e, err := lf.read(last.offset)
+	if err != nil || e.mark != last.mark || !checkpointKeyMatches(e, last.key) {
+		df.opt.Logger.Warnf("Ignoring checkpoint %q which does not match the log file", path)
+		return 0, nil
+	}
+	if _, err = hf.replay(lf, idxs, fn); err != nil {
+		return 0, err
+	}
+	return last.offset + e.Size(), nil
+}
+
+// checkpointKeyMatches tells whether e is an entry of key.
+func checkpointKeyMatches(e *Entry, key []byte) bool {
+	if e.flags&flagRef != 0 {
+		return hashKey(key) == e.keyHash
+	}
+	return bytes.Equal(e.key, key)
+}
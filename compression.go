@@ -0,0 +1,122 @@
+package minidb
+
+import (
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pingcap/errors"
+	"sync"
+)
+
+// Compression decides how the values of new entries are compressed, see
+// Options.Compression. Entries record the compression of their value in the mark
+// byte, so entries written with different ones are read alike.
+type Compression byte
+
+const (
+	// NoCompression stores values as they are.
+	NoCompression Compression = iota
+	// SnappyCompression compresses values with the snappy block format, which is fast
+	// and shrinks repetitive values such as JSON well.
+	SnappyCompression
+	// ZstdCompression compresses values with zstd, which shrinks them further than
+	// snappy at a few times its cost.
+	ZstdCompression
+
+	// maxCompression is the largest Compression this version can read.
+	maxCompression = ZstdCompression
+)
+
+// zstdEncoder and zstdDecoder are shared by every database, since EncodeAll and
+// DecodeAll may be called concurrently. They are created on first use, see initZstd.
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func initZstd() error {
+	zstdOnce.Do(func() {
+		if zstdEncoder, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+			zstdErr = errors.Wrap(zstdErr, "Unable to create zstd encoder")
+			return
+		}
+		if zstdDecoder, zstdErr = zstd.NewReader(nil); zstdErr != nil {
+			zstdErr = errors.Wrap(zstdErr, "Unable to create zstd decoder")
+		}
+	})
+	return zstdErr
+}
+
+// compress returns val compressed with c.
+func compress(c Compression, val []byte) ([]byte, error) {
+	switch c {
+	case NoCompression:
+		return val, nil
+	case SnappyCompression:
+		return snappy.Encode(nil, val), nil
+	case ZstdCompression:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(val, nil), nil
+	default:
+		return nil, errors.Errorf("Unknown compression: %d", c)
+	}
+}
+
+// decompress returns val, which was compressed with c, as it was before.
+func decompress(c Compression, val []byte) ([]byte, error) {
+	switch c {
+	case NoCompression:
+		return val, nil
+	case SnappyCompression:
+		out, err := snappy.Decode(nil, val)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to decode snappy value")
+		}
+		return out, nil
+	case ZstdCompression:
+		if err := initZstd(); err != nil {
+			return nil, err
+		}
+		out, err := zstdDecoder.DecodeAll(val, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to decode zstd value")
+		}
+		return out, nil
+	default:
+		return nil, errors.Errorf("Unknown compression: %d", c)
+	}
+}
+
+// compressValue compresses the value of e with e.compression and returns the bytes to
+// store, setting e.vLen to their length. A value which does not shrink is stored as is.
+func (e *Entry) compressValue() ([]byte, error) {
+	if e.compression == NoCompression {
+		return e.value, nil
+	}
+	val, err := compress(e.compression, e.value)
+	if err != nil {
+		return nil, err
+	}
+	if len(val) >= len(e.value) {
+		e.compression = NoCompression
+		val = e.value
+	}
+	e.vLen = uint64(len(val))
+	return val, nil
+}
+
+// decompressValue replaces the value read back with the one it was compressed from.
+func (e *Entry) decompressValue() error {
+	if e.compression == NoCompression {
+		return nil
+	}
+	val, err := decompress(e.compression, e.value)
+	if err != nil {
+		return err
+	}
+	e.value = val
+	return nil
+}
@@ -0,0 +1,94 @@
+package minidb
+
+import "sync/atomic"
+
+// Counters are the numbers of operations done since Open or the last ResetCounters,
+// which tell the rates of operations when sampled periodically.
+type Counters struct {
+	// Key-value pairs written by Put, PutAsync, PutSequenced and ReplacePrefix.
+	Puts uint64
+	// Lookups by Get, GetShared, GetWithMeta and SnapshotGet, missing keys included.
+	Gets uint64
+	// Keys deleted by Delete, ReplacePrefix, Demote and the TTL sweeper.
+	Deletes uint64
+	// Merges finished by Merge and MergeWait.
+	Merges uint64
+	// Bytes of entries appended to the log files, tombstones included.
+	BytesWritten uint64
+	// Bytes of the values returned by the lookups.
+	BytesRead uint64
+}
+
+// counters are updated atomically, so operations running concurrently with
+// Counters and ResetCounters are neither blocked nor lost.
+type counters struct {
+	puts         atomic.Uint64
+	gets         atomic.Uint64
+	deletes      atomic.Uint64
+	merges       atomic.Uint64
+	bytesWritten atomic.Uint64
+	bytesRead    atomic.Uint64
+	lastErr      atomic.Pointer[recordedError]
+}
+
+// recordedError boxes an error, which atomic.Pointer cannot hold directly,
+// along with whether a merge returned it.
+type recordedError struct {
+	err   error
+	merge bool
+}
+
+// Counters returns the operation counters. Each counter is read atomically, but
+// operations may finish between reading two counters.
+func (db *DB) Counters() Counters {
+	c := &db.counters
+	return Counters{
+		Puts:         c.puts.Load(),
+		Gets:         c.gets.Load(),
+		Deletes:      c.deletes.Load(),
+		Merges:       c.merges.Load(),
+		BytesWritten: c.bytesWritten.Load(),
+		BytesRead:    c.bytesRead.Load(),
+	}
+}
+
+// ResetCounters sets the operation counters to zero and clears LastError. It is safe to call while
+// operations are running, which are counted either before or after the reset.
+func (db *DB) ResetCounters() {
+	c := &db.counters
+	c.puts.Store(0)
+	c.gets.Store(0)
+	c.deletes.Store(0)
+	c.merges.Store(0)
+	c.bytesWritten.Store(0)
+	c.bytesRead.Store(0)
+	c.lastErr.Store(nil)
+}
+
+// LastError returns the last error of an operation which is only logged or which may
+// run unattended, that is a failed merge, a failed repair of the background check, a
+// failed caching of a value read from Overflow or a failed rollback of Defragment, or
+// nil if there is none. A successful merge clears a merge error, and ResetCounters
+// clears any error. It lets health checks notice problems without parsing the logs.
+func (db *DB) LastError() error {
+	if r := db.counters.lastErr.Load(); r != nil {
+		return r.err
+	}
+	return nil
+}
+
+// recordError records err to be returned by LastError.
+func (db *DB) recordError(err error) {
+	db.counters.lastErr.Store(&recordedError{err: err})
+}
+
+// mergeDone records the error of a merge, or clears the error of an earlier one.
+func (db *DB) mergeDone(err error) {
+	if err != nil {
+		db.counters.lastErr.Store(&recordedError{err: err, merge: true})
+		return
+	}
+	if r := db.counters.lastErr.Load(); r != nil && r.merge {
+		db.counters.lastErr.CompareAndSwap(r, nil)
+	}
+}
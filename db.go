@@ -1,32 +1,82 @@
 package minidb
 
 import (
-	"github.com/ngaut/log"
+	"bytes"
+	"context"
 	"github.com/pingcap/errors"
+	"io"
+	"math"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
 	lockFile = "LOCK"
+
+	// keyDir is rebuilt automatically once its live keys drop below
+	// compactIndexRatio of its peak size, if the peak is large enough.
+	compactIndexRatio   = 0.25
+	compactIndexMinPeak = 1 << 16
 )
 
 type DB struct {
-	mu           sync.RWMutex
+	mu sync.RWMutex
+	// writeMu orders the writes to the active log file. It is taken before mu,
+	// so the queued writes can be written with mu released, see applyPuts.
+	writeMu      sync.Mutex
 	dirLockGuard *directoryLockGuard
 
-	opt    Options
-	keyDir map[string]*logOffset
-	dbFile dbFile
-	closed atomic.Bool
-	gcLock sync.Mutex
+	opt      Options
+	manifest *manifest
+	keyDir   *keyDir
+	// keyDirPeak is the max size of keyDir since it was built, guarded by mu.
+	keyDirPeak int
+	// valueBytes is the total value size of live keys, guarded by mu.
+	valueBytes int64
+	dbFile     dbFile
+	closed     atomic.Bool
+	gcLock     chanMutex
+	// epochs keeps the log files replaced or dropped by Merge and the like open
+	// until the reads which looked them up are done.
+	epochs epochs
+	// waiters are woken up by the writes of keys, see WaitGet.
+	waiters keyWaiters
+	// readOnly is set by opt.ReadOnly, or when Open replays only opt.ReplayLimit entries.
+	readOnly bool
+
+	counters counters
+
+	asyncMu sync.RWMutex
+	async   *asyncWriter
+
+	// sharedBufs pools the buffers of the values returned by GetShared.
+	sharedBufs sync.Pool
+	// readBufs pools the buffers entries are read into, see readBuf.
+	readBufs sync.Pool
+	// cache keeps the entries recently read by Get, nil unless opt.CacheSize is set.
+	cache *valueCache
+
+	scrub     *scrubber
+	autoMerge *autoMerger
+	ttlSweep  *ttlSweeper
+	// mergePaused is set by PauseMerge.
+	mergePaused atomic.Bool
 }
 
 // Open return a new DB instance.
-func Open(opt Options) (*DB, error) {
-	if _, err := os.Stat(opt.Dir); err != nil {
-		if !os.IsNotExist(err) {
+func Open(opt Options) (_ *DB, err error) {
+	if opt.Logger == nil {
+		opt.Logger = defaultLogger{}
+	}
+	if opt.AutoMerge && (opt.MergeRatio <= 0 || opt.MergeRatio >= 1) {
+		return nil, ErrMergeRatio
+	}
+	if _, err = os.Stat(opt.Dir); err != nil {
+		if !os.IsNotExist(err) || opt.ReadOnly {
 			return nil, errors.Wrapf(err, "Invalid Dir: %q", opt.Dir)
 		}
 		if err = os.MkdirAll(opt.Dir, 0700); err != nil && !os.IsExist(err) {
@@ -34,42 +84,110 @@ func Open(opt Options) (*DB, error) {
 		}
 	}
 
-	dirLockGuard, err := acquireDirectoryLock(opt.Dir, lockFile)
+	dirLockGuard, err := acquireDirectoryLock(opt.Dir, lockFile, opt.ReadOnly, opt.StealStaleLock, opt.Logger)
 	if err != nil {
 		return nil, err
 	}
+	// Let a later Open take the directory over if this one fails.
+	defer func() {
+		if err != nil {
+			if guardErr := dirLockGuard.release(); guardErr != nil {
+				opt.Logger.Warnf("Unable to release directory lock: %v", guardErr)
+			}
+		}
+	}()
 
-	if opt.LogFileSize < 1<<20 || opt.LogFileSize > 2<<30 {
+	if opt.LogFileSize < 1<<20 || opt.LogFileSize > maxLogFileSize {
 		return nil, ErrLogFileSize
 	}
 
+	if opt.Codec != FixedCodec && opt.Codec != VarintCodec {
+		return nil, ErrInvalidCodec
+	}
+
+	if opt.Compression > maxCompression {
+		return nil, ErrInvalidCompression
+	}
+
+	var m *manifest
+	if opt.ReadOnly {
+		if m, err = readManifest(opt.Dir); err == nil && m == nil {
+			err = errors.Errorf("No manifest to open read only in %q", opt.Dir)
+		}
+	} else {
+		m, err = loadManifest(opt.Dir, opt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.codec != opt.Codec {
+		opt.Logger.Warnf("Using codec %d recorded in manifest instead of %d", m.codec, opt.Codec)
+		opt.Codec = m.codec
+	}
+
 	db := &DB{
 		dirLockGuard: dirLockGuard,
 		opt:          opt,
-		keyDir:       make(map[string]*logOffset),
+		manifest:     m,
+		keyDir:       newKeyDir(int(m.keyCount), opt.ShardFunc, opt.KeyPrefixDelimiter),
+		gcLock:       make(chanMutex, 1),
+		cache:        newValueCache(opt.CacheSize),
+		readOnly:     opt.ReplayLimit > 0 || opt.ReadOnly,
 	}
 
-	log.Info("Database opening")
-	if err := db.dbFile.Open(db, opt); err != nil {
+	opt.Logger.Infof("Database opening")
+	if err = db.upgradeHints(); err != nil {
+		return nil, err
+	}
+	if !opt.ReadOnly {
+		if err = db.recordEntryFlags(); err != nil {
+			return nil, err
+		}
+		if err = db.addCompression(opt.Compression); err != nil {
+			return nil, err
+		}
+	}
+	if err = db.dbFile.Open(db, opt); err != nil {
 		return nil, err
 	}
 
 	// Replay log file or hint file
-	err = db.dbFile.Replay(func(key []byte, lo *logOffset) error {
+	err = db.dbFile.Replay(func(key []byte, lo *logOffset, _ uint64) error {
+		if old, ok := db.keyDir.get(key); ok {
+			db.valueBytes -= int64(old.vLen)
+		}
 		if lo == nil {
-			delete(db.keyDir, string(key))
+			db.keyDir.remove(key)
 		} else {
-			db.keyDir[string(key)] = lo
+			db.keyDir.set(key, lo)
+			db.valueBytes += int64(lo.vLen)
 		}
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
-	log.Info("Database opened")
+	db.keyDirPeak = db.keyDir.len()
+	if db.manifest.maxSeq > db.dbFile.seq {
+		db.dbFile.seq = db.manifest.maxSeq
+	}
+	db.startAsyncWriter()
+	db.startScrubber()
+	db.startAutoMerger()
+	db.startTTLSweeper()
+	opt.Logger.Infof("Database opened")
 	return db, nil
 }
 
+// syncDir syncs dir unless Options.NoSyncDir is set. It is used where a crash losing
+// the directory entry of a new file is tolerable; renames are always synced.
+func (db *DB) syncDir(dir string) error {
+	if db.opt.NoSyncDir {
+		return nil
+	}
+	return syncDir(dir)
+}
+
 // When you create or delete a file, you have to ensure the directory entry for the file is synced
 // in order to guarantee the file is visible (if the system crashes).  (See the man page for fsync,
 // or see https://github.com/coreos/etcd/issues/6368 for an example.)
@@ -86,34 +204,470 @@ func syncDir(dir string) error {
 	return errors.Wrapf(closeErr, "While closing directory: %s", dir)
 }
 
-// Put adds a key-value pair to the database.
+// Put adds a key-value pair to the database. Once it returns, the value is read back
+// by every later Get, from any goroutine, since the index is updated before the lock
+// is released. The entry is then written to the log file but, unless SyncWrites is
+// set, not synced, so it survives a crash of the process but may be lost by a crash
+// of the machine, after readers have seen it. Call Sync before relying on the write
+// being on disk. A key larger than 4GB, or a key and value larger than 1TB together,
+// fail with ErrEntryTooLarge.
 func (db *DB) Put(key, val []byte) (err error) {
-	if db.isClosed() {
-		return ErrDatabaseClosed
+	if err = db.writable(); err != nil {
+		return err
+	}
+	if err = db.checkKey(key); err != nil {
+		return err
+	}
+
+	if err = db.lockWriteOpen(LockOpPut); err != nil {
+		return err
+	}
+	defer db.unlockWrite()
+	return db.put(key, val)
+}
+
+// PutContext is like Put, but returns ctx.Err() without writing if ctx is already done,
+// so that a request given up on does not queue behind a long Merge or the like. Once
+// it waits for the lock, the wait is not interrupted by ctx.
+func (db *DB) PutContext(ctx context.Context, key, val []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return db.Put(key, val)
+}
+
+// PutWithTTL is like Put, but the key expires once ttl has passed: Get and GetWithMeta
+// report it as ErrKeyNotFound and drop it from the in-memory index, and Merge drops its
+// entry. Until it is read, merged or swept, see Options.TTLSweepInterval, an expired key
+// is still counted by Len and listed by Keys and the like. The expiry costs 8 bytes in the entry header, and once a key
+// has been written with it the database cannot be opened by versions which do not know
+// the expiry. The ttl must be positive.
+func (db *DB) PutWithTTL(key, val []byte, ttl time.Duration) (err error) {
+	if err = db.writable(); err != nil {
+		return err
+	}
+	if err = db.checkKey(key); err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return errors.Errorf("Invalid ttl: %v", ttl)
+	}
+
+	if err = db.lockWriteOpen(LockOpPut); err != nil {
+		return err
+	}
+	defer db.unlockWrite()
+	if err = db.addEntryFlags(flagExpiry); err != nil {
+		return err
+	}
+	e := NewEntry(key, val, Normal)
+	e.flags |= flagExpiry
+	e.expiry = nowFunc().Add(ttl).UnixNano()
+	return db.putEntry(e)
+}
+
+// Sync flushes the writes done so far to disk, so that they survive a crash of the
+// machine. Sealed log files are synced as they are sealed, so only the active log file
+// is synced, along with the directory if Options.NoSyncDir is set. Writes wait for it,
+// while reads go on.
+func (db *DB) Sync() error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+
+	// Holding writeMu keeps the active log file from being written or sealed.
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	if err := db.rlockOpen(LockOpMaintenance); err != nil {
+		return err
+	}
+	alf := db.dbFile.activeLogFile()
+	db.mu.RUnlock()
+	if alf == nil {
+		return errors.New("Unable to find the active log file")
+	}
+	if err := syncFile(alf.fd, db.opt.SyncMode); err != nil {
+		return errors.Wrapf(err, "Unable to sync log file: %q", alf.path)
 	}
+	if db.opt.NoSyncDir {
+		// The active log file may have been created without syncing the directory.
+		return syncDir(db.opt.Dir)
+	}
+	return nil
+}
+
+// checkKey returns an error if key cannot be written.
+func (db *DB) checkKey(key []byte) error {
 	if len(key) == 0 {
 		return ErrEmptyKey
 	}
+	if db.opt.ShardFunc != nil && db.opt.ShardFunc(key) != db.opt.ShardFunc(key) {
+		return errors.Errorf("ShardFunc returned different shards for key %q", key)
+	}
+	if db.opt.KeyValidator != nil {
+		return db.opt.KeyValidator(key)
+	}
+	return nil
+}
 
-	db.mu.Lock()
-	defer db.mu.Unlock()
+// checkEntrySize returns ErrEntryTooLarge if key and val do not fit in an entry,
+// see maxEntrySize. Key lengths are 32 bits.
+func checkEntrySize(key, val []byte) error {
+	if uint64(len(key)) > math.MaxUint32 || uint64(len(key))+uint64(len(val)) > maxEntrySize {
+		return ErrEntryTooLarge
+	}
+	return nil
+}
+
+// put writes the key-value pair, the caller must hold db.mu.
+func (db *DB) put(key, val []byte) error {
+	return db.putEntry(NewEntry(key, val, Normal))
+}
+
+// putEntry writes the normal entry e and points its key at it, the caller must hold db.mu.
+func (db *DB) putEntry(e *Entry) error {
+	if err := checkEntrySize(e.key, e.value); err != nil {
+		return err
+	}
+	// Check quota, an overwritten value no longer counts. The value counts in full, as
+	// its compressed size is only known once written.
+	var oldBytes int64
+	if old, ok := db.keyDir.get(e.key); ok {
+		oldBytes = int64(old.vLen)
+	}
+	if db.opt.MaxTotalValueBytes > 0 && db.valueBytes-oldBytes+int64(e.vLen) > db.opt.MaxTotalValueBytes {
+		return ErrQuotaExceeded
+	}
 
 	// Write to file
-	e := NewEntry(key, val, Normal)
 	lo, err := db.dbFile.Write(e)
 	if err != nil {
 		return err
 	}
 
 	// Update index
-	db.keyDir[string(key)] = lo
+	db.keyDir.set(e.key, lo)
+	db.ttlSweep.add(e.key, lo.expiry)
+	db.cache.remove(e.key)
+	db.waiters.notify()
+	db.valueBytes += int64(lo.vLen) - oldBytes
+	db.counters.puts.Add(1)
+	if n := db.keyDir.len(); n > db.keyDirPeak {
+		db.keyDirPeak = n
+	}
+	return nil
+}
 
-	return
+// Get looks for key and returns corresponding Item. If key is not found, it is looked
+// for in Options.Overflow if set, and ErrKeyNotFound is returned if it is not there.
+func (db *DB) Get(key []byte) ([]byte, error) {
+	if db.isClosed() {
+		return nil, ErrDatabaseClosed
+	}
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+
+	db.counters.gets.Add(1)
+	val, err := db.get(key)
+	if err == ErrKeyNotFound && db.opt.Overflow != nil {
+		val, err = db.getOverflow(key)
+	}
+	db.counters.bytesRead.Add(uint64(len(val)))
+	return val, err
+}
+
+// GetContext is like Get, but returns ctx.Err() without looking for key if ctx is
+// already done, see PutContext.
+func (db *DB) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return db.Get(key)
+}
+
+// get looks for key in the database only.
+func (db *DB) get(key []byte) ([]byte, error) {
+	e, err := db.readCurrent(key)
+	if err != nil {
+		return nil, err
+	}
+	return e.value, nil
+}
+
+// readCurrent reads the latest entry of key, or takes it from the cache. db.mu is only
+// held to look the entry up and the read is done within an epoch, so a merge replacing
+// the log file meanwhile waits for the lookup alone, and the file it replaces stays open
+// until the read is done.
+func (db *DB) readCurrent(key []byte) (*Entry, error) {
+	epoch, err := db.enterRead()
+	if err != nil {
+		return nil, err
+	}
+	defer db.epochs.exit(epoch)
+	db.rlock(LockOpGet)
+	cur, ok := db.keyDir.get(key)
+	if !ok {
+		db.mu.RUnlock()
+		return nil, ErrKeyNotFound
+	}
+	e := db.cache.get(key, cur)
+	if e == nil {
+		lf, err := db.dbFile.getFile(cur.fid)
+		db.mu.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		if e, err = lf.read(cur.offset); err != nil {
+			return nil, err
+		}
+		db.cache.add(key, cur, e)
+	} else {
+		db.mu.RUnlock()
+	}
+	if e.expired(nowFunc().UnixNano()) {
+		db.lock(LockOpGet)
+		db.removeExpired(cur.fid, map[string]uint64{string(key): cur.offset})
+		db.mu.Unlock()
+		return nil, ErrKeyNotFound
+	}
+	return e, nil
 }
 
-// Get looks for key and returns corresponding Item.
+// WriteValueTo looks for key and copies its value straight from the log file to w,
+// without holding the whole value in memory, and returns the number of bytes copied.
+// If key is not found, ErrKeyNotFound is returned. The copy is done without holding
+// the database lock, so a slow w does not block writes, but the log file is pinned
+// meanwhile, like by a snapshot, so Merge leaves it alone, and Close waits for the copy.
+// A compressed value, see Options.Compression, is held in memory to be decompressed
+// though.
+func (db *DB) WriteValueTo(key []byte, w io.Writer) (int64, error) {
+	if db.isClosed() {
+		return 0, ErrDatabaseClosed
+	}
+	if len(key) == 0 {
+		return 0, ErrEmptyKey
+	}
+
+	epoch, err := db.enterRead()
+	if err != nil {
+		return 0, err
+	}
+	defer db.epochs.exit(epoch)
+	lf, sr, err := db.openValue(key)
+	if err != nil {
+		return 0, err
+	}
+	defer atomic.AddInt32(&lf.refs, -1)
+	return io.CopyN(w, sr, sr.Size())
+}
+
+// openValue pins the log file holding the value of key and returns a reader of the value.
+func (db *DB) openValue(key []byte) (*logFile, *io.SectionReader, error) {
+	db.rlock(LockOpGet)
+	defer db.mu.RUnlock()
+	lo, ok := db.keyDir.get(key)
+	if !ok {
+		return nil, nil, ErrKeyNotFound
+	}
+	lf, err := db.dbFile.getFile(lo.fid)
+	if err != nil {
+		return nil, nil, err
+	}
+	e, err := lf.readHeader(lo.offset)
+	if err != nil {
+		return nil, nil, err
+	}
+	if e.compression != NoCompression {
+		// A compressed value is decompressed as a whole.
+		if e, err = lf.read(lo.offset); err != nil {
+			return nil, nil, err
+		}
+		atomic.AddInt32(&lf.refs, 1)
+		return lf, io.NewSectionReader(bytes.NewReader(e.value), 0, int64(len(e.value))), nil
+	}
+	atomic.AddInt32(&lf.refs, 1)
+	return lf, io.NewSectionReader(lf.fd, int64(lo.offset)+int64(e.hLen)+int64(e.kLen), int64(e.vLen)), nil
+}
+
+// GetWithMeta looks for key and returns corresponding value and metadata.
 // If key is not found, ErrKeyNotFound is returned.
-func (db *DB) Get(key []byte) ([]byte, error) {
+func (db *DB) GetWithMeta(key []byte) ([]byte, EntryMeta, error) {
+	if db.isClosed() {
+		return nil, EntryMeta{}, ErrDatabaseClosed
+	}
+	if len(key) == 0 {
+		return nil, EntryMeta{}, ErrEmptyKey
+	}
+
+	db.counters.gets.Add(1)
+	e, err := db.readCurrent(key)
+	if err != nil {
+		return nil, EntryMeta{}, err
+	}
+	db.counters.bytesRead.Add(uint64(len(e.value)))
+	return e.value, e.meta(), nil
+}
+
+// GetFresh looks for key and returns corresponding value if it was written
+// no longer than maxAge ago. Older entries are reported as ErrKeyNotFound but
+// are kept in the database. It relies on the write timestamp of entries, which
+// requires Options.EntryTimestamps, so entries written without a timestamp are
+// always treated as stale.
+func (db *DB) GetFresh(key []byte, maxAge time.Duration) ([]byte, error) {
+	val, meta, err := db.GetWithMeta(key)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Timestamp.IsZero() || nowFunc().Sub(meta.Timestamp) > maxAge {
+		return nil, ErrKeyNotFound
+	}
+	return val, nil
+}
+
+// Exists tells whether key is in the database, by looking it up in the in-memory index
+// without reading the log files. Options.Overflow is not looked into.
+func (db *DB) Exists(key []byte) (bool, error) {
+	if db.isClosed() {
+		return false, ErrDatabaseClosed
+	}
+	if len(key) == 0 {
+		return false, ErrEmptyKey
+	}
+
+	db.rlock(LockOpGet)
+	defer db.mu.RUnlock()
+	_, ok := db.keyDir.get(key)
+	return ok, nil
+}
+
+// Len returns the number of live keys, or zero if the database is closed.
+func (db *DB) Len() int {
+	if db.isClosed() {
+		return 0
+	}
+
+	db.rlock(LockOpGet)
+	defer db.mu.RUnlock()
+	return db.keyDir.len()
+}
+
+// FileOf returns the fid of the log file holding the current value of key,
+// without reading the value. Merge keeps the fid of an entry it rewrites.
+// If key is not found, ErrKeyNotFound is returned.
+func (db *DB) FileOf(key []byte) (uint32, error) {
+	if db.isClosed() {
+		return 0, ErrDatabaseClosed
+	}
+	if len(key) == 0 {
+		return 0, ErrEmptyKey
+	}
+
+	db.rlock(LockOpGet)
+	defer db.mu.RUnlock()
+	lo, ok := db.keyDir.get(key)
+	if !ok {
+		return 0, ErrKeyNotFound
+	}
+	return lo.fid, nil
+}
+
+// AverageEntrySize returns the exact average key size and value size of the live keys,
+// which helps to choose LogFileSize. It walks the in-memory index to sum up key sizes
+// but reads nothing from disk. Both averages are zero for an empty database.
+func (db *DB) AverageEntrySize() (keyAvg, valAvg float64, err error) {
+	if db.isClosed() {
+		return 0, 0, ErrDatabaseClosed
+	}
+
+	db.rlock(LockOpScan)
+	defer db.mu.RUnlock()
+	n := db.keyDir.len()
+	if n == 0 {
+		return 0, 0, nil
+	}
+	var keyBytes int
+	db.keyDir.forEach(func(key string, _ *logOffset) bool {
+		keyBytes += len(key)
+		return true
+	})
+	return float64(keyBytes) / float64(n), float64(db.valueBytes) / float64(n), nil
+}
+
+// Stats returns the disk usage of the database, which tells whether a Merge is worth
+// running. The size of the live entries is summed up from the in-memory index without
+// reading the log files, so their headers are assumed to have the fields which the
+// current options add to new entries, which makes ReclaimableBytes an estimate. The
+// expiry of keys is kept in the index as well, so counting them costs no disk read
+// either, but the walk takes time in proportion to the number of keys, during which
+// writes wait. It returns zero stats if the database is closed.
+func (db *DB) Stats() Stats {
+	if db.isClosed() {
+		return Stats{}
+	}
+	return db.stats(false)
+}
+
+// stats returns the disk usage of all log files, or of the sealed ones only.
+func (db *DB) stats(sealedOnly bool) Stats {
+	flags := defaultEntryFlags
+	if db.opt.EntryTimestamps {
+		flags |= flagTimestamp
+	}
+	if db.opt.ContentHash {
+		flags |= flagContentHash
+	}
+	if !db.opt.NoChecksums {
+		flags |= flagChecksum
+	}
+	codec := db.opt.Codec
+
+	db.rlock(LockOpScan)
+	defer db.mu.RUnlock()
+	var stats Stats
+	alf := db.dbFile.activeLogFile()
+	for _, lf := range db.dbFile.files {
+		if lf != alf {
+			stats.TotalBytes += int64(lf.size)
+		} else if !sealedOnly {
+			stats.TotalBytes += int64(db.dbFile.writableOffset())
+		} else {
+			continue
+		}
+		stats.LogFiles++
+	}
+	var liveBytes int64
+	now := nowFunc().UnixNano()
+	db.keyDir.forEach(func(key string, lo *logOffset) bool {
+		if sealedOnly && lo.fid == alf.fid {
+			return true
+		}
+		kLen := uint32(len(key))
+		entryFlags := flags
+		if lo.expiry != 0 {
+			entryFlags |= flagExpiry
+		}
+		liveBytes += int64(headerSize(codec, entryFlags, kLen, lo.vLen)) + int64(kLen) + int64(lo.vLen)
+		stats.LiveKeys++
+		if lo.expiry > now {
+			stats.LiveWithTTL++
+		} else if lo.expiry != 0 {
+			stats.ExpiredPending++
+		}
+		return true
+	})
+	if liveBytes < stats.TotalBytes {
+		stats.ReclaimableBytes = stats.TotalBytes - liveBytes
+	}
+	return stats
+}
+
+// GetOldest returns the earliest value of key written since it was last deleted,
+// instead of the current one. Versions dropped by merge are gone, so the result
+// is the oldest version which survives on disk. It is meant for diagnostics and
+// reconciliation, as it reads the index of every log file.
+// If key is not found, ErrKeyNotFound is returned.
+func (db *DB) GetOldest(key []byte) ([]byte, error) {
 	if db.isClosed() {
 		return nil, ErrDatabaseClosed
 	}
@@ -121,56 +675,442 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 		return nil, ErrEmptyKey
 	}
 
+	// The active log file is read to its end, which must not be in the middle of a write.
+	start := db.waitStart()
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
 	db.mu.RLock()
 	defer db.mu.RUnlock()
-	lo, ok := db.keyDir[string(key)]
-	if !ok {
+	db.waited(LockOpScan, start)
+	if db.isClosed() {
+		return nil, ErrDatabaseClosed
+	}
+	if _, ok := db.keyDir.get(key); !ok {
 		return nil, ErrKeyNotFound
 	}
-	e, err := db.dbFile.Read(lo)
+	var oldest *logOffset
+	for _, lf := range db.dbFile.files {
+		_, err := db.dbFile.iterate(lf, func(k []byte, lo *logOffset, _ uint64) error {
+			if string(k) != string(key) {
+				return nil
+			}
+			if lo == nil {
+				// Versions before a tombstone are not alive any more
+				oldest = nil
+			} else if oldest == nil {
+				oldest = lo
+			}
+			return nil
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if oldest == nil {
+		return nil, ErrKeyNotFound
+	}
+	e, err := db.dbFile.Read(oldest)
 	if err != nil {
 		return nil, err
 	}
 	return e.value, nil
 }
 
-// Delete deletes a key. This is done by adding a deleted marker for the key.
-func (db *DB) Delete(key []byte) (err error) {
+// VersionCount returns the number of entries of key on disk, values and tombstones
+// alike, across all log files. A count well above one means Merge would reclaim space
+// for the key. Versions Merge has already dropped are not counted, so it may be zero
+// for a deleted key. It reads the hint files or entries of every log file, so it takes
+// time in proportion to the number of entries, and writes wait meanwhile.
+func (db *DB) VersionCount(key []byte) (int, error) {
 	if db.isClosed() {
-		return ErrDatabaseClosed
+		return 0, ErrDatabaseClosed
 	}
 	if len(key) == 0 {
-		return ErrEmptyKey
+		return 0, ErrEmptyKey
 	}
 
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	// The active log file is read to its end, which must not be in the middle of a write.
+	start := db.waitStart()
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	db.waited(LockOpScan, start)
+	if db.isClosed() {
+		return 0, ErrDatabaseClosed
+	}
+	var n int
+	for _, lf := range db.dbFile.files {
+		_, err := db.dbFile.iterate(lf, func(k []byte, _ *logOffset, _ uint64) error {
+			if string(k) == string(key) {
+				n++
+			}
+			return nil
+		}, nil)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// KeysBySize calls fn for every key whose value is larger than minBytes.
+// Only the entry header is read for each key, so the cost is one small
+// disk read per live key regardless of the value size. The size of a
+// compressed value is the compressed one, see Options.Compression.
+// The callback must not modify the database.
+func (db *DB) KeysBySize(minBytes uint64, fn func(key []byte, size uint64) error) error {
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+
+	if err := db.rlockOpen(LockOpScan); err != nil {
+		return err
+	}
+	defer db.mu.RUnlock()
+	var err error
+	db.keyDir.forEach(func(key string, lo *logOffset) bool {
+		var e *Entry
+		if e, err = db.dbFile.ReadHeader(lo); err != nil {
+			return false
+		}
+		if e.vLen <= minBytes {
+			return true
+		}
+		err = fn([]byte(key), e.vLen)
+		return err == nil
+	})
+	return err
+}
+
+// RawIterateReverse calls fn for every entry on disk from the newest to the oldest,
+// including overwritten entries and tombstones. Files are walked from the highest
+// fid to the lowest and entries within a file from the end to the start. Since
+// entries can only be decoded forwards, the offsets of a file are collected first,
+// which costs 8 bytes of memory per entry of the file being walked.
+// Merge fails with ErrGcWorking during the iteration.
+func (db *DB) RawIterateReverse(fn func(fid uint32, offset uint64, e *Entry) error) error {
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+
+	// Hold gcLock so that sealed files are not replaced during reading.
+	db.gcLock.Lock()
+	defer db.gcLock.Unlock()
+	// The database may be closed while waiting.
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+
+	db.rlock(LockOpScan)
+	files := make([]*logFile, len(db.dbFile.files))
+	copy(files, db.dbFile.files)
+	endOffset := db.dbFile.writableOffset()
+	db.mu.RUnlock()
+
+	for i := len(files) - 1; i >= 0; i-- {
+		lf := files[i]
+		end := lf.size
+		if i == len(files)-1 {
+			end = endOffset
+		}
+		offsets, err := lf.entryOffsets(end)
+		if err != nil {
+			return err
+		}
+		for j := len(offsets) - 1; j >= 0; j-- {
+			e, err := lf.read(offsets[j])
+			if err != nil {
+				return errors.Wrapf(err, "Unable to read entry at offset %d of %q", offsets[j], lf.path)
+			}
+			if err = fn(lf.fid, offsets[j], e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Delete deletes a key. This is done by adding a deleted marker for the key.
+// Deleting a missing key is a no-op, unless StrictDelete is set and then
+// ErrKeyNotFound is returned.
+func (db *DB) Delete(key []byte) (err error) {
+	if err = db.writable(); err != nil {
+		return err
+	}
+	if err = db.checkKey(key); err != nil {
+		return err
+	}
+
+	if err = db.lockWriteOpen(LockOpDelete); err != nil {
+		return err
+	}
+	defer db.unlockWrite()
 
 	// Search for key
-	if _, ok := db.keyDir[string(key)]; !ok {
+	lo, ok := db.keyDir.get(key)
+	if !ok {
+		if db.opt.StrictDelete {
+			return ErrKeyNotFound
+		}
 		return
 	}
 
-	// Write to file
+	return db.delete(key, lo)
+}
+
+// delete writes a tombstone for key whose current entry is at lo, the caller must hold db.mu.
+func (db *DB) delete(key []byte, lo *logOffset) error {
 	e := NewEntry(key, nil, Tombstone)
-	_, err = db.dbFile.Write(e)
-	if err != nil {
+	// A running merge may move the entry, so only refer to it when there is none.
+	// A merge starting later cannot move it either, since it is dead by then.
+	// gcLock is taken before db.mu elsewhere, but TryLock never waits for it, so
+	// this cannot deadlock; it only holds off a merge while the tombstone is written.
+	// A tombstone only has 4 bytes for the offset it refers to, see flagRef.
+	if db.opt.CompactTombstones && lo.offset <= math.MaxUint32 && db.gcLock.TryLock() {
+		e = newRefTombstone(key, lo)
+		db.gcLock.Unlock()
+	}
+	if _, err := db.dbFile.Write(e); err != nil {
+		return err
+	}
+
+	// Delete index, the map does not shrink so rebuild it once it gets sparse
+	db.keyDir.remove(key)
+	db.cache.remove(key)
+	db.valueBytes -= int64(lo.vLen)
+	db.counters.deletes.Add(1)
+	if db.keyDirPeak >= compactIndexMinPeak && float64(db.keyDir.len()) < float64(db.keyDirPeak)*compactIndexRatio {
+		db.compactIndex()
+	}
+	return nil
+}
+
+// ReplacePrefix replaces all keys starting with prefix by entries, whose keys must
+// start with prefix as well. Readers see either the old keys or the new ones, never
+// a mix of them, since the database is locked during the replacement. Keys which are
+// not in entries are deleted. If a write fails in the middle, the keys written so far
+// stay replaced.
+func (db *DB) ReplacePrefix(prefix []byte, entries map[string][]byte) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		if !strings.HasPrefix(key, string(prefix)) {
+			return errors.Errorf("Key %q does not start with prefix %q", key, prefix)
+		}
+		if err := db.checkKey([]byte(key)); err != nil {
+			return err
+		}
+		if err := checkEntrySize([]byte(key), entries[key]); err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if err := db.lockWriteOpen(LockOpReplacePrefix); err != nil {
+		return err
+	}
+	defer db.unlockWrite()
+
+	// Check quota up front, so that the replacement is not stopped halfway by it
+	valueBytes := db.valueBytes
+	stale := make(map[string]*logOffset)
+	db.keyDir.forEach(func(key string, lo *logOffset) bool {
+		if strings.HasPrefix(key, string(prefix)) {
+			valueBytes -= int64(lo.vLen)
+			if _, ok := entries[key]; !ok {
+				stale[key] = lo
+			}
+		}
+		return true
+	})
+	for _, val := range entries {
+		valueBytes += int64(len(val))
+	}
+	if db.opt.MaxTotalValueBytes > 0 && valueBytes > db.opt.MaxTotalValueBytes {
+		return ErrQuotaExceeded
+	}
+
+	staleKeys := make([]string, 0, len(stale))
+	for key := range stale {
+		staleKeys = append(staleKeys, key)
+	}
+	sort.Strings(staleKeys)
+	for _, key := range staleKeys {
+		if err := db.delete([]byte(key), stale[key]); err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		if err := db.put([]byte(key), entries[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CompactIndex rebuilds the in-memory index to release the memory held by
+// deleted keys, since a map never shrinks. It is also done automatically
+// after heavy deletes.
+func (db *DB) CompactIndex() {
+	if db.isClosed() {
 		return
 	}
+	db.lock(LockOpMaintenance)
+	defer db.mu.Unlock()
+	db.compactIndex()
+}
 
-	// Delete index (possible memory leak because the map does not shrink)
-	delete(db.keyDir, string(key))
+func (db *DB) compactIndex() {
+	db.keyDir = db.keyDir.clone()
+	db.keyDirPeak = db.keyDir.len()
+}
 
-	return
+// ActiveFileUsage returns the write offset of the active log file and the
+// configured LogFileSize, a new log file is created once offset exceeds capacity.
+func (db *DB) ActiveFileUsage() (offset uint64, capacity int64) {
+	return db.dbFile.writableOffset(), db.opt.LogFileSize
+}
+
+// Options returns a copy of the options the database runs with, which are those passed
+// to Open except for Codec, taken from the manifest of an existing database, and a nil
+// Logger, replaced by the default one. Changing the copy has no effect on the database.
+func (db *DB) Options() Options {
+	return db.opt
 }
 
 // Merge cleans old log file and rewrite key-value pair index.
+// Files pinned by an open Snapshot are left as they are.
 func (db *DB) Merge() error {
+	if err := db.writable(); err != nil {
+		return err
+	}
 	if !db.gcLock.TryLock() {
 		return ErrGcWorking
 	}
 	defer db.gcLock.Unlock()
-	return db.dbFile.merge()
+	// The database may have been closed since it was checked.
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+	return db.merge()
+}
+
+// CompactWhere is like Merge, but only reclaims the space of the keys pred returns true
+// for: their overwritten and deleted entries are dropped from the sealed log files, while
+// the entries of other keys are kept as they are, alive or not. It compacts every sealed
+// file regardless of MergePolicy, except those pinned by a snapshot. pred is called for
+// every entry without holding the database lock. It fails with ErrGcWorking if a merge
+// is running. It cannot be used once CompactTombstones has been set on the database,
+// since tombstones referring to the dead entries it keeps would lose track of them.
+func (db *DB) CompactWhere(pred func(key []byte) bool) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	if !db.gcLock.TryLock() {
+		return ErrGcWorking
+	}
+	defer db.gcLock.Unlock()
+	// The database may have been closed since it was checked.
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+	if db.manifest.entryFlags&flagRef != 0 {
+		return errors.New("CompactWhere cannot compact tombstones referring to entries")
+	}
+	return db.dbFile.compact(pred, nil)
+}
+
+// MergeWait is like Merge, but waits for a running merge to finish instead of
+// failing with ErrGcWorking, so concurrent calls run one after another.
+// It returns ctx.Err() if ctx is done before the merge starts.
+func (db *DB) MergeWait(ctx context.Context) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	if err := db.gcLock.LockContext(ctx); err != nil {
+		return err
+	}
+	defer db.gcLock.Unlock()
+	// The database may be closed while waiting.
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+	return db.merge()
+}
+
+// MergeDryRun tells what Merge would do now without modifying anything: it reads the
+// sealed log files Merge would compact and reports for each of them how many entries
+// would be kept or dropped and how many bytes would be reclaimed. Entries which become
+// dead before the actual merge make the estimate fall short. It fails with ErrGcWorking
+// if a merge is running.
+func (db *DB) MergeDryRun() (MergePlan, error) {
+	if db.isClosed() {
+		return MergePlan{}, ErrDatabaseClosed
+	}
+	if !db.gcLock.TryLock() {
+		return MergePlan{}, ErrGcWorking
+	}
+	defer db.gcLock.Unlock()
+	// The database may have been closed since it was checked.
+	if db.isClosed() {
+		return MergePlan{}, ErrDatabaseClosed
+	}
+	var plan MergePlan
+	if err := db.dbFile.compact(nil, &plan); err != nil {
+		return MergePlan{}, err
+	}
+	return plan, nil
+}
+
+// merge runs a merge and counts it, or records its error for LastError.
+// The caller must hold gcLock.
+func (db *DB) merge() error {
+	err := db.dbFile.merge()
+	db.mergeDone(err)
+	if err != nil {
+		return err
+	}
+	db.counters.merges.Add(1)
+	return nil
+}
+
+// chanMutex is a mutex whose waiting can be given up, since it is a channel
+// holding a token while locked. Its zero value is not usable, make it with
+// capacity 1.
+type chanMutex chan struct{}
+
+func (m chanMutex) Lock() {
+	m <- struct{}{}
+}
+
+func (m chanMutex) TryLock() bool {
+	select {
+	case m <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// LockContext locks m, or returns ctx.Err() if ctx is done first.
+func (m chanMutex) LockContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case m <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m chanMutex) Unlock() {
+	<-m
 }
 
 func (db *DB) updateKeyDir(m map[string]*logOffset) {
@@ -179,21 +1119,84 @@ func (db *DB) updateKeyDir(m map[string]*logOffset) {
 	}
 	for key, newOffset := range m {
 		// Confirm that the key has not been modified
-		if curOffset, has := db.keyDir[key]; has && curOffset.fid == newOffset.fid {
-			db.keyDir[key] = newOffset
+		k := []byte(key)
+		if curOffset, has := db.keyDir.get(k); has && curOffset.fid == newOffset.fid {
+			db.keyDir.set(k, newOffset)
 		}
 	}
 }
 
-// Close an opened DB instance.
+// updateKeyDirFromHint is like updateKeyDir, but streams the new offsets from the hint
+// file written by a merge of log file fid instead of holding them in memory. Reading it
+// keeps the lock held longer, but the file has just been written and is likely cached.
+// Like on replay, the last index of a key wins, so the dead entries CompactWhere keeps
+// cannot shadow a live one later in the file.
+func (db *DB) updateKeyDirFromHint(fid uint32, path string) error {
+	hf := &hintFile{fid: fid, path: path}
+	if err := hf.openReadOnly(); err != nil {
+		return err
+	}
+	defer hf.fd.Close()
+	return hf.forEach(func(idx *Index) error {
+		if idx.mark != Normal {
+			return nil
+		}
+		// Confirm that the key has not been modified
+		if curOffset, has := db.keyDir.get(idx.key); has && curOffset.fid == fid {
+			db.keyDir.set(idx.key, &logOffset{fid: fid, offset: idx.offset, vLen: idx.valueSize, expiry: idx.expiresAt()})
+		}
+		return nil
+	})
+}
+
+// removeExpired removes the keys whose latest entry is one of the expired entries
+// of log file fid at the given offsets.
+func (db *DB) removeExpired(fid uint32, expired map[string]uint64) {
+	for key, offset := range expired {
+		k := []byte(key)
+		if lo, has := db.keyDir.get(k); has && lo.fid == fid && lo.offset == offset {
+			db.keyDir.remove(k)
+			db.valueBytes -= int64(lo.vLen)
+		}
+	}
+}
+
+// Close an opened DB instance. It waits for a running merge and the reads in progress
+// to finish before closing the files.
 func (db *DB) Close() (err error) {
 	if db.isClosed() {
-		log.Warn("Database has already closed")
+		db.opt.Logger.Warnf("Database has already closed")
 		return
 	}
-	log.Info("Database closing")
+	db.opt.Logger.Infof("Database closing")
+
+	// Finish the queued writes before closing files.
+	db.stopAsyncWriter()
+	db.stopScrubber()
+	db.stopAutoMerger()
+	db.stopTTLSweeper()
 
-	if dbFileErr := db.dbFile.Close(); err == nil {
+	// Mark the database closed under db.mu, so that no operation starts using the files
+	// any more. Those in progress are let finish before the files are closed: a merge and
+	// the reads holding gcLock by taking it, the reads within an epoch by draining them,
+	// and those holding db.mu or writeMu by locking them again.
+	db.lock(LockOpMaintenance)
+	db.closed.Store(true)
+	db.mu.Unlock()
+	db.gcLock.Lock()
+	defer db.gcLock.Unlock()
+	db.epochs.drain()
+	db.lockWrite(LockOpMaintenance)
+	// Remember the key count so the next Open can pre-size keyDir, unless the
+	// replay was partial.
+	if !db.readOnly {
+		if manifestErr := db.saveKeyCount(); err == nil {
+			err = errors.Wrap(manifestErr, "DB.Close")
+		}
+	}
+	dbFileErr := db.dbFile.Close()
+	db.unlockWrite()
+	if err == nil {
 		err = errors.Wrap(dbFileErr, "DB.Close")
 	}
 
@@ -206,16 +1209,108 @@ func (db *DB) Close() (err error) {
 	// Fsync directories to ensure that lock file, and any other removed files whose directory
 	// we haven't specifically fsynced, are guaranteed to have their directory entry removal
 	// persisted to disk.
-	if syncErr := syncDir(db.opt.Dir); err == nil {
-		err = errors.Wrap(syncErr, "DB.Close")
+	if !db.opt.ReadOnly {
+		if syncErr := db.syncDir(db.opt.Dir); err == nil {
+			err = errors.Wrap(syncErr, "DB.Close")
+		}
 	}
 
-	db.closed.CompareAndSwap(false, true)
-	db.keyDir = nil
-	log.Info("Database closed")
+	// keyDir is left in place, since a read which checked the database was open just
+	// before may still look a key up in it.
+	db.waiters.notify()
+	db.opt.Logger.Infof("Database closed")
 	return err
 }
 
+// lock acquires db.mu for op, reporting the wait to opt.LockWaitObserver if set.
+func (db *DB) lock(op LockOp) {
+	start := db.waitStart()
+	db.mu.Lock()
+	db.waited(op, start)
+}
+
+// rlock is like lock, but acquires db.mu for reading.
+func (db *DB) rlock(op LockOp) {
+	start := db.waitStart()
+	db.mu.RLock()
+	db.waited(op, start)
+}
+
+// lockWrite is like lock, but acquires db.writeMu first, as writers to the log do.
+func (db *DB) lockWrite(op LockOp) {
+	start := db.waitStart()
+	db.writeMu.Lock()
+	db.mu.Lock()
+	db.waited(op, start)
+}
+
+// unlockWrite releases the locks acquired by lockWrite.
+func (db *DB) unlockWrite() {
+	db.mu.Unlock()
+	db.writeMu.Unlock()
+}
+
+// lockWriteOpen is like lockWrite, but fails with ErrDatabaseClosed without holding the
+// locks if the database was closed while it waited. Close marks the database closed
+// under db.mu, and takes db.mu and writeMu again to close the files, so they stay open
+// as long as the locks are held otherwise.
+func (db *DB) lockWriteOpen(op LockOp) error {
+	db.lockWrite(op)
+	if db.isClosed() {
+		db.unlockWrite()
+		return ErrDatabaseClosed
+	}
+	return nil
+}
+
+// rlockOpen is like lockWriteOpen, but acquires db.mu for reading only.
+func (db *DB) rlockOpen(op LockOp) error {
+	db.rlock(op)
+	if db.isClosed() {
+		db.mu.RUnlock()
+		return ErrDatabaseClosed
+	}
+	return nil
+}
+
+// waitStart returns the time a lock wait starts, if opt.LockWaitObserver is set.
+func (db *DB) waitStart() (start time.Time) {
+	if db.opt.LockWaitObserver != nil {
+		start = nowFunc()
+	}
+	return
+}
+
+// waited reports the wait for op which started at start to opt.LockWaitObserver.
+func (db *DB) waited(op LockOp, start time.Time) {
+	if db.opt.LockWaitObserver != nil {
+		db.opt.LockWaitObserver(op, nowFunc().Sub(start))
+	}
+}
+
 func (db *DB) isClosed() bool {
 	return db.closed.Load()
 }
+
+// enterRead enters the current epoch to read the log files without holding db.mu, or
+// fails with ErrDatabaseClosed. Close sets closed before draining the epochs, so either
+// the read sees it or Close waits for the read to exit before closing the files.
+func (db *DB) enterRead() (uint64, error) {
+	epoch := db.epochs.enter()
+	if db.isClosed() {
+		db.epochs.exit(epoch)
+		return 0, ErrDatabaseClosed
+	}
+	return epoch, nil
+}
+
+// writable returns ErrDatabaseClosed or ErrReadOnly if the database cannot be written.
+func (db *DB) writable() error {
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	return nil
+}
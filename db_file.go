@@ -1,34 +1,59 @@
 package minidb
 
 import (
+	"bufio"
 	"fmt"
-	"github.com/ngaut/log"
 	"github.com/pingcap/errors"
 	"github.com/yanghao888/minidb/fileutil"
 	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 )
 
 const (
 	logFileNameSuffix   = ".log"
 	indexFileNameSuffix = ".index"
 	tempFileNameSuffix  = ".tmp"
+
+	hintWriteBufferSize = 64 << 10
 )
 
-type replayFn func(key []byte, lo *logOffset) error
+// nowFunc returns the write time of new entries, replaced in tests.
+var nowFunc = time.Now
+
+// mergeKeyDirLimit is the number of live entries of a log file whose new offsets a merge
+// holds in memory, beyond which it reads them back from the new hint file instead.
+// It is replaced in tests.
+var mergeKeyDirLimit = 10000
+
+// errInvalidHint is returned when a hint file is truncated or inconsistent.
+var errInvalidHint = errors.New("Invalid hint file")
+
+// errReplayLimit stops Replay once opt.ReplayLimit entries are replayed.
+var errReplayLimit = errors.New("Replay limit reached")
+
+type replayFn func(key []byte, lo *logOffset, seq uint64) error
 
 type dbFile struct {
 	dirPath string
 	files   []*logFile
+	ckpt    activeCheckpoint // Guarded by db.mu.
+
+	// activeFid is the fid of the active log file, and writePtr the offset in it which
+	// entries are appended at. Both are accessed atomically, see filePos.
+	activeFid uint32
+	writePtr  uint64
+	seq       uint64 // Write sequence of the last entry, guarded by db.mu.
+	db        *DB
+	opt       Options
 
-	maxPtr uint64
-	db     *DB
-	opt    Options
+	activeEntries uint32 // Number of entries in the active log file, reset along with writePtr.
 }
 
 func (df *dbFile) Open(db *DB, opt Options) error {
@@ -42,29 +67,56 @@ func (df *dbFile) Open(db *DB, opt Options) error {
 }
 
 func (df *dbFile) Close() error {
-	var err error
+	err := df.closeCheckpoint()
+	mode := df.opt.SyncMode
+	if mode == SyncDefault {
+		mode = SyncData
+	}
 	for _, lf := range df.files {
 		// A successful close does not guarantee that the data has been successfully saved to disk, as the kernel defers writes.
 		// It is not common for a file system to flush the buffers when the stream is closed.
-		if syncErr := fileutil.Fdatasync(lf.fd); syncErr != nil && err == nil {
-			err = syncErr
+		if !df.opt.ReadOnly {
+			if syncErr := syncFile(lf.fd, mode); syncErr != nil && err == nil {
+				err = syncErr
+			}
 		}
-		if closeErr := lf.fd.Close(); closeErr != nil && err == nil {
+		if closeErr := lf.close(); closeErr != nil && err == nil {
 			err = closeErr
 		}
 	}
 	return err
 }
 
+// Replay calls fn for the entries of all log files in order, or for the first
+// opt.ReplayLimit of them if it is set.
 func (df *dbFile) Replay(fn replayFn) error {
-	var lastOffset uint32
+	var lastOffset uint64
+	var n int
+	var fileEntries uint32
+	trackSeq := func(key []byte, lo *logOffset, seq uint64) error {
+		if df.opt.ReplayLimit > 0 && n == df.opt.ReplayLimit {
+			return errReplayLimit
+		}
+		n++
+		fileEntries++
+		if seq > df.seq {
+			df.seq = seq
+		}
+		return fn(key, lo, seq)
+	}
 	for _, lf := range df.files {
-		endAt, err := df.iterate(lf, fn)
+		fileEntries = 0
+		endAt, err := df.iterate(lf, trackSeq, df.opt.OnReplayError)
+		if errors.Cause(err) == errReplayLimit {
+			// The database is read only, so the write offset does not matter.
+			return nil
+		}
 		if err != nil {
 			return errors.Wrapf(err, "Unable to replay log: %q", lf.path)
 		}
 		if lf.fid == df.maxFid() {
 			lastOffset = endAt
+			atomic.StoreUint32(&df.activeEntries, fileEntries)
 		}
 	}
 
@@ -73,11 +125,21 @@ func (df *dbFile) Replay(fn replayFn) error {
 	if _, err := last.fd.Seek(int64(lastOffset), io.SeekStart); err != nil {
 		return errors.Wrapf(err, "Unable to seek to end of active log: %q", last.path)
 	}
-	atomic.AddUint64(&df.maxPtr, uint64(lastOffset))
+	atomic.StoreUint64(&df.writePtr, lastOffset)
 	return nil
 }
 
 func (df *dbFile) openOrCreateFiles() error {
+	if df.opt.ReadOnly {
+		// Recovering an interrupted defragment removes files.
+		if _, err := os.Stat(filepath.Join(df.dirPath, defragMarkerFile)); err == nil {
+			return errors.New("Unable to open read only while a defragment is to be recovered")
+		} else if !os.IsNotExist(err) {
+			return errors.Wrapf(err, "Unable to check defragment marker")
+		}
+	} else if err := recoverDefragment(df.dirPath, df.opt.Logger); err != nil {
+		return err
+	}
 	files, err := os.ReadDir(df.dirPath)
 	if err != nil {
 		return errors.Wrapf(err, "Error while opening log file dir")
@@ -109,10 +171,24 @@ func (df *dbFile) openOrCreateFiles() error {
 			maxFid = uint32(fid)
 		}
 	}
-	df.maxPtr = uint64(maxFid) << 32
+	df.activeFid = maxFid
+
+	// Only the active log file has a checkpoint, the others are left by a crash.
+	for _, file := range files {
+		name := file.Name()
+		if df.opt.ReadOnly || !strings.HasSuffix(name, checkpointFileNameSuffix) || name == filepath.Base(checkpointFilePath(df.dirPath, maxFid)) {
+			continue
+		}
+		if err = os.Remove(filepath.Join(df.dirPath, name)); err != nil {
+			return errors.Wrapf(err, "Unable to remove stale checkpoint: %q", name)
+		}
+	}
 
 	// If no files are found, then create a new file.
 	if len(df.files) == 0 {
+		if df.opt.ReadOnly {
+			return errors.Errorf("No log file to open read only in %q", df.dirPath)
+		}
 		return df.createLogFile(0)
 	}
 
@@ -120,24 +196,31 @@ func (df *dbFile) openOrCreateFiles() error {
 		return df.files[i].fid < df.files[j].fid
 	})
 
-	// Open all log files as read write.
+	// Open all log files as read write, or read only, and map the sealed ones.
 	for i := len(df.files) - 1; i >= 0; i-- {
 		lf := df.files[i]
-		err = lf.openReadWrite()
+		if df.opt.ReadOnly {
+			err = lf.open(os.O_RDONLY, 0)
+		} else {
+			err = lf.openReadWrite()
+		}
 		if err != nil {
 			return errors.Wrapf(err, "Open existing file: %q", lf.path)
 		}
+		if lf.fid != maxFid {
+			lf.mmap()
+		}
 		// We shouldn't delete the maxFid file.
-		if lf.size == 0 && lf.fid != maxFid {
-			log.Infof("Deleting empty file: %q", lf.path)
+		if lf.size == 0 && lf.fid != maxFid && !df.opt.PreserveEmptyFiles && !df.opt.ReadOnly {
+			df.opt.Logger.Infof("Deleting empty file: %q", lf.path)
 			if err = lf.delete(); err != nil {
 				return errors.Wrapf(err, "Error while trying to delete empty file: %q", lf.path)
 			}
 			df.files = append(df.files[:i], df.files[i+1:]...)
 
 			idxFilePath := indexFilePath(df.dirPath, lf.fid)
-			log.Infof("Deleting empty file: %q", idxFilePath)
-			if err = os.Remove(idxFilePath); err != nil {
+			df.opt.Logger.Infof("Deleting empty file: %q", idxFilePath)
+			if err = os.Remove(idxFilePath); err != nil && !os.IsNotExist(err) {
 				return errors.Wrapf(err, "Error while trying to delete empty file: %q", idxFilePath)
 			}
 		}
@@ -145,21 +228,32 @@ func (df *dbFile) openOrCreateFiles() error {
 	return nil
 }
 
-// iterate iterates over log file.
-func (df *dbFile) iterate(lf *logFile, fn replayFn) (uint32, error) {
+// iterate iterates over log file. Unreadable entries are handled as onError decides,
+// see Options.OnReplayError, a nil onError aborts.
+func (df *dbFile) iterate(lf *logFile, fn replayFn, onError func(fid uint32, offset uint64, err error) ReplayAction) (uint64, error) {
 	if lf.fid != df.maxFid() {
 		// Read index from hint file if the file exists
 		idxFilePath := indexFilePath(df.dirPath, lf.fid)
-		if fi, err := os.Stat(idxFilePath); os.IsExist(err) {
-			hf := &hintFile{fid: lf.fid, size: uint32(fi.Size()), path: idxFilePath}
+		if fi, err := os.Stat(idxFilePath); err == nil {
+			hf := &hintFile{fid: lf.fid, size: uint64(fi.Size()), path: idxFilePath}
 			if err = hf.openReadOnly(); err != nil {
 				return 0, err
 			}
-			defer hf.close(hf.size)
-			return hf.iterate(fn)
+			offset, err := hf.iterate(lf, fn)
+			hf.fd.Close()
+			if errors.Cause(err) != errInvalidHint {
+				return offset, err
+			}
+			df.opt.Logger.Warnf("Replaying %q instead of its hint file: %v", lf.path, err)
 		}
+		return lf.iterateFrom(0, lf.size, fn, onError)
 	}
-	return lf.iterate(fn)
+	offset, err := df.replayCheckpoint(lf, fn)
+	if err != nil {
+		return 0, err
+	}
+	// The active file may have grown past lf.size since it was opened.
+	return lf.iterateFrom(offset, math.MaxUint64, fn, onError)
 }
 
 // Read an entry from log file by logOffset. The log file may be readonly.
@@ -171,43 +265,289 @@ func (df *dbFile) Read(lo *logOffset) (e *Entry, err error) {
 	return lf.read(lo.offset)
 }
 
+// ReadHeader reads only the header of an entry by logOffset, so the key and value are not set.
+func (df *dbFile) ReadHeader(lo *logOffset) (*Entry, error) {
+	lf, err := df.getFile(lo.fid)
+	if err != nil {
+		return nil, err
+	}
+	return lf.readHeader(lo.offset)
+}
+
 // Write the entry into active log file.
-func (df *dbFile) Write(e *Entry) (lo *logOffset, err error) {
+func (df *dbFile) Write(e *Entry) (*logOffset, error) {
+	return df.write(e, nil)
+}
+
+// WriteRaw writes raw, the encoded bytes of e, into active log file as is,
+// so the write sequence and timestamp of e are kept.
+func (df *dbFile) WriteRaw(e *Entry, raw []byte) (*logOffset, error) {
+	return df.write(e, raw)
+}
+
+func (df *dbFile) write(e *Entry, raw []byte) (lo *logOffset, err error) {
 	alf := df.activeLogFile()
 	if alf == nil {
 		return nil, errors.New("Unable to find the active log file")
 	}
-	err = alf.write(e)
+	if debugMode {
+		if err = alf.checkWriteOffset(df.writableOffset()); err != nil {
+			return nil, err
+		}
+	}
+	if raw == nil {
+		df.stamp(e)
+		err = alf.write(e)
+	} else {
+		if e.seq > df.seq {
+			df.seq = e.seq
+		}
+		err = alf.writeAll(raw)
+	}
 	if err != nil {
 		return nil, errors.Wrapf(err, "Error while writing log file fid %d", alf.fid)
 	}
-	lo = &logOffset{fid: alf.fid, offset: df.writableOffset()}
-	atomic.AddUint64(&df.maxPtr, uint64(e.Size()))
-	if df.writableOffset() > uint32(df.opt.LogFileSize) {
-		if err = alf.doneWriting(df.writableOffset()); err != nil {
-			return
-		}
-		if err = df.createLogFile(df.maxFid() + 1); err != nil {
-			return
-		}
+	if lo, err = df.appended(alf, e); err != nil {
+		return nil, err
 	}
+	err = df.rotateIfFull(alf)
 	return
 }
 
+// stamp assigns the next write sequence to e, along with the timestamp,
+// the value hash and the compression if they are enabled.
+func (df *dbFile) stamp(e *Entry) {
+	df.seq++
+	e.seq = df.seq
+	if df.opt.EntryTimestamps {
+		e.flags |= flagTimestamp
+		e.timestamp = nowFunc().UnixNano()
+	}
+	if df.opt.ContentHash && e.mark == Normal {
+		e.flags |= flagContentHash
+		e.valueHash = hashKey(e.value)
+	}
+	if df.opt.NilValues && e.mark == Normal && e.value == nil {
+		e.flags |= flagNilValue
+	}
+	if !df.opt.NoChecksums {
+		e.flags |= flagChecksum
+	}
+	if df.opt.Compression != NoCompression && e.mark == Normal && len(e.value) > 0 {
+		e.compression = df.opt.Compression
+	}
+}
+
+// appended moves the write position past e, which has just been written at
+// the end of alf, and returns the position of e.
+func (df *dbFile) appended(alf *logFile, e *Entry) (*logOffset, error) {
+	if df.opt.ActiveCheckpointBytes > 0 {
+		if err := df.addCheckpoint(alf, e); err != nil {
+			return nil, err
+		}
+	}
+	lo := &logOffset{fid: alf.fid, offset: df.writableOffset(), vLen: e.vLen, expiry: e.expiresAt()}
+	atomic.AddUint64(&df.writePtr, e.Size())
+	atomic.AddUint32(&df.activeEntries, 1)
+	df.db.counters.bytesWritten.Add(e.Size())
+	return lo, nil
+}
+
+// rotateIfFull starts a new active log file once alf exceeds opt.LogFileSize,
+// or holds opt.MaxEntriesPerFile entries.
+func (df *dbFile) rotateIfFull(alf *logFile) error {
+	full := df.opt.MaxEntriesPerFile > 0 && atomic.LoadUint32(&df.activeEntries) >= uint32(df.opt.MaxEntriesPerFile)
+	if !full && df.writableOffset() <= uint64(df.opt.LogFileSize) {
+		return nil
+	}
+	if err := alf.doneWriting(df.writableOffset()); err != nil {
+		return err
+	}
+	if err := df.dropCheckpoint(alf.fid); err != nil {
+		return err
+	}
+	return df.createLogFile(df.maxFid() + 1)
+}
+
 func (df *dbFile) merge() error {
-	if len(df.files) < 2 {
+	return df.compact(nil, nil)
+}
+
+// compact rewrites the sealed log files chosen by opt.MergePolicy, or all of them and
+// only for the keys pred returns true for if pred is set, see runGc. If plan is set,
+// nothing is rewritten and the files which would be are added to plan instead.
+func (df *dbFile) compact(pred func(key []byte) bool, plan *MergePlan) error {
+	// Exclude active log file. Files are compacted oldest first, so by the time
+	// a file is rewritten every older file has already dropped the entries of
+	// deleted keys and its tombstones are no longer needed. Writes may append a
+	// new active log file meanwhile, so the files are copied under the lock.
+	df.db.rlock(LockOpMaintenance)
+	var oldFiles []*logFile
+	if n := len(df.files); n >= 2 {
+		oldFiles = append(oldFiles, df.files[:n-1]...)
+	}
+	df.db.mu.RUnlock()
+	if len(oldFiles) == 0 {
 		return nil
 	}
-	// Exclude active log file.
-	oldFiles := df.files[:len(df.files)-1]
+	var selected map[uint32]bool
+	if pred == nil {
+		selected = df.selectMergeFiles(oldFiles)
+	}
+	// Tombstones can only be dropped while every older file is compacted in this pass.
+	keepTombstones := false
 	for _, lf := range oldFiles {
-		if err := lf.runGc(); err != nil {
+		if lf.pinned() && df.opt.CompactTombstones {
+			// Newer files may hold tombstones referring to the entries of a pinned file.
+			break
+		}
+		if selected != nil && !selected[lf.fid] || lf.pinned() {
+			keepTombstones = true
+			continue
+		}
+		if plan != nil {
+			fp, err := lf.planGc(keepTombstones)
+			if err != nil {
+				return err
+			}
+			plan.Files = append(plan.Files, fp)
+			plan.ReclaimableBytes += fp.ReclaimableBytes
+			continue
+		}
+		err := lf.runGc(keepTombstones, pred)
+		if err == ErrFilesPinned {
+			// Pinned while being rewritten, so it is left alone like one pinned before.
+			if df.opt.CompactTombstones {
+				break
+			}
+			keepTombstones = true
+			continue
+		}
+		if err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// selectMergeFiles returns the fids of files to compact chosen by opt.MergePolicy,
+// or all of files if there is no policy. With opt.CompactTombstones the choice is
+// extended to every file older than a chosen one, since compacting the entry a
+// tombstone refers to is only safe once no older version of the key survives.
+func (df *dbFile) selectMergeFiles(files []*logFile) map[uint32]bool {
+	selected := make(map[uint32]bool, len(files))
+	if df.opt.MergePolicy == nil {
+		for _, lf := range files {
+			selected[lf.fid] = true
+		}
+		return selected
+	}
+	for _, fid := range df.opt.MergePolicy(df.fileStats(files)) {
+		selected[fid] = true
+	}
+	if df.opt.CompactTombstones {
+		for i := len(files) - 1; i >= 0; i-- {
+			if selected[files[i].fid] {
+				for _, lf := range files[:i] {
+					selected[lf.fid] = true
+				}
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// fileStats returns the stats of files.
+func (df *dbFile) fileStats(files []*logFile) []FileStat {
+	db := df.db
+	db.rlock(LockOpMaintenance)
+	defer db.mu.RUnlock()
+
+	stats := make([]FileStat, len(files))
+	pos := make(map[uint32]int, len(files))
+	for i, lf := range files {
+		stats[i] = FileStat{Fid: lf.fid, Size: int64(lf.size)}
+		pos[lf.fid] = i
+	}
+	db.keyDir.forEach(func(key string, lo *logOffset) bool {
+		if i, ok := pos[lo.fid]; ok {
+			stats[i].LiveKeys++
+			stats[i].LiveBytes += int64(len(key)) + int64(lo.vLen)
+		}
+		return true
+	})
+	return stats
+}
+
+// resolveRef returns the key of the entry which the tombstone refers to,
+// or nil if the entry no longer exists.
+func (df *dbFile) resolveRef(e *Entry) []byte {
+	lf, err := df.getFile(e.refFid)
+	if err != nil {
+		return nil
+	}
+	ref, err := lf.readHeader(uint64(e.refOffset))
+	if err != nil || ref.mark != Normal || ref.kLen == 0 {
+		return nil
+	}
+	// The offset may land inside another entry after the file is compacted,
+	// so the whole entry must fit in the file and be older than the tombstone.
+	fi, err := lf.fd.Stat()
+	if err != nil || uint64(e.refOffset)+ref.Size() > uint64(fi.Size()) {
+		return nil
+	}
+	if ref.seq != 0 && e.seq != 0 && ref.seq >= e.seq {
+		return nil
+	}
+	key := make([]byte, ref.kLen)
+	if _, err = lf.fd.ReadAt(key, int64(e.refOffset)+int64(ref.hLen)); err != nil {
+		return nil
+	}
+	if hashKey(key) != e.keyHash {
+		return nil
+	}
+	return key
+}
+
+// expandRefTombstone turns the tombstone which refers to an entry into one storing the key,
+// or returns nil if the entry no longer exists.
+func (df *dbFile) expandRefTombstone(e *Entry) *Entry {
+	key := df.resolveRef(e)
+	if key == nil {
+		df.opt.Logger.Warnf("Dropping tombstone which refers to missing entry at fid %d offset %d", e.refFid, e.refOffset)
+		return nil
+	}
+	e.key = key
+	e.kLen = uint32(len(key))
+	e.flags &^= flagRef
+	return e
+}
+
+// replaceFile puts nlf in place of lf and retires lf, and clears the cache since the
+// entries move. The caller must hold db.mu.
+func (df *dbFile) replaceFile(lf, nlf *logFile) {
+	for i, f := range df.files {
+		if f == lf {
+			df.files[i] = nlf
+			break
+		}
+	}
+	df.db.epochs.retire(lf)
+	df.db.cache.clear()
+}
+
+// removeFile removes the log file, which has been taken out of df.files, from FS
+// and retires it, and clears the cache. The caller must hold db.mu.
+func (df *dbFile) removeFile(lf *logFile) error {
+	if err := os.Remove(lf.path); err != nil {
+		return err
+	}
+	df.db.epochs.retire(lf)
+	df.db.cache.clear()
+	return nil
+}
+
 // getFile return logFile by fid, return ErrFileNotFound
 // if that logFile not found.
 func (df *dbFile) getFile(fid uint32) (*logFile, error) {
@@ -242,41 +582,84 @@ func (df *dbFile) activeLogFile() *logFile {
 
 // createLogFile create a new log file replace current active log file.
 func (df *dbFile) createLogFile(fid uint32) error {
-	atomic.StoreUint64(&df.maxPtr, uint64(fid)<<32)
+	df.setFilePos(fid)
+	atomic.StoreUint32(&df.activeEntries, 0)
 
+	lf, err := df.newLogFile(fid)
+	if err != nil {
+		return err
+	}
+	df.files = append(df.files, lf)
+	return nil
+}
+
+// newLogFile creates an empty log file to become the active one.
+func (df *dbFile) newLogFile(fid uint32) (*logFile, error) {
 	path := df.fPath(fid)
 	lf := &logFile{fid: fid, path: path, db: df.db}
 
 	var err error
 	if lf.fd, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666); err != nil {
-		return errors.Wrapf(err, "Unable to create log file")
+		return nil, errors.Wrapf(err, "Unable to create log file")
 	}
-	if err = lf.fd.Truncate(df.opt.LogFileSize); err != nil {
-		return errors.Wrap(err, "Unable to truncate log file")
+	if df.opt.Fallocate {
+		err = fileutil.Preallocate(lf.fd, df.opt.LogFileSize)
+	} else {
+		err = lf.fd.Truncate(df.opt.LogFileSize)
+	}
+	if err != nil {
+		lf.fd.Close()
+		os.Remove(path)
+		return nil, errors.Wrap(err, "Unable to extend log file")
 	}
 
-	if err = syncDir(df.dirPath); err != nil {
-		return errors.Wrapf(err, "Unable to sync log file dir")
+	if err = df.db.syncDir(df.dirPath); err != nil {
+		lf.fd.Close()
+		os.Remove(path)
+		return nil, errors.Wrapf(err, "Unable to sync log file dir")
 	}
-	df.files = append(df.files, lf)
-	return nil
+	return lf, nil
 }
 
 func (df *dbFile) maxFid() uint32 {
-	return uint32(atomic.LoadUint64(&df.maxPtr) >> 32)
+	return atomic.LoadUint32(&df.activeFid)
+}
+
+func (df *dbFile) writableOffset() uint64 {
+	return atomic.LoadUint64(&df.writePtr)
+}
+
+// setFilePos makes fid the active log file, to be written from its start. writePtr
+// is reset before activeFid moves, so that filePos never pairs the new fid with the
+// offset reached in the previous file.
+func (df *dbFile) setFilePos(fid uint32) {
+	atomic.StoreUint64(&df.writePtr, 0)
+	atomic.StoreUint32(&df.activeFid, fid)
 }
 
-func (df *dbFile) writableOffset() uint32 {
-	return uint32(atomic.LoadUint64(&df.maxPtr))
+// filePos returns the active fid along with the offset written up to in it. The
+// offset may lag behind during a rotation, but never belongs to another file.
+func (df *dbFile) filePos() (uint32, uint64) {
+	for {
+		fid := atomic.LoadUint32(&df.activeFid)
+		offset := atomic.LoadUint64(&df.writePtr)
+		if atomic.LoadUint32(&df.activeFid) == fid {
+			return fid, offset
+		}
+	}
 }
 
 // logFile provides read and write for log entry.
 type logFile struct {
 	fid  uint32
-	size uint32
+	size uint64
 	path string
 	fd   *os.File
 	db   *DB
+	refs int32 // Number of open snapshots referring to the file.
+	// mapped holds the contents of a sealed log file mapped into memory, which reads
+	// are served from, see Options.UseMmap. It is nil if the file is not mapped.
+	mapped atomic.Pointer[[]byte]
 }
 
 func (lf *logFile) openReadWrite() error {
@@ -293,53 +676,105 @@ func (lf *logFile) open(flag int, perm os.FileMode) (err error) {
 	if err != nil {
 		return errors.Wrapf(err, "Unable to check stat for %q", lf.path)
 	}
-	lf.size = uint32(fi.Size())
+	lf.size = uint64(fi.Size())
 	return nil
 }
 
-func (lf *logFile) doneWriting(offset uint32) error {
+func (lf *logFile) doneWriting(offset uint64) error {
 	if err := lf.fd.Truncate(int64(offset)); err != nil {
 		return errors.Wrapf(err, "Unable to truncate file: %q", lf.path)
 	}
-	if err := fileutil.Fsync(lf.fd); err != nil {
+	lf.size = offset
+	if err := syncFile(lf.fd, lf.db.opt.SyncMode); err != nil {
 		return errors.Wrapf(err, "Unable to sync log file: %q", lf.path)
 	}
+	lf.mmap()
 	return nil
 }
 
-// delete closes the log file and remove it from FS.
+// mmap maps the sealed log file into memory if opt.UseMmap is set. The file is read
+// through its descriptor if it cannot be mapped.
+func (lf *logFile) mmap() {
+	if !lf.db.opt.UseMmap || lf.size == 0 || lf.mapped.Load() != nil {
+		return
+	}
+	data, err := fileutil.Mmap(lf.fd, int(lf.size))
+	if err != nil {
+		lf.db.opt.Logger.Warnf("Reading %q without mmap: %v", lf.path, err)
+		return
+	}
+	lf.mapped.Store(&data)
+}
+
+// close unmaps the log file if it is mapped and closes it.
+func (lf *logFile) close() error {
+	if data := lf.mapped.Swap(nil); data != nil {
+		if err := fileutil.Munmap(*data); err != nil {
+			lf.fd.Close()
+			return errors.Wrapf(err, "Unable to munmap %q", lf.path)
+		}
+	}
+	return lf.fd.Close()
+}
+
+// readAt is like lf.fd.ReadAt, but reads from memory if the log file is mapped.
+func (lf *logFile) readAt(buf []byte, off int64) (int, error) {
+	data := lf.mapped.Load()
+	if data == nil {
+		return lf.fd.ReadAt(buf, off)
+	}
+	if off >= int64(len(*data)) {
+		return 0, io.EOF
+	}
+	n := copy(buf, (*data)[off:])
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// delete closes the log file and remove it from FS. It must not be mapped.
 func (lf *logFile) delete() error {
 	if err := lf.fd.Truncate(0); err != nil {
 		// This is very important to let the FS know that the file is deleted.
 		return err
 	}
 	filename := lf.fd.Name()
-	if err := lf.fd.Close(); err != nil {
+	if err := lf.close(); err != nil {
 		return err
 	}
 	return os.Remove(filename)
 }
 
+// syncFile flushes fd to disk with the primitive chosen by mode, replaced in tests.
+var syncFile = func(fd *os.File, mode SyncMode) error {
+	if mode == SyncData {
+		return fileutil.Fdatasync(fd)
+	}
+	return fileutil.Fsync(fd)
+}
+
 // OpenOrCreateFileWithZeroOffset Opens or create file for path, and seek start.
-func OpenOrCreateFileWithZeroOffset(path string, flag int) (*os.File, uint32, error) {
+func OpenOrCreateFileWithZeroOffset(path string, flag int) (*os.File, uint64, error) {
 	fd, err := os.OpenFile(path, flag|os.O_CREATE|os.O_EXCL, 0666)
 	if err != nil {
 		return nil, 0, errors.Wrapf(err, "Unable to create file: %q", path)
 	}
 	offset, err := fd.Seek(0, io.SeekStart)
 	if err != nil {
+		fd.Close()
 		return nil, 0, errors.Wrapf(err, "Unable to seek file: %q", path)
 	}
-	return fd, uint32(offset), nil
+	return fd, uint64(offset), nil
 }
 
-func TruncateAndCloseFile(fd *os.File, size uint32) error {
+func TruncateAndCloseFile(fd *os.File, size uint64, mode SyncMode) error {
 	var err error
 	filename := fd.Name()
 	if err = fd.Truncate(int64(size)); err != nil {
 		return errors.Wrapf(err, "Unable to truncate file: %q", filename)
 	}
-	if err = fileutil.Fsync(fd); err != nil {
+	if err = syncFile(fd, mode); err != nil {
 		return errors.Wrapf(err, "Unable to sync file: %q", filename)
 	}
 	if err = fd.Close(); err != nil {
@@ -348,31 +783,103 @@ func TruncateAndCloseFile(fd *os.File, size uint32) error {
 	return nil
 }
 
-func (lf *logFile) runGc() error {
-	var err error
+// runGc rewrites the live entries of the log file and writes a hint file for it.
+// Tombstones of deleted keys are kept if keepTombstones is set, since they may
+// still shadow entries in older files which have not been compacted. If pred is
+// set, the entries and tombstones of the keys it returns false for are all kept.
+func (lf *logFile) runGc(keepTombstones bool, pred func(key []byte) bool) error {
+	return lf.gc(keepTombstones, pred, nil)
+}
+
+// planGc tells what runGc would do to the log file without pred, without writing anything.
+func (lf *logFile) planGc(keepTombstones bool) (FileMergePlan, error) {
+	fp := FileMergePlan{Fid: lf.fid, Size: int64(lf.size)}
+	err := lf.gc(keepTombstones, nil, &fp)
+	return fp, err
+}
+
+// gc implements runGc, or planGc if plan is set, in which case the entries are only
+// counted into plan and nothing is written.
+func (lf *logFile) gc(keepTombstones bool, pred func(key []byte) bool, plan *FileMergePlan) (err error) {
+	var (
+		tmpLogFd       *os.File
+		writableOffset uint64
+		hw             *hintWriter
+	)
 	tempLogPath := lf.path + tempFileNameSuffix
-	tmpLogFd, writableOffset, err := OpenOrCreateFileWithZeroOffset(tempLogPath, os.O_WRONLY)
-	if err != nil {
-		return err
-	}
+	if plan == nil {
+		tmpLogFd, writableOffset, err = OpenOrCreateFileWithZeroOffset(tempLogPath, os.O_WRONLY)
+		if err != nil {
+			return err
+		}
+		// A failed merge leaves no temp log file behind, which would fail the next one.
+		defer func() {
+			if err != nil {
+				tmpLogFd.Close()
+				os.Remove(tempLogPath)
+			}
+		}()
 
-	idxFilePath := indexFilePath(filepath.Dir(lf.path), lf.fid)
-	tempIndexPath := idxFilePath + tempFileNameSuffix
-	hf := &hintFile{fid: lf.fid, path: tempIndexPath}
-	if err = hf.openWriteOnly(); err != nil {
-		return err
-	}
+		hw, err = newHintWriter(lf)
+		if err != nil {
+			return err
+		}
+		defer hw.abort()
 
-	if err = syncDir(filepath.Dir(lf.path)); err != nil {
-		return errors.Wrap(err, "Unable to sync log file dir")
+		if err = lf.db.syncDir(filepath.Dir(lf.path)); err != nil {
+			return errors.Wrap(err, "Unable to sync log file dir")
+		}
+	}
+	// The index of each entry written is added to the hint file, or counted if planning.
+	addHint := func(e *Entry, offset uint64) error {
+		if plan != nil {
+			plan.LiveEntries++
+			return nil
+		}
+		return hw.add(e, offset)
 	}
 
 	var (
-		offset    uint32
-		e         *Entry
-		newKeyDir = make(map[string]*logOffset)
+		offset     uint64
+		e          *Entry
+		maxSeq     uint64 // Max write sequence in the log file
+		maxKeptSeq uint64 // Max write sequence rewritten into temp log file
+		entries    int    // Number of entries read
+		newKeyDir  = make(map[string]*logOffset)
+		expired    = make(map[string]uint64) // Offsets of the expired entries dropped
+		cutoff     int64
+		now        = nowFunc().UnixNano()
+		limiter    *rateLimiter
+		charged    int64 // Bytes read and written which waited for limiter
 	)
+	if rate := lf.db.opt.MergeRateLimit; rate > 0 && plan == nil {
+		limiter = newRateLimiter(rate)
+	}
+	// The new offsets of live entries update keyDir once the file is replaced. A file
+	// with many live entries would make the map large, so past mergeKeyDirLimit it is
+	// dropped and keyDir is updated from the new hint file instead.
+	remap := func(key []byte, lo *logOffset) {
+		if newKeyDir == nil {
+			return
+		}
+		if len(newKeyDir) >= mergeKeyDirLimit {
+			newKeyDir = nil
+			return
+		}
+		newKeyDir[string(key)] = lo
+	}
+	// Versions a newer one replaced are dropped whatever their age, so keeping the latest
+	// ones leaves nothing for the period to drop.
+	if period := lf.db.opt.RetentionPeriod; period > 0 && !lf.db.opt.RetentionKeepLatest {
+		cutoff = nowFunc().Add(-period).UnixNano()
+	}
 	for {
+		// Every entry read and rewritten since the last one waits for its bytes.
+		if limiter != nil {
+			done := int64(offset) + int64(writableOffset)
+			limiter.wait(done - charged)
+			charged = done
+		}
 		e, err = lf.read(offset)
 		if err != nil {
 			if err == io.EOF {
@@ -380,8 +887,69 @@ func (lf *logFile) runGc() error {
 			}
 			return err
 		}
+		entries++
+		if e.seq > maxSeq {
+			maxSeq = e.seq
+		}
+		// Rewriting e compresses its value anew, which may not take the same size.
+		size := e.Size()
 		if e.mark == Tombstone {
-			offset += e.Size()
+			if keepTombstones && e.flags&flagRef != 0 {
+				// The referenced entry may be compacted away, so keep the key itself.
+				e = lf.db.dbFile.expandRefTombstone(e)
+			}
+			if e != nil && (keepTombstones || pred != nil && !pred(e.key)) {
+				successful, err := lf.rewriteTombstone(e, tmpLogFd)
+				if err != nil {
+					return errors.Wrapf(err, "Unable to write entry into temp log file: %q", tempLogPath)
+				}
+				if successful {
+					if err = addHint(e, writableOffset); err != nil {
+						return err
+					}
+					maxKeptSeq = e.seq
+					writableOffset += e.Size()
+				}
+			}
+			offset += size
+			continue
+		}
+		if pred != nil && !pred(e.key) {
+			alive, err := lf.keepEntry(e, offset, tmpLogFd)
+			if err != nil {
+				return errors.Wrapf(err, "Unable to write entry into temp log file: %q", tempLogPath)
+			}
+			if err = addHint(e, writableOffset); err != nil {
+				return err
+			}
+			if alive {
+				remap(e.key, &logOffset{fid: lf.fid, offset: writableOffset, vLen: e.vLen, expiry: e.expiresAt()})
+			}
+			maxKeptSeq = e.seq
+			writableOffset += e.Size()
+			offset += size
+			continue
+		}
+		if e.flags&flagTimestamp != 0 && e.timestamp < cutoff || e.expired(now) {
+			// The key is deleted if this is its latest version, which is checked on replacing.
+			expired[string(e.key)] = offset
+			if keepTombstones {
+				// Like a tombstone, the key must stay deleted though older files have it.
+				tomb := NewEntry(e.key, nil, Tombstone)
+				tomb.seq = e.seq
+				successful, err := lf.compareAndRewrite(tomb, offset, tmpLogFd)
+				if err != nil {
+					return errors.Wrapf(err, "Unable to write entry into temp log file: %q", tempLogPath)
+				}
+				if successful {
+					if err = addHint(tomb, writableOffset); err != nil {
+						return err
+					}
+					maxKeptSeq = tomb.seq
+					writableOffset += tomb.Size()
+				}
+			}
+			offset += size
 			continue
 		}
 		successful, err := lf.compareAndRewrite(e, offset, tmpLogFd)
@@ -390,58 +958,81 @@ func (lf *logFile) runGc() error {
 		}
 		if successful {
 			// Write index into hint file
-			idx := &Index{fid: lf.fid, offset: writableOffset, kLen: e.kLen, key: e.key}
-			if err = hf.write(idx); err != nil {
-				return errors.Wrapf(err, "Unable to write into hint file: %q", tempIndexPath)
+			if err = addHint(e, writableOffset); err != nil {
+				return err
 			}
 			// Cache offset waiting for a one-time update (because the file has not been replaced)
-			newKeyDir[string(e.key)] = &logOffset{fid: lf.fid, offset: writableOffset}
+			remap(e.key, &logOffset{fid: lf.fid, offset: writableOffset, vLen: e.vLen, expiry: e.expiresAt()})
+			maxKeptSeq = e.seq
 			writableOffset += e.Size()
 		}
-		offset += e.Size()
+		offset += size
 	}
 
-	if err = TruncateAndCloseFile(tmpLogFd, writableOffset); err != nil {
+	if plan != nil {
+		plan.DeadEntries = entries - plan.LiveEntries
+		plan.ReclaimableBytes = plan.Size - int64(writableOffset)
+		return nil
+	}
+
+	syncMode := lf.db.opt.SyncMode
+	if err = TruncateAndCloseFile(tmpLogFd, writableOffset, syncMode); err != nil {
 		return err
 	}
-	if err = hf.close(hf.size); err != nil {
+	if err = hw.close(syncMode); err != nil {
 		return err
 	}
 
-	// Replace log file and update keyDir
+	// Keep the write sequence from going backwards after the last entry is dropped
 	db := lf.db
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	if err = lf.delete(); err != nil {
-		return err
+	if maxSeq > maxKeptSeq {
+		if err = db.advanceSeqWatermark(maxSeq); err != nil {
+			return err
+		}
 	}
-	if err = os.Rename(tempLogPath, lf.path); err != nil {
+
+	// The new log file is opened before taking the lock, so the swap only renames it.
+	nlf := &logFile{fid: lf.fid, path: tempLogPath, db: db}
+	if err = nlf.openReadWrite(); err != nil {
 		return err
 	}
-	if err = lf.openReadWrite(); err != nil {
+	nlf.mmap()
+	nlf.path = lf.path
+
+	// Replace log file and update keyDir
+	db.lock(LockOpMaintenance)
+	defer db.mu.Unlock()
+	if lf.pinned() {
+		// A reader pinned the file meanwhile, which it can only do while holding db.mu.
+		nlf.close()
+		os.Remove(tempLogPath)
+		return ErrFilesPinned
+	}
+	// Reads which looked the old file up go on reading it through its descriptor,
+	// which is only closed by retire once they are done.
+	if err = os.Rename(tempLogPath, lf.path); err != nil {
+		nlf.close()
 		return err
 	}
-	db.updateKeyDir(newKeyDir)
-
-	if err = os.Rename(tempIndexPath, idxFilePath); err != nil {
+	db.dbFile.replaceFile(lf, nlf)
+	db.removeExpired(lf.fid, expired)
+	if newKeyDir != nil {
+		db.updateKeyDir(newKeyDir)
+	} else if err = db.updateKeyDirFromHint(lf.fid, hw.hf.path); err != nil {
 		return err
 	}
 
-	return nil
+	return hw.commit()
 }
 
-func (lf *logFile) compareAndRewrite(e *Entry, offset uint32, fd *os.File) (bool, error) {
+func (lf *logFile) compareAndRewrite(e *Entry, offset uint64, fd *os.File) (bool, error) {
 	db := lf.db
-	db.mu.RLock()
+	db.rlock(LockOpMaintenance)
 	defer db.mu.RUnlock()
 
-	if lo, has := db.keyDir[string(e.key)]; has && lo.fid == lf.fid && lo.offset == offset {
-		bytes, err := encodeEntry(e)
-		if err != nil {
-			return false, err
-		}
-		// Write entry to temp log file
-		if _, err = fd.Write(bytes); err != nil {
+	if lo, has := db.keyDir.get(e.key); has && lo.fid == lf.fid && lo.offset == offset {
+		// Write entry to temp log file, unless planning
+		if err := writeEncoded(e, lf.db.opt.Codec, fd); err != nil {
 			return false, err
 		}
 		return true, nil
@@ -449,104 +1040,377 @@ func (lf *logFile) compareAndRewrite(e *Entry, offset uint32, fd *os.File) (bool
 	return false, nil
 }
 
+// keepEntry writes e, which is at offset of the log file, to temp log file whether
+// it is alive or not, and tells whether it is alive.
+func (lf *logFile) keepEntry(e *Entry, offset uint64, fd *os.File) (bool, error) {
+	db := lf.db
+	db.rlock(LockOpMaintenance)
+	defer db.mu.RUnlock()
+
+	if err := writeEncoded(e, lf.db.opt.Codec, fd); err != nil {
+		return false, err
+	}
+	lo, has := db.keyDir.get(e.key)
+	return has && lo.fid == lf.fid && lo.offset == offset, nil
+}
+
+// rewriteTombstone writes the tombstone to temp log file if the key is still deleted.
+func (lf *logFile) rewriteTombstone(e *Entry, fd *os.File) (bool, error) {
+	db := lf.db
+	db.rlock(LockOpMaintenance)
+	defer db.mu.RUnlock()
+
+	// The key has been written again, so the tombstone no longer matters.
+	if _, has := db.keyDir.get(e.key); has {
+		return false, nil
+	}
+	if err := writeEncoded(e, lf.db.opt.Codec, fd); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// writeEncoded writes e to the temp log file fd of a merge, or nothing if fd is nil,
+// which is the case when the merge is only planned.
+func writeEncoded(e *Entry, codec Codec, fd *os.File) error {
+	if fd == nil {
+		return nil
+	}
+	bytes, err := encodeEntry(e, codec)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(bytes)
+	return err
+}
+
+// checkWriteOffset returns an error if the write position of the file is not at offset,
+// in which case entries would be written to a different place than keyDir records.
+func (lf *logFile) checkWriteOffset(offset uint64) error {
+	pos, err := lf.fd.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to get write position of file: %q", lf.path)
+	}
+	if pos != int64(offset) {
+		return errors.Errorf("Write position %d of file %q diverges from writable offset %d", pos, lf.path, offset)
+	}
+	return nil
+}
+
 // write the entry in log file.
 func (lf *logFile) write(e *Entry) error {
-	bytes, err := encodeEntry(e)
+	bytes, err := encodeEntry(e, lf.db.opt.Codec)
 	if err != nil {
 		return err
 	}
-	if _, err = lf.fd.Write(bytes); err != nil {
+	return lf.writeAll(bytes)
+}
+
+// writeAll appends b to the log file, retrying failed writes opt.WriteRetries times,
+// and syncs it if opt.SyncWrites is set.
+func (lf *logFile) writeAll(b []byte) error {
+	if err := writeAll(lf.fd, b, lf.db.opt.WriteRetries, lf.db.opt.Logger); err != nil {
 		return err
 	}
+	if !lf.db.opt.SyncWrites {
+		return nil
+	}
+	if err := syncFile(lf.fd, lf.db.opt.SyncMode); err != nil {
+		// Like after a failed write, the next write overwrites b.
+		if _, seekErr := lf.fd.Seek(-int64(len(b)), io.SeekCurrent); seekErr != nil {
+			lf.db.opt.Logger.Errorf("Unable to seek back over an unsynced write: %v", seekErr)
+		}
+		return errors.Wrapf(err, "Unable to sync log file: %q", lf.path)
+	}
 	return nil
 }
 
+// writeAll writes b to f, continuing short writes, and retrying a failed write up to
+// retries times from where it stopped. If it still fails, the offset of f is moved back
+// to where b starts, so that the bytes written so far are overwritten by the next write
+// instead of being followed by it. Interrupted system calls are already retried by *os.File.
+func writeAll(f io.WriteSeeker, b []byte, retries int, logger Logger) error {
+	var written int
+	for {
+		n, err := f.Write(b[written:])
+		written += n
+		if err == nil {
+			if written == len(b) {
+				return nil
+			}
+			if n > 0 {
+				continue
+			}
+			err = io.ErrShortWrite
+		}
+		if retries <= 0 {
+			if written > 0 {
+				if _, seekErr := f.Seek(-int64(written), io.SeekCurrent); seekErr != nil {
+					logger.Errorf("Unable to seek back over a partial write: %v", seekErr)
+				}
+			}
+			return err
+		}
+		retries--
+		logger.Warnf("Retrying write after %d of %d bytes: %v", written, len(b), err)
+	}
+}
+
 // readWithSize reads entry from log file.
-func (lf *logFile) readWithSize(offset, n uint32) (*Entry, error) {
-	buf := make([]byte, n)
-	if _, err := lf.fd.ReadAt(buf, int64(offset)); err != nil && err != io.EOF {
+func (lf *logFile) readWithSize(offset, n uint64) (*Entry, error) {
+	bp := lf.db.readBuf(int(n))
+	defer lf.db.releaseReadBuf(bp)
+	buf := (*bp)[:n]
+	// A pooled buffer holds stale bytes, so an entry cut short must not be decoded.
+	if n, err := lf.readAt(buf, int64(offset)); n < len(buf) {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return nil, err
 	}
-	return decodeEntry(buf)
+	return decodeEntry(buf, lf.db.opt.Codec)
 }
 
-// read entry from log file.
-func (lf *logFile) read(offset uint32) (*Entry, error) {
-	buf := make([]byte, entryHeaderSize)
-	if _, err := lf.fd.ReadAt(buf, int64(offset)); err != nil {
+// readHeader reads entry header from log file.
+func (lf *logFile) readHeader(offset uint64) (*Entry, error) {
+	var buf [varintEntryHeaderMaxSize + entryExtMaxSize]byte
+	n, err := lf.readAt(buf[:maxEntryHeaderSize(lf.db.opt.Codec)], int64(offset))
+	if err != nil && (err != io.EOF || n == 0) {
 		return nil, err
 	}
-	e, err := decodeEntry(buf)
+	// A variable length header may be shorter than buf at the end of file.
+	e := new(Entry)
+	err = decodeHeader(buf[:n], lf.db.opt.Codec, e)
+	if err == errShortEntry {
+		return nil, io.EOF
+	}
 	if err != nil {
 		return nil, err
 	}
-	if n := e.kLen + e.vLen; n > 0 {
-		if n > entryHeaderSize {
-			buf = make([]byte, n)
-		} else {
-			buf = buf[:n]
+	return e, nil
+}
+
+// read entry from log file, verifying its checksum if it has one.
+func (lf *logFile) read(offset uint64) (*Entry, error) {
+	e, err := lf.readHeader(offset)
+	if err != nil {
+		return nil, err
+	}
+	if n := uint64(e.kLen) + e.vLen; n == 0 {
+		if err = e.verifyChecksum(); err != nil {
+			return nil, errors.Wrapf(err, "Entry at offset %d of %q", offset, lf.path)
+		}
+	} else {
+		// The lengths are checked before a buffer is allocated for them.
+		if err = lf.checkEnd(offset, e); err != nil {
+			return nil, err
 		}
-		offset += entryHeaderSize
-		if _, err = lf.fd.ReadAt(buf, int64(offset)); err != nil {
+		// The key and value are copied out of a pooled buffer, so it is reused right away.
+		bp := lf.db.readBuf(int(n))
+		defer lf.db.releaseReadBuf(bp)
+		buf := (*bp)[:n]
+		if _, err = lf.readAt(buf, int64(offset)+int64(e.hLen)); err != nil {
+			if err == io.EOF {
+				// The header is complete, so the entry is torn rather than absent.
+				err = io.ErrUnexpectedEOF
+			}
 			return nil, err
 		}
-		e.key = make([]byte, e.kLen)
-		e.value = make([]byte, e.vLen)
-		copy(e.key, buf[:e.kLen])
-		copy(e.value, buf[e.kLen:])
+		if err = e.verifyChecksum(buf); err != nil {
+			return nil, errors.Wrapf(err, "Entry at offset %d of %q", offset, lf.path)
+		}
+		if n > uint64(lf.db.opt.ReadBufferSize) {
+			// A buffer of its own, which a large value gets, is kept instead.
+			e.key, e.value = buf[:e.kLen:e.kLen], buf[e.kLen:]
+		} else {
+			e.key = make([]byte, e.kLen)
+			e.value = make([]byte, e.vLen)
+			copy(e.key, buf[:e.kLen])
+			copy(e.value, buf[e.kLen:])
+		}
+		if err = e.decompressValue(); err != nil {
+			return nil, errors.Wrapf(err, "Entry at offset %d of %q", offset, lf.path)
+		}
+		e.restoreNilValue()
 	}
 	return e, nil
 }
 
-func (lf *logFile) iterate(fn replayFn) (uint32, error) {
-	var offset uint32
-	for {
+// checkEnd returns io.ErrUnexpectedEOF if the entry e at offset, whose header is read,
+// goes past the data of lf: its size once sealed, or for the active file the entries
+// written so far, or its size on disk while they are replayed.
+func (lf *logFile) checkEnd(offset uint64, e *Entry) error {
+	end := offset + e.Size()
+	fid, written := lf.db.dbFile.filePos()
+	if fid != lf.fid {
+		if end > lf.size {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+	}
+	if end <= written {
+		return nil
+	}
+	fi, err := lf.fd.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "Unable to check stat for %q", lf.path)
+	}
+	if end > uint64(fi.Size()) {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// readBuf returns a buffer of at least n bytes to read an entry into, from the pool
+// of read buffers if n is within opt.ReadBufferSize, or a new one otherwise. It is
+// returned by pointer, so that handing it back to the pool does not allocate.
+func (db *DB) readBuf(n int) *[]byte {
+	size := db.opt.ReadBufferSize
+	if n > size {
+		buf := make([]byte, n)
+		return &buf
+	}
+	if bp, _ := db.readBufs.Get().(*[]byte); bp != nil {
+		return bp
+	}
+	buf := make([]byte, size)
+	return &buf
+}
+
+// releaseReadBuf hands a buffer returned by readBuf back to the pool. The buffer
+// must not be used afterwards.
+func (db *DB) releaseReadBuf(bp *[]byte) {
+	if size := db.opt.ReadBufferSize; size > 0 && len(*bp) == size {
+		db.readBufs.Put(bp)
+	}
+}
+
+// iterateFrom iterates over log file from offset, which must be the start of an entry,
+// up to size, and returns the end of the last readable entry. Unreadable entries are
+// handled as onError decides, a nil onError aborts. A sealed file ends with its last
+// entry, so one cut short by size is unreadable too. The active file is passed a size
+// of math.MaxUint64 and read up to its actual end, where an entry torn by a crash
+// ends the iteration.
+func (lf *logFile) iterateFrom(offset, size uint64, fn replayFn, onError func(fid uint32, offset uint64, err error) ReplayAction) (uint64, error) {
+	// end stays at the last readable entry, so writing never resumes after skipped ones.
+	end := offset
+loop:
+	for offset < size {
 		e, err := lf.read(offset)
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			if size == math.MaxUint64 {
+				break loop
+			}
+			err = errors.Errorf("Entry at offset %d is cut short by the end of file at %d", offset, size)
+		case errors.Cause(err) == ErrChecksumMismatch && size == math.MaxUint64 && lf.lastEntryAt(offset):
+			// A torn write leaves the end of a preallocated file zeroed rather than cut short.
+			break loop
+		case err == nil && e.mark != Normal && e.mark != Tombstone:
+			err = errors.Errorf("Invalid entry mark %d at offset %d", e.mark, offset)
+		case err == nil && offset+e.Size() > size:
+			err = errors.Errorf("Entry at offset %d exceeds the end of file at %d", offset, size)
+		}
 		if err != nil {
-			if err == io.EOF {
-				break
+			action := Abort
+			if onError != nil {
+				action = onError(lf.fid, offset, err)
+			}
+			switch action {
+			case SkipEntry:
+				// The entry can only be skipped if its size is known and within the file.
+				if e, hErr := lf.readHeader(offset); hErr == nil && lf.checkEnd(offset, e) == nil {
+					lf.db.opt.Logger.Warnf("Skipping unreadable entry at offset %d of %q: %v", offset, lf.path, err)
+					offset += e.Size()
+					continue
+				}
+				fallthrough
+			case StopFile:
+				lf.db.opt.Logger.Warnf("Ignoring the rest of %q from offset %d: %v", lf.path, offset, err)
+				break loop
+			default:
+				return 0, err
 			}
-			return 0, err
 		}
 		if e.mark == Tombstone {
-			if err = fn(e.key, nil); err != nil {
-				return 0, err
+			key := e.key
+			if e.flags&flagRef != 0 {
+				key = lf.db.dbFile.resolveRef(e)
+			}
+			// A tombstone whose referenced entry is compacted away has nothing left to delete.
+			if key != nil {
+				if err = fn(key, nil, e.seq); err != nil {
+					return 0, err
+				}
 			}
 			offset += e.Size()
+			end = offset
 			continue
 		}
 		// The length of key cannot be zero unless the log file is not filled with actual data
 		if e.kLen == 0 {
 			break
 		}
-		if err = fn(e.key, &logOffset{fid: lf.fid, offset: offset}); err != nil {
+		if err = fn(e.key, &logOffset{fid: lf.fid, offset: offset, vLen: e.vLen, expiry: e.expiresAt()}, e.seq); err != nil {
 			return 0, err
 		}
 		offset += e.Size()
+		end = offset
 	}
-	return offset, nil
+	return end, nil
+}
+
+// lastEntryAt tells whether the entry at offset is followed by the end of file, or by
+// the zeros of a preallocated file.
+func (lf *logFile) lastEntryAt(offset uint64) bool {
+	e, err := lf.readHeader(offset)
+	if err != nil {
+		return false
+	}
+	next, err := lf.readHeader(offset + e.Size())
+	return err == io.EOF || err == nil && next.mark == Normal && next.kLen == 0 && next.vLen == 0 && next.flags == 0
+}
+
+// entryOffsets returns the offsets of the entries before end, reading headers only.
+func (lf *logFile) entryOffsets(end uint64) ([]uint64, error) {
+	var offsets []uint64
+	for offset := uint64(0); offset < end; {
+		e, err := lf.readHeader(offset)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to read entry header at offset %d of %q", offset, lf.path)
+		}
+		offsets = append(offsets, offset)
+		offset += e.Size()
+	}
+	return offsets, nil
 }
 
 // hintFile provides read and write for log index.
 type hintFile struct {
 	fid  uint32
-	size uint32
+	size uint64
 	path string
 	fd   *os.File
+	// w buffers the indexes written, so a file of many small keys takes few syscalls.
+	w *bufio.Writer
 }
 
 func (hf *hintFile) openReadOnly() error {
-	return hf.openOrCreate(os.O_RDONLY, 0666)
+	return hf.open(os.O_RDONLY, 0)
 }
 
 func (hf *hintFile) openWriteOnly() error {
-	return hf.openOrCreate(os.O_WRONLY, 0666)
+	if err := hf.open(os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666); err != nil {
+		return err
+	}
+	hf.w = bufio.NewWriterSize(hf.fd, hintWriteBufferSize)
+	return nil
 }
 
-func (hf *hintFile) openOrCreate(flag int, perm os.FileMode) (err error) {
-	hf.fd, err = os.OpenFile(hf.path, flag|os.O_CREATE|os.O_EXCL, perm)
+func (hf *hintFile) open(flag int, perm os.FileMode) (err error) {
+	hf.fd, err = os.OpenFile(hf.path, flag, perm)
 	if err != nil {
-		return errors.Wrapf(err, "Unable to open or create file: %q.", hf.path)
+		return errors.Wrapf(err, "Unable to open file: %q.", hf.path)
 	}
 
 	_, err = hf.fd.Seek(0, io.SeekStart)
@@ -556,13 +1420,18 @@ func (hf *hintFile) openOrCreate(flag int, perm os.FileMode) (err error) {
 	return nil
 }
 
-func (hf *hintFile) close(size uint32) error {
+func (hf *hintFile) close(size uint64, mode SyncMode) error {
 	var err error
 	filename := hf.fd.Name()
+	if hf.w != nil {
+		if err = hf.w.Flush(); err != nil {
+			return errors.Wrapf(err, "Unable to write file: %q", filename)
+		}
+	}
 	if err = hf.fd.Truncate(int64(size)); err != nil {
 		return errors.Wrapf(err, "Unable to truncate file: %q", filename)
 	}
-	if err = fileutil.Fsync(hf.fd); err != nil {
+	if err = syncFile(hf.fd, mode); err != nil {
 		return errors.Wrapf(err, "Unable to sync file: %q", filename)
 	}
 	if err = hf.fd.Close(); err != nil {
@@ -576,41 +1445,111 @@ func (hf *hintFile) write(idx *Index) error {
 	if err != nil {
 		return err
 	}
-	if _, err = hf.fd.Write(bytes); err != nil {
+	if _, err = hf.w.Write(bytes); err != nil {
 		return err
 	}
-	hf.size += idx.Size()
+	hf.size += uint64(idx.Size())
 	return nil
 }
 
-func (hf *hintFile) iterate(fn replayFn) (uint32, error) {
-	var lastOffset uint32
-	buf := make([]byte, indexHeaderSize)
-	for {
-		if _, err := hf.fd.Read(buf); err != nil {
-			if err == io.EOF {
-				break
+// iterate iterates over hint file, the value size missing in old index is read from lf.
+// The whole hint file is decoded before fn is called, so fn is not called at all if
+// the hint file is invalid, in which case an error caused by errInvalidHint is returned.
+func (hf *hintFile) iterate(lf *logFile, fn replayFn) (uint64, error) {
+	idxs, err := hf.readAll()
+	if err != nil {
+		return 0, err
+	}
+	return hf.replay(lf, idxs, fn)
+}
+
+// replay calls fn for idxs decoded from hint file, and returns the offset of the last one.
+func (hf *hintFile) replay(lf *logFile, idxs []*Index, fn replayFn) (uint64, error) {
+	var (
+		lastOffset uint64
+		err        error
+	)
+	for _, idx := range idxs {
+		lastOffset = idx.offset
+		if idx.mark == Tombstone {
+			err = fn(idx.key, nil, idx.seq)
+		} else {
+			if idx.flags&flagValueSize == 0 {
+				e, err := lf.readHeader(idx.offset)
+				if err != nil {
+					return 0, errors.Wrapf(err, "Unable to read entry header of index in file: %q", hf.path)
+				}
+				idx.valueSize = e.vLen
 			}
-			return 0, errors.Wrapf(err, "Unable to read file: %q", hf.path)
+			err = fn(idx.key, &logOffset{fid: idx.fid, offset: idx.offset, vLen: idx.valueSize, expiry: idx.expiresAt()}, idx.seq)
 		}
-		idx, err := decodeIndex(buf)
 		if err != nil {
 			return 0, err
 		}
-		idx.key = make([]byte, idx.kLen)
-		if _, err = hf.fd.Read(idx.key); err != nil {
+	}
+	return lastOffset, nil
+}
+
+// readAll decodes all indexes of hint file. A hint file may be cut short by a crash
+// while it is written, which is reported as errInvalidHint. The indexes decoded
+// before an error are returned along with it.
+func (hf *hintFile) readAll() ([]*Index, error) {
+	var idxs []*Index
+	err := hf.forEach(func(idx *Index) error {
+		idxs = append(idxs, idx)
+		return nil
+	})
+	return idxs, err
+}
+
+// forEach decodes the indexes of hint file one by one and calls fn for each of them,
+// see readAll.
+func (hf *hintFile) forEach(fn func(idx *Index) error) error {
+	var lastOffset uint64
+	r := bufio.NewReader(hf.fd)
+	buf := make([]byte, indexHeaderSize+entryExtMaxSize)
+	for n := 0; ; n++ {
+		if _, err := io.ReadFull(r, buf[:indexHeaderSize]); err != nil {
 			if err == io.EOF {
 				break
 			}
-			return 0, errors.Wrapf(err, "Unable to read file: %q", hf.path)
+			return hintReadError(err, hf.path)
 		}
-		if err = fn(idx.key, &logOffset{fid: idx.fid, offset: idx.offset}); err != nil {
-			return 0, err
+		idx, err := decodeIndex(buf[:indexHeaderSize])
+		if err != nil {
+			return err
 		}
-		if idx.offset <= lastOffset {
-			return 0, errors.Errorf("Error offset, idx.offset: %d, lastOffset: %d", idx.offset, lastOffset)
+		if idx.extended() {
+			ext := buf[indexHeaderSize:]
+			if _, err = io.ReadFull(r, ext[:1]); err == nil {
+				_, err = io.ReadFull(r, ext[1:entryFlag(ext[0]).extSize()])
+			}
+			if err != nil {
+				return hintReadError(err, hf.path)
+			}
+			if err = decodeIndexExt(idx, ext); err != nil {
+				return err
+			}
+		}
+		idx.key = make([]byte, idx.kLen)
+		if _, err = io.ReadFull(r, idx.key); err != nil {
+			return hintReadError(err, hf.path)
+		}
+		if n > 0 && idx.offset <= lastOffset {
+			return errors.Wrapf(errInvalidHint, "Error offset in file %q, idx.offset: %d, lastOffset: %d", hf.path, idx.offset, lastOffset)
 		}
 		lastOffset = idx.offset
+		if err = fn(idx); err != nil {
+			return err
+		}
 	}
-	return lastOffset, nil
+	return nil
+}
+
+// hintReadError reports a hint file which ends in the middle of an index as errInvalidHint.
+func hintReadError(err error, path string) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.Wrapf(errInvalidHint, "Truncated index in file: %q", path)
+	}
+	return errors.Wrapf(err, "Unable to read file: %q", path)
 }
@@ -0,0 +1,57 @@
+//go:build minidb_large
+
+package minidb
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"math"
+	"runtime/debug"
+	"testing"
+)
+
+// TestDB_LargeValue round trips a value of more than 4GB, whose header has a wide value
+// length, followed by an entry more than 4GB into the log file. It takes about 5GB of
+// memory and 5GB of disk, so it only runs with the minidb_large build tag.
+func TestDB_LargeValue(t *testing.T) {
+	db, opts := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 5 << 30
+	})
+	key := []byte("large")
+	// Only the pages touched here take memory, the others read as zeros
+	val := make([]byte, math.MaxUint32+1<<10)
+	val[0], val[len(val)/2], val[len(val)-1] = 'a', 'm', 'z'
+	require.NoError(t, db.Put(key, val))
+	require.NoError(t, db.Put([]byte("small"), []byte("val")))
+	debug.FreeOSMemory()
+	lo, ok := db.keyDir.get([]byte("small"))
+	require.True(t, ok)
+	require.Equal(t, uint32(0), lo.fid)
+	require.Greater(t, lo.offset, uint64(math.MaxUint32))
+
+	check := func(db *DB) {
+		// The value read by replay, if any, is returned to the OS first
+		debug.FreeOSMemory()
+		got, err := db.Get(key)
+		require.NoError(t, err)
+		// Not require.Equal, which would print both values on failure
+		require.True(t, bytes.Equal(val, got))
+		got = nil
+		debug.FreeOSMemory()
+
+		got, err = db.Get([]byte("small"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("val"), got)
+		lo, ok := db.keyDir.get(key)
+		require.True(t, ok)
+		require.EqualValues(t, len(val), lo.vLen)
+	}
+	check(db)
+	require.NoError(t, db.Close())
+
+	// The wide header is read back by replay
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	check(db)
+}
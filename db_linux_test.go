@@ -0,0 +1,81 @@
+//go:build linux
+
+package minidb
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDB_Fallocate(t *testing.T) {
+	// allocated returns the bytes of disk blocks allocated to the active log file.
+	allocated := func(db *DB) int64 {
+		fi, err := db.dbFile.activeLogFile().fd.Stat()
+		require.NoError(t, err)
+		return fi.Sys().(*syscall.Stat_t).Blocks * 512
+	}
+
+	for _, fallocate := range []bool{false, true} {
+		dir, err := os.MkdirTemp("", "minidb")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		opts := getTestOptions(dir)
+		opts.LogFileSize = 4 << 20
+		opts.Fallocate = fallocate
+		db, err := Open(opts)
+		require.NoError(t, err)
+
+		if fallocate {
+			require.True(t, allocated(db) >= opts.LogFileSize)
+		} else {
+			require.True(t, allocated(db) < opts.LogFileSize)
+		}
+
+		// Log files are used as usual
+		require.NoError(t, db.Put([]byte("key"), []byte("val")))
+		require.NoError(t, db.SealActive())
+		fi, err := db.dbFile.activeLogFile().fd.Stat()
+		require.NoError(t, err)
+		require.Equal(t, opts.LogFileSize, fi.Size())
+		require.NoError(t, db.Close())
+
+		db, err = Open(opts)
+		require.NoError(t, err)
+		v, err := db.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("val"), v)
+		require.NoError(t, db.Close())
+	}
+}
+
+func TestDB_EntryTooLarge(t *testing.T) {
+	// The value is mapped without reserving memory, and its pages are never touched
+	// as it is rejected up front
+	size := uint64(maxEntrySize)
+	val, err := syscall.Mmap(-1, 0, int(size), syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_PRIVATE|syscall.MAP_ANON|syscall.MAP_NORESERVE)
+	if err != nil {
+		t.Skipf("Unable to map a value of %d bytes: %v", size, err)
+	}
+	defer syscall.Munmap(val)
+
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		key := []byte("key")
+		require.Equal(t, ErrEntryTooLarge, db.Put(key, val))
+		require.Equal(t, ErrEntryTooLarge, db.PutWithTTL(key, val, time.Hour))
+		require.Equal(t, ErrEntryTooLarge, db.ReplacePrefix(key, map[string][]byte{"key": val}))
+		var err error
+		db.PutAsync(key, val, func(e error) { err = e })
+		require.Equal(t, ErrEntryTooLarge, err)
+		require.Equal(t, ErrEntryTooLarge, db.NewTxn().Put(key, val))
+
+		require.NoError(t, db.Put(key, val[:1<<10]))
+		got, err := db.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, val[:1<<10], got)
+	})
+}
@@ -1,13 +1,28 @@
 package minidb
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"github.com/pingcap/errors"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io"
 	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"runtime/debug"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func getTestOptions(dir string) Options {
@@ -15,6 +30,29 @@ func getTestOptions(dir string) Options {
 	return opts
 }
 
+// openTestDB opens a mini db with the test options, changed by setOpts if set, in a
+// directory of its own, and returns it along with the options for reopening it. The
+// db is closed, unless the test did, and the directory removed once the test ends.
+func openTestDB(t *testing.T, setOpts func(opts *Options)) (*DB, Options) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	opts := getTestOptions(dir)
+	if setOpts != nil {
+		setOpts(&opts)
+	}
+	db, err := Open(opts)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		if !db.isClosed() {
+			db.Close()
+		}
+	})
+	return db, opts
+}
+
 // Opens a mini db and runs a test on it.
 func runTest(t *testing.T, opts *Options, test func(t *testing.T, db *DB)) {
 	dir, err := os.MkdirTemp("", "minidb")
@@ -39,7 +77,7 @@ func TestDB_Put(t *testing.T) {
 			err := db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i)))
 			require.NoError(t, err)
 		}
-		require.Equal(t, n, len(db.keyDir))
+		require.Equal(t, n, db.keyDir.len())
 	})
 }
 
@@ -47,25 +85,248 @@ func TestDB_Delete(t *testing.T) {
 	runTest(t, nil, func(t *testing.T, db *DB) {
 		for i := 0; i < 1000; i++ {
 			// Simulate that key already exist
-			db.keyDir[fmt.Sprintf("key%d", i)] = &logOffset{}
+			db.keyDir.set([]byte(fmt.Sprintf("key%d", i)), &logOffset{})
 
 			// Delete the key
 			err := db.Delete([]byte(fmt.Sprintf("key%d", i)))
 			require.NoError(t, err)
 
-			require.Equal(t, 0, len(db.keyDir))
+			require.Equal(t, 0, db.keyDir.len())
 		}
 	})
 }
 
-func TestDB_Get(t *testing.T) {
+func TestDB_StrictDelete(t *testing.T) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, strict := range []bool{false, true} {
+		opts := getTestOptions(dir)
+		opts.StrictDelete = strict
+		db, err := Open(opts)
+		require.NoError(t, err)
+
+		key := []byte(fmt.Sprintf("key-%v", strict))
+		require.NoError(t, db.Put(key, []byte("val")))
+		require.NoError(t, db.Delete(key))
+
+		// The key is gone now
+		err = db.Delete(key)
+		if strict {
+			require.Equal(t, ErrKeyNotFound, err)
+		} else {
+			require.NoError(t, err)
+		}
+		require.NoError(t, db.Close())
+	}
+}
+
+func TestDB_KeyValidator(t *testing.T) {
+	db, opts := openTestDB(t, nil)
+	require.NoError(t, db.Put([]byte("legacy"), []byte("val")))
+	require.NoError(t, db.Close())
+
+	errInvalidKey := errors.New("key must start with user/")
+	opts.KeyValidator = func(key []byte) error {
+		if !bytes.HasPrefix(key, []byte("user/")) {
+			return errInvalidKey
+		}
+		return nil
+	}
+	// Existing keys are not validated on replay
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	v, err := db.Get([]byte("legacy"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("val"), v)
+
+	require.NoError(t, db.Put([]byte("user/1"), []byte("val")))
+	require.Equal(t, errInvalidKey, db.Put([]byte("group/1"), []byte("val")))
+	require.Equal(t, ErrEmptyKey, db.Put(nil, []byte("val")))
+	_, err = db.Get([]byte("group/1"))
+	require.Equal(t, ErrKeyNotFound, err)
+
+	require.Equal(t, errInvalidKey, db.Delete([]byte("legacy")))
+	require.NoError(t, db.Delete([]byte("user/1")))
+
+	done := make(chan error, 1)
+	db.PutAsync([]byte("group/2"), []byte("val"), func(err error) { done <- err })
+	require.Equal(t, errInvalidKey, <-done)
+}
+
+func TestDB_LockWaitObserver(t *testing.T) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	waits := make(map[LockOp][]time.Duration)
+	opts := getTestOptions(dir)
+	opts.LockWaitObserver = func(op LockOp, wait time.Duration) {
+		waits[op] = append(waits[op], wait)
+	}
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Put([]byte("key"), []byte("val")))
+	_, err = db.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Len(t, waits[LockOpPut], 1)
+	require.Len(t, waits[LockOpGet], 1)
+
+	// A Delete waiting behind a held lock reports the wait, timed by a clock which
+	// only moves on once the Delete has started waiting
+	var clock atomic.Int64
+	started := make(chan struct{})
+	var once sync.Once
+	nowFunc = func() time.Time {
+		once.Do(func() { close(started) })
+		return time.Unix(0, clock.Load())
+	}
+	defer func() { nowFunc = time.Now }()
+	db.mu.Lock()
+	done := make(chan error)
+	go func() { done <- db.Delete([]byte("key")) }()
+	<-started
+	clock.Add(int64(20 * time.Millisecond))
+	db.mu.Unlock()
+	require.NoError(t, <-done)
+	require.Equal(t, []time.Duration{20 * time.Millisecond}, waits[LockOpDelete])
+	nowFunc = time.Now
+
+	// Every operation locking the database reports its waits
+	_, _, err = db.GetWithMeta([]byte("key"))
+	require.Equal(t, ErrKeyNotFound, err)
+	require.Len(t, waits[LockOpGet], 2)
+	// Queued writes lock before and after writing
+	require.NoError(t, db.PutSequenced([]byte("key"), []byte("val")))
+	require.Len(t, waits[LockOpPutAsync], 2)
+	require.NoError(t, db.ReplacePrefix([]byte("k"), nil))
+	require.Len(t, waits[LockOpReplacePrefix], 1)
+	raw, _, err := db.ReadRaw(db.dbFile.activeLogFile().fid, 0)
+	require.NoError(t, err)
+	_, _, err = db.AppendRaw(raw)
+	require.NoError(t, err)
+	require.Len(t, waits[LockOpRaw], 2)
+}
+
+// captureLogger records the messages logged through it.
+type captureLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *captureLogger) logf(level, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *captureLogger) Infof(format string, args ...interface{}) { l.logf("INFO", format, args...) }
+
+func (l *captureLogger) Warnf(format string, args ...interface{}) { l.logf("WARN", format, args...) }
+
+func (l *captureLogger) Errorf(format string, args ...interface{}) { l.logf("ERROR", format, args...) }
+
+func TestDB_Logger(t *testing.T) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	logger := &captureLogger{}
+	opts := getTestOptions(dir)
+	opts.Logger = logger
+	db, err := Open(opts)
+	require.NoError(t, err)
+	require.Equal(t, []string{"INFO Database opening", "INFO Database opened"}, logger.msgs)
+
+	logger.msgs = nil
+	require.NoError(t, db.Close())
+	require.Equal(t, []string{"INFO Database closing", "INFO Database closed"}, logger.msgs)
+	logger.msgs = nil
+	require.NoError(t, db.Close())
+	require.Equal(t, []string{"WARN Database has already closed"}, logger.msgs)
+}
+
+func TestDB_Scrub(t *testing.T) {
 	dir, err := os.MkdirTemp("", "minidb")
 	require.NoError(t, err)
 	defer os.RemoveAll(dir)
 
+	found := make(chan string, 100)
 	opts := getTestOptions(dir)
+	opts.ScrubInterval = 5 * time.Millisecond
+	opts.OnScrubError = func(key []byte, err error) {
+		select {
+		case found <- string(key):
+		default:
+		}
+	}
 	db, err := Open(opts)
 	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Put([]byte("a"), []byte("val")))
+	require.NoError(t, db.Put([]byte("b"), []byte("val")))
+	// Nothing is reported while keyDir is sane
+	time.Sleep(20 * time.Millisecond)
+	require.Empty(t, found)
+
+	// Point a at the entry of b
+	db.mu.Lock()
+	lo, _ := db.keyDir.get([]byte("b"))
+	db.keyDir.set([]byte("a"), lo)
+	db.mu.Unlock()
+	select {
+	case key := <-found:
+		require.Equal(t, "a", key)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "divergence not detected")
+	}
+
+	// The scrubber stops on Close
+	require.NoError(t, db.Close())
+	select {
+	case <-db.scrub.done:
+	default:
+		require.Fail(t, "scrubber still running")
+	}
+}
+
+func TestDB_ScrubRepair(t *testing.T) {
+	db, _ := openTestDB(t, func(opts *Options) {
+		opts.ScrubRepair = true
+	})
+
+	require.NoError(t, db.Put([]byte("a"), []byte("a1")))
+	require.NoError(t, db.Put([]byte("a"), []byte("a2")))
+	require.NoError(t, db.Put([]byte("b"), []byte("val")))
+	require.NoError(t, db.Put([]byte("c"), []byte("val")))
+	require.NoError(t, db.Delete([]byte("c")))
+	valueBytes := db.valueBytes
+
+	// Point a and the deleted c at the entry of b
+	db.mu.Lock()
+	lo, _ := db.keyDir.get([]byte("b"))
+	old, _ := db.keyDir.get([]byte("a"))
+	db.keyDir.set([]byte("a"), lo)
+	db.keyDir.set([]byte("c"), lo)
+	db.valueBytes += 2*int64(lo.vLen) - int64(old.vLen)
+	db.mu.Unlock()
+	db.scrubSample(db.keyDir.len())
+
+	v, err := db.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("a2"), v)
+	_, err = db.Get([]byte("c"))
+	require.Equal(t, ErrKeyNotFound, err)
+	require.Equal(t, valueBytes, db.valueBytes)
+}
+
+func TestDB_Get(t *testing.T) {
+	db, opts := openTestDB(t, nil)
 	defer func(db *DB) {
 		if db.isClosed() {
 			return
@@ -116,14 +377,9 @@ func TestDB_Get(t *testing.T) {
 }
 
 func TestDB_Merge(t *testing.T) {
-	dir, err := os.MkdirTemp("", "minidb")
-	require.NoError(t, err)
-	defer os.RemoveAll(dir)
-
-	opts := getTestOptions(dir)
-	opts.LogFileSize = 1 << 20
-	db, err := Open(opts)
-	require.NoError(t, err)
+	db, opts := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+	})
 	defer func(db *DB) {
 		if db.isClosed() {
 			return
@@ -134,8 +390,9 @@ func TestDB_Merge(t *testing.T) {
 	var (
 		keySize            = 16 * 1024
 		valSize            = 32 * 1024
-		normalEntrySize    = entryHeaderSize + keySize + valSize
-		tombstoneEntrySize = entryHeaderSize + keySize
+		headerSize         = int(NewEntry(nil, nil, Normal).Size())
+		normalEntrySize    = headerSize + keySize + valSize
+		tombstoneEntrySize = headerSize + keySize
 		numPut             = 100
 		numDel             = 60
 		numTotalFiles      = int(math.Ceil(float64(numPut*normalEntrySize+numDel*tombstoneEntrySize) / float64(opts.LogFileSize)))
@@ -156,7 +413,7 @@ func TestDB_Merge(t *testing.T) {
 		numLogFiles  int
 		numHintFiles int
 	)
-	entries, err := os.ReadDir(dir)
+	entries, err := os.ReadDir(opts.Dir)
 	require.NoError(t, err)
 	for _, entry := range entries {
 		if entry.IsDir() {
@@ -183,7 +440,7 @@ func TestDB_Merge(t *testing.T) {
 	defer db.Close()
 
 	numLogFiles, numHintFiles = 0, 0
-	entries, err = os.ReadDir(dir)
+	entries, err = os.ReadDir(opts.Dir)
 	require.NoError(t, err)
 	for _, entry := range entries {
 		if entry.IsDir() {
@@ -213,3 +470,5476 @@ func TestDB_Merge(t *testing.T) {
 		}
 	}
 }
+
+func TestDB_MergePolicy(t *testing.T) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var stats []FileStat
+	opts := getTestOptions(dir)
+	opts.LogFileSize = 1 << 20
+	opts.MergePolicy = func(files []FileStat) []uint32 {
+		stats = files
+		return []uint32{1}
+	}
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Every sealed file holds one dead and one live value
+	val := make([]byte, 600<<10)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, db.Put([]byte("dead"), val))
+		require.NoError(t, db.Put([]byte(strconv.Itoa(i)), val))
+	}
+	require.NoError(t, db.Put([]byte("dead"), val))
+	require.Equal(t, 4, len(db.dbFile.files))
+	sizes := make([]uint64, 3)
+	for i := range sizes {
+		sizes[i] = db.dbFile.files[i].size
+	}
+
+	require.NoError(t, db.Merge())
+	require.Equal(t, 3, len(stats))
+	for i, stat := range stats {
+		require.EqualValues(t, i, stat.Fid)
+		require.EqualValues(t, sizes[i], stat.Size)
+		require.Equal(t, 1, stat.LiveKeys)
+		require.EqualValues(t, 1+len(val), stat.LiveBytes)
+	}
+
+	// Only file 1 is compacted
+	for i, lf := range db.dbFile.files[:3] {
+		_, err = os.Stat(indexFilePath(dir, lf.fid))
+		if i == 1 {
+			require.NoError(t, err)
+			require.Less(t, lf.size, sizes[i])
+		} else {
+			require.True(t, os.IsNotExist(err))
+			require.Equal(t, sizes[i], lf.size)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		v, err := db.Get([]byte(strconv.Itoa(i)))
+		require.NoError(t, err)
+		require.Equal(t, val, v)
+	}
+}
+
+func TestDB_AutoMerge(t *testing.T) {
+	interval := autoMergeInterval
+	autoMergeInterval = 10 * time.Millisecond
+	defer func() { autoMergeInterval = interval }()
+
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := getTestOptions(dir)
+	opts.LogFileSize = 1 << 20
+	opts.AutoMerge = true
+	_, err = Open(opts)
+	require.Equal(t, ErrMergeRatio, err)
+	opts.MergeRatio = 0.5
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Every key is overwritten many times, which leaves the sealed files mostly dead
+	val := make([]byte, 64<<10)
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 10; i++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), val))
+		}
+	}
+	require.Eventually(t, func() bool {
+		stats := db.stats(true)
+		return stats.ReclaimableBytes <= stats.TotalBytes/2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Greater(t, db.Counters().Merges, uint64(0))
+	require.Less(t, db.Stats().TotalBytes, int64(100*len(val)))
+	for i := 0; i < 10; i++ {
+		v, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, val, v)
+	}
+}
+
+func TestDB_PauseMerge(t *testing.T) {
+	interval := autoMergeInterval
+	autoMergeInterval = 10 * time.Millisecond
+	defer func() { autoMergeInterval = interval }()
+
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := getTestOptions(dir)
+	opts.LogFileSize = 1 << 20
+	opts.AutoMerge = true
+	opts.MergeRatio = 0.5
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	db.PauseMerge()
+	val := make([]byte, 64<<10)
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 10; i++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), val))
+		}
+	}
+	// The auto merger checks many times without merging while paused
+	time.Sleep(20 * autoMergeInterval)
+	require.Equal(t, uint64(0), db.Counters().Merges)
+	stats := db.stats(true)
+	require.Greater(t, stats.ReclaimableBytes, stats.TotalBytes/2)
+
+	// Manual merges are not paused
+	require.NoError(t, db.Merge())
+	require.Equal(t, uint64(1), db.Counters().Merges)
+
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 10; i++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), val))
+		}
+	}
+	time.Sleep(20 * autoMergeInterval)
+	require.Equal(t, uint64(1), db.Counters().Merges)
+
+	db.ResumeMerge()
+	require.Eventually(t, func() bool {
+		return db.Counters().Merges > 1
+	}, 5*time.Second, 10*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		v, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, val, v)
+	}
+}
+
+func TestDB_MergeFailureCleanup(t *testing.T) {
+	db, opts := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+	})
+
+	val := make([]byte, 64<<10)
+	for i := 0; i < 40; i++ {
+		require.NoError(t, db.Put([]byte(strconv.Itoa(i%10)), val))
+	}
+	require.Greater(t, len(db.dbFile.files), 1)
+
+	// Fail the merge once the temp log file is written
+	errSync := errors.New("sync failed")
+	syncFileOrig := syncFile
+	syncFile = func(fd *os.File, mode SyncMode) error {
+		if strings.HasSuffix(fd.Name(), logFileNameSuffix+tempFileNameSuffix) {
+			return errSync
+		}
+		return syncFileOrig(fd, mode)
+	}
+	defer func() { syncFile = syncFileOrig }()
+	require.Equal(t, errSync, errors.Cause(db.Merge()))
+
+	// Neither temp file is left behind to fail the next merge
+	tmps, err := filepath.Glob(filepath.Join(opts.Dir, "*"+tempFileNameSuffix))
+	require.NoError(t, err)
+	require.Empty(t, tmps)
+	syncFile = syncFileOrig
+	require.NoError(t, db.Merge())
+	for i := 0; i < 10; i++ {
+		got, err := db.Get([]byte(strconv.Itoa(i)))
+		require.NoError(t, err)
+		require.Equal(t, val, got)
+	}
+}
+
+func TestDB_MergeWait(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		for i := 0; i < 100; i++ {
+			require.NoError(t, db.Put([]byte(strconv.Itoa(i%10)), []byte("val")))
+		}
+
+		// Both calls wait for the running merge, then run one after another
+		db.gcLock.Lock()
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = db.MergeWait(context.Background())
+			}(i)
+		}
+		require.Equal(t, ErrGcWorking, db.Merge())
+		db.gcLock.Unlock()
+		wg.Wait()
+		for _, err := range errs {
+			require.NoError(t, err)
+		}
+
+		// A waiting call gives up with ctx
+		db.gcLock.Lock()
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		require.Equal(t, context.DeadlineExceeded, db.MergeWait(ctx))
+		db.gcLock.Unlock()
+		// Nothing takes the lock behind the caller's back after giving up
+		require.True(t, db.gcLock.TryLock())
+		db.gcLock.Unlock()
+		require.NoError(t, db.MergeWait(context.Background()))
+		for i := 0; i < 10; i++ {
+			v, err := db.Get([]byte(strconv.Itoa(i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte("val"), v)
+		}
+
+		// A call waiting while the database is closed does not merge
+		db.gcLock.Lock()
+		errCh := make(chan error)
+		go func() {
+			errCh <- db.MergeWait(context.Background())
+		}()
+		time.Sleep(10 * time.Millisecond)
+		// Close waits for the running merge
+		closeErr := make(chan error)
+		go func() {
+			closeErr <- db.Close()
+		}()
+		require.Eventually(t, db.isClosed, 5*time.Second, time.Millisecond)
+		db.gcLock.Unlock()
+		require.Equal(t, ErrDatabaseClosed, <-errCh)
+		require.NoError(t, <-closeErr)
+	})
+}
+
+func BenchmarkDB_MergeSmallKeys(b *testing.B) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	opts := getTestOptions(dir)
+	opts.LogFileSize = 1 << 20
+	db, err := Open(opts)
+	require.NoError(b, err)
+	defer db.Close()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		// Fill a whole file with small live entries
+		for j := 0; db.dbFile.maxFid() == uint32(i); j++ {
+			require.NoError(b, db.Put([]byte(fmt.Sprintf("%d-%d", i, j)), []byte("v")))
+		}
+		b.StartTimer()
+		require.NoError(b, db.Merge())
+	}
+}
+
+func TestDB_PreserveEmptyFiles(t *testing.T) {
+	db, opts := openTestDB(t, nil)
+	require.NoError(t, db.Close())
+
+	// Simulate empty sealed log files, the first with a hint file and the second without
+	emptyLogPaths := []string{logFilePath(opts.Dir, 1), logFilePath(opts.Dir, 2)}
+	hintPath := indexFilePath(opts.Dir, 1)
+	for _, path := range emptyLogPaths {
+		require.NoError(t, os.WriteFile(path, nil, 0666))
+	}
+	require.NoError(t, os.WriteFile(hintPath, nil, 0666))
+	require.NoError(t, os.WriteFile(logFilePath(opts.Dir, 3), nil, 0666))
+
+	opts.PreserveEmptyFiles = true
+	db, err := Open(opts)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	// The empty files should be kept along with the hint file
+	for _, path := range append(emptyLogPaths, hintPath) {
+		_, err = os.Stat(path)
+		require.NoError(t, err)
+	}
+
+	opts.PreserveEmptyFiles = false
+	db, err = Open(opts)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	// The empty files should be deleted, even the one which has no hint file
+	for _, path := range append(emptyLogPaths, hintPath) {
+		_, err = os.Stat(path)
+		require.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestDB_OpenWithEmptyLogFile(t *testing.T) {
+	db, opts := openTestDB(t, nil)
+	require.NoError(t, db.Put([]byte("key"), []byte("val")))
+	require.NoError(t, db.Close())
+
+	// Simulate an empty sealed log file (no hint file) before the active one
+	require.NoError(t, os.Rename(logFilePath(opts.Dir, 0), logFilePath(opts.Dir, 1)))
+	require.NoError(t, os.WriteFile(logFilePath(opts.Dir, 0), nil, 0666))
+	_, err := os.Stat(indexFilePath(opts.Dir, 0))
+	require.True(t, os.IsNotExist(err))
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	val, err := db.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("val"), val)
+}
+
+func TestDB_ReplayTombstone(t *testing.T) {
+	db, opts := openTestDB(t, nil)
+	require.NoError(t, db.Put([]byte("key"), []byte("val")))
+	require.NoError(t, db.Put([]byte("other"), []byte("val")))
+	require.NoError(t, db.Delete([]byte("key")))
+	require.NoError(t, db.Close())
+
+	// The tombstone removes the key instead of leaving it without an offset
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	_, ok := db.keyDir.get([]byte("key"))
+	require.False(t, ok)
+	_, err = db.Get([]byte("key"))
+	require.Equal(t, ErrKeyNotFound, err)
+	v, err := db.Get([]byte("other"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("val"), v)
+}
+
+func TestDB_ReplayTombstoneWithHint(t *testing.T) {
+	db, opts := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+	})
+	defer func(db *DB) {
+		if db.isClosed() {
+			return
+		}
+		require.NoError(t, db.Close())
+	}(db)
+
+	val := make([]byte, opts.LogFileSize)
+	// The key lives in file 0, its tombstone in file 1
+	require.NoError(t, db.Put([]byte("key"), val))
+	require.NoError(t, db.Delete([]byte("key")))
+	require.NoError(t, db.Put([]byte("filler"), val))
+	require.Equal(t, 3, len(db.dbFile.files))
+
+	// Compact file 1 only, so its hint file has to carry the tombstone
+	require.NoError(t, db.dbFile.files[1].runGc(true, nil))
+	_, err := os.Stat(indexFilePath(opts.Dir, 1))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	_, err = db.Get([]byte("key"))
+	require.Equal(t, ErrKeyNotFound, err)
+	got, err := db.Get([]byte("filler"))
+	require.NoError(t, err)
+	require.Equal(t, val, got)
+
+	// A full merge drops both the key and its tombstone
+	require.NoError(t, db.Merge())
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Get([]byte("key"))
+	require.Equal(t, ErrKeyNotFound, err)
+	got, err = db.Get([]byte("filler"))
+	require.NoError(t, err)
+	require.Equal(t, val, got)
+}
+
+func TestDB_FileOf(t *testing.T) {
+	db, _ := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+	})
+
+	require.NoError(t, db.Put([]byte("a"), make([]byte, 1<<20)))
+	require.NoError(t, db.Put([]byte("b"), []byte("val")))
+	fid, err := db.FileOf([]byte("a"))
+	require.NoError(t, err)
+	require.EqualValues(t, 0, fid)
+	fid, err = db.FileOf([]byte("b"))
+	require.NoError(t, err)
+	require.EqualValues(t, 1, fid)
+
+	_, err = db.FileOf([]byte("c"))
+	require.Equal(t, ErrKeyNotFound, err)
+	_, err = db.FileOf(nil)
+	require.Equal(t, ErrEmptyKey, err)
+}
+
+func TestDB_AverageEntrySize(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		keyAvg, valAvg, err := db.AverageEntrySize()
+		require.NoError(t, err)
+		require.Zero(t, keyAvg)
+		require.Zero(t, valAvg)
+
+		for i := 0; i < 100; i++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key%03d", i)), make([]byte, 100)))
+		}
+		// Overwritten and deleted values do not count
+		require.NoError(t, db.Put([]byte("key000"), make([]byte, 200)))
+		require.NoError(t, db.Put([]byte("deleted"), make([]byte, 1000)))
+		require.NoError(t, db.Delete([]byte("deleted")))
+		keyAvg, valAvg, err = db.AverageEntrySize()
+		require.NoError(t, err)
+		require.Equal(t, float64(6), keyAvg)
+		require.Equal(t, float64(101), valAvg)
+	})
+}
+
+func TestDB_Stats(t *testing.T) {
+	for _, codec := range []Codec{FixedCodec, VarintCodec} {
+		dir, err := os.MkdirTemp("", "minidb")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		opts := New(dir, WithLogFileSize(1<<20), WithCodec(codec))
+		opts.EntryTimestamps = true
+		db, err := Open(opts)
+		require.NoError(t, err)
+		defer db.Close()
+
+		for i := 0; i < 100; i++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key%03d", i)), make([]byte, 100+i)))
+		}
+		stats := db.Stats()
+		require.Equal(t, 1, stats.LogFiles)
+		require.Equal(t, 100, stats.LiveKeys)
+		require.Equal(t, int64(db.dbFile.writableOffset()), stats.TotalBytes)
+		require.Zero(t, stats.ReclaimableBytes)
+
+		// Overwritten and deleted entries are dead, along with the tombstones
+		for i := 0; i < 50; i++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key%03d", i)), make([]byte, 10)))
+		}
+		for i := 50; i < 60; i++ {
+			require.NoError(t, db.Delete([]byte(fmt.Sprintf("key%03d", i))))
+		}
+		require.NoError(t, db.Put([]byte("filler"), make([]byte, opts.LogFileSize)))
+		stats = db.Stats()
+		require.Equal(t, 2, stats.LogFiles)
+		require.Equal(t, 91, stats.LiveKeys)
+		require.Greater(t, stats.ReclaimableBytes, int64(50*100))
+
+		require.NoError(t, db.Merge())
+		stats = db.Stats()
+		require.Equal(t, 91, stats.LiveKeys)
+		require.Zero(t, stats.ReclaimableBytes)
+		require.NoError(t, db.Close())
+		require.Equal(t, Stats{}, db.Stats())
+	}
+}
+
+func TestDB_StatsTTL(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = time.Now }()
+
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.LogFileSize = 1 << 20
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer func() { db.Close() }()
+
+	// 10 keys without TTL, 20 expiring in a minute and 30 in an hour
+	for i := 0; i < 60; i++ {
+		key := []byte(fmt.Sprintf("key%02d", i))
+		switch {
+		case i < 10:
+			require.NoError(t, db.Put(key, []byte("v")))
+		case i < 30:
+			require.NoError(t, db.PutWithTTL(key, []byte("v"), time.Minute))
+		default:
+			require.NoError(t, db.PutWithTTL(key, []byte("v"), time.Hour))
+		}
+	}
+	requireCounts := func(live, expiredPending, liveWithTTL int) {
+		t.Helper()
+		stats := db.Stats()
+		require.Equal(t, live, stats.LiveKeys)
+		require.Equal(t, expiredPending, stats.ExpiredPending)
+		require.Equal(t, liveWithTTL, stats.LiveWithTTL)
+	}
+	requireCounts(60, 0, 50)
+
+	now = now.Add(2 * time.Minute)
+	requireCounts(60, 20, 30)
+	// Reading an expired key drops it, overwriting one without TTL makes it live
+	_, err = db.Get([]byte("key10"))
+	require.Equal(t, ErrKeyNotFound, err)
+	require.NoError(t, db.Put([]byte("key11"), []byte("v")))
+	requireCounts(59, 18, 30)
+
+	// The expiry is restored on Open, from the log file as well as from a hint file.
+	// A key dropped on read comes back expired until the next merge.
+	require.NoError(t, db.Put([]byte("filler"), make([]byte, opts.LogFileSize)))
+	require.NoError(t, db.Close())
+	db, err = Open(opts)
+	require.NoError(t, err)
+	requireCounts(61, 19, 30)
+	require.NoError(t, db.SealActive())
+	require.NoError(t, db.Merge())
+	requireCounts(42, 0, 30)
+	require.NoError(t, db.Close())
+	db, err = Open(opts)
+	require.NoError(t, err)
+	requireCounts(42, 0, 30)
+}
+
+func TestDB_ReplacePrefix(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		oldSet := map[string][]byte{"snap/a": []byte("1"), "snap/b": []byte("1"), "snap/c": []byte("1")}
+		newSet := map[string][]byte{"snap/a": []byte("22"), "snap/b": []byte("22"), "snap/d": []byte("22")}
+		require.NoError(t, db.Put([]byte("other"), []byte("333")))
+		require.NoError(t, db.ReplacePrefix([]byte("snap/"), oldSet))
+
+		// Value sizes tell the sets apart, and KeysBySize reads all keys under one lock
+		sizes := func(set map[string][]byte) map[string]uint64 {
+			m := map[string]uint64{"other": 3}
+			for key, val := range set {
+				m[key] = uint64(len(val))
+			}
+			return m
+		}
+		oldSizes, newSizes := sizes(oldSet), sizes(newSet)
+		stop := make(chan struct{})
+		var wg sync.WaitGroup
+		for r := 0; r < 4; r++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					got := make(map[string]uint64)
+					assert.NoError(t, db.KeysBySize(0, func(key []byte, size uint64) error {
+						got[string(key)] = size
+						return nil
+					}))
+					if !assert.Condition(t, func() bool {
+						return reflect.DeepEqual(got, oldSizes) || reflect.DeepEqual(got, newSizes)
+					}, "partial replacement: %v", got) {
+						return
+					}
+				}
+			}()
+		}
+		for i := 0; i < 100; i++ {
+			set := newSet
+			if i%2 == 0 {
+				set = oldSet
+			}
+			require.NoError(t, db.ReplacePrefix([]byte("snap/"), set))
+		}
+		close(stop)
+		wg.Wait()
+
+		_, err := db.Get([]byte("snap/c"))
+		require.Equal(t, ErrKeyNotFound, err)
+		v, err := db.Get([]byte("snap/d"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("22"), v)
+
+		require.Error(t, db.ReplacePrefix([]byte("snap/"), map[string][]byte{"other": nil}))
+	})
+}
+
+func TestDB_GetOldest(t *testing.T) {
+	db, _ := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+	})
+
+	key := []byte("key")
+	padding := make([]byte, 1<<20)
+	put := func(val string) {
+		require.NoError(t, db.Put(key, []byte(val)))
+		// Push the next version into another file
+		require.NoError(t, db.Put([]byte("padding"), padding))
+	}
+	put("v1")
+	require.NoError(t, db.Delete(key))
+	put("v2")
+	put("v3")
+	put("v4")
+	require.Greater(t, len(db.dbFile.files), 3)
+
+	v, err := db.GetOldest(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v2"), v)
+	v, err = db.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v4"), v)
+
+	// Merge drops the overwritten versions
+	require.NoError(t, db.Merge())
+	v, err = db.GetOldest(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v4"), v)
+
+	require.NoError(t, db.Delete(key))
+	_, err = db.GetOldest(key)
+	require.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_CompactTombstones(t *testing.T) {
+	diskUsage := func(compact bool) int64 {
+		dir, err := os.MkdirTemp("", "minidb")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		opts := getTestOptions(dir)
+		opts.LogFileSize = 1 << 20
+		opts.CompactTombstones = compact
+		db, err := Open(opts)
+		require.NoError(t, err)
+
+		key := func(i int) []byte {
+			return []byte(fmt.Sprintf("%01024d", i))
+		}
+		check := func(db *DB) {
+			for i := 0; i < 2000; i++ {
+				_, err := db.Get(key(i))
+				if i%2 == 0 {
+					require.Equal(t, ErrKeyNotFound, err)
+				} else {
+					require.NoError(t, err)
+				}
+			}
+		}
+		for i := 0; i < 2000; i++ {
+			require.NoError(t, db.Put(key(i), []byte("val")))
+		}
+		written := func() int64 {
+			n := int64(db.dbFile.writableOffset())
+			for _, lf := range db.dbFile.files[:len(db.dbFile.files)-1] {
+				n += int64(lf.size)
+			}
+			return n
+		}
+		before := written()
+		for i := 0; i < 2000; i += 2 {
+			require.NoError(t, db.Delete(key(i)))
+		}
+		usage := written() - before
+		require.NoError(t, db.Close())
+
+		// Tombstones are resolved when replaying log files
+		db, err = Open(opts)
+		require.NoError(t, err)
+		check(db)
+
+		// Merge drops tombstones and their referenced entries together
+		require.NoError(t, db.Merge())
+		require.NoError(t, db.Close())
+		db, err = Open(opts)
+		require.NoError(t, err)
+		defer db.Close()
+		check(db)
+		return usage
+	}
+	full, compact := diskUsage(false), diskUsage(true)
+	require.Less(t, compact*10, full)
+}
+
+func TestDB_ResolveRef(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Put([]byte("key"), []byte("val")))
+		lo, ok := db.keyDir.get([]byte("key"))
+		require.True(t, ok)
+		tomb := newRefTombstone([]byte("key"), lo)
+		tomb.seq = db.dbFile.seq + 1
+		require.Equal(t, []byte("key"), db.dbFile.resolveRef(tomb))
+
+		// A newer entry of the key at the position is not the deleted one
+		tomb.seq = db.dbFile.seq
+		require.Nil(t, db.dbFile.resolveRef(tomb))
+
+		// Nor is another key, or a position inside an entry
+		tomb.seq = db.dbFile.seq + 1
+		tomb.keyHash = hashKey([]byte("other"))
+		require.Nil(t, db.dbFile.resolveRef(tomb))
+		tomb.keyHash = hashKey([]byte("key"))
+		tomb.refOffset++
+		require.Nil(t, db.dbFile.resolveRef(tomb))
+	})
+}
+
+func TestDB_ActiveCheckpoint(t *testing.T) {
+	db, opts := openTestDB(t, func(opts *Options) {
+		opts.ActiveCheckpointBytes = 4 << 10
+	})
+	for i := 0; i < 5000; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("val")))
+	}
+	require.NoError(t, db.Delete([]byte("key0")))
+	for i := 5000; i < 5010; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("val")))
+	}
+	// Crash without appending the last indexes
+	for _, lf := range db.dbFile.files {
+		require.NoError(t, lf.fd.Close())
+	}
+	require.NoError(t, db.dbFile.ckpt.fd.Close())
+	require.NoError(t, db.dirLockGuard.release())
+	ckptPath := checkpointFilePath(opts.Dir, 0)
+	fi, err := os.Stat(ckptPath)
+	require.NoError(t, err)
+
+	check := func() {
+		db, err := Open(opts)
+		require.NoError(t, err)
+		defer db.Close()
+		require.Equal(t, 5009, db.keyDir.len())
+		_, err = db.Get([]byte("key0"))
+		require.Equal(t, ErrKeyNotFound, err)
+		for i := 1; i < 5010; i++ {
+			v, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte("val"), v)
+		}
+	}
+	check()
+
+	// Only the entries after the checkpoint are read from the log file
+	lf := &logFile{fid: 0, path: logFilePath(opts.Dir, 0), db: &DB{opt: opts}}
+	require.NoError(t, lf.open(os.O_RDONLY, 0))
+	df := &dbFile{dirPath: opts.Dir, opt: opts}
+	var n int
+	offset, err := df.replayCheckpoint(lf, func([]byte, *logOffset, uint64) error {
+		n++
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, lf.fd.Close())
+	require.Greater(t, n, 4000)
+	require.Greater(t, offset, uint64(0))
+
+	// A checkpoint cut short still covers the indexes before the cut
+	require.NoError(t, os.Truncate(ckptPath, fi.Size()-3))
+	check()
+
+	// A checkpoint not matching the log file is ignored
+	hf := &hintFile{path: ckptPath}
+	require.NoError(t, os.Remove(ckptPath))
+	require.NoError(t, hf.openWriteOnly())
+	require.NoError(t, hf.write(&Index{mark: Normal, offset: 1 << 20, kLen: 3, key: []byte("bad")}))
+	require.NoError(t, hf.close(hf.size, SyncFull))
+	check()
+}
+
+func BenchmarkDB_ReplayActiveCheckpoint(b *testing.B) {
+	for _, ckptBytes := range []uint32{0, 64 << 10} {
+		b.Run(fmt.Sprintf("checkpoint=%d", ckptBytes), func(b *testing.B) {
+			dir, err := os.MkdirTemp("", "minidb")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+
+			opts := getTestOptions(dir)
+			opts.LogFileSize = 256 << 20
+			opts.ActiveCheckpointBytes = ckptBytes
+			db, err := Open(opts)
+			require.NoError(b, err)
+			val := make([]byte, 1024)
+			for i := 0; i < 100000; i++ {
+				require.NoError(b, db.Put([]byte(strconv.Itoa(i)), val))
+			}
+			require.NoError(b, db.Close())
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				db, err = Open(opts)
+				require.NoError(b, err)
+				require.NoError(b, db.Close())
+			}
+		})
+	}
+}
+
+func TestDB_ReplayTruncatedHint(t *testing.T) {
+	db, opts := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+	})
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("val")))
+	}
+	require.NoError(t, db.Put([]byte("filler"), make([]byte, opts.LogFileSize)))
+	require.NoError(t, db.Merge())
+	require.NoError(t, db.Close())
+
+	fi, err := os.Stat(indexFilePath(opts.Dir, 0))
+	require.NoError(t, err)
+	// Cut the last index in the middle of its key, then in the middle of its header
+	for _, cut := range []int64{1, 38} {
+		require.NoError(t, os.Truncate(indexFilePath(opts.Dir, 0), fi.Size()-cut))
+
+		db, err = Open(opts)
+		require.NoError(t, err)
+		require.Equal(t, 101, db.keyDir.len())
+		for i := 0; i < 100; i++ {
+			v, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte("val"), v)
+		}
+		require.NoError(t, db.Close())
+	}
+}
+
+func TestDB_KeysBySize(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		for i := 0; i < 100; i++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), make([]byte, i)))
+		}
+
+		sizes := make(map[string]uint64)
+		err := db.KeysBySize(89, func(key []byte, size uint64) error {
+			sizes[string(key)] = size
+			return nil
+		})
+		require.NoError(t, err)
+		require.Equal(t, 10, len(sizes))
+		for i := 90; i < 100; i++ {
+			require.EqualValues(t, i, sizes[fmt.Sprintf("key%d", i)])
+		}
+	})
+}
+
+func TestDB_GetDuringMerge(t *testing.T) {
+	db, _ := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+	})
+
+	const n = 200
+	val := make([]byte, 16*1024)
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), val))
+	}
+	// Overwrite half of the keys to leave dead entries behind
+	for i := 0; i < n; i += 2 {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), val))
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				for i := 0; i < n; i++ {
+					got, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+					if !assert.NoError(t, err) {
+						return
+					}
+					assert.Equal(t, len(val), len(got))
+				}
+			}
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		require.NoError(t, db.Merge())
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestDB_VarintCodec(t *testing.T) {
+	db, opts := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+		opts.Codec = VarintCodec
+	})
+
+	const n = 50000
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("val%d", i))))
+	}
+	for i := 0; i < n; i += 2 {
+		require.NoError(t, db.Delete([]byte(fmt.Sprintf("key%d", i))))
+	}
+	require.Greater(t, len(db.dbFile.files), 1)
+	require.NoError(t, db.Merge())
+	require.NoError(t, db.Close())
+
+	// The codec recorded in manifest takes precedence over options
+	opts.Codec = FixedCodec
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, VarintCodec, db.opt.Codec)
+
+	for i := 0; i < n; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+		if i%2 == 0 {
+			require.Equal(t, ErrKeyNotFound, err)
+		} else {
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprintf("val%d", i)), val)
+		}
+	}
+}
+
+func TestDB_WideValueLength(t *testing.T) {
+	// A FixedCodec header takes an 8 bytes value length for a value of 4GB or more
+	vLen := uint64(math.MaxUint32) + 1
+	header := []byte{byte(Normal | markWideValue)}
+	header = binary.BigEndian.AppendUint32(header, 3)
+	header = binary.BigEndian.AppendUint64(header, vLen)
+	var e Entry
+	require.NoError(t, decodeHeader(header, FixedCodec, &e))
+	require.Equal(t, Normal, e.mark)
+	require.EqualValues(t, 3, e.kLen)
+	require.Equal(t, vLen, e.vLen)
+	require.EqualValues(t, wideEntryHeaderSize, e.hLen)
+	require.Equal(t, e.hLen, headerSize(FixedCodec, 0, 3, vLen))
+	require.Equal(t, errShortEntry, decodeHeader(header[:entryHeaderSize], FixedCodec, &e))
+
+	// Smaller values keep the 4 bytes value length
+	small := NewEntry([]byte("key"), []byte("val"), Normal)
+	buf, err := encodeEntry(small, FixedCodec)
+	require.NoError(t, err)
+	require.Zero(t, EntryMark(buf[0])&markWideValue)
+	require.Equal(t, small.hLen, headerSize(FixedCodec, small.flags, 3, 3))
+
+	header = binary.AppendUvarint([]byte{byte(Normal)}, 3)
+	header = binary.AppendUvarint(header, vLen)
+	require.NoError(t, decodeHeader(header, VarintCodec, &e))
+	require.Equal(t, vLen, e.vLen)
+	require.Equal(t, e.hLen, headerSize(VarintCodec, 0, 3, vLen))
+
+	// No entry larger than maxEntrySize is written, so the length is corrupt
+	header = binary.AppendUvarint([]byte{byte(Normal)}, 3)
+	header = binary.AppendUvarint(header, maxEntrySize)
+	require.Error(t, decodeHeader(header, VarintCodec, &e))
+
+	// Offsets and value sizes of indexes take 8 bytes
+	idx := &Index{
+		entryExt: entryExt{flags: flagValueSize, valueSize: vLen},
+		mark:     Normal,
+		fid:      1,
+		offset:   1<<33 + 5,
+		kLen:     3,
+		key:      []byte("key"),
+	}
+	buf, err = encodeIndex(idx)
+	require.NoError(t, err)
+	got, err := decodeIndex(buf)
+	require.NoError(t, err)
+	require.True(t, got.extended())
+	require.NoError(t, decodeIndexExt(got, buf[indexHeaderSize:]))
+	require.Equal(t, idx.fid, got.fid)
+	require.Equal(t, idx.offset, got.offset)
+	require.Equal(t, idx.kLen, got.kLen)
+	require.Equal(t, vLen, got.valueSize)
+}
+
+func TestDB_OpenInvalidOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		setOpts func(opts *Options)
+		err     error
+	}{
+		{"MergeRatio", func(opts *Options) { opts.AutoMerge = true; opts.MergeRatio = 1 }, ErrMergeRatio},
+		{"LogFileSizeTooSmall", func(opts *Options) { opts.LogFileSize = 1 << 10 }, ErrLogFileSize},
+		{"LogFileSizeTooLarge", func(opts *Options) { opts.LogFileSize = maxLogFileSize + 1 }, ErrLogFileSize},
+		{"Codec", func(opts *Options) { opts.Codec = Codec(42) }, ErrInvalidCodec},
+		{"Compression", func(opts *Options) { opts.Compression = maxCompression + 1 }, ErrInvalidCompression},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "minidb")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			opts := getTestOptions(dir)
+			tt.setOpts(&opts)
+			_, err = Open(opts)
+			require.Equal(t, tt.err, err)
+
+			// The failed Open does not keep the directory locked
+			db, err := Open(getTestOptions(dir))
+			require.NoError(t, err)
+			require.NoError(t, db.Close())
+		})
+	}
+}
+
+func TestDB_OpenFailureReleasesLock(t *testing.T) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := getTestOptions(dir)
+	opts.Codec = Codec(42)
+	_, err = Open(opts)
+	require.Equal(t, ErrInvalidCodec, err)
+
+	opts.Codec = FixedCodec
+	db, err := Open(opts)
+	require.NoError(t, err)
+	require.NoError(t, db.Put([]byte("key"), []byte("val")))
+	require.NoError(t, db.Close())
+
+	// An unreadable manifest fails Open, but leaves the directory to the next one
+	manifestPath := filepath.Join(dir, manifestFile)
+	manifest, err := os.ReadFile(manifestPath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(manifestPath, []byte("garbage"), 0666))
+	_, err = Open(opts)
+	require.Error(t, err)
+
+	require.NoError(t, os.WriteFile(manifestPath, manifest, 0666))
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	val, err := db.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("val"), val)
+}
+
+func BenchmarkDB_CodecDiskSize(b *testing.B) {
+	for _, codec := range []Codec{FixedCodec, VarintCodec} {
+		b.Run(fmt.Sprintf("codec=%d", codec), func(b *testing.B) {
+			dir, err := os.MkdirTemp("", "minidb")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+
+			opts := getTestOptions(dir)
+			opts.Codec = codec
+			db, err := Open(opts)
+			require.NoError(b, err)
+			defer db.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, db.Put([]byte(strconv.Itoa(i)), []byte("v")))
+			}
+			b.StopTimer()
+
+			var size uint64
+			for _, lf := range db.dbFile.files[:len(db.dbFile.files)-1] {
+				size += uint64(lf.size)
+			}
+			size += uint64(db.dbFile.writableOffset())
+			b.ReportMetric(float64(size)/float64(b.N), "disk-bytes/op")
+		})
+	}
+}
+
+func TestDB_GetWithMeta(t *testing.T) {
+	db, opts := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+	})
+	defer func(db *DB) {
+		if db.isClosed() {
+			return
+		}
+		require.NoError(t, db.Close())
+	}(db)
+
+	keyA := make([]byte, 1024)
+	keyB := []byte("b")
+	require.NoError(t, db.Put(keyA, make([]byte, opts.LogFileSize)))
+	require.NoError(t, db.Put(keyB, make([]byte, opts.LogFileSize-512)))
+	_, meta, err := db.GetWithMeta(keyB)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, meta.Seq)
+
+	// The tombstone holding the max sequence is the last entry of a sealed file
+	require.NoError(t, db.Delete(keyA))
+	require.Equal(t, 3, len(db.dbFile.files))
+	require.Zero(t, db.dbFile.writableOffset())
+
+	// Merge drops the tombstone, the sequence must survive reopen anyway
+	require.NoError(t, db.Merge())
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	_, meta, err = db.GetWithMeta(keyB)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, meta.Seq)
+
+	require.NoError(t, db.Put([]byte("c"), []byte("c")))
+	_, meta, err = db.GetWithMeta([]byte("c"))
+	require.NoError(t, err)
+	require.EqualValues(t, 4, meta.Seq)
+}
+
+func TestDB_GetFresh(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = time.Now }()
+
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.EntryTimestamps = true
+	runTest(t, &opts, func(t *testing.T, db *DB) {
+		key, val := []byte("key"), []byte("val")
+		require.NoError(t, db.Put(key, val))
+		_, meta, err := db.GetWithMeta(key)
+		require.NoError(t, err)
+		require.True(t, now.Equal(meta.Timestamp))
+
+		maxAge := time.Minute
+		now = now.Add(maxAge - time.Nanosecond)
+		v, err := db.GetFresh(key, maxAge)
+		require.NoError(t, err)
+		require.Equal(t, val, v)
+
+		// An entry exactly maxAge old is still fresh
+		now = now.Add(time.Nanosecond)
+		v, err = db.GetFresh(key, maxAge)
+		require.NoError(t, err)
+		require.Equal(t, val, v)
+
+		now = now.Add(time.Nanosecond)
+		_, err = db.GetFresh(key, maxAge)
+		require.Equal(t, ErrKeyNotFound, err)
+
+		// Stale entries are not deleted
+		v, err = db.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, val, v)
+
+		// Rewriting the key refreshes it
+		require.NoError(t, db.Put(key, val))
+		v, err = db.GetFresh(key, maxAge)
+		require.NoError(t, err)
+		require.Equal(t, val, v)
+
+		_, err = db.GetFresh([]byte("missing"), maxAge)
+		require.Equal(t, ErrKeyNotFound, err)
+	})
+
+	// Without timestamps every entry is stale
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		key := []byte("key")
+		require.NoError(t, db.Put(key, []byte("val")))
+		_, meta, err := db.GetWithMeta(key)
+		require.NoError(t, err)
+		require.True(t, meta.Timestamp.IsZero())
+		_, err = db.GetFresh(key, time.Hour)
+		require.Equal(t, ErrKeyNotFound, err)
+	})
+}
+
+func TestDB_KeyCountInManifest(t *testing.T) {
+	db, opts := openTestDB(t, nil)
+	n := 10000
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put([]byte(strconv.Itoa(i)), []byte("val")))
+	}
+	require.NoError(t, db.Delete([]byte("0")))
+	require.NoError(t, db.Close())
+
+	m, err := readManifest(opts.Dir)
+	require.NoError(t, err)
+	require.EqualValues(t, n-1, m.keyCount)
+
+	// Replay into the pre-sized keyDir
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, n-1, db.keyDir.len())
+	val, err := db.Get([]byte(strconv.Itoa(n - 1)))
+	require.NoError(t, err)
+	require.Equal(t, []byte("val"), val)
+}
+
+func BenchmarkDB_Replay(b *testing.B) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	opts := getTestOptions(dir)
+	db, err := Open(opts)
+	require.NoError(b, err)
+	for i := 0; i < 100000; i++ {
+		require.NoError(b, db.Put([]byte(strconv.Itoa(i)), []byte("val")))
+	}
+	require.NoError(b, db.Close())
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		db, err = Open(opts)
+		require.NoError(b, err)
+		require.NoError(b, db.Close())
+	}
+}
+
+func TestDB_CompactIndex(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		const n = 200000
+		for i := 0; i < n; i++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), nil))
+		}
+		// Stay above the ratio which triggers an automatic rebuild
+		for i := 0; i < n/2; i++ {
+			require.NoError(t, db.Delete([]byte(fmt.Sprintf("key%d", i))))
+		}
+		require.Equal(t, n, db.keyDirPeak)
+
+		// The index is rebuilt into new maps holding the same keys
+		old := db.keyDir
+		db.CompactIndex()
+		require.True(t, old != db.keyDir)
+		require.Equal(t, old.shards, db.keyDir.shards)
+		require.Equal(t, n/2, db.keyDirPeak)
+		require.Equal(t, n/2, db.keyDir.len())
+
+		// Heavy deletes rebuild the index automatically
+		for i := n / 2; i < n-100; i++ {
+			require.NoError(t, db.Delete([]byte(fmt.Sprintf("key%d", i))))
+		}
+		require.Less(t, db.keyDirPeak, n/2)
+		for i := n - 100; i < n; i++ {
+			_, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+			require.NoError(t, err)
+		}
+	})
+}
+
+func TestDB_MaxTotalValueBytes(t *testing.T) {
+	db, opts := openTestDB(t, func(opts *Options) {
+		opts.MaxTotalValueBytes = 100
+	})
+	defer func(db *DB) {
+		if db.isClosed() {
+			return
+		}
+		require.NoError(t, db.Close())
+	}(db)
+
+	require.NoError(t, db.Put([]byte("a"), make([]byte, 60)))
+	require.NoError(t, db.Put([]byte("b"), make([]byte, 40)))
+	require.Equal(t, ErrQuotaExceeded, db.Put([]byte("c"), make([]byte, 1)))
+
+	// Overwriting replaces the accounted size of the old value
+	require.NoError(t, db.Put([]byte("a"), make([]byte, 50)))
+	require.NoError(t, db.Put([]byte("c"), make([]byte, 10)))
+	require.Equal(t, ErrQuotaExceeded, db.Put([]byte("a"), make([]byte, 51)))
+	require.NoError(t, db.Delete([]byte("b")))
+	require.EqualValues(t, 60, db.valueBytes)
+	require.NoError(t, db.Close())
+
+	// The total is recomputed on reopen
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	require.EqualValues(t, 60, db.valueBytes)
+	require.NoError(t, db.Put([]byte("b"), make([]byte, 40)))
+	require.Equal(t, ErrQuotaExceeded, db.Put([]byte("d"), make([]byte, 1)))
+}
+
+func TestDB_MaxTotalValueBytesWithHint(t *testing.T) {
+	db, opts := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+	})
+	defer func(db *DB) {
+		if db.isClosed() {
+			return
+		}
+		require.NoError(t, db.Close())
+	}(db)
+
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i%10)), make([]byte, 32*1024)))
+	}
+	require.NoError(t, db.Merge())
+	require.EqualValues(t, 10*32*1024, db.valueBytes)
+	require.NoError(t, db.Close())
+
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	require.EqualValues(t, 10*32*1024, db.valueBytes)
+}
+
+func TestDB_PhysicalBackup(t *testing.T) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	backupDir, err := os.MkdirTemp("", "minidb-backup")
+	require.NoError(t, err)
+	defer os.RemoveAll(backupDir)
+
+	opts := getTestOptions(dir)
+	opts.LogFileSize = 1 << 20
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	val := make([]byte, 32*1024)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i%50)), val))
+	}
+	require.NoError(t, db.Merge())
+	require.NoError(t, db.Delete([]byte("key0")))
+
+	require.NoError(t, db.PhysicalBackup(backupDir))
+	require.Error(t, db.PhysicalBackup(backupDir))
+
+	// Writes after the backup are not included
+	require.NoError(t, db.Put([]byte("key1000"), val))
+
+	restored, err := Open(getTestOptions(backupDir))
+	require.NoError(t, err)
+	defer restored.Close()
+	_, err = restored.Get([]byte("key0"))
+	require.Equal(t, ErrKeyNotFound, err)
+	_, err = restored.Get([]byte("key1000"))
+	require.Equal(t, ErrKeyNotFound, err)
+	for i := 1; i < 50; i++ {
+		got, err := restored.Get([]byte(fmt.Sprintf("key%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, val, got)
+	}
+	require.NoError(t, restored.Put([]byte("key0"), val))
+}
+
+func TestDB_Backup(t *testing.T) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	restoreDir, err := os.MkdirTemp("", "minidb-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(restoreDir)
+
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	defer db.Close()
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i%500)), bytes.Repeat([]byte{byte(i)}, (1000-i)*10)))
+	}
+	require.NoError(t, db.Delete([]byte("key1")))
+	require.NoError(t, db.Put([]byte("empty"), []byte{}))
+
+	var buf bytes.Buffer
+	require.NoError(t, db.Backup(&buf))
+	require.Less(t, int64(buf.Len()), db.Stats().TotalBytes/2)
+	backup := buf.Bytes()
+
+	restored, err := Open(getTestOptions(restoreDir))
+	require.NoError(t, err)
+	defer restored.Close()
+	require.NoError(t, restored.Restore(bytes.NewReader(backup)))
+	require.Equal(t, db.Len(), restored.Len())
+	want, err := db.Digest()
+	require.NoError(t, err)
+	got, err := restored.Digest()
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	_, err = restored.Get([]byte("key1"))
+	require.Equal(t, ErrKeyNotFound, err)
+	val, err := restored.Get([]byte("key499"))
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat([]byte{999 % 256}, 10), val)
+
+	// Only a whole backup is restored into an empty database
+	require.Error(t, restored.Restore(bytes.NewReader(backup)))
+	for _, b := range [][]byte{backup[:len(backup)-1], append([]byte("MDBX"), backup[4:]...), append(backup, 0)} {
+		emptyDir, err := os.MkdirTemp("", "minidb-restore")
+		require.NoError(t, err)
+		defer os.RemoveAll(emptyDir)
+		empty, err := Open(getTestOptions(emptyDir))
+		require.NoError(t, err)
+		require.Error(t, empty.Restore(bytes.NewReader(b)))
+		require.NoError(t, empty.Close())
+	}
+}
+
+func TestDB_Defragment(t *testing.T) {
+	db, opts := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+	})
+
+	// Overwrite and delete keys so that most of the data is dead
+	val := make([]byte, 64<<10)
+	for i := 0; i < 200; i++ {
+		require.NoError(t, db.Put([]byte(strconv.Itoa(i%40)), val))
+	}
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Delete([]byte(strconv.Itoa(i))))
+	}
+	require.Greater(t, len(db.dbFile.files), 10)
+	_, meta, err := db.GetWithMeta([]byte("39"))
+	require.NoError(t, err)
+
+	require.NoError(t, db.Defragment())
+
+	// 30 live values fit in two sealed files, followed by an empty active file
+	require.Equal(t, 3, len(db.dbFile.files))
+	require.Zero(t, db.dbFile.writableOffset())
+	entries, err := os.ReadDir(opts.Dir)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	require.ElementsMatch(t, []string{lockFile, manifestFile,
+		filepath.Base(logFilePath(opts.Dir, db.dbFile.files[0].fid)),
+		filepath.Base(indexFilePath(opts.Dir, db.dbFile.files[0].fid)),
+		filepath.Base(logFilePath(opts.Dir, db.dbFile.files[1].fid)),
+		filepath.Base(indexFilePath(opts.Dir, db.dbFile.files[1].fid)),
+		filepath.Base(logFilePath(opts.Dir, db.dbFile.files[2].fid)),
+	}, names)
+
+	check := func(db *DB) {
+		require.Equal(t, 30, db.keyDir.len())
+		for i := 0; i < 40; i++ {
+			v, err := db.Get([]byte(strconv.Itoa(i)))
+			if i < 10 {
+				require.Equal(t, ErrKeyNotFound, err)
+				continue
+			}
+			require.NoError(t, err)
+			require.Equal(t, val, v)
+		}
+		_, m, err := db.GetWithMeta([]byte("39"))
+		require.NoError(t, err)
+		require.Equal(t, meta, m)
+	}
+	check(db)
+	require.NoError(t, db.Put([]byte("new"), []byte("val")))
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Delete([]byte("new")))
+	check(db)
+}
+
+func TestDB_RawIterateReverse(t *testing.T) {
+	db, _ := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+	})
+
+	// Spread the history over several files
+	val := make([]byte, 300<<10)
+	var want []string
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i%3)
+		require.NoError(t, db.Put([]byte(key), val))
+		want = append(want, key)
+	}
+	require.NoError(t, db.Delete([]byte("key0")))
+	want = append(want, "key0")
+	require.Greater(t, len(db.dbFile.files), 2)
+
+	var got []string
+	var marks []EntryMark
+	lastFid, lastOffset := uint32(math.MaxUint32), uint64(0)
+	err := db.RawIterateReverse(func(fid uint32, offset uint64, e *Entry) error {
+		if fid == lastFid {
+			require.Less(t, offset, lastOffset)
+		} else {
+			require.Less(t, fid, lastFid)
+		}
+		lastFid, lastOffset = fid, offset
+		got = append(got, string(e.Key()))
+		marks = append(marks, e.Mark())
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, len(want), len(got))
+	for i := range want {
+		require.Equal(t, want[len(want)-1-i], got[i])
+	}
+	require.Equal(t, Tombstone, marks[0])
+	require.Equal(t, Normal, marks[1])
+}
+
+func TestDB_ReadRawAppendRaw(t *testing.T) {
+	newDB := func(opts *Options) *DB {
+		dir, err := os.MkdirTemp("", "minidb")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		o := getTestOptions(dir)
+		if opts != nil {
+			o.CompactTombstones = opts.CompactTombstones
+			o.KeyValidator = opts.KeyValidator
+		}
+		db, err := Open(o)
+		require.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+	// ship appends the whole active log file of primary to replica entry by entry
+	ship := func(primary, replica *DB, check func(offset uint64, fid uint32, off uint64)) {
+		for offset := uint64(0); ; {
+			raw, size, err := primary.ReadRaw(0, offset)
+			if err == io.EOF {
+				return
+			}
+			require.NoError(t, err)
+			fid, off, err := replica.AppendRaw(raw)
+			require.NoError(t, err)
+			if check != nil {
+				check(offset, fid, off)
+			}
+			offset += size
+		}
+	}
+	primary, replica := newDB(nil), newDB(nil)
+
+	require.NoError(t, primary.Put([]byte("a"), []byte("a1")))
+	require.NoError(t, primary.Put([]byte("b"), []byte("b1")))
+	require.NoError(t, primary.Delete([]byte("a")))
+	require.NoError(t, primary.Put([]byte("b"), []byte("b2")))
+	require.NoError(t, primary.Put([]byte("c"), []byte("c1")))
+
+	ship(primary, replica, func(offset uint64, fid uint32, off uint64) {
+		require.EqualValues(t, 0, fid)
+		require.Equal(t, offset, off)
+	})
+	require.Equal(t, primary.dbFile.writableOffset(), replica.dbFile.writableOffset())
+
+	for _, key := range []string{"a", "b", "c"} {
+		want, wantMeta, wantErr := primary.GetWithMeta([]byte(key))
+		got, gotMeta, gotErr := replica.GetWithMeta([]byte(key))
+		require.Equal(t, wantErr, gotErr)
+		require.Equal(t, want, got)
+		require.Equal(t, wantMeta, gotMeta)
+	}
+	require.Equal(t, primary.keyDir.len(), replica.keyDir.len())
+	require.Equal(t, primary.valueBytes, replica.valueBytes)
+
+	_, _, err := replica.AppendRaw([]byte{1, 2, 3})
+	require.Error(t, err)
+
+	// Bytes past the end of the active log file, e.g. of a failed write, are not read
+	end := primary.dbFile.writableOffset()
+	raw, _, err := primary.ReadRaw(0, 0)
+	require.NoError(t, err)
+	_, err = primary.dbFile.activeLogFile().fd.WriteAt(raw, int64(end))
+	require.NoError(t, err)
+	_, _, err = primary.ReadRaw(0, end)
+	require.Equal(t, io.EOF, err)
+
+	// Tombstones referring to the deleted entry are shipped storing the key
+	primary = newDB(&Options{CompactTombstones: true})
+	replica = newDB(&Options{CompactTombstones: true})
+	require.NoError(t, primary.Put([]byte("a"), []byte("a1")))
+	require.NoError(t, primary.Delete([]byte("a")))
+	ship(primary, replica, nil)
+	_, err = replica.Get([]byte("a"))
+	require.Equal(t, ErrKeyNotFound, err)
+	require.Equal(t, 0, replica.keyDir.len())
+
+	// Appended keys are validated like written ones
+	errInvalid := errors.New("invalid key")
+	replica = newDB(&Options{KeyValidator: func(key []byte) error {
+		if string(key) == "a" {
+			return errInvalid
+		}
+		return nil
+	}})
+	raw, _, err = primary.ReadRaw(0, 0)
+	require.NoError(t, err)
+	_, _, err = replica.AppendRaw(raw)
+	require.Equal(t, errInvalid, err)
+}
+
+func TestDB_Verify(t *testing.T) {
+	db, opts := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+	})
+
+	val := make([]byte, 300<<10)
+	for i := 0; i < 12; i++ {
+		require.NoError(t, db.Put([]byte(strconv.Itoa(i)), val))
+	}
+	require.NoError(t, db.Delete([]byte("0")))
+	require.Greater(t, len(db.dbFile.files), 3)
+	for _, concurrency := range []int{0, 1, 4} {
+		require.NoError(t, db.Verify(concurrency))
+	}
+
+	// Corrupt the mark kind of the first entry in two sealed files
+	for _, fid := range []uint32{2, 1} {
+		f, err := os.OpenFile(logFilePath(opts.Dir, fid), os.O_RDWR, 0666)
+		require.NoError(t, err)
+		_, err = f.WriteAt([]byte{byte(markExtended | 0x05)}, 0)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+	for _, concurrency := range []int{1, 4} {
+		err := db.Verify(concurrency)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), logFilePath(opts.Dir, 1))
+	}
+}
+
+func BenchmarkDB_Verify(b *testing.B) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	opts := getTestOptions(dir)
+	opts.LogFileSize = 1 << 20
+	db, err := Open(opts)
+	require.NoError(b, err)
+	defer db.Close()
+	val := make([]byte, 1024)
+	for i := 0; i < 32<<10; i++ {
+		require.NoError(b, db.Put([]byte(strconv.Itoa(i)), val))
+	}
+
+	for _, concurrency := range []int{1, 4} {
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, db.Verify(concurrency))
+			}
+		})
+	}
+}
+
+func TestDB_OnReplayError(t *testing.T) {
+	db, opts := openTestDB(t, nil)
+	var offsets []uint64
+	for i := 0; i < 3; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		require.NoError(t, db.Put(key, []byte(fmt.Sprintf("val%d", i))))
+		lo, _ := db.keyDir.get(key)
+		offsets = append(offsets, lo.offset)
+	}
+	require.NoError(t, db.Close())
+
+	// Corrupt the mark kind of the second entry
+	f, err := os.OpenFile(logFilePath(opts.Dir, 0), os.O_RDWR, 0666)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{byte(markExtended | 0x05)}, int64(offsets[1]))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	tests := []struct {
+		action ReplayAction
+		found  []bool
+	}{
+		{action: SkipEntry, found: []bool{true, false, true}},
+		{action: StopFile, found: []bool{true, false, false}},
+	}
+	for _, tt := range tests {
+		opts.OnReplayError = func(fid uint32, offset uint64, err error) ReplayAction {
+			require.EqualValues(t, 0, fid)
+			require.Equal(t, offsets[1], offset)
+			return tt.action
+		}
+		db, err = Open(opts)
+		require.NoError(t, err)
+		for i, found := range tt.found {
+			_, err = db.Get([]byte(fmt.Sprintf("key%d", i)))
+			if found {
+				require.NoError(t, err)
+			} else {
+				require.Equal(t, ErrKeyNotFound, err)
+			}
+		}
+		require.NoError(t, db.Close())
+	}
+
+	// The hook is only consulted by Open, reads fail instead
+	calls := 0
+	opts.OnReplayError = func(fid uint32, offset uint64, err error) ReplayAction {
+		calls++
+		return SkipEntry
+	}
+	db, err = Open(opts)
+	require.NoError(t, err)
+	require.Equal(t, 1, calls)
+	_, err = db.GetOldest([]byte("key0"))
+	require.Error(t, err)
+	require.Equal(t, 1, calls)
+	require.NoError(t, db.Close())
+
+	opts.OnReplayError = func(fid uint32, offset uint64, err error) ReplayAction {
+		return Abort
+	}
+	_, err = Open(opts)
+	require.Error(t, err)
+}
+
+func TestDB_OnReplayErrorCorruptLength(t *testing.T) {
+	db, opts := openTestDB(t, nil)
+	require.NoError(t, db.Put([]byte("key0"), []byte("val0")))
+	require.NoError(t, db.Put([]byte("key1"), []byte("val1")))
+	lo, _ := db.keyDir.get([]byte("key1"))
+	end := db.dbFile.writableOffset()
+	require.NoError(t, db.Close())
+
+	// Corrupt the value length of the last entry, widened to 8 bytes, beyond any entry
+	// which can be written
+	f, err := os.OpenFile(logFilePath(opts.Dir, 0), os.O_RDWR, 0666)
+	require.NoError(t, err)
+	mark := make([]byte, 1)
+	_, err = f.ReadAt(mark, int64(lo.offset))
+	require.NoError(t, err)
+	mark[0] |= byte(markWideValue)
+	_, err = f.WriteAt(mark, int64(lo.offset))
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, int64(lo.offset+5))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// It is reported rather than taken for a torn write, and no buffer is allocated for
+	// it. Writing resumes right after the last readable entry.
+	var replayErrs []uint64
+	opts.OnReplayError = func(fid uint32, offset uint64, err error) ReplayAction {
+		require.Contains(t, err.Error(), "Invalid entry length")
+		replayErrs = append(replayErrs, uint64(fid), offset)
+		return SkipEntry
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	db, err = Open(opts)
+	runtime.ReadMemStats(&after)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, lo.offset}, replayErrs)
+	require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(64<<20))
+	require.Equal(t, lo.offset, db.dbFile.writableOffset())
+	require.Less(t, db.dbFile.writableOffset(), end)
+	require.NoError(t, db.Put([]byte("key2"), []byte("val2")))
+	require.NoError(t, db.Close())
+
+	opts.OnReplayError = nil
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	for _, key := range []string{"key0", "key2"} {
+		_, err = db.Get([]byte(key))
+		require.NoError(t, err)
+	}
+	_, err = db.Get([]byte("key1"))
+	require.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_ActiveFileUsage(t *testing.T) {
+	db, opts := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+	})
+
+	offset, capacity := db.ActiveFileUsage()
+	require.Zero(t, offset)
+	require.Equal(t, opts.LogFileSize, capacity)
+
+	val := make([]byte, 1024)
+	// The checksum, see Options.NoChecksums, adds 4 bytes to the header
+	entrySize := NewEntry([]byte("key"), val, Normal).Size() + 4
+	for i := 0; i < 990; i++ {
+		require.NoError(t, db.Put([]byte("key"), val))
+	}
+	offset, _ = db.ActiveFileUsage()
+	require.Equal(t, 990*entrySize, offset)
+	require.Greater(t, float64(offset)/float64(capacity), 0.9)
+
+	// The active file rolls over once it is full
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Put([]byte("key"), val))
+	}
+	offset, _ = db.ActiveFileUsage()
+	require.Less(t, float64(offset)/float64(capacity), 0.1)
+}
+
+func TestDB_PutAsync(t *testing.T) {
+	db, opts := openTestDB(t, nil)
+
+	const n = 1000
+	var (
+		mu      sync.Mutex
+		results []int
+	)
+	for i := 0; i < n; i++ {
+		i := i
+		db.PutAsync([]byte("key"), []byte(strconv.Itoa(i)), func(err error) {
+			assert.NoError(t, err)
+			mu.Lock()
+			results = append(results, i)
+			mu.Unlock()
+		})
+		db.PutAsync([]byte(fmt.Sprintf("key%d", i)), []byte(strconv.Itoa(i)), nil)
+	}
+
+	// Close drains the queue
+	require.NoError(t, db.Close())
+	require.Equal(t, n, len(results))
+	for i, r := range results {
+		require.Equal(t, i, r)
+	}
+	db.PutAsync([]byte("key"), nil, func(err error) {
+		require.Equal(t, ErrDatabaseClosed, err)
+	})
+
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	val, err := db.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte(strconv.Itoa(n-1)), val)
+	for i := 0; i < n; i++ {
+		_, err = db.Get([]byte(fmt.Sprintf("key%d", i)))
+		require.NoError(t, err)
+	}
+}
+
+func TestDB_PutAsyncRotation(t *testing.T) {
+	db, opts := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+	})
+	defer func() { db.Close() }()
+
+	// A batch larger than several log files rolls them over like Puts do
+	val := make([]byte, 64<<10)
+	entrySize := int64(NewEntry([]byte("key00"), val, Normal).Size()) + 4
+	var batch []*asyncPut
+	for i := 0; i < 40; i++ {
+		batch = append(batch, &asyncPut{key: []byte(fmt.Sprintf("key%02d", i)), val: val})
+	}
+	db.applyPuts(batch)
+	require.Len(t, db.dbFile.files, 3)
+	for _, lf := range db.dbFile.files[:2] {
+		require.LessOrEqual(t, int64(lf.size), opts.LogFileSize+entrySize)
+		require.Greater(t, int64(lf.size), opts.LogFileSize)
+	}
+	for _, p := range batch {
+		v, err := db.Get(p.key)
+		require.NoError(t, err)
+		require.Equal(t, val, v)
+	}
+
+	// Likewise with MaxEntriesPerFile
+	require.NoError(t, db.Close())
+	opts.MaxEntriesPerFile = 10
+	db, err := Open(opts)
+	require.NoError(t, err)
+	require.NoError(t, db.SealActive())
+	batch = batch[:0]
+	for i := 0; i < 25; i++ {
+		batch = append(batch, &asyncPut{key: []byte(fmt.Sprintf("small%02d", i)), val: []byte("v")})
+	}
+	db.applyPuts(batch)
+	fids := make(map[uint32]int)
+	for _, p := range batch {
+		fid, err := db.FileOf(p.key)
+		require.NoError(t, err)
+		fids[fid]++
+	}
+	require.Len(t, fids, 3)
+	for _, n := range fids {
+		require.Contains(t, []int{10, 5}, n)
+	}
+}
+
+func TestDB_PutSequenced(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				key := []byte(fmt.Sprintf("writer%d", w))
+				var lastSeq uint64
+				for i := 0; i < 200; i++ {
+					assert.NoError(t, db.PutSequenced(key, []byte(strconv.Itoa(i))))
+					// Writes of one caller are committed in call order
+					_, meta, err := db.GetWithMeta(key)
+					assert.NoError(t, err)
+					assert.Greater(t, meta.Seq, lastSeq)
+					lastSeq = meta.Seq
+				}
+			}(w)
+		}
+		// Readers run while the queued writes are written without db.mu.
+		stop := make(chan struct{})
+		readDone := make(chan struct{})
+		go func() {
+			defer close(readDone)
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := db.GetOldest([]byte("writer0")); err != ErrKeyNotFound {
+					assert.NoError(t, err)
+				}
+			}
+		}()
+		wg.Wait()
+		close(stop)
+		<-readDone
+
+		for w := 0; w < 8; w++ {
+			v, err := db.Get([]byte(fmt.Sprintf("writer%d", w)))
+			require.NoError(t, err)
+			require.Equal(t, []byte("199"), v)
+		}
+		require.Equal(t, ErrEmptyKey, db.PutSequenced(nil, []byte("val")))
+	})
+}
+
+func TestDB_PutSequencedQuota(t *testing.T) {
+	db, _ := openTestDB(t, func(opts *Options) {
+		opts.MaxTotalValueBytes = 10
+	})
+
+	// Queue the writes while the writer is blocked
+	db.mu.Lock()
+	errCh := make(chan error, 3)
+	cb := func(err error) { errCh <- err }
+	db.PutAsync([]byte("key"), []byte("12345678"), cb)
+	db.PutAsync([]byte("key"), []byte("1234"), cb)
+	db.PutAsync([]byte("other"), []byte("1234567"), cb)
+	db.mu.Unlock()
+
+	require.NoError(t, <-errCh)
+	require.NoError(t, <-errCh)
+	require.Equal(t, ErrQuotaExceeded, <-errCh)
+	v, err := db.Get([]byte("key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("1234"), v)
+	require.Equal(t, int64(4), db.valueBytes)
+}
+
+func TestDB_PutAsyncNonBlocking(t *testing.T) {
+	db, _ := openTestDB(t, func(opts *Options) {
+		opts.AsyncQueueSize = 1
+		opts.AsyncNonBlocking = true
+	})
+
+	// Block the background writer
+	db.mu.Lock()
+	errCh := make(chan error, 3)
+	cb := func(err error) { errCh <- err }
+	db.PutAsync([]byte("key0"), nil, cb)
+	for len(db.async.ch) > 0 {
+		runtime.Gosched()
+	}
+	db.PutAsync([]byte("key1"), nil, cb)
+	db.PutAsync([]byte("key2"), nil, cb)
+	require.Equal(t, ErrAsyncQueueFull, <-errCh)
+	db.mu.Unlock()
+
+	require.NoError(t, <-errCh)
+	require.NoError(t, <-errCh)
+}
+
+func TestDB_CheckWriteOffset(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Put([]byte("key"), []byte("val")))
+		alf := db.dbFile.activeLogFile()
+		require.NoError(t, alf.checkWriteOffset(db.dbFile.writableOffset()))
+
+		// Simulate the write position moved behind our back
+		_, err := alf.fd.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		require.Error(t, alf.checkWriteOffset(db.dbFile.writableOffset()))
+		if debugMode {
+			require.Error(t, db.Put([]byte("key"), []byte("val")))
+		}
+
+		_, err = alf.fd.Seek(int64(db.dbFile.writableOffset()), io.SeekStart)
+		require.NoError(t, err)
+		require.NoError(t, db.Put([]byte("key"), []byte("val")))
+	})
+}
+
+func TestDB_SealActive(t *testing.T) {
+	db, opts := openTestDB(t, nil)
+
+	// Sealing an empty active file is a no-op
+	require.NoError(t, db.SealActive())
+	require.Equal(t, 1, len(db.dbFile.files))
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Put([]byte(strconv.Itoa(i)), []byte("val")))
+	}
+	require.NoError(t, db.Delete([]byte("0")))
+	// A temp hint file left behind by a crash is replaced
+	tempIndexPath := indexFilePath(opts.Dir, 0) + tempFileNameSuffix
+	require.NoError(t, os.WriteFile(tempIndexPath, []byte("stale"), 0666))
+
+	// Sealing waits for a running merge
+	db.gcLock.Lock()
+	done := make(chan error)
+	go func() { done <- db.SealActive() }()
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, 1, len(db.dbFile.files))
+	db.gcLock.Unlock()
+	require.NoError(t, <-done)
+	require.NoError(t, db.SealActive())
+	require.Equal(t, 2, len(db.dbFile.files))
+	_, err := os.Stat(tempIndexPath)
+	require.True(t, os.IsNotExist(err))
+	require.Zero(t, db.dbFile.writableOffset())
+	sealed := db.dbFile.files[0]
+	_, err = os.Stat(indexFilePath(opts.Dir, sealed.fid))
+	require.NoError(t, err)
+
+	require.NoError(t, db.Put([]byte("new"), []byte("val")))
+	require.NoError(t, db.Close())
+
+	// The sealed file is replayed from its hint file
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, 2, len(db.dbFile.files))
+	_, err = db.Get([]byte("0"))
+	require.Equal(t, ErrKeyNotFound, err)
+	for i := 1; i < 10; i++ {
+		v, err := db.Get([]byte(strconv.Itoa(i)))
+		require.NoError(t, err)
+		require.Equal(t, []byte("val"), v)
+	}
+	v, err := db.Get([]byte("new"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("val"), v)
+}
+
+func TestDB_WriteValueTo(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		val := make([]byte, 100<<10)
+		for i := range val {
+			val[i] = byte(i)
+		}
+		require.NoError(t, db.Put([]byte("key"), val))
+
+		var buf bytes.Buffer
+		n, err := db.WriteValueTo([]byte("key"), &buf)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(val)), n)
+		require.Equal(t, val, buf.Bytes())
+
+		_, err = db.WriteValueTo([]byte("missing"), &buf)
+		require.Equal(t, ErrKeyNotFound, err)
+
+		// The database can be written and merged while copying, which rewrites the file
+		buf.Reset()
+		w := &hookWriter{w: &buf, hook: func() {
+			require.NoError(t, db.Put([]byte("key"), []byte("new")))
+			require.NoError(t, db.SealActive())
+			require.NoError(t, db.Merge())
+		}}
+		n, err = db.WriteValueTo([]byte("key"), w)
+		require.NoError(t, err)
+		require.Equal(t, int64(len(val)), n)
+		require.Equal(t, val, buf.Bytes())
+		v, err := db.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("new"), v)
+
+		// The file is left alone by merge until the copy is done
+		require.Greater(t, db.dbFile.files[0].size, uint64(len(val)))
+		require.False(t, db.dbFile.files[0].pinned())
+		require.NoError(t, db.Merge())
+		require.Less(t, db.dbFile.files[0].size, uint64(len(val)))
+	})
+}
+
+// hookWriter calls hook before the first write to w.
+type hookWriter struct {
+	w    io.Writer
+	hook func()
+}
+
+func (hw *hookWriter) Write(p []byte) (int, error) {
+	if hw.hook != nil {
+		hw.hook()
+		hw.hook = nil
+	}
+	return hw.w.Write(p)
+}
+
+func BenchmarkDB_WriteValueTo(b *testing.B) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(getTestOptions(dir))
+	require.NoError(b, err)
+	defer db.Close()
+	key := []byte("key")
+	require.NoError(b, db.Put(key, make([]byte, 1<<20)))
+
+	b.Run("Get", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			v, err := db.Get(key)
+			require.NoError(b, err)
+			_, err = io.Discard.Write(v)
+			require.NoError(b, err)
+		}
+	})
+	b.Run("WriteValueTo", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := db.WriteValueTo(key, io.Discard)
+			require.NoError(b, err)
+		}
+	})
+}
+
+func TestDB_ContentHash(t *testing.T) {
+	db, opts := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+		opts.ContentHash = true
+	})
+
+	val := make([]byte, 512<<10)
+	require.NoError(t, db.Put([]byte("a"), val))
+	require.NoError(t, db.Put([]byte("b"), val))
+	require.NoError(t, db.Put([]byte("c"), []byte("other")))
+	hashOf := func(db *DB, key string) uint64 {
+		_, meta, err := db.GetWithMeta([]byte(key))
+		require.NoError(t, err)
+		return meta.ContentHash
+	}
+	hash := hashOf(db, "a")
+	require.NotZero(t, hash)
+	require.Equal(t, hash, hashOf(db, "b"))
+	require.NotEqual(t, hash, hashOf(db, "c"))
+
+	// Merge rewrites the entries along with their hash
+	require.NoError(t, db.Delete([]byte("b")))
+	require.Greater(t, len(db.dbFile.files), 1)
+	require.NoError(t, db.Merge())
+	require.NoError(t, db.Close())
+
+	db, err := Open(opts)
+	require.NoError(t, err)
+	require.Equal(t, hash, hashOf(db, "a"))
+	require.Equal(t, hashKey([]byte("other")), hashOf(db, "c"))
+	require.NoError(t, db.Close())
+
+	// Entries written without the option have no hash, while the manifest still
+	// records that older entries have one
+	opts.ContentHash = false
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Put([]byte("d"), val))
+	require.Zero(t, hashOf(db, "d"))
+	require.Equal(t, hash, hashOf(db, "a"))
+	m, err := readManifest(opts.Dir)
+	require.NoError(t, err)
+	require.NotZero(t, m.entryFlags&flagContentHash)
+}
+
+func TestDB_Snapshot(t *testing.T) {
+	db, opts := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+	})
+
+	val := make([]byte, 64<<10)
+	write := func(n int, b byte) {
+		for i := range val {
+			val[i] = b
+		}
+		for i := 0; i < n; i++ {
+			require.NoError(t, db.Put([]byte(strconv.Itoa(i)), val))
+		}
+	}
+	sizeOf := func(fid uint32) int64 {
+		fi, err := os.Stat(logFilePath(opts.Dir, fid))
+		require.NoError(t, err)
+		return fi.Size()
+	}
+	check := func(s *Snapshot, b byte) {
+		for i := 0; i < 20; i++ {
+			v, err := s.Get([]byte(strconv.Itoa(i)))
+			require.NoError(t, err)
+			require.Equal(t, b, v[0])
+		}
+	}
+
+	write(20, 1)
+	s1, err := db.NewSnapshot()
+	require.NoError(t, err)
+	first := db.dbFile.files[0].fid
+	write(20, 2)
+	s2, err := db.NewSnapshot()
+	require.NoError(t, err)
+	write(20, 3)
+
+	// Every file but the active one is dead, yet pinned by the snapshots
+	require.NoError(t, db.Merge())
+	require.Equal(t, ErrFilesPinned, db.Defragment())
+	check(s1, 1)
+	check(s2, 2)
+	size := sizeOf(first)
+	require.NotZero(t, size)
+
+	s1.Close()
+	s1.Close()
+	require.NoError(t, db.Merge())
+	require.Equal(t, size, sizeOf(first))
+	check(s2, 2)
+
+	s2.Close()
+	require.NoError(t, db.Merge())
+	require.Zero(t, sizeOf(first))
+	v, err := db.Get([]byte("0"))
+	require.NoError(t, err)
+	require.Equal(t, byte(3), v[0])
+}
+
+func TestDB_ShardFunc(t *testing.T) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Keep the keys of a prefix together
+	opts := getTestOptions(dir)
+	opts.ShardFunc = func(key []byte) uint32 {
+		return uint32(key[0])
+	}
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	for _, prefix := range []string{"a", "b"} {
+		for i := 0; i < 100; i++ {
+			require.NoError(t, db.Put([]byte(prefix+strconv.Itoa(i)), []byte(strconv.Itoa(i))))
+		}
+	}
+	require.NoError(t, db.Delete([]byte("a0")))
+	check := func(db *DB) {
+		require.Equal(t, 99, len(db.keyDir.shards['a'%keyDirShards]))
+		require.Equal(t, 100, len(db.keyDir.shards['b'%keyDirShards]))
+		require.Equal(t, 199, db.keyDir.len())
+		_, err := db.Get([]byte("a0"))
+		require.Equal(t, ErrKeyNotFound, err)
+		for i := 1; i < 100; i++ {
+			v, err := db.Get([]byte("b" + strconv.Itoa(i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(strconv.Itoa(i)), v)
+		}
+	}
+	check(db)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	check(db)
+	require.NoError(t, db.Close())
+
+	// A function which does not return the same shard every time fails the writes
+	// instead of losing the keys
+	var calls uint32
+	opts.ShardFunc = func(key []byte) uint32 {
+		calls++
+		return calls
+	}
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	err = db.Put([]byte("c0"), []byte("0"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "ShardFunc")
+	require.Error(t, db.Delete([]byte("b1")))
+}
+
+func TestDB_RemoveLegacyHints(t *testing.T) {
+	db, opts := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+	})
+	val := make([]byte, 64<<10)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, db.Put([]byte(strconv.Itoa(i)), val))
+	}
+	require.Greater(t, len(db.dbFile.files), 1)
+	require.NoError(t, db.Close())
+
+	// Simulate a database written before the manifest, whose hint files have
+	// no mark byte: fid, offset and kLen of 4 bytes each, followed by the key.
+	require.NoError(t, os.Remove(filepath.Join(opts.Dir, manifestFile)))
+	var legacy []byte
+	legacy = binary.BigEndian.AppendUint32(legacy, 0)
+	legacy = binary.BigEndian.AppendUint32(legacy, 0)
+	legacy = binary.BigEndian.AppendUint32(legacy, 1)
+	legacy = append(legacy, '0')
+	require.NoError(t, os.WriteFile(indexFilePath(opts.Dir, 0), legacy, 0666))
+
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = os.Stat(indexFilePath(opts.Dir, 0))
+	require.True(t, os.IsNotExist(err))
+	require.EqualValues(t, hintVersion, db.manifest.hintVersion)
+	require.Equal(t, 20, db.keyDir.len())
+	for i := 0; i < 20; i++ {
+		v, err := db.Get([]byte(strconv.Itoa(i)))
+		require.NoError(t, err)
+		require.Equal(t, val, v)
+	}
+}
+
+func TestDB_MigrateHints(t *testing.T) {
+	db, opts := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+	})
+	val := make([]byte, 64<<10)
+	for i := 0; i < 40; i++ {
+		require.NoError(t, db.Put([]byte(strconv.Itoa(i%20)), val))
+	}
+	require.NoError(t, db.Delete([]byte("0")))
+	require.NoError(t, db.Merge())
+	require.NoError(t, db.Close())
+
+	// Rewrite the hint files in the layout of hint version 1, whose offsets and value
+	// sizes take 4 bytes.
+	hints, err := filepath.Glob(filepath.Join(opts.Dir, "*"+indexFileNameSuffix))
+	require.NoError(t, err)
+	require.NotEmpty(t, hints)
+	ckpts, err := filepath.Glob(filepath.Join(opts.Dir, "*"+checkpointFileNameSuffix))
+	require.NoError(t, err)
+	hints = append(hints, ckpts...)
+	want := make(map[string][]byte)
+	for _, path := range hints {
+		buf, err := os.ReadFile(path)
+		require.NoError(t, err)
+		if len(buf) == 0 {
+			continue
+		}
+		want[path] = buf
+		var legacy []byte
+		for len(buf) > 0 {
+			idx, err := decodeIndex(buf)
+			require.NoError(t, err)
+			legacy = append(legacy, buf[:5]...)
+			legacy = binary.BigEndian.AppendUint32(legacy, uint32(idx.offset))
+			legacy = append(legacy, buf[13:17]...)
+			if idx.extended() {
+				require.NoError(t, decodeIndexExt(idx, buf[indexHeaderSize:]))
+				ext := buf[indexHeaderSize : indexHeaderSize+idx.flags.extSize()]
+				if idx.flags&flagValueSize != 0 {
+					// Drop the high 4 bytes of the value size, which follows the seq
+					at := uint32(1)
+					if idx.flags&flagSeq != 0 {
+						at += 8
+					}
+					legacy = append(legacy, ext[:at]...)
+					ext = ext[at+4:]
+				}
+				legacy = append(legacy, ext...)
+			}
+			legacy = append(legacy, buf[idx.Size()-idx.kLen:idx.Size()]...)
+			buf = buf[idx.Size():]
+		}
+		require.NoError(t, os.WriteFile(path, legacy, 0666))
+	}
+	m, err := readManifest(opts.Dir)
+	require.NoError(t, err)
+	m.hintVersion = 1
+	require.NoError(t, writeManifest(opts.Dir, m))
+
+	// The hint files are migrated rather than removed
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	require.EqualValues(t, hintVersion, db.manifest.hintVersion)
+	for path, buf := range want {
+		got, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, buf, got)
+	}
+	require.Equal(t, 19, db.keyDir.len())
+	for i := 1; i < 20; i++ {
+		v, err := db.Get([]byte(strconv.Itoa(i)))
+		require.NoError(t, err)
+		require.Equal(t, val, v)
+	}
+}
+
+func TestDB_DefragmentRecovery(t *testing.T) {
+	// writeDB creates a database holding kvs in a single log file, and returns its dir.
+	writeDB := func(kvs ...string) string {
+		dir, err := os.MkdirTemp("", "minidb")
+		require.NoError(t, err)
+		opts := getTestOptions(dir)
+		opts.LogFileSize = 1 << 20
+		db, err := Open(opts)
+		require.NoError(t, err)
+		for i := 0; i < len(kvs); i += 2 {
+			require.NoError(t, db.Put([]byte(kvs[i]), []byte(kvs[i+1])))
+		}
+		require.NoError(t, db.Close())
+		return dir
+	}
+	copyFile := func(src, dst string) {
+		buf, err := os.ReadFile(src)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(dst, buf, 0666))
+	}
+	check := func(dir string, kvs map[string]string) {
+		opts := getTestOptions(dir)
+		opts.LogFileSize = 1 << 20
+		db, err := Open(opts)
+		require.NoError(t, err)
+		defer db.Close()
+		require.Equal(t, len(kvs), db.keyDir.len())
+		for k, v := range kvs {
+			val, err := db.Get([]byte(k))
+			require.NoError(t, err)
+			require.Equal(t, v, string(val))
+		}
+		_, err = os.Stat(filepath.Join(dir, defragMarkerFile))
+		require.True(t, os.IsNotExist(err))
+	}
+
+	// A crash before the commit leaves stale new files, which are removed
+	dir := writeDB("a", "new")
+	defer os.RemoveAll(dir)
+	stale := writeDB("a", "stale")
+	defer os.RemoveAll(stale)
+	copyFile(logFilePath(stale, 0), logFilePath(dir, 5))
+	copyFile(logFilePath(stale, 0), logFilePath(dir, 6)+tempFileNameSuffix)
+	require.NoError(t, writeDefragMarker(dir, &defragMarker{oldFids: []uint32{0}, newFids: []uint32{5, 6}}))
+	check(dir, map[string]string{"a": "new"})
+	_, err := os.Stat(logFilePath(dir, 5))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(logFilePath(dir, 6) + tempFileNameSuffix)
+	require.True(t, os.IsNotExist(err))
+
+	// A crash after the commit leaves old files, which are removed
+	dir2 := writeDB("a", "1", "b", "2")
+	defer os.RemoveAll(dir2)
+	live := writeDB("a", "1")
+	defer os.RemoveAll(live)
+	copyFile(logFilePath(live, 0), logFilePath(dir2, 1))
+	require.NoError(t, writeDefragMarker(dir2, &defragMarker{committed: true, oldFids: []uint32{0}, newFids: []uint32{1}}))
+	check(dir2, map[string]string{"a": "1"})
+	_, err = os.Stat(logFilePath(dir2, 0))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestDB_ListKeys(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		var want [][]byte
+		for i := 0; i < 25; i++ {
+			key := []byte(fmt.Sprintf("key%02d", i))
+			want = append(want, key)
+			require.NoError(t, db.Put(key, []byte("val")))
+		}
+		require.NoError(t, db.Put([]byte("deleted"), []byte("val")))
+		require.NoError(t, db.Delete([]byte("deleted")))
+
+		var got [][]byte
+		var after []byte
+		pages := 0
+		for {
+			keys, next, err := db.ListKeys(after, 10)
+			require.NoError(t, err)
+			got = append(got, keys...)
+			pages++
+			if next == nil {
+				break
+			}
+			require.Equal(t, keys[len(keys)-1], next)
+			after = next
+		}
+		require.Equal(t, want, got)
+		require.Equal(t, 3, pages)
+
+		// A key put behind the cursor is not listed, one put after it is
+		keys, next, err := db.ListKeys([]byte("key09"), 10)
+		require.NoError(t, err)
+		require.Equal(t, []byte("key19"), next)
+		require.NoError(t, db.Put([]byte("key05a"), []byte("val")))
+		require.NoError(t, db.Put([]byte("key19a"), []byte("val")))
+		keys, next, err = db.ListKeys(next, 10)
+		require.NoError(t, err)
+		require.Nil(t, next)
+		require.Equal(t, []byte("key19a"), keys[0])
+		require.Len(t, keys, 6)
+
+		_, _, err = db.ListKeys(nil, 0)
+		require.Error(t, err)
+	})
+}
+
+func TestDB_RetentionPeriod(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = time.Now }()
+
+	tests := []struct {
+		name       string
+		keepLatest bool
+		// oldVal is the value of the key last written before the period, nil once deleted.
+		oldVal []byte
+		// dropped are the value bytes merging the second file, then every file, drops.
+		dropped, droppedAll int64
+	}{
+		// A key whose latest version expired is deleted, with every version of it once
+		// all files are compacted
+		{"Unconditional", false, nil, 2, 2 + 1<<20},
+		// Only the versions a newer one replaced are dropped
+		{"KeepLatest", true, []byte("v1"), 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = time.Unix(1700000000, 0)
+			db, opts := openTestDB(t, func(opts *Options) {
+				opts.LogFileSize = 1 << 20
+				opts.EntryTimestamps = true
+				opts.RetentionPeriod = time.Hour
+				opts.RetentionKeepLatest = tt.keepLatest
+				// Leave the first file alone, so the old version of a key survives there
+				opts.MergePolicy = func(files []FileStat) []uint32 { return []uint32{1} }
+			})
+
+			filler := make([]byte, opts.LogFileSize)
+			require.NoError(t, db.Put([]byte("old"), []byte("v0")))
+			require.NoError(t, db.Put([]byte("filler0"), filler))
+			require.NoError(t, db.Put([]byte("old"), []byte("v1")))
+			require.NoError(t, db.Put([]byte("kept"), []byte("v1")))
+			now = now.Add(2 * time.Hour)
+			require.NoError(t, db.Put([]byte("kept"), []byte("v2")))
+			require.NoError(t, db.Put([]byte("filler1"), filler))
+			require.Equal(t, 3, len(db.dbFile.files))
+			valueBytes := db.valueBytes
+
+			// A key written again within the period is kept either way
+			require.NoError(t, db.Merge())
+			check := func(db *DB) {
+				v, err := db.Get([]byte("old"))
+				if tt.oldVal == nil {
+					require.Equal(t, ErrKeyNotFound, err)
+				} else {
+					require.NoError(t, err)
+					require.Equal(t, tt.oldVal, v)
+				}
+				v, err = db.Get([]byte("kept"))
+				require.NoError(t, err)
+				require.Equal(t, []byte("v2"), v)
+			}
+			check(db)
+			require.Equal(t, valueBytes-tt.dropped, db.valueBytes)
+			n, err := db.VersionCount([]byte("kept"))
+			require.NoError(t, err)
+			require.Equal(t, 1, n)
+			require.NoError(t, db.Close())
+
+			// Reopening keeps it so, though the first file still has an old version of the key
+			db, err = Open(opts)
+			require.NoError(t, err)
+			check(db)
+			require.NoError(t, db.Close())
+
+			// Compacting every file drops the older versions
+			opts.MergePolicy = nil
+			db, err = Open(opts)
+			require.NoError(t, err)
+			defer db.Close()
+			require.NoError(t, db.Merge())
+			check(db)
+			require.Equal(t, valueBytes-tt.droppedAll, db.valueBytes)
+			v, err := db.GetOldest([]byte("old"))
+			if tt.oldVal == nil {
+				require.Equal(t, ErrKeyNotFound, err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tt.oldVal, v)
+			}
+		})
+	}
+}
+
+func TestDB_PutWithTTL(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = time.Now }()
+
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.LogFileSize = 1 << 20
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	require.Error(t, db.PutWithTTL([]byte("a"), []byte("v"), 0))
+	require.NoError(t, db.PutWithTTL([]byte("a"), []byte("v"), time.Minute))
+	require.NoError(t, db.PutWithTTL([]byte("b"), []byte("v"), time.Hour))
+	require.NoError(t, db.Put([]byte("c"), []byte("v")))
+	val, meta, err := db.GetWithMeta([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v"), val)
+	require.True(t, now.Add(time.Minute).Equal(meta.ExpiresAt))
+	_, meta, err = db.GetWithMeta([]byte("c"))
+	require.NoError(t, err)
+	require.True(t, meta.ExpiresAt.IsZero())
+	m, err := readManifest(dir)
+	require.NoError(t, err)
+	require.NotZero(t, m.entryFlags&flagExpiry)
+
+	// An expired key is not found, and reading it drops it from the index
+	now = now.Add(2 * time.Minute)
+	require.Equal(t, 3, db.Len())
+	_, err = db.Get([]byte("a"))
+	require.Equal(t, ErrKeyNotFound, err)
+	ok, err := db.Exists([]byte("a"))
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Equal(t, 2, db.Len())
+	val, err = db.Get([]byte("b"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v"), val)
+
+	// Merge drops the expired entries, so the keys are gone on Open though never read
+	now = now.Add(time.Hour)
+	require.NoError(t, db.Put([]byte("filler"), make([]byte, opts.LogFileSize)))
+	require.NoError(t, db.Merge())
+	require.Equal(t, 2, db.Len())
+	require.NoError(t, db.Close())
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	for _, key := range []string{"a", "b"} {
+		ok, err = db.Exists([]byte(key))
+		require.NoError(t, err)
+		require.False(t, ok)
+	}
+	val, err = db.Get([]byte("c"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v"), val)
+}
+
+func TestDB_TTLSweep(t *testing.T) {
+	// The sweeper reads the time concurrently with the test moving it on
+	start := time.Now()
+	var elapsed atomic.Int64
+	nowFunc = func() time.Time { return start.Add(time.Duration(elapsed.Load())) }
+	defer func() { nowFunc = time.Now }()
+
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.TTLSweepInterval = 10 * time.Millisecond
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer func() { db.Close() }()
+
+	// key<i> expires after i+1 minutes, except key5 overwritten without TTL, key6
+	// deleted and key7 overwritten with a longer TTL
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.PutWithTTL([]byte(fmt.Sprintf("key%d", i)), []byte("v"), time.Duration(i+1)*time.Minute))
+	}
+	require.NoError(t, db.Put([]byte("key5"), []byte("v")))
+	require.NoError(t, db.Delete([]byte("key6")))
+	require.NoError(t, db.PutWithTTL([]byte("key7"), []byte("v"), 200*time.Minute))
+
+	elapsed.Store(int64(50*time.Minute + time.Second))
+	require.Eventually(t, func() bool {
+		return db.Len() == 52
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, uint64(48), db.Counters().Deletes)
+	// Only the keys which have not expired are left in the heap
+	db.mu.RLock()
+	require.Len(t, db.ttlSweep.expiries, 51)
+	db.mu.RUnlock()
+
+	// The keys were deleted by tombstones, so they are gone even at the time they
+	// were written
+	require.NoError(t, db.Close())
+	elapsed.Store(0)
+	db, err = Open(opts)
+	require.NoError(t, err)
+	require.Equal(t, 52, db.Len())
+	for i := 0; i < 100; i++ {
+		ok, err := db.Exists([]byte(fmt.Sprintf("key%d", i)))
+		require.NoError(t, err)
+		require.Equal(t, i >= 50 || i == 5 || i == 7, ok, i)
+	}
+	db.mu.RLock()
+	require.Len(t, db.ttlSweep.expiries, 51)
+	db.mu.RUnlock()
+}
+
+func TestDB_GetShared(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		for i := 0; i < 10; i++ {
+			require.NoError(t, db.Put([]byte(strconv.Itoa(i)), bytes.Repeat([]byte{byte(i)}, 100*i)))
+		}
+
+		// Readers releasing their values don't see each other's buffers
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for j := 0; j < 500; j++ {
+					i := (w + j) % 10
+					v, err := db.GetShared([]byte(strconv.Itoa(i)))
+					assert.NoError(t, err)
+					assert.Equal(t, bytes.Repeat([]byte{byte(i)}, 100*i), v)
+					db.ReleaseShared(v)
+				}
+			}(w)
+		}
+		wg.Wait()
+
+		_, err := db.GetShared([]byte("missing"))
+		require.Equal(t, ErrKeyNotFound, err)
+		_, err = db.GetShared(nil)
+		require.Equal(t, ErrEmptyKey, err)
+	})
+}
+
+func BenchmarkDB_GetShared(b *testing.B) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	db, err := Open(getTestOptions(dir))
+	require.NoError(b, err)
+	defer db.Close()
+	key := []byte("key")
+	require.NoError(b, db.Put(key, make([]byte, 4<<10)))
+
+	b.Run("Get", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, err := db.Get(key)
+			require.NoError(b, err)
+		}
+	})
+	b.Run("GetShared", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			v, err := db.GetShared(key)
+			require.NoError(b, err)
+			db.ReleaseShared(v)
+		}
+	})
+}
+
+// memOverflow is an in-memory Overflow counting its reads.
+type memOverflow struct {
+	mu    sync.Mutex
+	m     map[string][]byte
+	reads int
+}
+
+func (o *memOverflow) Get(key []byte) ([]byte, bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.reads++
+	val, ok := o.m[string(key)]
+	return val, ok, nil
+}
+
+func (o *memOverflow) Put(key, val []byte) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.m[string(key)] = append([]byte(nil), val...)
+	return nil
+}
+
+func TestDB_Overflow(t *testing.T) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ov := &memOverflow{m: map[string][]byte{"cold": []byte("cold value")}}
+	opt := getTestOptions(dir)
+	opt.Overflow = ov
+	db, err := Open(opt)
+	require.NoError(t, err)
+
+	// Misses go through to the overflow without caching
+	v, err := db.Get([]byte("cold"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("cold value"), v)
+	_, err = db.get([]byte("cold"))
+	require.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get([]byte("missing"))
+	require.Equal(t, ErrKeyNotFound, err)
+	require.Equal(t, 2, ov.reads)
+
+	// Hits never read the overflow
+	require.NoError(t, db.Put([]byte("hot"), []byte("hot value")))
+	v, err = db.Get([]byte("hot"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("hot value"), v)
+	require.Equal(t, 2, ov.reads)
+
+	// Demote moves the value into the overflow
+	require.NoError(t, db.Demote([]byte("hot")))
+	require.Equal(t, []byte("hot value"), ov.m["hot"])
+	_, err = db.get([]byte("hot"))
+	require.Equal(t, ErrKeyNotFound, err)
+	v, err = db.Get([]byte("hot"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("hot value"), v)
+	require.Equal(t, ErrKeyNotFound, db.Demote([]byte("missing")))
+	require.NoError(t, db.Close())
+
+	// Reads are written back with OverflowCache
+	opt.OverflowCache = true
+	db, err = Open(opt)
+	require.NoError(t, err)
+	defer db.Close()
+	reads := ov.reads
+	for i := 0; i < 3; i++ {
+		v, err = db.Get([]byte("cold"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("cold value"), v)
+	}
+	require.Equal(t, reads+1, ov.reads)
+	v, err = db.get([]byte("cold"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("cold value"), v)
+
+	// The database shadows the overflow once a key is written again
+	require.NoError(t, db.Put([]byte("hot"), []byte("new value")))
+	v, err = db.Get([]byte("hot"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("new value"), v)
+
+	db.opt.Overflow = nil
+	require.Equal(t, ErrNoOverflow, db.Demote([]byte("hot")))
+}
+
+func TestDB_SyncDirOff(t *testing.T) {
+	db, opts := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+		opts.NoSyncDir = true
+	})
+
+	// Roll over several log files, merge them and reopen
+	val := make([]byte, 256<<10)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, db.Put([]byte(strconv.Itoa(i%5)), val))
+	}
+	require.True(t, len(db.dbFile.files) > 4)
+	require.NoError(t, db.Merge())
+	require.NoError(t, db.Close())
+
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	for i := 0; i < 5; i++ {
+		v, err := db.Get([]byte(strconv.Itoa(i)))
+		require.NoError(t, err)
+		require.Equal(t, val, v)
+	}
+}
+
+func BenchmarkDB_SyncDir(b *testing.B) {
+	for _, on := range []bool{true, false} {
+		b.Run(fmt.Sprintf("SyncDir=%v", on), func(b *testing.B) {
+			dir, err := os.MkdirTemp("", "minidb")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+
+			opts := getTestOptions(dir)
+			opts.LogFileSize = 1 << 20
+			opts.NoSyncDir = !on
+			db, err := Open(opts)
+			require.NoError(b, err)
+			defer db.Close()
+
+			// Every 16 writes roll over the active log file
+			val := make([]byte, 64<<10)
+			b.SetBytes(int64(len(val)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				require.NoError(b, db.Put([]byte(strconv.Itoa(i)), val))
+			}
+		})
+	}
+}
+
+func TestDB_Digest(t *testing.T) {
+	dir1, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir1)
+	dir2, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir2)
+
+	opts := getTestOptions(dir1)
+	opts.LogFileSize = 1 << 20
+	db1, err := Open(opts)
+	require.NoError(t, err)
+	defer db1.Close()
+	opts.Dir = dir2
+	db2, err := Open(opts)
+	require.NoError(t, err)
+	defer db2.Close()
+
+	empty, err := db1.Digest()
+	require.NoError(t, err)
+
+	// db1 overwrites and deletes across several log files, db2 writes the final state once
+	val := make([]byte, 64<<10)
+	for i := 0; i < 60; i++ {
+		require.NoError(t, db1.Put([]byte(strconv.Itoa(i%20)), append(val, byte(i))))
+	}
+	for i := 0; i < 20; i += 3 {
+		require.NoError(t, db1.Delete([]byte(strconv.Itoa(i))))
+	}
+	for i := 19; i >= 0; i-- {
+		if i%3 != 0 {
+			require.NoError(t, db2.Put([]byte(strconv.Itoa(i)), append(val, byte(40+i))))
+		}
+	}
+	d1, err := db1.Digest()
+	require.NoError(t, err)
+	d2, err := db2.Digest()
+	require.NoError(t, err)
+	require.Equal(t, d1, d2)
+	require.NotEqual(t, empty, d1)
+
+	// Merging changes the layout but not the digest
+	require.NoError(t, db1.Merge())
+	d1, err = db1.Digest()
+	require.NoError(t, err)
+	require.Equal(t, d2, d1)
+
+	// A different value, or the same bytes split differently, changes it
+	require.NoError(t, db2.Put([]byte("1"), []byte("x")))
+	d2, err = db2.Digest()
+	require.NoError(t, err)
+	require.NotEqual(t, d1, d2)
+	require.NoError(t, db2.Put([]byte("1"), append(val, 41)))
+
+	require.NoError(t, db1.Put([]byte("ab"), []byte("c")))
+	require.NoError(t, db2.Put([]byte("a"), []byte("bc")))
+	d1, err = db1.Digest()
+	require.NoError(t, err)
+	d2, err = db2.Digest()
+	require.NoError(t, err)
+	require.NotEqual(t, d1, d2)
+	require.NoError(t, db1.Delete([]byte("ab")))
+	require.NoError(t, db2.Delete([]byte("a")))
+	d1, err = db1.Digest()
+	require.NoError(t, err)
+	d2, err = db2.Digest()
+	require.NoError(t, err)
+	require.Equal(t, d1, d2)
+}
+
+func TestDB_ReplayLimit(t *testing.T) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Spread the keys over sealed files with hint files and the active file
+	opts := getTestOptions(dir)
+	opts.LogFileSize = 1 << 20
+	db, err := Open(opts)
+	require.NoError(t, err)
+	val := make([]byte, 100<<10)
+	for i := 0; i < 30; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%02d", i)), val))
+	}
+	require.NoError(t, db.Merge())
+	require.True(t, len(db.dbFile.files) > 2)
+	require.NoError(t, db.Close())
+
+	for _, n := range []int{1, 12, 25} {
+		opts.ReplayLimit = n
+		db, err = Open(opts)
+		require.NoError(t, err)
+		require.Equal(t, n, db.keyDir.len())
+		for i := 0; i < n; i++ {
+			v, err := db.Get([]byte(fmt.Sprintf("key%02d", i)))
+			require.NoError(t, err)
+			require.Equal(t, val, v)
+		}
+		_, err = db.Get([]byte(fmt.Sprintf("key%02d", n)))
+		require.Equal(t, ErrKeyNotFound, err)
+
+		require.Equal(t, ErrReadOnly, db.Put([]byte("new"), val))
+		require.Equal(t, ErrReadOnly, db.Delete([]byte("key00")))
+		require.Equal(t, ErrReadOnly, db.PutSequenced([]byte("new"), val))
+		require.Equal(t, ErrReadOnly, db.Merge())
+		require.Equal(t, ErrReadOnly, db.SealActive())
+		require.Equal(t, ErrReadOnly, db.Defragment())
+		var asyncErr error
+		db.PutAsync([]byte("new"), val, func(err error) { asyncErr = err })
+		require.Equal(t, ErrReadOnly, asyncErr)
+		require.NoError(t, db.Close())
+	}
+
+	// Nothing was lost or written
+	opts.ReplayLimit = 0
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, 30, db.keyDir.len())
+	_, err = db.Get([]byte("new"))
+	require.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_IterateRange(t *testing.T) {
+	db, _ := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+	})
+
+	// Keys of one byte and values of 100 bytes make entries of known size
+	keys := []string{"a", "b", "c", "d", "e"}
+	for _, key := range keys {
+		require.NoError(t, db.Put([]byte(key), bytes.Repeat([]byte(key), 100)))
+	}
+	require.NoError(t, db.Delete([]byte("b")))
+	var offsets []uint64
+	require.NoError(t, db.RawIterateReverse(func(_ uint32, offset uint64, _ *Entry) error {
+		offsets = append([]uint64{offset}, offsets...)
+		return nil
+	}))
+	require.Equal(t, 6, len(offsets))
+	end, _ := db.ActiveFileUsage()
+
+	collect := func(fid uint32, start, end uint64) ([]string, error) {
+		var got []string
+		err := db.IterateRange(fid, start, end, func(offset uint64, e *Entry) error {
+			got = append(got, fmt.Sprintf("%d:%s:%d", offset, e.key, e.mark))
+			return nil
+		})
+		return got, err
+	}
+
+	// The middle entries, the whole file and an empty range
+	got, err := collect(0, offsets[1], offsets[3])
+	require.NoError(t, err)
+	require.Equal(t, []string{fmt.Sprintf("%d:b:%d", offsets[1], Normal), fmt.Sprintf("%d:c:%d", offsets[2], Normal)}, got)
+	got, err = collect(0, 0, end)
+	require.NoError(t, err)
+	require.Equal(t, 6, len(got))
+	require.Equal(t, fmt.Sprintf("%d:b:%d", offsets[5], Tombstone), got[5])
+	got, err = collect(0, offsets[2], offsets[2])
+	require.NoError(t, err)
+	require.Empty(t, got)
+
+	// An end in the middle of an entry still visits the entry starting before it
+	got, err = collect(0, offsets[3], offsets[3]+1)
+	require.NoError(t, err)
+	require.Equal(t, []string{fmt.Sprintf("%d:d:%d", offsets[3], Normal)}, got)
+
+	// A start in the middle of an entry lands in the value, which does not decode
+	_, err = collect(0, offsets[1]+60, end)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "is not the start of an entry")
+
+	// Bounds are checked against the written part of the file
+	_, err = collect(0, 0, end+1)
+	require.Error(t, err)
+	_, err = collect(0, offsets[2], offsets[1])
+	require.Error(t, err)
+	_, err = collect(1, 0, 0)
+	require.Equal(t, ErrFileNotFound, err)
+
+	// fn stops the iteration with its error
+	stop := errors.New("stop")
+	require.Equal(t, stop, db.IterateRange(0, 0, end, func(uint64, *Entry) error { return stop }))
+}
+
+var errFlakyWrite = errors.New("Flaky write")
+
+// flakyFile writes at most max bytes per call and fails the calls listed in fail.
+type flakyFile struct {
+	buf    []byte
+	offset int
+	max    int
+	fail   map[int]bool
+	calls  int
+}
+
+func (f *flakyFile) Write(b []byte) (int, error) {
+	f.calls++
+	if len(b) > f.max {
+		b = b[:f.max]
+	}
+	f.buf = append(f.buf[:f.offset], b...)
+	f.offset += len(b)
+	if f.fail[f.calls] {
+		return len(b), errFlakyWrite
+	}
+	return len(b), nil
+}
+
+func (f *flakyFile) Seek(offset int64, whence int) (int64, error) {
+	if whence != io.SeekCurrent {
+		return 0, errors.New("Unsupported whence")
+	}
+	f.offset += int(offset)
+	return int64(f.offset), nil
+}
+
+func TestDB_WriteRetries(t *testing.T) {
+	entry := bytes.Repeat([]byte("entry"), 20)
+
+	// Short writes continue where they stopped
+	f := &flakyFile{max: 7}
+	require.NoError(t, writeAll(f, entry, 0, defaultLogger{}))
+	require.Equal(t, entry, f.buf)
+	require.Equal(t, 15, f.calls)
+
+	// Failed writes are retried up to the limit
+	f = &flakyFile{max: 30, fail: map[int]bool{1: true, 3: true}}
+	require.NoError(t, writeAll(f, entry, 2, defaultLogger{}))
+	require.Equal(t, entry, f.buf)
+
+	// Past the limit, the partial entry is overwritten by the next write
+	f = &flakyFile{max: 30, fail: map[int]bool{2: true, 3: true}}
+	require.Equal(t, errFlakyWrite, writeAll(f, entry, 1, defaultLogger{}))
+	require.Equal(t, 0, f.offset)
+	f.fail = nil
+	require.NoError(t, writeAll(f, []byte("next"), 0, defaultLogger{}))
+	require.Equal(t, []byte("next"), f.buf)
+}
+
+func TestDB_VersionCount(t *testing.T) {
+	db, opts := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+	})
+	defer func() { db.Close() }()
+
+	count := func(key string) int {
+		n, err := db.VersionCount([]byte(key))
+		require.NoError(t, err)
+		return n
+	}
+	require.Equal(t, 0, count("key"))
+
+	// Versions spread over sealed and active files are all counted
+	val := make([]byte, 300<<10)
+	for i := 0; i < 5; i++ {
+		require.NoError(t, db.Put([]byte("key"), val))
+		require.NoError(t, db.Put([]byte("other"), val))
+	}
+	require.True(t, len(db.dbFile.files) > 2)
+	require.NoError(t, db.Delete([]byte("key")))
+	require.Equal(t, 6, count("key"))
+	require.Equal(t, 5, count("other"))
+
+	// The versions on the sealed files survive a reopen through their hint files
+	require.NoError(t, db.SealActive())
+	require.NoError(t, db.Close())
+	db, err := Open(opts)
+	require.NoError(t, err)
+	require.Equal(t, 6, count("key"))
+
+	// Merge drops the dead versions
+	require.NoError(t, db.Merge())
+	require.Equal(t, 0, count("key"))
+	require.Equal(t, 1, count("other"))
+
+	_, err = db.VersionCount(nil)
+	require.Equal(t, ErrEmptyKey, err)
+}
+
+func TestDB_Counters(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		require.Equal(t, Counters{}, db.Counters())
+
+		require.NoError(t, db.Put([]byte("a"), []byte("12345")))
+		require.NoError(t, db.PutSequenced([]byte("b"), []byte("123")))
+		require.NoError(t, db.ReplacePrefix([]byte("c"), map[string][]byte{"c1": []byte("1")}))
+		_, err := db.Get([]byte("a"))
+		require.NoError(t, err)
+		_, _, err = db.GetWithMeta([]byte("b"))
+		require.NoError(t, err)
+		v, err := db.GetShared([]byte("c1"))
+		require.NoError(t, err)
+		db.ReleaseShared(v)
+		_, err = db.Get([]byte("missing"))
+		require.Equal(t, ErrKeyNotFound, err)
+		require.NoError(t, db.Delete([]byte("a")))
+		require.NoError(t, db.Delete([]byte("missing")))
+		require.NoError(t, db.Merge())
+
+		c := db.Counters()
+		require.Equal(t, uint64(3), c.Puts)
+		require.Equal(t, uint64(4), c.Gets)
+		require.Equal(t, uint64(1), c.Deletes)
+		require.Equal(t, uint64(1), c.Merges)
+		require.Equal(t, uint64(5+3+1), c.BytesRead)
+		require.Equal(t, uint64(db.dbFile.writableOffset()), c.BytesWritten)
+
+		db.ResetCounters()
+		require.Equal(t, Counters{}, db.Counters())
+
+		// Resetting while writing loses no later operation
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					assert.NoError(t, db.Put([]byte(fmt.Sprintf("%d-%d", w, i)), nil))
+				}
+			}(w)
+		}
+		for i := 0; i < 10; i++ {
+			db.ResetCounters()
+		}
+		wg.Wait()
+		db.ResetCounters()
+		require.NoError(t, db.Put([]byte("z"), nil))
+		require.Equal(t, uint64(1), db.Counters().Puts)
+	})
+}
+
+func TestDB_ScanWithDelimiter(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		for _, key := range []string{"a/b/c", "a/b/d", "a/b/e/f", "a/c", "a/d/", "a/b", "ab", "b/c"} {
+			require.NoError(t, db.Put([]byte(key), []byte(key)))
+		}
+		scan := func(prefix, delim string) []string {
+			var got []string
+			require.NoError(t, db.ScanWithDelimiter([]byte(prefix), []byte(delim), func(key []byte, isPrefix bool) error {
+				if isPrefix {
+					key = append(key, '*')
+				}
+				got = append(got, string(key))
+				return nil
+			}))
+			return got
+		}
+
+		require.Equal(t, []string{"a/*", "ab", "b/*"}, scan("", "/"))
+		require.Equal(t, []string{"a/b", "a/b/*", "a/c", "a/d/*"}, scan("a/", "/"))
+		require.Equal(t, []string{"a/b/c", "a/b/d", "a/b/e/*"}, scan("a/b/", "/"))
+		require.Equal(t, []string{"a/b/c", "a/b/d", "a/b/e/f"}, scan("a/b/", ""))
+
+		// A multi-byte delimiter is matched as a whole
+		require.NoError(t, db.Put([]byte("a/b/e//g"), nil))
+		require.NoError(t, db.Put([]byte("a/b//h"), nil))
+		require.Equal(t, []string{"a/b", "a/b//*", "a/b/c", "a/b/d", "a/b/e//*", "a/b/e/f", "a/c", "a/d/"}, scan("a/", "//"))
+		require.Empty(t, scan("c", "/"))
+
+		stop := errors.New("stop")
+		require.Equal(t, stop, db.ScanWithDelimiter(nil, []byte("/"), func([]byte, bool) error { return stop }))
+	})
+}
+
+func TestDB_Scan(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		for _, key := range []string{"user:1", "user:2", "user:3", "users", "order:1", "a:user:4"} {
+			require.NoError(t, db.Put([]byte(key), []byte("v"+key)))
+		}
+		require.NoError(t, db.Delete([]byte("user:3")))
+		require.NoError(t, db.Put([]byte("user:2"), []byte("v2")))
+
+		got := make(map[string]string)
+		require.NoError(t, db.Scan([]byte("user:"), func(key, value []byte) error {
+			got[string(key)] = string(value)
+			return nil
+		}))
+		require.Equal(t, map[string]string{"user:1": "vuser:1", "user:2": "v2"}, got)
+
+		n := 0
+		require.NoError(t, db.Scan(nil, func(key, value []byte) error {
+			n++
+			return nil
+		}))
+		require.Equal(t, 5, n)
+
+		stop := errors.New("stop")
+		n = 0
+		require.Equal(t, stop, db.Scan([]byte("user:"), func(key, value []byte) error {
+			n++
+			return stop
+		}))
+		require.Equal(t, 1, n)
+	})
+}
+
+func TestDB_Fold(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		want := 0
+		for i := 0; i < 1000; i++ {
+			require.NoError(t, db.Put([]byte(strconv.Itoa(i)), []byte(strconv.Itoa(i*2))))
+			want += i * 2
+		}
+		require.NoError(t, db.Delete([]byte("999")))
+		want -= 999 * 2
+
+		// fn may write, the pairs stay as of when Fold started
+		sum, n := 0, 0
+		require.NoError(t, db.Fold(func(key, value []byte) error {
+			v, err := strconv.Atoi(string(value))
+			require.NoError(t, err)
+			sum += v
+			n++
+			return db.Put(key, []byte("0"))
+		}))
+		require.Equal(t, 999, n)
+		require.Equal(t, want, sum)
+		val, err := db.Get([]byte("1"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("0"), val)
+
+		stop := errors.New("stop")
+		n = 0
+		require.Equal(t, stop, db.Fold(func(key, value []byte) error {
+			n++
+			return stop
+		}))
+		require.Equal(t, 1, n)
+		for _, lf := range db.dbFile.files {
+			require.Zero(t, atomic.LoadInt32(&lf.refs))
+		}
+	})
+}
+
+func TestDB_MaxEntriesPerFile(t *testing.T) {
+	db, opts := openTestDB(t, func(opts *Options) {
+		opts.MaxEntriesPerFile = 10
+	})
+
+	// Tombstones count as entries
+	for i := 0; i < 25; i++ {
+		require.NoError(t, db.Put([]byte(strconv.Itoa(i)), []byte("val")))
+	}
+	require.NoError(t, db.Delete([]byte("0")))
+	require.NoError(t, db.Delete([]byte("1")))
+	require.Equal(t, 3, len(db.dbFile.files))
+	entries := func(lf *logFile) int {
+		var n int
+		require.NoError(t, db.IterateRange(lf.fid, 0, lf.size, func(uint64, *Entry) error {
+			n++
+			return nil
+		}))
+		return n
+	}
+	require.Equal(t, 10, entries(db.dbFile.files[0]))
+	require.Equal(t, 10, entries(db.dbFile.files[1]))
+	require.Equal(t, uint32(7), db.dbFile.activeEntries)
+	require.NoError(t, db.Close())
+
+	// The count of the active file survives a reopen
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, uint32(7), db.dbFile.activeEntries)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, db.Put([]byte("more"), []byte("val")))
+	}
+	require.Equal(t, 4, len(db.dbFile.files))
+	require.Equal(t, uint32(0), db.dbFile.activeEntries)
+
+	// Size still rolls files over before the count is reached
+	require.NoError(t, db.Put([]byte("big"), make([]byte, opts.LogFileSize)))
+	require.Equal(t, 5, len(db.dbFile.files))
+}
+
+func TestDB_SnapshotGet(t *testing.T) {
+	db, _ := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+	})
+
+	keys := [][]byte{[]byte("k1"), []byte("k2"), []byte("k3")}
+	vals, err := db.SnapshotGet(keys)
+	require.NoError(t, err)
+	require.Empty(t, vals)
+
+	// The writer replaces all keys at once, and fills files to keep merges busy
+	pad := make([]byte, 32<<10)
+	write := func(i int) {
+		v := append([]byte(strconv.Itoa(i)), pad...)
+		require.NoError(t, db.ReplacePrefix([]byte("k"), map[string][]byte{"k1": v, "k2": v, "k3": v}))
+	}
+	write(0)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 1; i < 300; i++ {
+			write(i)
+		}
+		close(done)
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			assert.NoError(t, db.Merge())
+		}
+	}()
+
+	// Every snapshot sees all the keys from the same write
+	for {
+		vals, err := db.SnapshotGet(keys)
+		require.NoError(t, err)
+		require.Equal(t, 3, len(vals))
+		require.Equal(t, vals["k1"], vals["k2"])
+		require.Equal(t, vals["k1"], vals["k3"])
+		select {
+		case <-done:
+			wg.Wait()
+			for _, lf := range db.dbFile.files {
+				require.False(t, lf.pinned())
+			}
+			vals, err = db.SnapshotGet([][]byte{[]byte("k1"), []byte("missing")})
+			require.NoError(t, err)
+			require.Equal(t, map[string][]byte{"k1": append([]byte("299"), pad...)}, vals)
+			_, err = db.SnapshotGet([][]byte{[]byte("k1"), nil})
+			require.Equal(t, ErrEmptyKey, err)
+			return
+		default:
+		}
+	}
+}
+
+func TestDB_LastError(t *testing.T) {
+	db, _ := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+	})
+
+	val := make([]byte, 512<<10)
+	for i := 0; i < 4; i++ {
+		require.NoError(t, db.Put([]byte("key"), val))
+	}
+	require.NoError(t, db.LastError())
+
+	// A directory in place of the temp file of file 0 makes the merge fail
+	tempPath := db.dbFile.files[0].path + tempFileNameSuffix
+	require.NoError(t, os.Mkdir(tempPath, 0755))
+	mergeErr := db.Merge()
+	require.Error(t, mergeErr)
+	require.Equal(t, mergeErr, db.LastError())
+
+	// Other operations leave it, a successful merge clears it
+	require.NoError(t, db.Put([]byte("key"), val))
+	require.Equal(t, mergeErr, db.LastError())
+	require.NoError(t, os.Remove(tempPath))
+	require.NoError(t, db.Merge())
+	require.NoError(t, db.LastError())
+
+	// ResetCounters clears it as well
+	require.NoError(t, os.Mkdir(db.dbFile.files[0].path+tempFileNameSuffix, 0755))
+	require.NoError(t, db.Put([]byte("key"), val))
+	require.NoError(t, db.Put([]byte("key"), val))
+	require.Error(t, db.Merge())
+	require.Error(t, db.LastError())
+	db.ResetCounters()
+	require.NoError(t, db.LastError())
+}
+
+func TestDB_CompactWhere(t *testing.T) {
+	db, opts := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+	})
+	defer func() { db.Close() }()
+
+	// Every key gets 4 versions spread over several files, and one key of each kind is deleted
+	val := make([]byte, 64<<10)
+	for i := 0; i < 4; i++ {
+		for _, prefix := range []string{"hot/", "cold/"} {
+			for j := 0; j < 5; j++ {
+				require.NoError(t, db.Put([]byte(fmt.Sprintf("%s%d", prefix, j)), append(val, byte(i))))
+			}
+		}
+	}
+	require.NoError(t, db.Delete([]byte("hot/0")))
+	require.NoError(t, db.Delete([]byte("cold/0")))
+	require.NoError(t, db.SealActive())
+	require.True(t, len(db.dbFile.files) > 2)
+
+	diskSize := func() int64 {
+		var n int64
+		for _, lf := range db.dbFile.files {
+			n += int64(lf.size)
+		}
+		return n
+	}
+	versions := func(key string) int {
+		n, err := db.VersionCount([]byte(key))
+		require.NoError(t, err)
+		return n
+	}
+	before := diskSize()
+	require.NoError(t, db.CompactWhere(func(key []byte) bool {
+		return bytes.HasPrefix(key, []byte("hot/"))
+	}))
+
+	// Only the dead versions of the hot keys are gone
+	entrySize := int64(NewEntry([]byte("hot/1"), append(val, 0), Normal).Size())
+	reclaimed := before - diskSize()
+	require.True(t, reclaimed >= 16*entrySize, "reclaimed %d", reclaimed)
+	require.True(t, reclaimed < 17*entrySize, "reclaimed %d", reclaimed)
+	require.Equal(t, 0, versions("hot/0"))
+	require.Equal(t, 1, versions("hot/1"))
+	require.Equal(t, 5, versions("cold/0"))
+	require.Equal(t, 4, versions("cold/1"))
+
+	check := func() {
+		for _, prefix := range []string{"hot/", "cold/"} {
+			_, err := db.Get([]byte(prefix + "0"))
+			require.Equal(t, ErrKeyNotFound, err)
+			for j := 1; j < 5; j++ {
+				v, err := db.Get([]byte(fmt.Sprintf("%s%d", prefix, j)))
+				require.NoError(t, err)
+				require.Equal(t, append(val, 3), v)
+			}
+		}
+	}
+	check()
+	require.NoError(t, db.Close())
+	db, err := Open(opts)
+	require.NoError(t, err)
+	check()
+
+	// A full merge reclaims the rest
+	require.NoError(t, db.Merge())
+	require.Equal(t, 0, versions("cold/0"))
+	require.Equal(t, 1, versions("cold/1"))
+	check()
+
+	// Tombstones referring to entries rule it out
+	require.NoError(t, db.Close())
+	opts.CompactTombstones = true
+	db, err = Open(opts)
+	require.NoError(t, err)
+	require.Error(t, db.CompactWhere(func([]byte) bool { return true }))
+}
+
+func TestDB_CloseDuringGet(t *testing.T) {
+	db, _ := openTestDB(t, nil)
+	key := []byte("key")
+	require.NoError(t, db.Put(key, []byte("val")))
+
+	// Gets racing with Close must not panic, whatever they return
+	var wg sync.WaitGroup
+	started := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i == 0 {
+				close(started)
+			}
+			for !db.isClosed() {
+				db.Get(key)
+				db.Exists(key)
+			}
+		}(i)
+	}
+	<-started
+	require.NoError(t, db.Close())
+	wg.Wait()
+}
+
+func TestDB_CloseDuringSnapshotGet(t *testing.T) {
+	db, _ := openTestDB(t, func(opts *Options) {
+		opts.UseMmap = true
+	})
+	key, val := []byte("key"), []byte("val")
+	require.NoError(t, db.Put(key, val))
+	// Seal the file so that it is mapped, reading an unmapped file would crash
+	require.NoError(t, db.SealActive())
+	snap, err := db.NewSnapshot()
+	require.NoError(t, err)
+	defer snap.Close()
+
+	// Snapshot reads racing with Close either read the value or see it closed
+	var wg sync.WaitGroup
+	started := make(chan struct{})
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i == 0 {
+				close(started)
+			}
+			for {
+				v, err := snap.Get(key)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(val, v) {
+					errs <- fmt.Errorf("got %q", v)
+					return
+				}
+			}
+		}(i)
+	}
+	<-started
+	require.NoError(t, db.Close())
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.Equal(t, ErrDatabaseClosed, err)
+	}
+}
+
+// blockingWriter signals started on its first write, then waits for release.
+type blockingWriter struct {
+	buf     bytes.Buffer
+	started chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	if w.started != nil {
+		close(w.started)
+		w.started = nil
+		<-w.release
+	}
+	return w.buf.Write(p)
+}
+
+func TestDB_CloseWaitsForReads(t *testing.T) {
+	db, _ := openTestDB(t, func(opts *Options) {
+		opts.UseMmap = true
+	})
+	key, val := []byte("key"), bytes.Repeat([]byte("v"), 1<<10)
+	require.NoError(t, db.Put(key, val))
+	require.NoError(t, db.SealActive())
+
+	// Close waits for a copy of WriteValueTo in progress
+	w := &blockingWriter{started: make(chan struct{}), release: make(chan struct{})}
+	started := w.started
+	copied := make(chan error, 1)
+	go func() {
+		_, err := db.WriteValueTo(key, w)
+		copied <- err
+	}()
+	<-started
+	closed := make(chan error, 1)
+	go func() { closed <- db.Close() }()
+	require.Eventually(t, db.isClosed, 5*time.Second, time.Millisecond)
+	select {
+	case <-closed:
+		t.Fatal("Close returned during WriteValueTo")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(w.release)
+	require.NoError(t, <-copied)
+	require.NoError(t, <-closed)
+	require.Equal(t, val, w.buf.Bytes())
+
+	// The reads starting once it is closed fail
+	_, err := db.WriteValueTo(key, w)
+	require.Equal(t, ErrDatabaseClosed, err)
+	_, err = db.SnapshotGet([][]byte{key})
+	require.Equal(t, ErrDatabaseClosed, err)
+	require.Equal(t, ErrDatabaseClosed, db.Fold(func(key, value []byte) error { return nil }))
+}
+
+func TestDB_Closed(t *testing.T) {
+	db, opts := openTestDB(t, nil)
+	key := []byte("key")
+	require.NoError(t, db.Put(key, []byte("val")))
+	snap, err := db.NewSnapshot()
+	require.NoError(t, err)
+	defer snap.Close()
+	require.NoError(t, db.Close())
+
+	// Every method touching files or keyDir fails cleanly
+	ctx := context.Background()
+	calls := []struct {
+		name string
+		call func() error
+	}{
+		{"Put", func() error { return db.Put(key, nil) }},
+		{"PutContext", func() error { return db.PutContext(ctx, key, nil) }},
+		{"PutWithTTL", func() error { return db.PutWithTTL(key, nil, time.Hour) }},
+		{"PutSequenced", func() error { return db.PutSequenced(key, nil) }},
+		{"PutAsync", func() (err error) {
+			db.PutAsync(key, nil, func(e error) { err = e })
+			return
+		}},
+		{"Delete", func() error { return db.Delete(key) }},
+		{"ReplacePrefix", func() error { return db.ReplacePrefix(key, nil) }},
+		{"Txn.Commit", func() error { return db.NewTxn().Commit() }},
+		{"Get", func() error { _, err := db.Get(key); return err }},
+		{"GetContext", func() error { _, err := db.GetContext(ctx, key); return err }},
+		{"WaitGet", func() error { _, err := db.WaitGet(ctx, key); return err }},
+		{"GetShared", func() error { _, err := db.GetShared(key); return err }},
+		{"GetWithMeta", func() error { _, _, err := db.GetWithMeta(key); return err }},
+		{"GetFresh", func() error { _, err := db.GetFresh(key, time.Hour); return err }},
+		{"GetOldest", func() error { _, err := db.GetOldest(key); return err }},
+		{"Txn.Get", func() error { _, err := db.NewTxn().Get(key); return err }},
+		{"Exists", func() error { _, err := db.Exists(key); return err }},
+		{"WriteValueTo", func() error { _, err := db.WriteValueTo(key, io.Discard); return err }},
+		{"SnapshotGet", func() error { _, err := db.SnapshotGet([][]byte{key}); return err }},
+		{"FileOf", func() error { _, err := db.FileOf(key); return err }},
+		{"VersionCount", func() error { _, err := db.VersionCount(key); return err }},
+		{"AverageEntrySize", func() error { _, _, err := db.AverageEntrySize(); return err }},
+		{"Keys", func() error { _, err := db.Keys(); return err }},
+		{"ListKeys", func() error { _, _, err := db.ListKeys(nil, 1); return err }},
+		{"Scan", func() error { return db.Scan(nil, func([]byte, []byte) error { return nil }) }},
+		{"ScanWithDelimiter", func() error {
+			return db.ScanWithDelimiter(nil, nil, func([]byte, bool) error { return nil })
+		}},
+		{"Fold", func() error { return db.Fold(func([]byte, []byte) error { return nil }) }},
+		{"KeysBySize", func() error { return db.KeysBySize(0, func([]byte, uint64) error { return nil }) }},
+		{"RawIterateReverse", func() error {
+			return db.RawIterateReverse(func(uint32, uint64, *Entry) error { return nil })
+		}},
+		{"IterateRange", func() error { return db.IterateRange(0, 0, 0, func(uint64, *Entry) error { return nil }) }},
+		{"FileTimeRange", func() error { _, _, err := db.FileTimeRange(0); return err }},
+		{"Digest", func() error { _, err := db.Digest(); return err }},
+		{"DumpIndex", func() error { return db.DumpIndex(io.Discard) }},
+		{"ReadRaw", func() error { _, _, err := db.ReadRaw(0, 0); return err }},
+		{"AppendRaw", func() error { _, _, err := db.AppendRaw(nil); return err }},
+		{"Demote", func() error { return db.Demote(key) }},
+		{"Sync", func() error { return db.Sync() }},
+		{"Merge", func() error { return db.Merge() }},
+		{"MergeWait", func() error { return db.MergeWait(ctx) }},
+		{"CompactWhere", func() error { return db.CompactWhere(func([]byte) bool { return true }) }},
+		{"MergeDryRun", func() error { _, err := db.MergeDryRun(); return err }},
+		{"DropFilesOlderThan", func() error { _, err := db.DropFilesOlderThan(time.Now()); return err }},
+		{"Defragment", func() error { return db.Defragment() }},
+		{"SealActive", func() error { return db.SealActive() }},
+		{"Verify", func() error { return db.Verify(1) }},
+		{"Backup", func() error { return db.Backup(io.Discard) }},
+		{"Restore", func() error { return db.Restore(bytes.NewReader(nil)) }},
+		{"PhysicalBackup", func() error { return db.PhysicalBackup(filepath.Join(opts.Dir, "backup")) }},
+		{"NewSnapshot", func() error { _, err := db.NewSnapshot(); return err }},
+		{"Snapshot.Get", func() error { _, err := snap.Get(key); return err }},
+	}
+	for _, c := range calls {
+		assert.Equal(t, ErrDatabaseClosed, c.call(), c.name)
+	}
+
+	// Those without an error neither panic
+	require.Zero(t, db.Len())
+	require.Equal(t, Stats{}, db.Stats())
+	db.Counters()
+	require.NoError(t, db.LastError())
+	db.CompactIndex()
+	db.ResetCounters()
+	db.ActiveFileUsage()
+	require.NoError(t, db.Close())
+}
+
+func TestDB_PutDuringClose(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		db, _ := openTestDB(t, nil)
+		// Writers which passed the closed check before Close may get the lock after it
+		// closed the files, and must fail the same way as those which did not
+		var wg sync.WaitGroup
+		errs := make(chan error, 8)
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for j := 0; ; j++ {
+					if err := db.Put([]byte(fmt.Sprintf("key%d-%d", w, j)), []byte("val")); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}(w)
+		}
+		time.Sleep(time.Millisecond)
+		require.NoError(t, db.Close())
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			require.Equal(t, ErrDatabaseClosed, err)
+		}
+	}
+}
+
+func TestDB_ReadBufferPool(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		// Values around the pooled buffer size, larger ones get a buffer of their own
+		sizes := []int{0, 1, 100, db.opt.ReadBufferSize - 10, db.opt.ReadBufferSize, db.opt.ReadBufferSize + 1, 3 * db.opt.ReadBufferSize}
+		for i, n := range sizes {
+			require.NoError(t, db.Put([]byte(strconv.Itoa(i)), bytes.Repeat([]byte{byte(i + 1)}, n)))
+		}
+
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for j := 0; j < 200; j++ {
+					i := (w + j) % len(sizes)
+					v, err := db.Get([]byte(strconv.Itoa(i)))
+					assert.NoError(t, err)
+					assert.Equal(t, bytes.Repeat([]byte{byte(i + 1)}, sizes[i]), v)
+				}
+			}(w)
+		}
+		wg.Wait()
+	})
+}
+
+func BenchmarkDB_Get(b *testing.B) {
+	for _, size := range []int{0, 64 << 10} {
+		b.Run(fmt.Sprintf("ReadBufferSize=%d", size), func(b *testing.B) {
+			dir, err := os.MkdirTemp("", "minidb")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+
+			opts := getTestOptions(dir)
+			opts.ReadBufferSize = size
+			db, err := Open(opts)
+			require.NoError(b, err)
+			defer db.Close()
+			key := []byte("key")
+			require.NoError(b, db.Put(key, make([]byte, 4<<10)))
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := db.Get(key)
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+func TestDB_CacheSize(t *testing.T) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.LogFileSize = 1 << 20
+	opts.CacheSize = 100
+	runTest(t, &opts, func(t *testing.T, db *DB) {
+		get := func(key string) []byte {
+			v, err := db.Get([]byte(key))
+			require.NoError(t, err)
+			return v
+		}
+		require.NoError(t, db.Put([]byte("a"), []byte("v1")))
+		require.Equal(t, []byte("v1"), get("a"))
+		require.Equal(t, 3, db.cache.size)
+
+		// The values returned are copies of the cached ones
+		get("a")[0] = 'x'
+		require.Equal(t, []byte("v1"), get("a"))
+
+		// Writes of every kind are seen, never the stale value
+		require.NoError(t, db.Put([]byte("a"), []byte("v2")))
+		require.Equal(t, []byte("v2"), get("a"))
+		require.NoError(t, db.PutSequenced([]byte("a"), []byte("v3")))
+		require.Equal(t, []byte("v3"), get("a"))
+		require.NoError(t, db.ReplacePrefix([]byte("a"), map[string][]byte{"a": []byte("v4")}))
+		require.Equal(t, []byte("v4"), get("a"))
+		require.NoError(t, db.Delete([]byte("a")))
+		_, err := db.Get([]byte("a"))
+		require.Equal(t, ErrKeyNotFound, err)
+
+		// The least recently read values are evicted past CacheSize
+		for i := 0; i < 10; i++ {
+			require.NoError(t, db.Put([]byte(strconv.Itoa(i)), make([]byte, 19)))
+			get(strconv.Itoa(i))
+		}
+		require.Equal(t, 100, db.cache.size)
+		require.Nil(t, db.cache.get([]byte("4"), nil))
+		lo, _ := db.keyDir.get([]byte("5"))
+		require.NotNil(t, db.cache.get([]byte("5"), lo))
+		require.NoError(t, db.Put([]byte("big"), make([]byte, 100)))
+		get("big")
+		require.Equal(t, 100, db.cache.size)
+
+		// Merge moves the entries, which clears the cache
+		require.NoError(t, db.Put([]byte("filler"), make([]byte, opts.LogFileSize)))
+		require.NoError(t, db.Merge())
+		require.Zero(t, db.cache.size)
+		require.Equal(t, make([]byte, 19), get("9"))
+	})
+}
+
+func BenchmarkDB_CacheSize(b *testing.B) {
+	for _, size := range []int{0, 1 << 20} {
+		b.Run(fmt.Sprintf("CacheSize=%d", size), func(b *testing.B) {
+			dir, err := os.MkdirTemp("", "minidb")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+
+			opts := getTestOptions(dir)
+			opts.CacheSize = size
+			db, err := Open(opts)
+			require.NoError(b, err)
+			defer db.Close()
+			for i := 0; i < 100; i++ {
+				require.NoError(b, db.Put([]byte(strconv.Itoa(i)), make([]byte, 4<<10)))
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := db.Get([]byte(strconv.Itoa(i % 100)))
+				require.NoError(b, err)
+			}
+		})
+	}
+}
+
+func TestDB_UseMmap(t *testing.T) {
+	vals := make(map[string][]byte)
+	for i := 0; i < 300; i++ {
+		vals[strconv.Itoa(i)] = bytes.Repeat([]byte{byte(i)}, 10<<10)
+	}
+	for _, useMmap := range []bool{false, true} {
+		dir, err := os.MkdirTemp("", "minidb")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		opts := getTestOptions(dir)
+		opts.LogFileSize = 1 << 20
+		opts.UseMmap = useMmap
+		db, err := Open(opts)
+		require.NoError(t, err)
+
+		check := func(db *DB) {
+			for key, val := range vals {
+				v, err := db.Get([]byte(key))
+				require.NoError(t, err)
+				require.Equal(t, val, v)
+			}
+			files := db.dbFile.files
+			require.Greater(t, len(files), 1)
+			for _, lf := range files[:len(files)-1] {
+				require.Equal(t, useMmap, lf.mapped.Load() != nil)
+			}
+			require.Nil(t, files[len(files)-1].mapped.Load())
+		}
+		// Across rotations, a merge and reopening
+		for key, val := range vals {
+			require.NoError(t, db.Put([]byte(key), val))
+		}
+		check(db)
+		for i := 0; i < 100; i++ {
+			require.NoError(t, db.Put([]byte(strconv.Itoa(i)), vals[strconv.Itoa(i)]))
+		}
+		require.NoError(t, db.Merge())
+		check(db)
+		require.NoError(t, db.Close())
+		db, err = Open(opts)
+		require.NoError(t, err)
+		check(db)
+		require.NoError(t, db.Defragment())
+		require.NoError(t, db.Put([]byte("0"), vals["0"]))
+		require.NoError(t, db.SealActive())
+		check(db)
+		require.NoError(t, db.Close())
+	}
+}
+
+func TestDB_Compression(t *testing.T) {
+	vals := map[string][]byte{"empty": {}, "small": []byte("v"), "random": make([]byte, 4<<10)}
+	rand.New(rand.NewSource(1)).Read(vals["random"])
+	for i := 0; i < 200; i++ {
+		vals[strconv.Itoa(i)] = []byte(strings.Repeat(fmt.Sprintf(`{"id":%d,"name":"user","tags":["a","b"]},`, i), i%50+1))
+	}
+	// Values written by the reference implementations decode, a snappy block with a
+	// literal and a copy, and a frame of the zstd command line tool
+	refs := []struct {
+		c    Compression
+		enc  []byte
+		want string
+	}{
+		{SnappyCompression, []byte{0x05, 0x10, 'h', 'e', 'l', 'l', 'o'}, "hello"},
+		{SnappyCompression, []byte{0x09, 0x08, 'a', 'b', 'c', 0x09, 0x03}, "abcabcabc"},
+		{ZstdCompression, []byte{
+			0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x58, 0x65, 0x00, 0x00, 0x30, 0x68, 0x65,
+			0x6c, 0x6c, 0x6f, 0x20, 0x01, 0x00, 0x99, 0x4b, 0x11,
+		}, "hello hello hello hello"},
+	}
+	for _, ref := range refs {
+		got, err := decompress(ref.c, ref.enc)
+		require.NoError(t, err)
+		require.Equal(t, ref.want, string(got))
+	}
+
+	check := func(db *DB) {
+		for key, val := range vals {
+			v, err := db.Get([]byte(key))
+			require.NoError(t, err)
+			require.Equal(t, val, v)
+			v, err = db.GetShared([]byte(key))
+			require.NoError(t, err)
+			require.Equal(t, val, v)
+			db.ReleaseShared(v)
+			var buf bytes.Buffer
+			_, err = db.WriteValueTo([]byte(key), &buf)
+			require.NoError(t, err)
+			require.Equal(t, val, buf.Bytes())
+		}
+	}
+	sizes := make(map[Compression]int64)
+	dirs := make(map[Compression]string)
+	for _, c := range []Compression{NoCompression, SnappyCompression, ZstdCompression} {
+		dir, err := os.MkdirTemp("", "minidb")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		dirs[c] = dir
+		opts := getTestOptions(dir)
+		opts.Compression = c
+		db, err := Open(opts)
+		require.NoError(t, err)
+		for key, val := range vals {
+			require.NoError(t, db.Put([]byte(key), val))
+		}
+		check(db)
+		sizes[c] = db.Stats().TotalBytes
+
+		// Merge rewrites the compressed values, which are replayed on reopening
+		for key, val := range vals {
+			require.NoError(t, db.Put([]byte(key), val))
+		}
+		require.NoError(t, db.SealActive())
+		require.NoError(t, db.Merge())
+		check(db)
+		require.NoError(t, db.Close())
+		db, err = Open(opts)
+		require.NoError(t, err)
+		check(db)
+		require.NoError(t, db.Close())
+	}
+	require.Less(t, sizes[SnappyCompression], sizes[NoCompression]/2)
+	require.Less(t, sizes[ZstdCompression], sizes[SnappyCompression])
+
+	// Entries written with another compression are read alike
+	opts := getTestOptions(dirs[SnappyCompression])
+	opts.Compression = ZstdCompression
+	db, err := Open(opts)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Put([]byte(strconv.Itoa(i)), vals[strconv.Itoa(i)]))
+	}
+	check(db)
+	require.NoError(t, db.Close())
+	m, err := readManifest(opts.Dir)
+	require.NoError(t, err)
+	require.EqualValues(t, 1<<SnappyCompression|1<<ZstdCompression, m.compressions)
+	opts.Compression = NoCompression
+	db, err = Open(opts)
+	require.NoError(t, err)
+	check(db)
+	require.NoError(t, db.Close())
+
+	opts.Compression = ZstdCompression + 1
+	_, err = Open(opts)
+	require.Equal(t, ErrInvalidCompression, err)
+}
+
+func FuzzCompression(f *testing.F) {
+	f.Add([]byte(""))
+	f.Add([]byte("hello hello hello hello"))
+	f.Add([]byte(strings.Repeat(`{"id":1,"name":"user"},`, 20)))
+	f.Fuzz(func(t *testing.T, val []byte) {
+		for c := NoCompression; c <= maxCompression; c++ {
+			enc, err := compress(c, val)
+			require.NoError(t, err)
+			got, err := decompress(c, enc)
+			require.NoError(t, err)
+			require.Equal(t, len(val), len(got))
+			require.True(t, bytes.Equal(val, got))
+			// Corrupt input fails rather than panicking
+			decompress(c, val)
+		}
+	})
+}
+
+func TestDB_HeterogeneousFileSizes(t *testing.T) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Fill files with two different LogFileSize settings
+	opts := getTestOptions(dir)
+	val := make([]byte, 100<<10)
+	var n int
+	for _, size := range []int64{1 << 20, 3 << 20, 1 << 20} {
+		opts.LogFileSize = size
+		db, err := Open(opts)
+		require.NoError(t, err)
+		for i := 0; i < 25; i++ {
+			require.NoError(t, db.Put([]byte(strconv.Itoa(n)), val))
+			n++
+		}
+		require.NoError(t, db.Close())
+	}
+
+	// Replay the log files themselves rather than their hint files
+	hints, err := filepath.Glob(filepath.Join(dir, "*"+indexFileNameSuffix))
+	require.NoError(t, err)
+	for _, hint := range hints {
+		require.NoError(t, os.Remove(hint))
+	}
+
+	db, err := Open(opts)
+	require.NoError(t, err)
+	sizes := make(map[uint64]bool)
+	for _, lf := range db.dbFile.files[:len(db.dbFile.files)-1] {
+		sizes[lf.size] = true
+	}
+	require.True(t, len(sizes) > 1, "files should have different sizes")
+	for i := 0; i < n; i++ {
+		got, err := db.Get([]byte(strconv.Itoa(i)))
+		require.NoError(t, err)
+		require.Equal(t, val, got)
+	}
+
+	// A value length corrupted past the end of a sealed file fails the read before a
+	// buffer is allocated for it
+	lo, ok := db.keyDir.get([]byte("0"))
+	require.True(t, ok)
+	require.NotEqual(t, db.dbFile.maxFid(), lo.fid)
+	f, err := os.OpenFile(logFilePath(dir, lo.fid), os.O_RDWR, 0666)
+	require.NoError(t, err)
+	vLen := make([]byte, 4)
+	_, err = f.ReadAt(vLen, int64(lo.offset+5))
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0x40, 0, 0, 0}, int64(lo.offset+5))
+	require.NoError(t, err)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = db.Get([]byte("0"))
+	runtime.ReadMemStats(&after)
+	require.Equal(t, io.ErrUnexpectedEOF, errors.Cause(err))
+	require.Less(t, after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+	_, err = f.WriteAt(vLen, int64(lo.offset+5))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	lf := db.dbFile.files[1]
+	path, size := lf.path, lf.size
+	require.NoError(t, db.Close())
+
+	// A sealed file cut in its last entry is reported instead of losing the entry silently
+	require.NoError(t, os.Truncate(path, int64(size)-10))
+	var replayErr error
+	opts.OnReplayError = func(_ uint32, _ uint64, err error) ReplayAction {
+		replayErr = err
+		return StopFile
+	}
+	db, err = Open(opts)
+	require.NoError(t, err)
+	require.Error(t, replayErr)
+	require.Contains(t, replayErr.Error(), "cut short")
+	var missing int
+	for i := 0; i < n; i++ {
+		if _, err := db.Get([]byte(strconv.Itoa(i))); err == ErrKeyNotFound {
+			missing++
+		}
+	}
+	require.Equal(t, 1, missing)
+	require.NoError(t, db.Close())
+
+	opts.OnReplayError = nil
+	_, err = Open(opts)
+	require.Error(t, err)
+}
+
+func TestDB_NewOptions(t *testing.T) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// No options means the defaults
+	require.Equal(t, DefaultOptions(dir), New(dir))
+
+	// Options compose, and a later one wins
+	opts := New(dir,
+		WithLogFileSize(4<<20),
+		WithCodec(VarintCodec),
+		WithSyncDir(false),
+		WithLogFileSize(2<<20),
+	)
+	want := DefaultOptions(dir)
+	want.LogFileSize = 2 << 20
+	want.Codec = VarintCodec
+	want.NoSyncDir = true
+	require.Equal(t, want, opts)
+
+	// Open validates them like any other Options
+	badDir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(badDir)
+	_, err = Open(New(badDir, WithLogFileSize(1<<10)))
+	require.Equal(t, ErrLogFileSize, err)
+
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Put([]byte("key"), []byte("val")))
+	_, capacity := db.ActiveFileUsage()
+	require.Equal(t, int64(2<<20), capacity)
+}
+
+func TestDB_FileTimeRange(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = time.Now }()
+
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	runTest(t, &opts, func(t *testing.T, db *DB) {
+		// Entries written without timestamps have no range
+		require.NoError(t, db.Put([]byte("old"), []byte("val")))
+		_, _, err := db.FileTimeRange(0)
+		require.Equal(t, ErrNoTimestamps, err)
+	})
+
+	opts.EntryTimestamps = true
+	runTest(t, &opts, func(t *testing.T, db *DB) {
+		start := now
+		for i := 0; i < 5; i++ {
+			require.NoError(t, db.Put([]byte(strconv.Itoa(i)), []byte("val")))
+			now = now.Add(time.Minute)
+		}
+		require.NoError(t, db.Delete([]byte("0")))
+		fid := db.dbFile.activeLogFile().fid
+		oldest, newest, err := db.FileTimeRange(fid)
+		require.NoError(t, err)
+		require.True(t, start.Equal(oldest))
+		require.True(t, now.Equal(newest))
+
+		// Sealing the file keeps its range, and the new active file has its own
+		require.NoError(t, db.SealActive())
+		now = now.Add(time.Hour)
+		require.NoError(t, db.Put([]byte("new"), []byte("val")))
+		oldest, newest, err = db.FileTimeRange(fid)
+		require.NoError(t, err)
+		require.True(t, start.Equal(oldest))
+		require.True(t, now.Add(-time.Hour).Equal(newest))
+		oldest, newest, err = db.FileTimeRange(db.dbFile.activeLogFile().fid)
+		require.NoError(t, err)
+		require.True(t, now.Equal(oldest))
+		require.True(t, now.Equal(newest))
+
+		_, _, err = db.FileTimeRange(fid + 100)
+		require.Equal(t, ErrFileNotFound, errors.Cause(err))
+	})
+}
+
+func TestDB_DropFilesOlderThan(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	nowFunc = func() time.Time { return now }
+	defer func() { nowFunc = time.Now }()
+
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.EntryTimestamps = true
+	db, err := Open(opts)
+	require.NoError(t, err)
+
+	// Every file is written an hour after the previous one
+	write := func(fn func()) {
+		fn()
+		require.NoError(t, db.SealActive())
+		now = now.Add(time.Hour)
+	}
+	val := []byte("val")
+	write(func() {
+		require.NoError(t, db.Put([]byte("a"), val))
+		require.NoError(t, db.Put([]byte("b"), val))
+		require.NoError(t, db.Put([]byte("c"), val))
+	})
+	write(func() {
+		require.NoError(t, db.Put([]byte("a"), val))
+		require.NoError(t, db.Delete([]byte("c")))
+	})
+	cutoff := now
+	write(func() {
+		require.NoError(t, db.Put([]byte("b"), []byte("new")))
+		require.NoError(t, db.Put([]byte("d"), val))
+	})
+	require.NoError(t, db.Put([]byte("e"), val))
+	seq := db.dbFile.seq
+
+	// Only the files written before the cutoff are dropped
+	n, err := db.DropFilesOlderThan(cutoff)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	for fid := uint32(0); fid < 2; fid++ {
+		_, err = os.Stat(logFilePath(dir, fid))
+		require.True(t, os.IsNotExist(err))
+		_, err = os.Stat(indexFilePath(dir, fid))
+		require.True(t, os.IsNotExist(err))
+	}
+	check := func() {
+		for _, key := range []string{"a", "c"} {
+			_, err := db.Get([]byte(key))
+			require.Equal(t, ErrKeyNotFound, err, key)
+		}
+		got, err := db.Get([]byte("b"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("new"), got)
+		for _, key := range []string{"d", "e"} {
+			_, err := db.Get([]byte(key))
+			require.NoError(t, err, key)
+		}
+	}
+	check()
+	n, err = db.DropFilesOlderThan(cutoff)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	require.NoError(t, db.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() { db.Close() }()
+	check()
+	require.Equal(t, seq, db.dbFile.seq)
+
+	// A pinned file is kept until the snapshot is closed
+	snap, err := db.NewSnapshot()
+	require.NoError(t, err)
+	n, err = db.DropFilesOlderThan(now)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+	snap.Close()
+	n, err = db.DropFilesOlderThan(now)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	for _, key := range []string{"b", "d"} {
+		_, err := db.Get([]byte(key))
+		require.Equal(t, ErrKeyNotFound, err, key)
+	}
+	_, err = db.Get([]byte("e"))
+	require.NoError(t, err)
+}
+
+func TestDB_MergeDryRun(t *testing.T) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.LogFileSize = 1 << 20
+	runTest(t, &opts, func(t *testing.T, db *DB) {
+		plan, err := db.MergeDryRun()
+		require.NoError(t, err)
+		require.Empty(t, plan.Files)
+
+		val := make([]byte, 1<<10)
+		for i := 0; i < 3000; i++ {
+			require.NoError(t, db.Put([]byte(strconv.Itoa(i%1000)), val))
+		}
+		for i := 0; i < 100; i++ {
+			require.NoError(t, db.Delete([]byte(strconv.Itoa(i))))
+		}
+		require.NoError(t, db.SealActive())
+		sizes := func() map[uint32]int64 {
+			m := make(map[uint32]int64)
+			for _, lf := range db.dbFile.files {
+				m[lf.fid] = int64(lf.size)
+			}
+			return m
+		}
+		before := sizes()
+
+		plan, err = db.MergeDryRun()
+		require.NoError(t, err)
+		require.NotEmpty(t, plan.Files)
+		require.Equal(t, before, sizes(), "dry run must not modify files")
+		var live int
+		for _, fp := range plan.Files {
+			live += fp.LiveEntries
+			require.Equal(t, before[fp.Fid], fp.Size)
+		}
+		// Tombstones of the oldest files are dropped along with the keys they delete
+		require.Equal(t, 900, live)
+		require.True(t, plan.ReclaimableBytes > 0)
+
+		// The estimate matches what a merge actually reclaims
+		require.NoError(t, db.Merge())
+		after := sizes()
+		var reclaimed int64
+		for _, fp := range plan.Files {
+			require.Equal(t, fp.ReclaimableBytes, before[fp.Fid]-after[fp.Fid], "fid %d", fp.Fid)
+			reclaimed += before[fp.Fid] - after[fp.Fid]
+		}
+		require.Equal(t, plan.ReclaimableBytes, reclaimed)
+
+		// Nothing is left to reclaim after the merge
+		plan, err = db.MergeDryRun()
+		require.NoError(t, err)
+		require.Equal(t, int64(0), plan.ReclaimableBytes)
+		for _, fp := range plan.Files {
+			require.Equal(t, 0, fp.DeadEntries)
+		}
+	})
+}
+
+func TestDB_NilValues(t *testing.T) {
+	db, opts := openTestDB(t, nil)
+
+	// Without the option nil and empty values both read back as empty
+	require.NoError(t, db.Put([]byte("old"), nil))
+	got, err := db.Get([]byte("old"))
+	require.NoError(t, err)
+	require.NotNil(t, got)
+	require.Empty(t, got)
+	require.NoError(t, db.Close())
+
+	opts.NilValues = true
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer func() { db.Close() }()
+	require.Equal(t, flagNilValue, db.manifest.entryFlags&flagNilValue)
+	require.NoError(t, db.Put([]byte("nil"), nil))
+	require.NoError(t, db.Put([]byte("empty"), []byte{}))
+	require.NoError(t, db.Put([]byte("val"), []byte("val")))
+	done := make(chan error, 1)
+	db.PutAsync([]byte("async"), nil, func(err error) { done <- err })
+	require.NoError(t, <-done)
+
+	check := func() {
+		for _, key := range []string{"nil", "async"} {
+			got, err := db.Get([]byte(key))
+			require.NoError(t, err)
+			require.Nil(t, got, key)
+		}
+		got, err := db.Get([]byte("empty"))
+		require.NoError(t, err)
+		require.NotNil(t, got)
+		require.Empty(t, got)
+		got, err = db.Get([]byte("val"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("val"), got)
+		// Entries written before the option was set are not marked
+		got, err = db.Get([]byte("old"))
+		require.NoError(t, err)
+		require.NotNil(t, got)
+
+		got, err = db.GetShared([]byte("nil"))
+		require.NoError(t, err)
+		require.Nil(t, got)
+		got, _, err = db.GetWithMeta([]byte("nil"))
+		require.NoError(t, err)
+		require.Nil(t, got)
+	}
+	check()
+
+	// The mark survives a reopen, replayed from the log file or the hint file, and a merge
+	require.NoError(t, db.Close())
+	db, err = Open(opts)
+	require.NoError(t, err)
+	check()
+	require.NoError(t, db.SealActive())
+	require.NoError(t, db.Merge())
+	check()
+	require.NoError(t, db.Close())
+	db, err = Open(opts)
+	require.NoError(t, err)
+	check()
+}
+
+func TestDB_ImportFrom(t *testing.T) {
+	// The legacy format has a record per line, a key and a value separated by '='
+	parse := func(b []byte) ([]byte, []byte, int, error) {
+		end := bytes.IndexByte(b, '\n')
+		if end < 0 {
+			return nil, nil, 0, nil
+		}
+		sep := bytes.IndexByte(b[:end], '=')
+		if sep < 0 {
+			return nil, nil, 0, errors.New("missing '='")
+		}
+		return b[:sep], b[sep+1 : end], end + 1, nil
+	}
+	var stream bytes.Buffer
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&stream, "key%d=%s\n", i%4000, strings.Repeat(strconv.Itoa(i), 100))
+	}
+	legacy := stream.Bytes()
+
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	opts.LogFileSize = 1 << 20
+	// Read in small pieces, so that records are split across reads
+	db, err := ImportFrom(opts, iotest.HalfReader(bytes.NewReader(legacy)), parse)
+	require.NoError(t, err)
+	require.Equal(t, 4000, db.keyDir.len())
+	require.True(t, len(db.dbFile.files) > 1)
+	for i := 1000; i < 5000; i++ {
+		got, err := db.Get([]byte("key" + strconv.Itoa(i%4000)))
+		require.NoError(t, err)
+		require.Equal(t, strings.Repeat(strconv.Itoa(i), 100), string(got))
+	}
+
+	// Only a database without keys is imported into
+	err = db.importFrom(bytes.NewReader(legacy), parse)
+	require.Error(t, err)
+	require.NoError(t, db.Close())
+
+	for _, tc := range []struct {
+		stream string
+		err    string
+	}{
+		{"a=1\nb\nc=3\n", "offset 4"},
+		{"a=1\nb=2", "Truncated record at offset 4"},
+		{"a=1\n=2\n", "offset 4"},
+	} {
+		dir, err := os.MkdirTemp("", "minidb")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		_, err = ImportFrom(getTestOptions(dir), strings.NewReader(tc.stream), parse)
+		require.Error(t, err, tc.stream)
+		require.Contains(t, err.Error(), tc.err, tc.stream)
+
+		// The database is closed, keeping the records before the failure
+		db, err := Open(getTestOptions(dir))
+		require.NoError(t, err)
+		got, err := db.Get([]byte("a"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("1"), got)
+		require.NoError(t, db.Close())
+	}
+}
+
+func TestDB_MergeKeyDirLimit(t *testing.T) {
+	limit := mergeKeyDirLimit
+	mergeKeyDirLimit = 10
+	defer func() { mergeKeyDirLimit = limit }()
+
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	opts := getTestOptions(dir)
+	runTest(t, &opts, func(t *testing.T, db *DB) {
+		want := make(map[string]string)
+		for i := 0; i < 300; i++ {
+			key, val := strconv.Itoa(i%100), strconv.Itoa(i)
+			require.NoError(t, db.Put([]byte(key), []byte(val)))
+			want[key] = val
+		}
+		for i := 0; i < 100; i += 7 {
+			require.NoError(t, db.Delete([]byte(strconv.Itoa(i))))
+			delete(want, strconv.Itoa(i))
+		}
+		require.NoError(t, db.SealActive())
+		// Overwritten while sealed, which the merge must not undo
+		require.NoError(t, db.Put([]byte("1"), []byte("new")))
+		want["1"] = "new"
+
+		check := func() {
+			require.Equal(t, len(want), db.keyDir.len())
+			for key, val := range want {
+				got, err := db.Get([]byte(key))
+				require.NoError(t, err, key)
+				require.Equal(t, val, string(got), key)
+			}
+		}
+		fid := db.dbFile.files[0].fid
+		before := db.dbFile.files[0].size
+		require.NoError(t, db.Merge())
+		require.True(t, db.dbFile.files[0].size < before)
+		check()
+		for key := range want {
+			lo, _ := db.keyDir.get([]byte(key))
+			if key != "1" {
+				require.Equal(t, fid, lo.fid)
+			}
+		}
+
+		// Dead entries kept by CompactWhere do not shadow the live ones after them
+		for i := 0; i < 300; i++ {
+			key, val := strconv.Itoa(i%100), strconv.Itoa(-i)
+			require.NoError(t, db.Put([]byte(key), []byte(val)))
+			want[key] = val
+		}
+		require.NoError(t, db.SealActive())
+		require.NoError(t, db.CompactWhere(func(key []byte) bool { return false }))
+		check()
+	})
+}
+
+func BenchmarkDB_MergeLargeFile(b *testing.B) {
+	for _, limit := range []int{math.MaxInt, mergeKeyDirLimit} {
+		b.Run(fmt.Sprintf("mergeKeyDirLimit=%d", limit), func(b *testing.B) {
+			defer func(old int) { mergeKeyDirLimit = old }(mergeKeyDirLimit)
+			mergeKeyDirLimit = limit
+
+			dir, err := os.MkdirTemp("", "minidb")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+			opts := getTestOptions(dir)
+			opts.LogFileSize = 32 << 20
+			db, err := Open(opts)
+			require.NoError(b, err)
+			defer db.Close()
+
+			// Collect garbage eagerly, so that the peak reflects the memory held by the merge
+			defer debug.SetGCPercent(debug.SetGCPercent(5))
+			var peak uint64
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				// Fill a whole file with small live entries
+				for j := 0; db.dbFile.maxFid() == uint32(i); j++ {
+					require.NoError(b, db.Put([]byte(fmt.Sprintf("%d-%08d", i, j)), []byte("v")))
+				}
+				runtime.GC()
+				var ms runtime.MemStats
+				runtime.ReadMemStats(&ms)
+				base := ms.HeapInuse
+				// Sample the heap during the merge
+				done := make(chan struct{})
+				sampled := make(chan uint64)
+				go func() {
+					var max uint64
+					for {
+						var ms runtime.MemStats
+						runtime.ReadMemStats(&ms)
+						if ms.HeapInuse > base && ms.HeapInuse-base > max {
+							max = ms.HeapInuse - base
+						}
+						select {
+						case <-done:
+							sampled <- max
+							return
+						case <-time.After(time.Millisecond):
+						}
+					}
+				}()
+				b.StartTimer()
+				require.NoError(b, db.Merge())
+				b.StopTimer()
+				close(done)
+				if max := <-sampled; max > peak {
+					peak = max
+				}
+				b.StartTimer()
+			}
+			b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+		})
+	}
+}
+
+func TestDB_Options(t *testing.T) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := New(dir, WithLogFileSize(2<<20), WithCodec(VarintCodec))
+	opts.MaxEntriesPerFile = 100
+	db, err := Open(opts)
+	require.NoError(t, err)
+	got := db.Options()
+	require.Equal(t, Logger(defaultLogger{}), got.Logger)
+	opts.Logger = got.Logger
+	require.Equal(t, opts, got)
+
+	// The copy does not change the database
+	got.LogFileSize = 4 << 20
+	_, capacity := db.ActiveFileUsage()
+	require.Equal(t, int64(2<<20), capacity)
+	require.Equal(t, opts, db.Options())
+	require.NoError(t, db.Close())
+
+	// The codec of an existing database is the one it was created with
+	opts.Codec = FixedCodec
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, VarintCodec, db.Options().Codec)
+}
+
+func TestDB_ReadDuringMerge(t *testing.T) {
+	db, _ := openTestDB(t, func(opts *Options) {
+		opts.LogFileSize = 1 << 20
+	})
+
+	// Every key is overwritten many times, so merges rewrite the files the readers use
+	n := 64
+	val := func(i, round int) []byte {
+		v := make([]byte, 4<<10)
+		copy(v, fmt.Sprintf("%d-%d", i, round))
+		return v
+	}
+	for i := 0; i < n; i++ {
+		require.NoError(t, db.Put([]byte(strconv.Itoa(i)), val(i, 0)))
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for j := r; ; j++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				i := j % n
+				v, err := db.Get([]byte(strconv.Itoa(i)))
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.True(t, bytes.HasPrefix(v, []byte(strconv.Itoa(i)+"-")))
+			}
+		}(r)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := db.Merge(); err != ErrGcWorking {
+				assert.NoError(t, err)
+			}
+		}
+	}()
+	for round := 1; round <= 20; round++ {
+		for i := 0; i < n; i++ {
+			require.NoError(t, db.Put([]byte(strconv.Itoa(i)), val(i, round)))
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	// The replaced files are all closed once no read is using them
+	require.NoError(t, db.Merge())
+	require.Empty(t, db.epochs.readers)
+	require.Empty(t, db.epochs.retired)
+	for i := 0; i < n; i++ {
+		v, err := db.Get([]byte(strconv.Itoa(i)))
+		require.NoError(t, err)
+		require.Equal(t, val(i, 20), v)
+	}
+}
+
+func TestDB_EpochsDrain(t *testing.T) {
+	var ep epochs
+	early := ep.enter()
+	drained := make(chan struct{})
+	go func() {
+		ep.drain()
+		close(drained)
+	}()
+	// Wait for drain to start, which advances the epoch
+	for {
+		ep.mu.Lock()
+		current := ep.current
+		ep.mu.Unlock()
+		if current > early {
+			break
+		}
+		runtime.Gosched()
+	}
+
+	// A reader entering after drain started is not waited for
+	late := ep.enter()
+	select {
+	case <-drained:
+		t.Fatal("drain returned while an earlier reader is still in")
+	default:
+	}
+	ep.exit(early)
+	<-drained
+	ep.exit(late)
+}
+
+func BenchmarkDB_GetDuringMerge(b *testing.B) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	opts := getTestOptions(dir)
+	opts.LogFileSize = 1 << 20
+	db, err := Open(opts)
+	require.NoError(b, err)
+	defer db.Close()
+	val := make([]byte, 4<<10)
+	for i := 0; i < 2048; i++ {
+		require.NoError(b, db.Put([]byte(strconv.Itoa(i%256)), val))
+	}
+
+	// Merges run for as long as the benchmark, rewriting the files with new dead entries
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := db.Put([]byte(strconv.Itoa(i%256)), val); err != nil {
+				b.Error(err)
+				return
+			}
+			if i%256 == 0 {
+				if err := db.Merge(); err != nil && err != ErrGcWorking {
+					b.Error(err)
+					return
+				}
+			}
+		}
+	}()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := db.Get([]byte(strconv.Itoa(i % 256)))
+		require.NoError(b, err)
+	}
+	b.StopTimer()
+	close(stop)
+	<-done
+}
+
+func TestDB_DumpIndex(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		n := 100
+		for i := n - 1; i >= 0; i-- {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("val")))
+		}
+		require.NoError(t, db.Delete([]byte("key050")))
+
+		var buf bytes.Buffer
+		require.NoError(t, db.DumpIndex(&buf))
+		entries, err := LoadIndexDump(&buf)
+		require.NoError(t, err)
+		require.Equal(t, n-1, len(entries))
+		for i, ie := range entries {
+			if i > 0 {
+				require.Less(t, string(entries[i-1].Key), string(ie.Key))
+			}
+			lo, ok := db.keyDir.get(ie.Key)
+			require.True(t, ok)
+			require.Equal(t, lo.fid, ie.Fid)
+			require.Equal(t, lo.offset, ie.Offset)
+		}
+
+		// A truncated dump is rejected
+		buf.Reset()
+		require.NoError(t, db.DumpIndex(&buf))
+		_, err = LoadIndexDump(bytes.NewReader(buf.Bytes()[:buf.Len()-3]))
+		require.Equal(t, errInvalidIndexDump, errors.Cause(err))
+		_, err = LoadIndexDump(strings.NewReader("junk"))
+		require.Equal(t, errInvalidIndexDump, errors.Cause(err))
+
+		// A dump whose offsets take 4 bytes is still read
+		legacy := append([]byte(nil), legacyIndexDumpMagic[:]...)
+		legacy = binary.AppendUvarint(legacy, 3)
+		legacy = append(legacy, "key"...)
+		legacy = binary.BigEndian.AppendUint32(legacy, 2)
+		legacy = binary.BigEndian.AppendUint32(legacy, 100)
+		entries, err = LoadIndexDump(bytes.NewReader(legacy))
+		require.NoError(t, err)
+		require.Equal(t, []IndexEntry{{Key: []byte("key"), Fid: 2, Offset: 100}}, entries)
+		_, err = LoadIndexDump(bytes.NewReader(legacy[:len(legacy)-1]))
+		require.Equal(t, errInvalidIndexDump, errors.Cause(err))
+	})
+}
+
+func TestDB_MergeRateLimit(t *testing.T) {
+	// The clock only moves on when the rate limiter sleeps, so the time a merge takes
+	// is the time it is held back
+	var clock time.Time
+	nowFunc = func() time.Time { return clock }
+	sleepFunc = func(d time.Duration) { clock = clock.Add(d) }
+	defer func() {
+		nowFunc = time.Now
+		sleepFunc = time.Sleep
+	}()
+
+	mergeTime := func(rate int64) time.Duration {
+		dir, err := os.MkdirTemp("", "minidb")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		opts := getTestOptions(dir)
+		opts.LogFileSize = 1 << 20
+		opts.MergeRateLimit = rate
+		db, err := Open(opts)
+		require.NoError(t, err)
+		defer db.Close()
+
+		// The sealed file holds 1200KB, 900KB of which is live
+		val := make([]byte, 300<<10)
+		for _, key := range []string{"dead", "a", "b", "dead"} {
+			require.NoError(t, db.Put([]byte(key), val))
+		}
+		require.Equal(t, 2, len(db.dbFile.files))
+		start := clock
+		require.NoError(t, db.Merge())
+		return clock.Sub(start)
+	}
+
+	// Reading 1200KB and writing 900KB at 5MB/s takes 410ms, and a few headers more,
+	// less up to the burst left unpaid at the end
+	require.Zero(t, mergeTime(0))
+	took := mergeTime(5 << 20).Milliseconds()
+	require.GreaterOrEqual(t, took, int64(410-rateLimitBurst.Milliseconds()))
+	require.LessOrEqual(t, took, int64(411))
+}
+
+func TestDB_Sync(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		// A crash of the machine keeps a log file up to the offset it was last synced at
+		durable := make(map[string]uint64)
+		syncFileOrig := syncFile
+		syncFile = func(fd *os.File, mode SyncMode) error {
+			durable[fd.Name()] = db.dbFile.writableOffset()
+			return syncFileOrig(fd, mode)
+		}
+		defer func() { syncFile = syncFileOrig }()
+		survives := func(key []byte) bool {
+			lo, ok := db.keyDir.get(key)
+			require.True(t, ok)
+			end := lo.offset + uint64(entryHeaderSize+(defaultEntryFlags|flagChecksum).extSize()) + uint64(len(key)) + lo.vLen
+			return durable[db.dbFile.activeLogFile().path] >= end
+		}
+
+		// The write is read back at once, but is not on disk
+		key := []byte("key")
+		require.NoError(t, db.Put(key, []byte("val")))
+		val, err := db.Get(key)
+		require.NoError(t, err)
+		require.Equal(t, []byte("val"), val)
+		require.False(t, survives(key))
+
+		// Sync puts it on disk
+		require.NoError(t, db.Sync())
+		require.True(t, survives(key))
+		require.NoError(t, db.Put([]byte("key2"), []byte("val2")))
+		require.False(t, survives([]byte("key2")))
+		require.True(t, survives(key))
+	})
+}
+
+func TestDB_KeyPrefixDelimiter(t *testing.T) {
+	db, opts := openTestDB(t, func(opts *Options) {
+		opts.KeyPrefixDelimiter = ":"
+	})
+
+	keys := []string{"tenant:a:1", "tenant:a:2", "tenant:b:1", "flat", "tenant:", ":x"}
+	for _, key := range keys {
+		require.NoError(t, db.Put([]byte(key), []byte("v-"+key)))
+	}
+	require.NoError(t, db.Put([]byte("tenant:a:1"), []byte("new")))
+	require.Equal(t, 4, len(db.keyDir.prefixes.ids))
+	for _, key := range keys[1:] {
+		val, err := db.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, []byte("v-"+key), val)
+	}
+	val, err := db.Get([]byte("tenant:a:1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), val)
+	for _, key := range []string{"tenant:c:1", "tenant:a:", "tenant", "x"} {
+		_, err = db.Get([]byte(key))
+		require.Equal(t, ErrKeyNotFound, err)
+	}
+	listed, _, err := db.ListKeys(nil, 10)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte(":x"), []byte("flat"), []byte("tenant:"), []byte("tenant:a:1"), []byte("tenant:a:2"), []byte("tenant:b:1")}, listed)
+
+	// A prefix no longer used is dropped, and its id reused
+	require.NoError(t, db.Delete([]byte("tenant:b:1")))
+	require.Equal(t, 3, len(db.keyDir.prefixes.ids))
+	require.NoError(t, db.Put([]byte("tenant:c:1"), []byte("c")))
+	require.Equal(t, 4, len(db.keyDir.prefixes.names))
+	db.CompactIndex()
+	val, err = db.Get([]byte("tenant:c:1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("c"), val)
+	require.NoError(t, db.Close())
+
+	// The keys are interned again on replay
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	require.Equal(t, len(keys), db.keyDir.len())
+	val, err = db.Get([]byte("tenant:a:2"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v-tenant:a:2"), val)
+}
+
+func BenchmarkKeyDir_SharedPrefixes(b *testing.B) {
+	const n = 1000000
+	for _, delim := range []string{"", ":"} {
+		b.Run(fmt.Sprintf("KeyPrefixDelimiter=%q", delim), func(b *testing.B) {
+			var heap uint64
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+				var before runtime.MemStats
+				runtime.ReadMemStats(&before)
+				kd := newKeyDir(n, nil, delim)
+				lo := &logOffset{}
+				for j := 0; j < n; j++ {
+					kd.set([]byte(fmt.Sprintf("tenant:%04d:user:%08d", j%1000, j)), lo)
+				}
+				runtime.GC()
+				var after runtime.MemStats
+				runtime.ReadMemStats(&after)
+				heap = after.HeapInuse - before.HeapInuse
+				runtime.KeepAlive(kd)
+			}
+			b.ReportMetric(float64(heap)/(1<<20), "heap-MB")
+		})
+	}
+}
+
+func TestDB_Context(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		ctx, cancel := context.WithCancel(context.Background())
+		require.NoError(t, db.PutContext(ctx, []byte("key"), []byte("val")))
+		val, err := db.GetContext(ctx, []byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("val"), val)
+
+		cancel()
+		require.Equal(t, context.Canceled, db.PutContext(ctx, []byte("key"), []byte("new")))
+		require.Equal(t, context.Canceled, db.PutContext(ctx, []byte("other"), []byte("val")))
+		_, err = db.GetContext(ctx, []byte("key"))
+		require.Equal(t, context.Canceled, err)
+		require.Equal(t, 1, db.keyDir.len())
+		val, err = db.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("val"), val)
+	})
+}
+
+func TestDB_WaitGet(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		// An existing key is returned at once
+		require.NoError(t, db.Put([]byte("here"), []byte("val")))
+		val, err := db.WaitGet(context.Background(), []byte("here"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("val"), val)
+
+		// A waiter is woken up by the put of its key, not by others
+		got := make(chan []byte)
+		go func() {
+			val, err := db.WaitGet(context.Background(), []byte("key"))
+			assert.NoError(t, err)
+			got <- val
+		}()
+		time.Sleep(10 * time.Millisecond)
+		require.NoError(t, db.Put([]byte("other"), []byte("other")))
+		db.PutAsync([]byte("async"), []byte("async"), nil)
+		select {
+		case <-got:
+			t.Fatal("Woken up by another key")
+		case <-time.After(10 * time.Millisecond):
+		}
+		require.NoError(t, db.Put([]byte("key"), []byte("val")))
+		require.Equal(t, []byte("val"), <-got)
+
+		// Waiting is given up with ctx
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err = db.WaitGet(ctx, []byte("missing"))
+		require.Equal(t, context.DeadlineExceeded, err)
+	})
+
+	// Closing the database wakes up the waiters
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	db, err := Open(getTestOptions(dir))
+	require.NoError(t, err)
+	errs := make(chan error)
+	go func() {
+		_, err := db.WaitGet(context.Background(), []byte("missing"))
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, db.Close())
+	require.Equal(t, ErrDatabaseClosed, <-errs)
+}
+
+func TestDB_Txn(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Put([]byte("a"), []byte("1")))
+		require.NoError(t, db.Put([]byte("b"), []byte("1")))
+
+		// Writes are seen by the transaction, and by others once committed
+		txn := db.NewTxn()
+		val, err := txn.Get([]byte("a"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("1"), val)
+		require.NoError(t, txn.Put([]byte("a"), []byte("2")))
+		require.NoError(t, txn.Delete([]byte("b")))
+		val, err = txn.Get([]byte("a"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("2"), val)
+		_, err = txn.Get([]byte("b"))
+		require.Equal(t, ErrKeyNotFound, err)
+		val, err = db.Get([]byte("a"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("1"), val)
+		require.NoError(t, txn.Commit())
+		require.Equal(t, ErrTxnDone, txn.Commit())
+		val, err = db.Get([]byte("a"))
+		require.NoError(t, err)
+		require.Equal(t, []byte("2"), val)
+		_, err = db.Get([]byte("b"))
+		require.Equal(t, ErrKeyNotFound, err)
+
+		// A key written or put since it was read, even as missing, is a conflict
+		for _, key := range []string{"a", "b"} {
+			txn = db.NewTxn()
+			txn.Get([]byte(key))
+			require.NoError(t, txn.Put([]byte("c"), []byte("1")))
+			require.NoError(t, db.Put([]byte(key), []byte("3")))
+			require.Equal(t, ErrConflict, txn.Commit())
+			_, err = db.Get([]byte("c"))
+			require.Equal(t, ErrKeyNotFound, err)
+		}
+
+		// A merge moving the entry read is not
+		txn = db.NewTxn()
+		_, err = txn.Get([]byte("a"))
+		require.NoError(t, err)
+		require.NoError(t, db.SealActive())
+		require.NoError(t, db.Put([]byte("a"), []byte("4")))
+		require.NoError(t, db.Put([]byte("a"), []byte("3")))
+		require.NoError(t, db.SealActive())
+		txn2 := db.NewTxn()
+		_, err = txn2.Get([]byte("b"))
+		require.NoError(t, err)
+		before, _ := db.keyDir.get([]byte("b"))
+		require.NoError(t, db.Merge())
+		after, _ := db.keyDir.get([]byte("b"))
+		require.NotEqual(t, *before, *after)
+		require.NoError(t, txn2.Put([]byte("c"), []byte("1")))
+		require.NoError(t, txn2.Commit())
+		require.Equal(t, ErrConflict, txn.Commit())
+	})
+}
+
+func TestDB_TxnConcurrent(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		require.NoError(t, db.Put([]byte("counter"), []byte("0")))
+		incr := func(ready *sync.WaitGroup, start chan struct{}) error {
+			txn := db.NewTxn()
+			val, err := txn.Get([]byte("counter"))
+			if err != nil {
+				return err
+			}
+			n, _ := strconv.Atoi(string(val))
+			if err = txn.Put([]byte("counter"), []byte(strconv.Itoa(n+1))); err != nil {
+				return err
+			}
+			if ready != nil {
+				ready.Done()
+				<-start
+			}
+			return txn.Commit()
+		}
+
+		// Of the transactions which all read the counter before any commits, only one commits
+		const n = 8
+		var ready, wg sync.WaitGroup
+		start := make(chan struct{})
+		errs := make([]error, n)
+		ready.Add(n)
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = incr(&ready, start)
+			}(i)
+		}
+		ready.Wait()
+		close(start)
+		wg.Wait()
+		committed := 0
+		for _, err := range errs {
+			if err == nil {
+				committed++
+			} else {
+				require.Equal(t, ErrConflict, err)
+			}
+		}
+		require.Equal(t, 1, committed)
+
+		// Retrying on conflict loses no increment
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					err := incr(nil, nil)
+					for err == ErrConflict {
+						err = incr(nil, nil)
+					}
+					assert.NoError(t, err)
+				}
+			}()
+		}
+		wg.Wait()
+		val, err := db.Get([]byte("counter"))
+		require.NoError(t, err)
+		require.Equal(t, []byte(strconv.Itoa(1+n*10)), val)
+	})
+}
+
+func TestDB_Exists(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		key := []byte("key")
+		ok, err := db.Exists(key)
+		require.NoError(t, err)
+		require.False(t, ok)
+		require.NoError(t, db.Put(key, []byte("val")))
+
+		// The log file is not read, so a closed one does not matter
+		lf := db.dbFile.activeLogFile()
+		fd := lf.fd
+		closed, err := os.Open(lf.path)
+		require.NoError(t, err)
+		require.NoError(t, closed.Close())
+		lf.fd = closed
+		ok, err = db.Exists(key)
+		lf.fd = fd
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		require.NoError(t, db.Delete(key))
+		ok, err = db.Exists(key)
+		require.NoError(t, err)
+		require.False(t, ok)
+		_, err = db.Exists(nil)
+		require.Equal(t, ErrEmptyKey, err)
+	})
+}
+
+func TestDB_Len(t *testing.T) {
+	db, _ := openTestDB(t, nil)
+	require.Equal(t, 0, db.Len())
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), []byte("val")))
+	}
+	// Overwrites do not count
+	require.NoError(t, db.Put([]byte("key0"), []byte("new")))
+	for i := 0; i < 300; i++ {
+		require.NoError(t, db.Delete([]byte(fmt.Sprintf("key%d", i))))
+	}
+	require.Equal(t, 700, db.Len())
+	require.NoError(t, db.Close())
+	require.Equal(t, 0, db.Len())
+}
+
+func TestDB_Keys(t *testing.T) {
+	runTest(t, nil, func(t *testing.T, db *DB) {
+		want := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key%d", i)
+			require.NoError(t, db.Put([]byte(key), []byte("val")))
+			want[key] = true
+		}
+		require.NoError(t, db.Delete([]byte("key7")))
+		delete(want, "key7")
+
+		keys, err := db.Keys()
+		require.NoError(t, err)
+		got := make(map[string]bool)
+		for _, key := range keys {
+			got[string(key)] = true
+		}
+		require.Equal(t, want, got)
+
+		// The keys are copies
+		keys[0][0] = 'x'
+		keys, err = db.Keys()
+		require.NoError(t, err)
+		for _, key := range keys {
+			require.True(t, want[string(key)])
+		}
+	})
+}
+
+func TestDB_Checksums(t *testing.T) {
+	db, opts := openTestDB(t, nil)
+	require.NoError(t, db.Put([]byte("a"), []byte("aaaa")))
+	require.NoError(t, db.Put([]byte("b"), []byte("bbbb")))
+	require.NoError(t, db.Put([]byte("c"), []byte("cccc")))
+	require.NoError(t, db.Delete([]byte("c")))
+	loA, _ := db.keyDir.get([]byte("a"))
+	loB, _ := db.keyDir.get([]byte("b"))
+	path := db.dbFile.activeLogFile().path
+	require.NoError(t, db.Close())
+
+	flip := func(offset int64) {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		require.NoError(t, err)
+		defer f.Close()
+		b := make([]byte, 1)
+		_, err = f.ReadAt(b, offset)
+		require.NoError(t, err)
+		b[0] ^= 0x01
+		_, err = f.WriteAt(b, offset)
+		require.NoError(t, err)
+	}
+	// Flip the last byte of the value of b
+	e := NewEntry([]byte("b"), []byte("bbbb"), Normal)
+	e.flags |= flagChecksum
+	bEnd := int64(loB.offset + uint64(entryHeaderSize+e.flags.extSize()+e.kLen) + e.vLen)
+	flip(bEnd - 1)
+
+	// Replaying the active log file skips the entry if told to
+	opts.OnReplayError = func(fid uint32, offset uint64, err error) ReplayAction {
+		return SkipEntry
+	}
+	db, err := Open(opts)
+	require.NoError(t, err)
+	_, err = db.Get([]byte("b"))
+	require.Equal(t, ErrKeyNotFound, err)
+
+	// Reads of an entry corrupted later fail as well
+	db.keyDir.set([]byte("b"), loB)
+	_, err = db.Get([]byte("b"))
+	require.Equal(t, ErrChecksumMismatch, errors.Cause(err))
+	_, err = db.GetShared([]byte("b"))
+	require.Equal(t, ErrChecksumMismatch, errors.Cause(err))
+	val, err := db.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("aaaa"), val)
+	require.NoError(t, db.Close())
+
+	// Without checksums, the corrupt value is returned
+	dir2, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir2)
+	opts2 := getTestOptions(dir2)
+	opts2.NoChecksums = true
+	db, err = Open(opts2)
+	require.NoError(t, err)
+	require.NoError(t, db.Put([]byte("a"), []byte("aaaa")))
+	lf := db.dbFile.activeLogFile()
+	_, err = lf.fd.WriteAt([]byte("x"), int64(loA.offset)+int64(entryHeaderSize+defaultEntryFlags.extSize()+1))
+	require.NoError(t, err)
+	val, err = db.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("xaaa"), val)
+	require.NoError(t, db.Close())
+
+	// Replaying fails on the entry by default
+	opts.OnReplayError = nil
+	_, err = Open(opts)
+	require.Equal(t, ErrChecksumMismatch, errors.Cause(err))
+
+	// Options not built by DefaultOptions store checksums as well
+	dir3, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir3)
+	db, err = Open(Options{Dir: dir3, LogFileSize: 1 << 20})
+	require.NoError(t, err)
+	require.NoError(t, db.Put([]byte("a"), []byte("aaaa")))
+	require.NotZero(t, db.manifest.entryFlags&flagChecksum)
+	require.NoError(t, db.Close())
+}
+
+func TestDB_ChecksumTornWrite(t *testing.T) {
+	db, opts := openTestDB(t, nil)
+	require.NoError(t, db.Put([]byte("a"), []byte("aaaa")))
+	end := db.dbFile.writableOffset()
+	require.NoError(t, db.Put([]byte("b"), []byte("bbbb")))
+	bEnd := db.dbFile.writableOffset()
+	path := db.dbFile.activeLogFile().path
+	require.NoError(t, db.Close())
+
+	// The last entry is torn, its value left zeroed like in a preallocated file
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt(make([]byte, 4), int64(bEnd)-4)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	db, err = Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Get([]byte("b"))
+	require.Equal(t, ErrKeyNotFound, err)
+	require.Equal(t, end, db.dbFile.writableOffset())
+	val, err := db.Get([]byte("a"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("aaaa"), val)
+}
+
+func TestDB_SyncWrites(t *testing.T) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := New(dir, WithSyncWrites(true))
+	db, err := Open(opts)
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Every write is synced before it returns
+	var syncs int
+	syncFileOrig := syncFile
+	syncFile = func(fd *os.File, mode SyncMode) error {
+		syncs++
+		return syncFileOrig(fd, mode)
+	}
+	defer func() { syncFile = syncFileOrig }()
+	require.NoError(t, db.Put([]byte("a"), []byte("1")))
+	require.Equal(t, 1, syncs)
+	require.NoError(t, db.Delete([]byte("a")))
+	require.NoError(t, db.Put([]byte("b"), []byte("2")))
+	require.Equal(t, 3, syncs)
+	done := make(chan error)
+	db.PutAsync([]byte("c"), []byte("3"), func(err error) { done <- err })
+	require.NoError(t, <-done)
+	require.Equal(t, 4, syncs)
+
+	// The files as they are without Close hold the writes
+	restarted, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(restarted)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		if entry.Name() != lockFile {
+			require.NoError(t, copyFile(filepath.Join(dir, entry.Name()), filepath.Join(restarted, entry.Name()), -1))
+		}
+	}
+	db2, err := Open(New(restarted))
+	require.NoError(t, err)
+	defer db2.Close()
+	_, err = db2.Get([]byte("a"))
+	require.Equal(t, ErrKeyNotFound, err)
+	for key, want := range map[string]string{"b": "2", "c": "3"} {
+		val, err := db2.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, []byte(want), val)
+	}
+}
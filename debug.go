@@ -0,0 +1,6 @@
+//go:build minidb_debug
+
+package minidb
+
+// debugMode enables the invariant checks, build with "-tags minidb_debug" to turn it on.
+const debugMode = true
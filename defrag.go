@@ -0,0 +1,362 @@
+package minidb
+
+import (
+	"encoding/binary"
+	"github.com/pingcap/errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+)
+
+// Defragment rewrites the live entries of all log files, including the active one,
+// into as few new log files as LogFileSize allows, writes fresh hint files for them
+// and starts a new active log file. Unlike Merge it leaves no dead entries behind,
+// but it blocks reads and writes while running. It fails with ErrGcWorking if a
+// merge is in progress, or with ErrFilesPinned while a snapshot is open or values
+// are being read by WriteValueTo or SnapshotGet.
+//
+// The new files are written under temp names, and switched to through a marker file
+// which Open uses to roll the switch back or forward, so the database opens with
+// either the old files or the new ones whenever the process crashes.
+func (db *DB) Defragment() error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	if !db.gcLock.TryLock() {
+		return ErrGcWorking
+	}
+	defer db.gcLock.Unlock()
+
+	if err := db.lockWriteOpen(LockOpMaintenance); err != nil {
+		return err
+	}
+	defer db.unlockWrite()
+	for _, lf := range db.dbFile.files {
+		if lf.pinned() {
+			return ErrFilesPinned
+		}
+	}
+	return db.dbFile.defragment()
+}
+
+// defragFile is a log file being written by defragment, together with its hint file.
+type defragFile struct {
+	fid    uint32
+	fd     *os.File
+	hf     *hintFile
+	offset uint64
+}
+
+func (df *dbFile) createDefragFile(fid uint32) (*defragFile, error) {
+	logPath := df.fPath(fid) + tempFileNameSuffix
+	idxPath := indexFilePath(df.dirPath, fid) + tempFileNameSuffix
+	// Temp files may be left behind by a crashed defragment.
+	for _, path := range []string{logPath, idxPath} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "Unable to remove file: %q", path)
+		}
+	}
+	fd, offset, err := OpenOrCreateFileWithZeroOffset(logPath, os.O_WRONLY)
+	if err != nil {
+		return nil, err
+	}
+	hf := &hintFile{fid: fid, path: idxPath}
+	if err = hf.openWriteOnly(); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return &defragFile{fid: fid, fd: fd, hf: hf, offset: offset}, nil
+}
+
+// write appends the entry and its index, and returns where the entry is written.
+func (f *defragFile) write(e *Entry, codec Codec) (*logOffset, error) {
+	bytes, err := encodeEntry(e, codec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = f.fd.Write(bytes); err != nil {
+		return nil, errors.Wrapf(err, "Unable to write file: %q", f.fd.Name())
+	}
+	idx := &Index{entryExt: e.entryExt, fid: f.fid, offset: f.offset, kLen: e.kLen, key: e.key}
+	idx.flags = idx.flags&^flagChecksum | flagValueSize
+	idx.valueSize = e.vLen
+	if err = f.hf.write(idx); err != nil {
+		return nil, errors.Wrapf(err, "Unable to write into hint file: %q", f.hf.path)
+	}
+	lo := &logOffset{fid: f.fid, offset: f.offset, vLen: e.vLen, expiry: e.expiresAt()}
+	f.offset += e.Size()
+	return lo, nil
+}
+
+func (f *defragFile) close(mode SyncMode) error {
+	if err := TruncateAndCloseFile(f.fd, f.offset, mode); err != nil {
+		return err
+	}
+	return f.hf.close(f.hf.size, mode)
+}
+
+// defragment rewrites all live entries into new files. The caller must hold db.mu and gcLock.
+func (df *dbFile) defragment() (err error) {
+	db := df.db
+	oldFiles := df.files
+	fid := df.maxFid() + 1
+
+	// Rewrite the live entries in write order
+	los := make([]*logOffset, 0, db.keyDir.len())
+	db.keyDir.forEach(func(_ string, lo *logOffset) bool {
+		los = append(los, lo)
+		return true
+	})
+	sort.Slice(los, func(i, j int) bool {
+		if los[i].fid != los[j].fid {
+			return los[i].fid < los[j].fid
+		}
+		return los[i].offset < los[j].offset
+	})
+
+	var (
+		cur    *defragFile
+		sealed []*defragFile
+		kd     = newKeyDir(db.keyDir.len(), df.opt.ShardFunc, df.opt.KeyPrefixDelimiter)
+	)
+	defer func() {
+		if err == nil {
+			return
+		}
+		if cur != nil {
+			cur.fd.Close()
+			cur.hf.fd.Close()
+			sealed = append(sealed, cur)
+		}
+		for _, f := range sealed {
+			os.Remove(df.fPath(f.fid) + tempFileNameSuffix)
+			os.Remove(indexFilePath(df.dirPath, f.fid) + tempFileNameSuffix)
+		}
+	}()
+	for _, lo := range los {
+		lf, err := df.getFile(lo.fid)
+		if err != nil {
+			return err
+		}
+		e, err := lf.read(lo.offset)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to read entry at offset %d of %q", lo.offset, lf.path)
+		}
+		if cur == nil {
+			if cur, err = df.createDefragFile(fid); err != nil {
+				return err
+			}
+			fid++
+		}
+		newLo, err := cur.write(e, df.opt.Codec)
+		if err != nil {
+			return err
+		}
+		kd.set(e.key, newLo)
+		if cur.offset > uint64(df.opt.LogFileSize) {
+			if err = cur.close(df.opt.SyncMode); err != nil {
+				return err
+			}
+			sealed = append(sealed, cur)
+			cur = nil
+		}
+	}
+	if cur != nil {
+		if err = cur.close(df.opt.SyncMode); err != nil {
+			return err
+		}
+		sealed = append(sealed, cur)
+		cur = nil
+	}
+
+	// Keep the write sequence from going backwards, since dead entries are dropped.
+	if err = db.advanceSeqWatermark(df.seq); err != nil {
+		return err
+	}
+
+	// Publish the new files along with a new active log file. The marker is
+	// committed only once all of them are in place, so a crash before that
+	// rolls back to the old files and a crash after it rolls forward.
+	marker := &defragMarker{}
+	for _, lf := range oldFiles {
+		marker.oldFids = append(marker.oldFids, lf.fid)
+	}
+	for _, f := range sealed {
+		marker.newFids = append(marker.newFids, f.fid)
+	}
+	marker.newFids = append(marker.newFids, fid)
+	if err = writeDefragMarker(df.dirPath, marker); err != nil {
+		return err
+	}
+	newFiles, err := df.publishDefragFiles(sealed, fid)
+	if err == nil {
+		marker.committed = true
+		err = writeDefragMarker(df.dirPath, marker)
+	}
+	if err != nil {
+		for _, lf := range newFiles {
+			lf.close()
+		}
+		// Open rolls back if this fails, since the marker is not committed.
+		rmErr := removeDefragFiles(df.dirPath, marker.newFids)
+		if rmErr == nil {
+			rmErr = removeDefragMarker(df.dirPath)
+		}
+		if rmErr != nil {
+			df.opt.Logger.Errorf("Unable to roll back defragment: %v", rmErr)
+			db.recordError(rmErr)
+		}
+		sealed = nil
+		return err
+	}
+	sealed = nil
+
+	if err = df.dropCheckpoint(oldFiles[len(oldFiles)-1].fid); err != nil {
+		return err
+	}
+	df.files = newFiles
+	df.setFilePos(fid)
+	atomic.StoreUint32(&df.activeEntries, 0)
+	db.keyDir = kd
+	db.keyDirPeak = kd.len()
+
+	// Delete the old files, which Open finishes after a crash as the marker is committed.
+	for _, lf := range oldFiles {
+		if err = df.removeFile(lf); err != nil {
+			return errors.Wrapf(err, "Unable to delete file: %q", lf.path)
+		}
+	}
+	if err = removeDefragFiles(df.dirPath, marker.oldFids); err != nil {
+		return err
+	}
+	return removeDefragMarker(df.dirPath)
+}
+
+// publishDefragFiles renames the sealed files to their final names, and creates the
+// new active log file activeFid. It returns the files in use, including the ones
+// opened before an error.
+func (df *dbFile) publishDefragFiles(sealed []*defragFile, activeFid uint32) ([]*logFile, error) {
+	newFiles := make([]*logFile, 0, len(sealed)+1)
+	for _, f := range sealed {
+		lf := &logFile{fid: f.fid, path: df.fPath(f.fid), db: df.db}
+		if err := os.Rename(lf.path+tempFileNameSuffix, lf.path); err != nil {
+			return newFiles, errors.Wrapf(err, "Unable to rename file: %q", lf.path)
+		}
+		idxPath := indexFilePath(df.dirPath, f.fid)
+		if err := os.Rename(idxPath+tempFileNameSuffix, idxPath); err != nil {
+			return newFiles, errors.Wrapf(err, "Unable to rename file: %q", idxPath)
+		}
+		if err := lf.openReadWrite(); err != nil {
+			return newFiles, err
+		}
+		lf.mmap()
+		newFiles = append(newFiles, lf)
+	}
+	alf, err := df.newLogFile(activeFid)
+	if err != nil {
+		return newFiles, err
+	}
+	return append(newFiles, alf), nil
+}
+
+// defragMarkerFile records the files replaced by a running defragment.
+const defragMarkerFile = "DEFRAG"
+
+// defragMarker tells Open how to finish a defragment interrupted by a crash:
+// the new files are removed unless it is committed, the old ones otherwise.
+type defragMarker struct {
+	committed bool
+	oldFids   []uint32
+	newFids   []uint32
+}
+
+func encodeDefragMarker(m *defragMarker) []byte {
+	buf := make([]byte, 0, 9+4*(len(m.oldFids)+len(m.newFids)))
+	if m.committed {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	for _, fids := range [][]uint32{m.oldFids, m.newFids} {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(fids)))
+		for _, fid := range fids {
+			buf = binary.BigEndian.AppendUint32(buf, fid)
+		}
+	}
+	return buf
+}
+
+func decodeDefragMarker(buf []byte) (*defragMarker, error) {
+	if len(buf) < 1 {
+		return nil, errors.New("Invalid defragment marker")
+	}
+	m := &defragMarker{committed: buf[0] == 1}
+	buf = buf[1:]
+	for _, fids := range []*[]uint32{&m.oldFids, &m.newFids} {
+		if len(buf) < 4 {
+			return nil, errors.New("Invalid defragment marker")
+		}
+		n := binary.BigEndian.Uint32(buf)
+		buf = buf[4:]
+		if uint64(len(buf)) < 4*uint64(n) {
+			return nil, errors.New("Invalid defragment marker")
+		}
+		for i := uint32(0); i < n; i++ {
+			*fids = append(*fids, binary.BigEndian.Uint32(buf))
+			buf = buf[4:]
+		}
+	}
+	return m, nil
+}
+
+func writeDefragMarker(dir string, m *defragMarker) error {
+	return writeFileAtomically(dir, defragMarkerFile, encodeDefragMarker(m))
+}
+
+func removeDefragMarker(dir string) error {
+	path := filepath.Join(dir, defragMarkerFile)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Unable to remove file: %q", path)
+	}
+	return syncDir(dir)
+}
+
+// removeDefragFiles removes the log files of fids along with their hint and
+// checkpoint files and the temp files of defragment.
+func removeDefragFiles(dir string, fids []uint32) error {
+	for _, fid := range fids {
+		logPath, idxPath := logFilePath(dir, fid), indexFilePath(dir, fid)
+		for _, path := range []string{logPath, idxPath, checkpointFilePath(dir, fid),
+			logPath + tempFileNameSuffix, idxPath + tempFileNameSuffix} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, "Unable to remove file: %q", path)
+			}
+		}
+	}
+	return syncDir(dir)
+}
+
+// recoverDefragment finishes a defragment interrupted by a crash, see defragMarker.
+func recoverDefragment(dir string, logger Logger) error {
+	buf, err := os.ReadFile(filepath.Join(dir, defragMarkerFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.Wrapf(err, "Unable to read defragment marker")
+	}
+	m, err := decodeDefragMarker(buf)
+	if err != nil {
+		return err
+	}
+	fids := m.newFids
+	if m.committed {
+		fids = m.oldFids
+	}
+	logger.Infof("Recovering interrupted defragment, committed: %t", m.committed)
+	if err = removeDefragFiles(dir, fids); err != nil {
+		return err
+	}
+	return removeDefragMarker(dir)
+}
@@ -0,0 +1,21 @@
+package minidb
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// isStaleLock reports whether the pid file records a process which is no longer alive.
+// The lock is never considered stale if the pid file is missing or unreadable.
+func isStaleLock(pidFilePath string) bool {
+	buf, err := os.ReadFile(pidFilePath)
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil || pid <= 0 || pid == os.Getpid() {
+		return false
+	}
+	return !processAlive(pid)
+}
@@ -20,12 +20,16 @@ type directoryLockGuard struct {
 	f *os.File
 	// The absolute path to our pid file.
 	path string
+	// Was this a shared lock for a read-only database?
+	readOnly bool
 }
 
 // acquireDirectoryLock gets a lock on the directory (using flock). If
 // this is not read-only, it will also write our pid to
-// dirPath/pidFileName for convenience.
-func acquireDirectoryLock(dirPath string, pidFileName string) (*directoryLockGuard, error) {
+// dirPath/pidFileName for convenience. If stealStale is set and the lock
+// is held on behalf of a dead process, the lock is taken over anyway.
+// A read-only lock is shared with other read-only ones, and is never stolen.
+func acquireDirectoryLock(dirPath string, pidFileName string, readOnly, stealStale bool, logger Logger) (*directoryLockGuard, error) {
 	// Convert to absolute path so that Release still works even if we do an unbalanced
 	// chdir in the meantime.
 	absPidFilePath, err := filepath.Abs(filepath.Join(dirPath, pidFileName))
@@ -37,14 +41,24 @@ func acquireDirectoryLock(dirPath string, pidFileName string) (*directoryLockGua
 		return nil, errors.Wrapf(err, "cannot open directory %q", dirPath)
 	}
 	opts := unix.LOCK_EX | unix.LOCK_NB
+	if readOnly {
+		opts = unix.LOCK_SH | unix.LOCK_NB
+	}
 
 	err = unix.Flock(int(f.Fd()), opts)
-	if err != nil {
+	if err != nil && (readOnly || !(stealStale && isStaleLock(absPidFilePath))) {
 		f.Close()
 		return nil, errors.Wrapf(err,
 			"Cannot acquire directory lock on %q.  Another process is using this Badger database.",
 			dirPath)
 	}
+	if err != nil {
+		logger.Warnf("Stealing stale directory lock on %q", dirPath)
+	}
+
+	if readOnly {
+		return &directoryLockGuard{f, absPidFilePath, true}, nil
+	}
 
 	// Yes, we happily overwrite a pre-existing pid file.  We're the
 	// only read-write minidb process using this directory.
@@ -54,14 +68,22 @@ func acquireDirectoryLock(dirPath string, pidFileName string) (*directoryLockGua
 		return nil, errors.Wrapf(err,
 			"Cannot write pid file %q", absPidFilePath)
 	}
-	return &directoryLockGuard{f, absPidFilePath}, nil
+	return &directoryLockGuard{f, absPidFilePath, false}, nil
+}
+
+// processAlive reports whether the process exists.
+func processAlive(pid int) bool {
+	// Signal 0 only checks whether the process exists.
+	return unix.Kill(pid, 0) != unix.ESRCH
 }
 
 // Release deletes the pid file and releases our lock on the directory.
 func (guard *directoryLockGuard) release() error {
 	var err error
-	// It's important that we remove the pid file first.
-	err = os.Remove(guard.path)
+	if !guard.readOnly {
+		// It's important that we remove the pid file first.
+		err = os.Remove(guard.path)
+	}
 
 	if closeErr := guard.f.Close(); err == nil {
 		err = closeErr
@@ -0,0 +1,101 @@
+//go:build !windows
+
+package minidb
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestDB_StealStaleLock(t *testing.T) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Simulate a lock which is left behind by a crashed process
+	f, err := os.Open(dir)
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB))
+
+	cmd := exec.Command("true")
+	require.NoError(t, cmd.Run())
+	pidFilePath := filepath.Join(dir, lockFile)
+	require.NoError(t, os.WriteFile(pidFilePath, []byte(fmt.Sprintf("%d\n", cmd.Process.Pid)), 0666))
+
+	opts := getTestOptions(dir)
+	_, err = Open(opts)
+	require.Error(t, err)
+
+	opts.StealStaleLock = true
+	db, err := Open(opts)
+	require.NoError(t, err)
+	require.NoError(t, db.Put([]byte("key"), []byte("val")))
+	require.NoError(t, db.Close())
+
+	// A lock held by a live process, or with a garbage pid, is never stolen
+	for _, pid := range []string{fmt.Sprint(os.Getpid()), "garbage"} {
+		require.NoError(t, os.WriteFile(pidFilePath, []byte(pid+"\n"), 0666))
+		_, err = Open(opts)
+		require.Error(t, err)
+	}
+}
+
+func TestDB_ReadOnly(t *testing.T) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := getTestOptions(dir)
+	db, err := Open(opts)
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprint(i)), []byte(fmt.Sprint("val", i))))
+	}
+	require.NoError(t, db.Delete([]byte("0")))
+	require.NoError(t, db.Close())
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+
+	// Two instances share the directory, while a writer is locked out
+	opts.ReadOnly = true
+	db1, err := Open(opts)
+	require.NoError(t, err)
+	db2, err := Open(opts)
+	require.NoError(t, err)
+	_, err = Open(getTestOptions(dir))
+	require.Error(t, err)
+	for _, db := range []*DB{db1, db2} {
+		for i := 1; i < 100; i++ {
+			val, err := db.Get([]byte(fmt.Sprint(i)))
+			require.NoError(t, err)
+			require.Equal(t, []byte(fmt.Sprint("val", i)), val)
+		}
+		_, err = db.Get([]byte("0"))
+		require.Equal(t, ErrKeyNotFound, err)
+		require.Equal(t, ErrReadOnly, db.Put([]byte("key"), []byte("val")))
+		require.Equal(t, ErrReadOnly, db.Delete([]byte("1")))
+		require.Equal(t, ErrReadOnly, db.Merge())
+	}
+	require.NoError(t, db1.Close())
+	require.NoError(t, db2.Close())
+	after, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Equal(t, files, after)
+
+	db, err = Open(getTestOptions(dir))
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+
+	// Nothing is created for a missing database
+	opts.Dir = filepath.Join(dir, "missing")
+	_, err = Open(opts)
+	require.Error(t, err)
+	_, err = os.Stat(opts.Dir)
+	require.True(t, os.IsNotExist(err))
+}
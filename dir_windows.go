@@ -11,6 +11,13 @@ import (
 	"syscall"
 )
 
+const (
+	// stillActive is the exit code of a process which has not exited.
+	stillActive = 259
+	// errorInvalidParameter is returned by OpenProcess for a pid of no process.
+	errorInvalidParameter syscall.Errno = 87
+)
+
 func openDir(path string) (*os.File, error) {
 	fd, err := openDirWin(path)
 	if err != nil {
@@ -39,8 +46,14 @@ type directoryLockGuard struct {
 	path string
 }
 
-// AcquireDirectoryLock acquires exclusive access to a directory.
-func acquireDirectoryLock(dirPath string, pidFileName string) (*directoryLockGuard, error) {
+// AcquireDirectoryLock acquires exclusive access to a directory. If stealStale is set
+// and the lock file is left behind by a dead process, it is replaced. The lock file
+// cannot be shared, so read-only access is not supported.
+func acquireDirectoryLock(dirPath string, pidFileName string, readOnly, stealStale bool, logger Logger) (*directoryLockGuard, error) {
+	if readOnly {
+		return nil, errors.New("Read-only mode is not supported on windows")
+	}
+
 	// Convert to absolute path so that Release still works even if we do an unbalanced
 	// chdir in the meantime.
 	absLockFilePath, err := filepath.Abs(filepath.Join(dirPath, pidFileName))
@@ -49,6 +62,13 @@ func acquireDirectoryLock(dirPath string, pidFileName string) (*directoryLockGua
 	}
 
 	f, err := os.OpenFile(absLockFilePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) && stealStale && isStaleLock(absLockFilePath) {
+		logger.Warnf("Stealing stale directory lock on %q", dirPath)
+		if err = os.Remove(absLockFilePath); err != nil {
+			return nil, errors.Wrapf(err, "Cannot remove stale pid lock file %q", absLockFilePath)
+		}
+		f, err = os.OpenFile(absLockFilePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	}
 	if err != nil {
 		return nil, errors.Wrapf(err,
 			"Cannot create pid lock file %q.  Another process is using this mini database",
@@ -65,6 +85,21 @@ func acquireDirectoryLock(dirPath string, pidFileName string) (*directoryLockGua
 	return &directoryLockGuard{path: absLockFilePath}, nil
 }
 
+// processAlive reports whether the process exists and has not exited.
+func processAlive(pid int) bool {
+	h, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		// Access is denied to the processes of other users, which are alive.
+		return err != errorInvalidParameter
+	}
+	defer syscall.CloseHandle(h)
+	var code uint32
+	if err = syscall.GetExitCodeProcess(h, &code); err != nil {
+		return true
+	}
+	return code == stillActive
+}
+
 // Release removes the directory lock.
 func (g *directoryLockGuard) release() error {
 	path := g.path
@@ -0,0 +1,41 @@
+//go:build windows
+
+package minidb
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestDB_StealStaleLock(t *testing.T) {
+	dir, err := os.MkdirTemp("", "minidb")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Simulate a lock file which is left behind by a crashed process
+	cmd := exec.Command("cmd", "/c", "exit")
+	require.NoError(t, cmd.Run())
+	lockFilePath := filepath.Join(dir, lockFile)
+	require.NoError(t, os.WriteFile(lockFilePath, []byte(fmt.Sprintf("%d\n", cmd.Process.Pid)), 0666))
+
+	opts := getTestOptions(dir)
+	_, err = Open(opts)
+	require.Error(t, err)
+
+	opts.StealStaleLock = true
+	db, err := Open(opts)
+	require.NoError(t, err)
+	require.NoError(t, db.Put([]byte("key"), []byte("val")))
+	require.NoError(t, db.Close())
+
+	// A lock held by a live process, or with a garbage pid, is never stolen
+	for _, pid := range []string{fmt.Sprint(os.Getpid()), "garbage"} {
+		require.NoError(t, os.WriteFile(lockFilePath, []byte(pid+"\n"), 0666))
+		_, err = Open(opts)
+		require.Error(t, err)
+	}
+}
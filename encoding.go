@@ -3,57 +3,284 @@ package minidb
 import (
 	"encoding/binary"
 	"github.com/pingcap/errors"
+	"hash/crc32"
+	"math"
 )
 
-func encodeEntry(e *Entry) ([]byte, error) {
-	buf := make([]byte, e.Size())
+// errShortEntry is returned when the buffer is too short to decode an entry header.
+var errShortEntry = errors.New("Buffer too short for entry header")
 
-	buf[0] = byte(e.mark)
-	binary.BigEndian.PutUint32(buf[1:5], e.kLen)
-	binary.BigEndian.PutUint32(buf[5:9], e.vLen)
-	copy(buf[entryHeaderSize:], e.key)
-	copy(buf[entryHeaderSize+e.kLen:], e.value)
+// maxEntryHeaderSize returns the max size of the entry header encoded with codec.
+func maxEntryHeaderSize(codec Codec) int {
+	if codec == VarintCodec {
+		return varintEntryHeaderMaxSize + entryExtMaxSize
+	}
+	return wideEntryHeaderSize + entryExtMaxSize
+}
 
-	return buf, nil
+// appendExt appends the flags byte and the optional fields.
+func appendExt(buf []byte, ext *entryExt) []byte {
+	if ext.flags == 0 {
+		return buf
+	}
+	buf = append(buf, byte(ext.flags))
+	if ext.flags&flagSeq != 0 {
+		buf = binary.BigEndian.AppendUint64(buf, ext.seq)
+	}
+	if ext.flags&flagValueSize != 0 {
+		buf = binary.BigEndian.AppendUint64(buf, ext.valueSize)
+	}
+	if ext.flags&flagTimestamp != 0 {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(ext.timestamp))
+	}
+	if ext.flags&flagRef != 0 {
+		buf = binary.BigEndian.AppendUint32(buf, ext.refFid)
+		buf = binary.BigEndian.AppendUint32(buf, ext.refOffset)
+		buf = binary.BigEndian.AppendUint64(buf, ext.keyHash)
+	}
+	if ext.flags&flagContentHash != 0 {
+		buf = binary.BigEndian.AppendUint64(buf, ext.valueHash)
+	}
+	if ext.flags&flagExpiry != 0 {
+		buf = binary.BigEndian.AppendUint64(buf, uint64(ext.expiry))
+	}
+	if ext.flags&flagChecksum != 0 {
+		buf = binary.BigEndian.AppendUint32(buf, ext.checksum)
+	}
+	return buf
+}
+
+// decodeExt decodes the flags byte and the optional fields, and returns the decoded size.
+func decodeExt(buf []byte, ext *entryExt) (int, error) {
+	if len(buf) < 1 {
+		return 0, errShortEntry
+	}
+	ext.flags = entryFlag(buf[0])
+	if ext.flags&^knownEntryFlags != 0 {
+		return 0, errors.Errorf("Unknown entry flags %#x", byte(ext.flags&^knownEntryFlags))
+	}
+	size := int(ext.flags.extSize())
+	if len(buf) < size {
+		return 0, errShortEntry
+	}
+	n := 1
+	if ext.flags&flagSeq != 0 {
+		ext.seq = binary.BigEndian.Uint64(buf[n : n+8])
+		n += 8
+	}
+	if ext.flags&flagValueSize != 0 {
+		ext.valueSize = binary.BigEndian.Uint64(buf[n : n+8])
+		n += 8
+	}
+	if ext.flags&flagTimestamp != 0 {
+		ext.timestamp = int64(binary.BigEndian.Uint64(buf[n : n+8]))
+		n += 8
+	}
+	if ext.flags&flagRef != 0 {
+		ext.refFid = binary.BigEndian.Uint32(buf[n : n+4])
+		ext.refOffset = binary.BigEndian.Uint32(buf[n+4 : n+8])
+		ext.keyHash = binary.BigEndian.Uint64(buf[n+8 : n+16])
+		n += 16
+	}
+	if ext.flags&flagContentHash != 0 {
+		ext.valueHash = binary.BigEndian.Uint64(buf[n : n+8])
+		n += 8
+	}
+	if ext.flags&flagExpiry != 0 {
+		ext.expiry = int64(binary.BigEndian.Uint64(buf[n : n+8]))
+		n += 8
+	}
+	if ext.flags&flagChecksum != 0 {
+		ext.checksum = binary.BigEndian.Uint32(buf[n : n+4])
+	}
+	return size, nil
+}
+
+// headerSize returns the size of the header of an entry having flags and the given key
+// and value lengths, encoded with codec.
+func headerSize(codec Codec, flags entryFlag, kLen uint32, vLen uint64) uint32 {
+	if codec != VarintCodec {
+		if vLen > math.MaxUint32 {
+			return wideEntryHeaderSize + flags.extSize()
+		}
+		return entryHeaderSize + flags.extSize()
+	}
+	var buf [binary.MaxVarintLen64]byte
+	n := 1 + binary.PutUvarint(buf[:], uint64(kLen)) + binary.PutUvarint(buf[:], uint64(vLen))
+	return uint32(n) + flags.extSize()
 }
 
-func decodeEntry(buf []byte) (*Entry, error) {
-	if len(buf) < entryHeaderSize {
-		return nil, errors.Errorf("len(buf) must greater than or equal to %d", entryHeaderSize)
+// encodeEntry encodes the entry with codec and records its header size.
+func encodeEntry(e *Entry, codec Codec) ([]byte, error) {
+	value, err := e.compressValue()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, maxEntryHeaderSize(codec))
+	mark := e.mark | EntryMark(e.compression)<<markCompressionShift
+	if e.flags != 0 {
+		mark |= markExtended
+	}
+	if codec == FixedCodec && e.vLen > math.MaxUint32 {
+		mark |= markWideValue
 	}
-	kLen := binary.BigEndian.Uint32(buf[1:5])
-	vLen := binary.BigEndian.Uint32(buf[5:9])
+	header = append(header, byte(mark))
+	switch codec {
+	case FixedCodec:
+		header = binary.BigEndian.AppendUint32(header, e.kLen)
+		if mark&markWideValue != 0 {
+			header = binary.BigEndian.AppendUint64(header, e.vLen)
+		} else {
+			header = binary.BigEndian.AppendUint32(header, uint32(e.vLen))
+		}
+	case VarintCodec:
+		header = binary.AppendUvarint(header, uint64(e.kLen))
+		header = binary.AppendUvarint(header, e.vLen)
+	default:
+		return nil, errors.Errorf("Unknown codec: %d", codec)
+	}
+	header = appendExt(header, &e.entryExt)
+	e.hLen = uint32(len(header))
 
-	e := &Entry{
-		mark: EntryMark(buf[0]),
-		kLen: kLen,
-		vLen: vLen,
+	buf := make([]byte, e.Size())
+	copy(buf, header)
+	copy(buf[e.hLen:], e.key)
+	copy(buf[e.hLen+e.kLen:], value)
+	if e.flags&flagChecksum != 0 {
+		// The checksum is the last field of the header, a tombstone referring to an
+		// entry has no encoded key to cover.
+		crc := crc32.ChecksumIEEE(buf[:e.hLen-4])
+		e.checksum = crc32.Update(crc, crc32.IEEETable, buf[e.hLen:])
+		binary.BigEndian.PutUint32(buf[e.hLen-4:], e.checksum)
 	}
-	if len(buf) > entryHeaderSize {
-		key := make([]byte, kLen)
-		value := make([]byte, vLen)
-		copy(key, buf[entryHeaderSize:entryHeaderSize+kLen])
-		copy(value, buf[entryHeaderSize+kLen:])
-		e.key = key
-		e.value = value
+	return buf, nil
+}
+
+// decodeEntry decodes the entry header from buf, and the key and value as well
+// if buf holds the whole entry, in which case its checksum is verified.
+func decodeEntry(buf []byte, codec Codec) (*Entry, error) {
+	e := new(Entry)
+	if err := decodeHeader(buf, codec, e); err != nil {
+		return nil, err
+	}
+	if len(buf) >= int(e.Size()) {
+		if err := e.verifyChecksum(buf[e.hLen:e.Size()]); err != nil {
+			return nil, err
+		}
+	}
+	if len(buf) >= int(e.Size()) && uint64(e.kLen)+e.vLen > 0 {
+		e.key = make([]byte, e.kLen)
+		e.value = make([]byte, e.vLen)
+		copy(e.key, buf[e.hLen:e.hLen+e.kLen])
+		copy(e.value, buf[e.hLen+e.kLen:e.Size()])
+		if err := e.decompressValue(); err != nil {
+			return nil, err
+		}
+		e.restoreNilValue()
 	}
 	return e, nil
 }
 
+// decodeHeader decodes the entry header from buf into e.
+func decodeHeader(buf []byte, codec Codec, e *Entry) error {
+	if len(buf) < 1 {
+		return errShortEntry
+	}
+	mark := EntryMark(buf[0])
+	e.mark = mark &^ (markExtended | markCompression | markWideValue)
+	e.compression = Compression(mark & markCompression >> markCompressionShift)
+	if e.compression > maxCompression {
+		return errors.Errorf("Unknown compression %d in entry header", e.compression)
+	}
+	n := 1
+	switch codec {
+	case FixedCodec:
+		n = entryHeaderSize
+		if mark&markWideValue != 0 {
+			n = wideEntryHeaderSize
+		}
+		if len(buf) < n {
+			return errShortEntry
+		}
+		e.kLen = binary.BigEndian.Uint32(buf[1:5])
+		if n == wideEntryHeaderSize {
+			e.vLen = binary.BigEndian.Uint64(buf[5:13])
+		} else {
+			e.vLen = uint64(binary.BigEndian.Uint32(buf[5:9]))
+		}
+	case VarintCodec:
+		kLen, m := binary.Uvarint(buf[n:])
+		if m > 0 {
+			n += m
+			e.vLen, m = binary.Uvarint(buf[n:])
+		}
+		if m == 0 {
+			return errShortEntry
+		}
+		if m < 0 || kLen > math.MaxUint32 {
+			return errors.New("Invalid varint length in entry header")
+		}
+		e.kLen = uint32(kLen)
+		n += m
+	default:
+		return errors.Errorf("Unknown codec: %d", codec)
+	}
+	// No entry this large can be written, so the lengths are corrupt rather than torn.
+	if e.vLen > maxEntrySize || uint64(e.kLen)+e.vLen > maxEntrySize {
+		return errors.Errorf("Invalid entry length %d in entry header", uint64(e.kLen)+e.vLen)
+	}
+	if mark&markExtended != 0 {
+		m, err := decodeExt(buf[n:], &e.entryExt)
+		if err != nil {
+			return err
+		}
+		n += m
+	}
+	e.hLen = uint32(n)
+	if e.flags&flagChecksum != 0 {
+		e.headerCRC = crc32.ChecksumIEEE(buf[:n-4])
+	}
+	return nil
+}
+
 func encodeIndex(idx *Index) ([]byte, error) {
-	buf := make([]byte, idx.Size())
-	binary.BigEndian.PutUint32(buf[:4], idx.fid)
-	binary.BigEndian.PutUint32(buf[4:8], idx.offset)
-	binary.BigEndian.PutUint32(buf[8:12], idx.kLen)
-	copy(buf[indexHeaderSize:], idx.key)
+	buf := make([]byte, indexHeaderSize, idx.Size())
+	mark := idx.mark
+	if idx.flags != 0 {
+		mark |= markExtended
+	}
+	buf[0] = byte(mark)
+	binary.BigEndian.PutUint32(buf[1:5], idx.fid)
+	binary.BigEndian.PutUint64(buf[5:13], idx.offset)
+	binary.BigEndian.PutUint32(buf[13:17], idx.kLen)
+	buf = appendExt(buf, &idx.entryExt)
+	buf = append(buf, idx.key...)
 	return buf, nil
 }
 
+// decodeIndex decodes the fixed part of index header. The optional fields
+// follow it if the index is extended, see decodeIndexExt.
 func decodeIndex(buf []byte) (*Index, error) {
+	if len(buf) < indexHeaderSize {
+		return nil, errors.Errorf("len(buf) must greater than or equal to %d", indexHeaderSize)
+	}
 	idx := &Index{
-		fid:    binary.BigEndian.Uint32(buf[:4]),
-		offset: binary.BigEndian.Uint32(buf[4:8]),
-		kLen:   binary.BigEndian.Uint32(buf[8:12]),
+		mark:   EntryMark(buf[0]),
+		fid:    binary.BigEndian.Uint32(buf[1:5]),
+		offset: binary.BigEndian.Uint64(buf[5:13]),
+		kLen:   binary.BigEndian.Uint32(buf[13:17]),
 	}
 	return idx, nil
 }
+
+// extended tells whether the optional fields follow the fixed part of index header.
+func (idx *Index) extended() bool {
+	return idx.mark&markExtended != 0
+}
+
+// decodeIndexExt decodes the optional fields of index header.
+func decodeIndexExt(idx *Index, buf []byte) error {
+	idx.mark &^= markExtended
+	_, err := decodeExt(buf, &idx.entryExt)
+	return err
+}
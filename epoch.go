@@ -0,0 +1,107 @@
+package minidb
+
+import (
+	"sync"
+)
+
+// epochs lets readers use a log file without holding db.mu while Merge and the like
+// replace or drop it. A reader enters the current epoch before looking the file up and
+// exits once done reading. A file taken out of dbFile.files is retired at the current
+// epoch, which then advances, and is only closed once every reader which entered at or
+// before that epoch has exited, since no later reader can have looked it up.
+type epochs struct {
+	mu      sync.Mutex
+	drained *sync.Cond // Signaled when the last reader of an epoch exits, see drain.
+	current uint64
+	readers map[uint64]int // Number of readers in each epoch, only those with any.
+	retired []retiredFile
+}
+
+// retiredFile is a log file waiting for the readers of its epoch to exit.
+type retiredFile struct {
+	epoch uint64
+	lf    *logFile
+}
+
+// enter registers a reader in the current epoch, which it must exit when done.
+func (ep *epochs) enter() uint64 {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if ep.readers == nil {
+		ep.readers = make(map[uint64]int)
+	}
+	ep.readers[ep.current]++
+	return ep.current
+}
+
+// exit unregisters a reader of epoch and closes the files it held back.
+func (ep *epochs) exit(epoch uint64) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if ep.readers[epoch]--; ep.readers[epoch] == 0 {
+		delete(ep.readers, epoch)
+		if ep.drained != nil {
+			ep.drained.Broadcast()
+		}
+	}
+	ep.reclaim()
+}
+
+// retire closes lf, which has just been taken out of dbFile.files, once no reader
+// may be using it any more. The caller must hold db.mu.
+func (ep *epochs) retire(lf *logFile) {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	ep.retired = append(ep.retired, retiredFile{epoch: ep.current, lf: lf})
+	ep.current++
+	ep.reclaim()
+}
+
+// drain waits for every reader which entered so far to exit and closes all the retired
+// files. Readers entering meanwhile are not waited for, so a steady stream of them cannot
+// hold it off.
+func (ep *epochs) drain() {
+	ep.mu.Lock()
+	defer ep.mu.Unlock()
+	if ep.drained == nil {
+		ep.drained = sync.NewCond(&ep.mu)
+	}
+	last := ep.current
+	ep.current++
+	for ep.oldest() <= last {
+		ep.drained.Wait()
+	}
+	ep.reclaim()
+}
+
+// oldest returns the oldest epoch with readers, or the current one if there are none.
+// The caller must hold ep.mu.
+func (ep *epochs) oldest() uint64 {
+	oldest := ep.current
+	for epoch := range ep.readers {
+		if epoch < oldest {
+			oldest = epoch
+		}
+	}
+	return oldest
+}
+
+// reclaim closes the retired files older than the oldest epoch with readers.
+// The caller must hold ep.mu.
+func (ep *epochs) reclaim() {
+	if len(ep.retired) == 0 {
+		return
+	}
+	oldest := ep.oldest()
+	kept := ep.retired[:0]
+	for _, r := range ep.retired {
+		if r.epoch >= oldest {
+			kept = append(kept, r)
+			continue
+		}
+		if err := r.lf.close(); err != nil {
+			r.lf.db.opt.Logger.Warnf("Unable to close retired log file %q: %v", r.lf.path, err)
+		}
+	}
+	ep.retired = kept
+}
@@ -4,7 +4,7 @@ import "github.com/pingcap/errors"
 
 var (
 	// ErrLogFileSize is returned when "opt.LogFileSize" option is not within the valid range.
-	ErrLogFileSize = errors.New("Invalid LogFileSize, must be between 1MB and 2GB")
+	ErrLogFileSize = errors.New("Invalid LogFileSize, must be between 1MB and 1TB")
 
 	ErrDatabaseClosed = errors.New("Database already closed")
 
@@ -15,4 +15,48 @@ var (
 	ErrFileNotFound = errors.New("File not found")
 
 	ErrGcWorking = errors.New("Gc is working")
+
+	// ErrQuotaExceeded is returned when a write would exceed "opt.MaxTotalValueBytes".
+	ErrQuotaExceeded = errors.New("Total value bytes quota exceeded")
+
+	// ErrEntryTooLarge is returned when a key and value are too large to fit in a log file.
+	ErrEntryTooLarge = errors.New("Entry too large")
+
+	// ErrAsyncQueueFull is returned when the queue of PutAsync is full and "opt.AsyncNonBlocking" is set.
+	ErrAsyncQueueFull = errors.New("Async write queue is full")
+
+	// ErrInvalidCodec is returned when "opt.Codec" option is unknown.
+	ErrInvalidCodec = errors.New("Invalid Codec")
+
+	// ErrInvalidCompression is returned when "opt.Compression" option is unknown.
+	ErrInvalidCompression = errors.New("Invalid Compression")
+
+	// ErrMergeRatio is returned when "opt.MergeRatio" option is not within the valid range
+	// while "opt.AutoMerge" is set.
+	ErrMergeRatio = errors.New("Invalid MergeRatio, must be between 0 and 1")
+
+	// ErrFilesPinned is returned when log files cannot be rewritten because a snapshot,
+	// or a value being read by WriteValueTo or SnapshotGet, refers to them.
+	ErrFilesPinned = errors.New("Log files are pinned by snapshots")
+
+	// ErrReadOnly is returned by writes to a database opened with "opt.ReadOnly" or
+	// "opt.ReplayLimit".
+	ErrReadOnly = errors.New("Database is read only")
+
+	// ErrNoOverflow is returned by Demote when "opt.Overflow" is not set.
+	ErrNoOverflow = errors.New("Overflow is not set")
+
+	// ErrConflict is returned by Txn.Commit when a key read by the transaction has been
+	// written since.
+	ErrConflict = errors.New("Transaction conflict")
+
+	// ErrTxnDone is returned when a transaction is used after Commit.
+	ErrTxnDone = errors.New("Transaction already committed")
+
+	// ErrChecksumMismatch is returned when an entry read does not match its checksum,
+	// see Options.NoChecksums.
+	ErrChecksumMismatch = errors.New("Entry checksum mismatch")
+
+	// ErrNoTimestamps is returned by FileTimeRange when no entry of the file has a timestamp.
+	ErrNoTimestamps = errors.New("No entry has a timestamp")
 )
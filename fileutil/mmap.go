@@ -0,0 +1,18 @@
+//go:build windows
+
+package fileutil
+
+import (
+	"errors"
+	"os"
+)
+
+// Mmap is not supported on windows, so it always fails.
+func Mmap(f *os.File, size int) ([]byte, error) {
+	return nil, errors.New("mmap is not supported on windows")
+}
+
+// Munmap unmaps b, which Mmap never returns on windows.
+func Munmap(b []byte) error {
+	return nil
+}
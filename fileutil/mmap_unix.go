@@ -0,0 +1,19 @@
+//go:build !windows
+
+package fileutil
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// Mmap maps the first size bytes of f read only into memory. The mapping stays valid
+// after f is closed, until it is unmapped by Munmap.
+func Mmap(f *os.File, size int) ([]byte, error) {
+	return unix.Mmap(int(f.Fd()), 0, size, unix.PROT_READ, unix.MAP_SHARED)
+}
+
+// Munmap unmaps b, which has been returned by Mmap.
+func Munmap(b []byte) error {
+	return unix.Munmap(b)
+}
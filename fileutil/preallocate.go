@@ -0,0 +1,10 @@
+//go:build !linux
+
+package fileutil
+
+import "os"
+
+// Preallocate extends f to size. Only linux allocates the blocks upfront.
+func Preallocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
@@ -0,0 +1,19 @@
+//go:build linux
+
+package fileutil
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// Preallocate allocates the blocks of f up to size and extends f to size, so later
+// writes neither fragment the file nor run out of space. It falls back to truncate,
+// which leaves the file sparse, on filesystems not supporting fallocate.
+func Preallocate(f *os.File, size int64) error {
+	err := unix.Fallocate(int(f.Fd()), 0, 0, size)
+	if err == unix.EOPNOTSUPP || err == unix.ENOSYS {
+		return f.Truncate(size)
+	}
+	return err
+}
@@ -3,15 +3,16 @@ module github.com/yanghao888/minidb
 go 1.19
 
 require (
+	github.com/klauspost/compress v1.17.6
+	github.com/ngaut/log v0.0.0-20221012222132-f3329cba28a5
 	github.com/pingcap/errors v0.11.4
 	github.com/stretchr/testify v1.4.0
+	golang.org/x/sys v0.6.0
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.0 // indirect
-	github.com/ngaut/log v0.0.0-20221012222132-f3329cba28a5 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/sys v0.6.0 // indirect
 	gopkg.in/yaml.v2 v2.2.2 // indirect
 )
@@ -0,0 +1,131 @@
+package minidb
+
+import (
+	"github.com/pingcap/errors"
+	"io"
+)
+
+const (
+	// importReadSize is the size of the reads from the stream ImportFrom imports.
+	importReadSize = 64 << 10
+	// importBatchBytes bounds the key and value bytes ImportFrom writes at once.
+	importBatchBytes = 1 << 20
+)
+
+// ImportFrom opens the database of opt, which must hold no keys, and puts the records
+// read from r into it, which migrates data kept in another format. parse is called
+// with the bytes of r not parsed yet, and returns the key and value of the first
+// record and its size n in bytes, or n == 0 if the bytes do not hold a whole record,
+// in which case it is called again once more bytes are read. The key and value may
+// point into the bytes passed. Records are written in batches, like those of
+// PutAsync, so later records of a key overwrite earlier ones. If parsing or writing
+// fails, the database is closed and the error tells the offset of the record in r;
+// the records before it are kept, as may be some of the batch it belongs to.
+func ImportFrom(opt Options, r io.Reader, parse func([]byte) (key, val []byte, n int, err error)) (*DB, error) {
+	db, err := Open(opt)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.importFrom(r, parse); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// importFrom puts the records parsed from r, see ImportFrom.
+func (db *DB) importFrom(r io.Reader, parse func([]byte) (key, val []byte, n int, err error)) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	db.rlock(LockOpScan)
+	n := db.keyDir.len()
+	db.mu.RUnlock()
+	if n > 0 {
+		return errors.Errorf("Unable to import into %q holding %d keys", db.opt.Dir, n)
+	}
+
+	var (
+		buf     = make([]byte, 0, importReadSize)
+		batch   []*asyncPut
+		offsets []int64 // Offsets in r of the records in batch
+		size    int
+		offset  int64 // Offset in r of the first byte of buf
+		eof     bool
+	)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		errs := make([]error, len(batch))
+		for i, p := range batch {
+			errs[i] = db.checkKey(p.key)
+		}
+		db.writePuts(batch, errs)
+		for i, err := range errs {
+			if err != nil {
+				return errors.Wrapf(err, "Unable to import record at offset %d", offsets[i])
+			}
+		}
+		batch, offsets, size = batch[:0], offsets[:0], 0
+		return nil
+	}
+	for {
+		// Parse the whole records in buf.
+		start := 0
+		var parseErr error
+		for start < len(buf) {
+			key, val, n, err := parse(buf[start:])
+			if err != nil {
+				parseErr = errors.Wrapf(err, "Unable to parse record at offset %d", offset+int64(start))
+				break
+			}
+			if n == 0 {
+				break
+			}
+			if n < 0 || n > len(buf)-start {
+				parseErr = errors.Errorf("Invalid size %d of record at offset %d", n, offset+int64(start))
+				break
+			}
+			batch = append(batch, &asyncPut{key: key, val: val})
+			offsets = append(offsets, offset+int64(start))
+			size += len(key) + len(val)
+			start += n
+			if size >= importBatchBytes {
+				if err = flush(); err != nil {
+					return err
+				}
+			}
+		}
+		// The batch may point into buf, which is overwritten from now on.
+		if err := flush(); err != nil {
+			return err
+		}
+		if parseErr != nil {
+			return parseErr
+		}
+		if eof {
+			if start < len(buf) {
+				return errors.Errorf("Truncated record at offset %d", offset+int64(start))
+			}
+			return nil
+		}
+
+		// Keep the partial record, and make room for reading the rest of it.
+		rest := copy(buf, buf[start:])
+		buf = buf[:rest]
+		offset += int64(start)
+		if cap(buf)-len(buf) < importReadSize/2 {
+			grown := make([]byte, len(buf), 2*cap(buf))
+			copy(grown, buf)
+			buf = grown
+		}
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			eof = true
+		} else if err != nil {
+			return errors.Wrapf(err, "Unable to read at offset %d", offset+int64(len(buf)))
+		}
+	}
+}
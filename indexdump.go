@@ -0,0 +1,96 @@
+package minidb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/pingcap/errors"
+	"io"
+	"sort"
+)
+
+// indexDumpMagic starts every index dump.
+var indexDumpMagic = [4]byte{'M', 'D', 'I', '2'}
+
+// legacyIndexDumpMagic starts the index dumps whose offsets take 4 bytes.
+var legacyIndexDumpMagic = [4]byte{'M', 'D', 'I', 'X'}
+
+var errInvalidIndexDump = errors.New("Invalid index dump")
+
+// DumpIndex writes the position of the latest entry of every live key to w in sorted
+// key order, e.g. to build an external sorted index or to diff two databases. Unlike
+// the hint files, which are per log file and unsorted, it is one global snapshot of
+// the index. After a magic, every key is written as its length in uvarint, the key,
+// and the fid and offset of its entry in 4 and 8 bytes big endian. It is read back by
+// LoadIndexDump. The index is copied under the read lock and written after.
+func (db *DB) DumpIndex(w io.Writer) error {
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+
+	db.rlock(LockOpScan)
+	entries := make([]IndexEntry, 0, db.keyDir.len())
+	db.keyDir.forEach(func(key string, lo *logOffset) bool {
+		entries = append(entries, IndexEntry{Key: []byte(key), Fid: lo.fid, Offset: lo.offset})
+		return true
+	})
+	db.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return string(entries[i].Key) < string(entries[j].Key)
+	})
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(indexDumpMagic[:]); err != nil {
+		return errors.Wrap(err, "Unable to write index dump")
+	}
+	var buf []byte
+	for _, ie := range entries {
+		buf = binary.AppendUvarint(buf[:0], uint64(len(ie.Key)))
+		buf = append(buf, ie.Key...)
+		buf = binary.BigEndian.AppendUint32(buf, ie.Fid)
+		buf = binary.BigEndian.AppendUint64(buf, ie.Offset)
+		if _, err := bw.Write(buf); err != nil {
+			return errors.Wrap(err, "Unable to write index dump")
+		}
+	}
+	return errors.Wrap(bw.Flush(), "Unable to write index dump")
+}
+
+// LoadIndexDump reads the entries written by DumpIndex, in sorted key order.
+func LoadIndexDump(r io.Reader) ([]IndexEntry, error) {
+	br := bufio.NewReader(r)
+	var magic [4]byte
+	if _, err := io.ReadFull(br, magic[:]); err != nil || magic != indexDumpMagic && magic != legacyIndexDumpMagic {
+		return nil, errInvalidIndexDump
+	}
+	var entries []IndexEntry
+	pos := make([]byte, 12)
+	if magic == legacyIndexDumpMagic {
+		pos = pos[:8]
+	}
+	for {
+		kLen, err := binary.ReadUvarint(br)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, errors.Wrap(errInvalidIndexDump, err.Error())
+		}
+		if kLen == 0 || kLen > uint64(^uint32(0)) {
+			return nil, errors.Wrapf(errInvalidIndexDump, "invalid key length %d", kLen)
+		}
+		key := make([]byte, kLen)
+		if _, err = io.ReadFull(br, key); err != nil {
+			return nil, errors.Wrap(errInvalidIndexDump, "truncated key")
+		}
+		if _, err = io.ReadFull(br, pos); err != nil {
+			return nil, errors.Wrap(errInvalidIndexDump, "truncated position")
+		}
+		ie := IndexEntry{Key: key, Fid: binary.BigEndian.Uint32(pos[:4])}
+		if len(pos) == 8 {
+			ie.Offset = uint64(binary.BigEndian.Uint32(pos[4:]))
+		} else {
+			ie.Offset = binary.BigEndian.Uint64(pos[4:])
+		}
+		entries = append(entries, ie)
+	}
+}
@@ -0,0 +1,259 @@
+package minidb
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// keyDirShards is the number of maps keyDir is split into.
+const keyDirShards = 16
+
+// keyDir maps live keys to the position of their latest entry. It is split into
+// shards chosen by Options.ShardFunc, so no single map has to hold every key and
+// grow them all at once, and related keys can be kept in the same shard.
+// It is guarded by db.mu.
+type keyDir struct {
+	shards    [keyDirShards]map[string]*logOffset
+	shardFunc func(key []byte) uint32
+	// prefixes interns the key prefixes if Options.KeyPrefixDelimiter is set, in which
+	// case the maps are keyed by the encoded keys, see prefixTable.
+	prefixes *prefixTable
+}
+
+// newKeyDir returns an empty keyDir sized for about n keys. The prefixes of the keys
+// up to their last prefixDelim are interned, unless it is empty.
+func newKeyDir(n int, shardFunc func(key []byte) uint32, prefixDelim string) *keyDir {
+	kd := &keyDir{shardFunc: shardFunc}
+	for i := range kd.shards {
+		kd.shards[i] = make(map[string]*logOffset, n/keyDirShards)
+	}
+	if prefixDelim != "" {
+		kd.prefixes = &prefixTable{delim: prefixDelim, ids: make(map[string]uint32)}
+	}
+	return kd
+}
+
+// defaultShard returns the shard of key used when Options.ShardFunc is not set,
+// which is the 32 bits FNV-1a hash of key, computed inline to avoid allocation.
+func defaultShard(key []byte) uint32 {
+	h := uint32(2166136261)
+	for _, c := range key {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return h
+}
+
+func (kd *keyDir) shard(key []byte) map[string]*logOffset {
+	var n uint32
+	if kd.shardFunc != nil {
+		n = kd.shardFunc(key)
+	} else {
+		n = defaultShard(key)
+	}
+	return kd.shards[n%keyDirShards]
+}
+
+func (kd *keyDir) get(key []byte) (*logOffset, bool) {
+	if kd.prefixes == nil {
+		lo, ok := kd.shard(key)[string(key)]
+		return lo, ok
+	}
+	var buf [64]byte
+	enc, ok := kd.prefixes.encode(buf[:0], key)
+	if !ok {
+		return nil, false
+	}
+	lo, ok := kd.shard(key)[string(enc)]
+	return lo, ok
+}
+
+func (kd *keyDir) set(key []byte, lo *logOffset) {
+	if kd.prefixes == nil {
+		kd.shard(key)[string(key)] = lo
+		return
+	}
+	var buf [64]byte
+	enc := kd.prefixes.intern(buf[:0], key)
+	m := kd.shard(key)
+	if _, ok := m[string(enc)]; ok {
+		// The key holds a reference to its prefix already.
+		kd.prefixes.release(key)
+	}
+	m[string(enc)] = lo
+}
+
+func (kd *keyDir) remove(key []byte) {
+	if kd.prefixes == nil {
+		delete(kd.shard(key), string(key))
+		return
+	}
+	var buf [64]byte
+	enc, ok := kd.prefixes.encode(buf[:0], key)
+	if !ok {
+		return
+	}
+	m := kd.shard(key)
+	if _, ok = m[string(enc)]; ok {
+		delete(m, string(enc))
+		kd.prefixes.release(key)
+	}
+}
+
+// len returns the number of keys.
+func (kd *keyDir) len() int {
+	var n int
+	for _, m := range kd.shards {
+		n += len(m)
+	}
+	return n
+}
+
+// forEach calls fn for every key until fn returns false.
+func (kd *keyDir) forEach(fn func(key string, lo *logOffset) bool) {
+	for i := range kd.shards {
+		if !kd.forEachInShard(i, fn) {
+			return
+		}
+	}
+}
+
+// forEachInShard calls fn for every key of the i-th shard until fn returns false,
+// and tells whether it got to the end.
+func (kd *keyDir) forEachInShard(i int, fn func(key string, lo *logOffset) bool) bool {
+	for key, lo := range kd.shards[i] {
+		if kd.prefixes != nil {
+			key = kd.prefixes.decode(key)
+		}
+		if !fn(key, lo) {
+			return false
+		}
+	}
+	return true
+}
+
+// clone returns a copy of keyDir whose maps are sized to the current keys,
+// which releases the memory held by deleted keys since a map never shrinks.
+func (kd *keyDir) clone() *keyDir {
+	c := &keyDir{shardFunc: kd.shardFunc}
+	for i, m := range kd.shards {
+		c.shards[i] = make(map[string]*logOffset, len(m))
+		for key, lo := range m {
+			c.shards[i][key] = lo
+		}
+	}
+	if kd.prefixes != nil {
+		c.prefixes = kd.prefixes.clone()
+	}
+	return c
+}
+
+// prefixTable interns the key prefixes, which end with the last delim of a key, so that
+// keys sharing a long prefix store it once. A key is encoded as the uvarint of one plus
+// the id of its prefix followed by the rest of the key, or as a zero byte followed by
+// the whole key if it has no delim. The prefixes are counted by the keys using them,
+// and their ids are reused once unused.
+type prefixTable struct {
+	delim string
+	ids   map[string]uint32
+	names []string // Prefixes by id, empty if unused.
+	refs  []int    // Number of keys using each prefix.
+	free  []uint32 // Unused ids.
+}
+
+// split returns the length of the prefix of key, or -1 if it has none.
+func (pt *prefixTable) split(key []byte) int {
+	i := strings.LastIndex(string(key), pt.delim)
+	if i < 0 {
+		return -1
+	}
+	return i + len(pt.delim)
+}
+
+// encode appends the encoded key to buf. It returns false if the prefix of key is
+// not interned, so no key having it is in keyDir.
+func (pt *prefixTable) encode(buf, key []byte) ([]byte, bool) {
+	n := pt.split(key)
+	if n < 0 {
+		return append(append(buf, 0), key...), true
+	}
+	id, ok := pt.ids[string(key[:n])]
+	if !ok {
+		return nil, false
+	}
+	buf = binary.AppendUvarint(buf, uint64(id)+1)
+	return append(buf, key[n:]...), true
+}
+
+// intern is like encode, but interns the prefix of key if needed and counts key as
+// using it. The caller must call release if key was in keyDir already.
+func (pt *prefixTable) intern(buf, key []byte) []byte {
+	n := pt.split(key)
+	if n < 0 {
+		return append(append(buf, 0), key...)
+	}
+	id, ok := pt.ids[string(key[:n])]
+	if !ok {
+		prefix := string(key[:n])
+		if k := len(pt.free); k > 0 {
+			id = pt.free[k-1]
+			pt.free = pt.free[:k-1]
+			pt.names[id] = prefix
+		} else {
+			id = uint32(len(pt.names))
+			pt.names = append(pt.names, prefix)
+			pt.refs = append(pt.refs, 0)
+		}
+		pt.ids[prefix] = id
+	}
+	pt.refs[id]++
+	buf = binary.AppendUvarint(buf, uint64(id)+1)
+	return append(buf, key[n:]...)
+}
+
+// release drops a use of the prefix of key, which must be interned.
+func (pt *prefixTable) release(key []byte) {
+	n := pt.split(key)
+	if n < 0 {
+		return
+	}
+	id := pt.ids[string(key[:n])]
+	if pt.refs[id]--; pt.refs[id] == 0 {
+		delete(pt.ids, pt.names[id])
+		pt.names[id] = ""
+		pt.free = append(pt.free, id)
+	}
+}
+
+// decode returns the key encoded as enc.
+func (pt *prefixTable) decode(enc string) string {
+	// The uvarint is decoded from the string in place, to save copying it.
+	var id uint64
+	var n int
+	for shift := 0; ; shift += 7 {
+		c := enc[n]
+		n++
+		id |= uint64(c&0x7f) << shift
+		if c < 0x80 {
+			break
+		}
+	}
+	if id == 0 {
+		return enc[n:]
+	}
+	return pt.names[id-1] + enc[n:]
+}
+
+func (pt *prefixTable) clone() *prefixTable {
+	c := &prefixTable{
+		delim: pt.delim,
+		ids:   make(map[string]uint32, len(pt.ids)),
+		names: append([]string(nil), pt.names...),
+		refs:  append([]int(nil), pt.refs...),
+		free:  append([]uint32(nil), pt.free...),
+	}
+	for prefix, id := range pt.ids {
+		c.ids[prefix] = id
+	}
+	return c
+}
@@ -0,0 +1,201 @@
+package minidb
+
+import (
+	"bytes"
+	"github.com/pingcap/errors"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Keys returns a copy of every live key, in no particular order, without reading the
+// values. The keys are copied under the read lock, so writes wait until it is done.
+// Use ListKeys to get them sorted, or a page at a time.
+func (db *DB) Keys() ([][]byte, error) {
+	if db.isClosed() {
+		return nil, ErrDatabaseClosed
+	}
+
+	db.rlock(LockOpScan)
+	defer db.mu.RUnlock()
+	keys := make([][]byte, 0, db.keyDir.len())
+	db.keyDir.forEach(func(key string, _ *logOffset) bool {
+		keys = append(keys, []byte(key))
+		return true
+	})
+	return keys, nil
+}
+
+// ListKeys returns up to limit keys greater than after in sorted order, and the cursor
+// of the next page, which is the last key returned, or nil if there are no more keys.
+// A nil after starts from the first key. Every call sorts the keys after the cursor,
+// so listing n keys in pages takes time in proportion to n*n/limit.
+// Pages are not a consistent view: a key put or deleted between two calls appears
+// or disappears in the later pages, if it sorts after the cursor.
+func (db *DB) ListKeys(after []byte, limit int) (keys [][]byte, next []byte, err error) {
+	if db.isClosed() {
+		return nil, nil, ErrDatabaseClosed
+	}
+	if limit <= 0 {
+		return nil, nil, errors.Errorf("Invalid limit: %d", limit)
+	}
+
+	db.rlock(LockOpScan)
+	var found []string
+	db.keyDir.forEach(func(key string, _ *logOffset) bool {
+		if key > string(after) {
+			found = append(found, key)
+		}
+		return true
+	})
+	db.mu.RUnlock()
+
+	sort.Strings(found)
+	if len(found) > limit {
+		found = found[:limit]
+		next = []byte(found[limit-1])
+	}
+	keys = make([][]byte, len(found))
+	for i, key := range found {
+		keys[i] = []byte(key)
+	}
+	return keys, next, nil
+}
+
+// ScanWithDelimiter calls fn in sorted order for the keys starting with prefix, like
+// listing a directory: the keys holding delim after prefix are rolled up into their
+// common prefix, which ends with the first delim after prefix and is passed once with
+// isPrefix set, and the other keys are passed as they are. An empty delim passes every
+// key. fn is called after the keys are collected, so it may use the database.
+func (db *DB) ScanWithDelimiter(prefix, delim []byte, fn func(key []byte, isPrefix bool) error) error {
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+
+	db.rlock(LockOpScan)
+	var found []string
+	db.keyDir.forEach(func(key string, _ *logOffset) bool {
+		if strings.HasPrefix(key, string(prefix)) {
+			found = append(found, key)
+		}
+		return true
+	})
+	db.mu.RUnlock()
+
+	// Keys sharing a common prefix are adjacent once sorted.
+	sort.Strings(found)
+	var last string
+	for _, key := range found {
+		i := -1
+		if len(delim) > 0 {
+			i = strings.Index(key[len(prefix):], string(delim))
+		}
+		if i < 0 {
+			if err := fn([]byte(key), false); err != nil {
+				return err
+			}
+			continue
+		}
+		common := key[:len(prefix)+i+len(delim)]
+		if common == last {
+			continue
+		}
+		last = common
+		if err := fn([]byte(common), true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scan calls fn with the key and value of every live key starting with prefix, in no
+// particular order since keyDir is unordered; an empty prefix matches every key. Expired
+// keys are skipped. Iteration stops at the first error returned by fn, which Scan
+// returns. The values are read under the read lock, so writes wait until it is done,
+// and fn must not modify the database.
+func (db *DB) Scan(prefix []byte, fn func(key, value []byte) error) error {
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+
+	if err := db.rlockOpen(LockOpScan); err != nil {
+		return err
+	}
+	defer db.mu.RUnlock()
+	now := nowFunc().UnixNano()
+	var err error
+	db.keyDir.forEach(func(key string, lo *logOffset) bool {
+		k := []byte(key)
+		if !bytes.HasPrefix(k, prefix) {
+			return true
+		}
+		var e *Entry
+		if e, err = db.dbFile.Read(lo); err != nil {
+			return false
+		}
+		if e.expired(now) {
+			return true
+		}
+		err = fn(k, e.value)
+		return err == nil
+	})
+	return err
+}
+
+// Fold calls fn with the key and value of every live key, in no particular order,
+// without holding the read lock while reading the values, unlike Scan. The positions
+// of all the keys are taken first, and their log files pinned, like by a snapshot, so
+// fn sees the pairs as of when Fold started, and may write meanwhile, but must not close
+// the database, since Close waits for Fold to return. Expired keys are skipped. Iteration stops at the first error returned by fn, which Fold returns.
+func (db *DB) Fold(fn func(key, value []byte) error) error {
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+
+	type position struct {
+		key    []byte
+		lf     *logFile
+		offset uint64
+	}
+	epoch, err := db.enterRead()
+	if err != nil {
+		return err
+	}
+	defer db.epochs.exit(epoch)
+	var positions []position
+	defer func() {
+		for _, p := range positions {
+			atomic.AddInt32(&p.lf.refs, -1)
+		}
+	}()
+	db.rlock(LockOpScan)
+	positions = make([]position, 0, db.keyDir.len())
+	db.keyDir.forEach(func(key string, lo *logOffset) bool {
+		var lf *logFile
+		if lf, err = db.dbFile.getFile(lo.fid); err != nil {
+			return false
+		}
+		atomic.AddInt32(&lf.refs, 1)
+		positions = append(positions, position{key: []byte(key), lf: lf, offset: lo.offset})
+		return true
+	})
+	db.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	now := nowFunc().UnixNano()
+	for _, p := range positions {
+		e, err := p.lf.read(p.offset)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to read entry at offset %d of %q", p.offset, p.lf.path)
+		}
+		if e.expired(now) {
+			continue
+		}
+		if err = fn(p.key, e.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
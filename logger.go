@@ -0,0 +1,25 @@
+package minidb
+
+import "github.com/ngaut/log"
+
+// Logger receives the messages the database logs, see Options.Logger.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// defaultLogger logs through github.com/ngaut/log, it is used when Options.Logger is nil.
+type defaultLogger struct{}
+
+func (defaultLogger) Infof(format string, args ...interface{}) {
+	log.Infof(format, args...)
+}
+
+func (defaultLogger) Warnf(format string, args ...interface{}) {
+	log.Warnf(format, args...)
+}
+
+func (defaultLogger) Errorf(format string, args ...interface{}) {
+	log.Errorf(format, args...)
+}
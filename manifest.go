@@ -0,0 +1,364 @@
+package minidb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/pingcap/errors"
+	"github.com/yanghao888/minidb/fileutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	manifestFile = "MANIFEST"
+	// manifestVersion 7 has the layout of version 6, but its log files may hold values
+	// of 4GB or more, see markWideValue, which older versions cannot read.
+	manifestVersion = 7
+
+	// hintVersion is the layout of hint files, in which every index starts with a
+	// mark byte and offsets and value sizes take 8 bytes. Hint files written before
+	// it was recorded use another layout, and those of version 1 are migrated.
+	hintVersion = 2
+	// hintV1IndexHeaderSize is indexHeaderSize in hint version 1, with a 4 bytes offset.
+	hintV1IndexHeaderSize = 13
+)
+
+var manifestMagic = []byte("MDB")
+
+// manifest records the on-disk format of a database.
+type manifest struct {
+	codec Codec
+	// maxSeq is at least the write sequence of every entry dropped by merge.
+	maxSeq uint64
+	// keyCount is the number of live keys when the database was last closed,
+	// used to pre-size keyDir on Open.
+	keyCount uint64
+	// hintVersion is the layout of the hint files in the database, zero if unknown.
+	hintVersion byte
+	// entryFlags are the optional fields which entries of the database may have
+	// apart from the write sequence, zero if unknown.
+	entryFlags entryFlag
+	// compressions has the bit 1<<c set for every Compression c which values of the
+	// database may have, NoCompression aside.
+	compressions byte
+}
+
+func encodeManifest(m *manifest) []byte {
+	buf := make([]byte, 0, len(manifestMagic)+21)
+	buf = append(buf, manifestMagic...)
+	buf = append(buf, manifestVersion, byte(m.codec))
+	buf = binary.BigEndian.AppendUint64(buf, m.maxSeq)
+	buf = binary.BigEndian.AppendUint64(buf, m.keyCount)
+	return append(buf, m.hintVersion, byte(m.entryFlags), m.compressions)
+}
+
+func decodeManifest(buf []byte) (*manifest, error) {
+	if len(buf) < len(manifestMagic)+2 || !bytes.Equal(buf[:len(manifestMagic)], manifestMagic) {
+		return nil, errors.New("Invalid manifest")
+	}
+	buf = buf[len(manifestMagic):]
+	m := &manifest{codec: Codec(buf[1])}
+	switch buf[0] {
+	case 1:
+	case 2:
+		if len(buf) < 10 {
+			return nil, errors.New("Invalid manifest")
+		}
+		m.maxSeq = binary.BigEndian.Uint64(buf[2:10])
+	case 3, 4, 5, 6, 7:
+		if len(buf) < 18 || buf[0] == 4 && len(buf) < 19 || buf[0] == 5 && len(buf) < 20 || buf[0] >= 6 && len(buf) < 21 {
+			return nil, errors.New("Invalid manifest")
+		}
+		m.maxSeq = binary.BigEndian.Uint64(buf[2:10])
+		m.keyCount = binary.BigEndian.Uint64(buf[10:18])
+		if buf[0] >= 4 {
+			m.hintVersion = buf[18]
+		}
+		if buf[0] >= 5 {
+			m.entryFlags = entryFlag(buf[19])
+		}
+		if buf[0] >= 6 {
+			m.compressions = buf[20]
+		}
+	default:
+		return nil, errors.Errorf("Unsupported manifest version: %d", buf[0])
+	}
+	if m.entryFlags&^knownEntryFlags != 0 {
+		return nil, errors.Errorf("Unsupported entry flags in manifest: %#x", byte(m.entryFlags))
+	}
+	if m.compressions>>(maxCompression+1) != 0 {
+		return nil, errors.Errorf("Unsupported compressions in manifest: %#x", m.compressions)
+	}
+	return m, nil
+}
+
+// readManifest reads the manifest in dir, it returns nil if the manifest does not exist.
+func readManifest(dir string) (*manifest, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "Unable to read manifest")
+	}
+	return decodeManifest(buf)
+}
+
+// writeManifest writes the manifest into a temp file and renames it to replace the old one.
+func writeManifest(dir string, m *manifest) error {
+	return writeFileAtomically(dir, manifestFile, encodeManifest(m))
+}
+
+// writeFileAtomically writes buf into a temp file and renames it to replace the file
+// name in dir, so the file holds either the old content or buf after a crash.
+func writeFileAtomically(dir, name string, buf []byte) error {
+	path := filepath.Join(dir, name)
+	tmpPath := path + tempFileNameSuffix
+	fd, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to create file: %q", tmpPath)
+	}
+	if _, err = fd.Write(buf); err != nil {
+		fd.Close()
+		return errors.Wrapf(err, "Unable to write file: %q", tmpPath)
+	}
+	if err = fileutil.Fsync(fd); err != nil {
+		fd.Close()
+		return errors.Wrapf(err, "Unable to sync file: %q", tmpPath)
+	}
+	if err = fd.Close(); err != nil {
+		return errors.Wrapf(err, "Unable to close file: %q", tmpPath)
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return errors.Wrapf(err, "Unable to rename file: %q", tmpPath)
+	}
+	return syncDir(dir)
+}
+
+// loadManifest reads the manifest of the database or creates one for it.
+// A database created before the manifest was introduced uses FixedCodec.
+func loadManifest(dir string, opt Options) (*manifest, error) {
+	m, err := readManifest(dir)
+	if err != nil || m != nil {
+		return m, err
+	}
+
+	m = &manifest{codec: opt.Codec, hintVersion: hintVersion}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error while opening dir: %q", dir)
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), logFileNameSuffix) {
+			m.codec = FixedCodec
+			m.hintVersion = 0
+			break
+		}
+	}
+	if err = writeManifest(dir, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// upgradeHints migrates the hint files of version 1 to the current layout, and removes
+// those of unknown layout, so that their log files are replayed instead. Merge writes
+// new hint files later. The current layout is then recorded in manifest.
+func (db *DB) upgradeHints() error {
+	if db.manifest.hintVersion == hintVersion {
+		return nil
+	}
+	if db.opt.ReadOnly {
+		return errors.New("Unable to open read only while hint files are to be upgraded")
+	}
+	dir := db.opt.Dir
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return errors.Wrapf(err, "Error while opening dir: %q", dir)
+	}
+	migrate := db.manifest.hintVersion == 1
+	if migrate {
+		// A crash while migrating leaves hint files of both layouts, which the next
+		// Open removes as the layout is unknown.
+		if err = db.recordHintVersion(0); err != nil {
+			return err
+		}
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, indexFileNameSuffix) && !strings.HasSuffix(name, checkpointFileNameSuffix) {
+			continue
+		}
+		if migrate {
+			if err = migrateHint(dir, name); err == nil {
+				continue
+			}
+			if errors.Cause(err) != errInvalidHint {
+				return err
+			}
+			db.opt.Logger.Warnf("Deleting hint file which cannot be migrated: %v", err)
+		} else {
+			db.opt.Logger.Infof("Deleting hint file of unknown layout: %q", name)
+		}
+		if err = os.Remove(filepath.Join(dir, name)); err != nil {
+			return errors.Wrapf(err, "Unable to remove file: %q", name)
+		}
+	}
+	if err = syncDir(dir); err != nil {
+		return err
+	}
+	return db.recordHintVersion(hintVersion)
+}
+
+// recordHintVersion records in manifest that the hint files have layout version.
+func (db *DB) recordHintVersion(version byte) error {
+	m := *db.manifest
+	m.hintVersion = version
+	if err := writeManifest(db.opt.Dir, &m); err != nil {
+		return err
+	}
+	db.manifest = &m
+	return nil
+}
+
+// migrateHint rewrites the hint file name in dir from hint version 1, whose offsets and
+// value sizes take 4 bytes, to the current layout. A checkpoint may end in the middle
+// of an index, see activeCheckpoint, in which case errInvalidHint is returned like for
+// any hint file which cannot be decoded.
+func migrateHint(dir, name string) error {
+	path := filepath.Join(dir, name)
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to read file: %q", path)
+	}
+	truncated := errors.Wrapf(errInvalidHint, "Truncated index in file: %q", path)
+	out := make([]byte, 0, len(buf)+len(buf)/2)
+	for len(buf) > 0 {
+		if len(buf) < hintV1IndexHeaderSize {
+			return truncated
+		}
+		mark := EntryMark(buf[0])
+		kLen := binary.BigEndian.Uint32(buf[9:13])
+		out = append(out, buf[:5]...)
+		out = binary.BigEndian.AppendUint64(out, uint64(binary.BigEndian.Uint32(buf[5:9])))
+		out = append(out, buf[9:13]...)
+		buf = buf[hintV1IndexHeaderSize:]
+		if mark&markExtended != 0 {
+			if len(buf) < 1 {
+				return truncated
+			}
+			flags := entryFlag(buf[0])
+			if flags&^knownEntryFlags != 0 {
+				return errors.Wrapf(errInvalidHint, "Unknown entry flags %#x in file: %q", byte(flags), path)
+			}
+			size := flags.extSize()
+			n := uint32(1)
+			if flags&flagSeq != 0 {
+				n += 8
+			}
+			if flags&flagValueSize != 0 {
+				size -= 4
+			}
+			if uint64(len(buf)) < uint64(size) {
+				return truncated
+			}
+			out = append(out, buf[:n]...)
+			if flags&flagValueSize != 0 {
+				out = binary.BigEndian.AppendUint64(out, uint64(binary.BigEndian.Uint32(buf[n:n+4])))
+				n += 4
+			}
+			out = append(out, buf[n:size]...)
+			buf = buf[size:]
+		}
+		if uint64(len(buf)) < uint64(kLen) {
+			return truncated
+		}
+		out = append(out, buf[:kLen]...)
+		buf = buf[kLen:]
+	}
+	return writeFileAtomically(dir, name, out)
+}
+
+// recordEntryFlags records in manifest the optional fields which the options add to
+// new entries, before any of them is written, so that the manifest tells whether the
+// database can be read by a version which does not know them.
+func (db *DB) recordEntryFlags() error {
+	var flags entryFlag
+	if db.opt.EntryTimestamps {
+		flags |= flagTimestamp
+	}
+	if db.opt.CompactTombstones {
+		flags |= flagRef
+	}
+	if db.opt.ContentHash {
+		flags |= flagContentHash
+	}
+	if db.opt.NilValues {
+		flags |= flagNilValue
+	}
+	if !db.opt.NoChecksums {
+		flags |= flagChecksum
+	}
+	return db.addEntryFlags(flags)
+}
+
+// addEntryFlags records flags in manifest along with those already recorded, before
+// an entry having them is written.
+func (db *DB) addEntryFlags(flags entryFlag) error {
+	flags |= db.manifest.entryFlags
+	if flags == db.manifest.entryFlags {
+		return nil
+	}
+	m := *db.manifest
+	m.entryFlags = flags
+	if err := writeManifest(db.opt.Dir, &m); err != nil {
+		return err
+	}
+	db.manifest = &m
+	return nil
+}
+
+// addCompression records in manifest that values may be compressed with c, before one
+// is written, so that versions which do not know c refuse to open the database.
+func (db *DB) addCompression(c Compression) error {
+	if c == NoCompression || db.manifest.compressions&(1<<c) != 0 {
+		return nil
+	}
+	m := *db.manifest
+	m.compressions |= 1 << c
+	if err := writeManifest(db.opt.Dir, &m); err != nil {
+		return err
+	}
+	db.manifest = &m
+	return nil
+}
+
+// advanceSeqWatermark records seq in manifest if it is larger than the recorded one.
+// It is called with gcLock held.
+func (db *DB) advanceSeqWatermark(seq uint64) error {
+	if seq <= db.manifest.maxSeq {
+		return nil
+	}
+	m := *db.manifest
+	m.maxSeq = seq
+	if err := writeManifest(db.opt.Dir, &m); err != nil {
+		return err
+	}
+	db.manifest = &m
+	return nil
+}
+
+// saveKeyCount records the number of live keys in manifest.
+func (db *DB) saveKeyCount() error {
+	m := *db.manifest
+	m.keyCount = uint64(db.keyDir.len())
+	if m.keyCount == db.manifest.keyCount {
+		return nil
+	}
+	if err := writeManifest(db.opt.Dir, &m); err != nil {
+		return err
+	}
+	db.manifest = &m
+	return nil
+}
@@ -1,5 +1,7 @@
 package minidb
 
+import "time"
+
 // Options are params for creating DB object.
 type Options struct {
 
@@ -16,13 +18,363 @@ type Options struct {
 
 	// Size of single log file.
 	LogFileSize int64
+
+	// Max number of entries of a log file, tombstones included, a new log file is started
+	// once it is reached even if the file is smaller than LogFileSize. The writes queued by
+	// PutAsync are appended in batches, which may take a file past it. Zero means no limit.
+	MaxEntriesPerFile int
+
+	// Max total size of the values of live keys, a Put exceeding it fails with
+	// ErrQuotaExceeded. Zero means unlimited.
+	MaxTotalValueBytes int64
+
+	// ----------------------------- //
+	//      Fine tuning flags        //
+	// ----------------------------- //
+
+	// Codec used to encode entry header. It only takes effect when creating a new database,
+	// an existing database keeps the codec recorded in its manifest.
+	Codec Codec
+
+	// Number of writes PutAsync can queue before it blocks.
+	AsyncQueueSize int
+
+	// Fail PutAsync with ErrAsyncQueueFull instead of blocking when its queue is full.
+	AsyncNonBlocking bool
+
+	// Take over the directory lock if it is still held but the process recorded in
+	// the LOCK file is dead. This works around locks left behind by a crash on some
+	// filesystems such as NFS. It is dangerous: if the recorded pid is wrong or has
+	// been reused by an unrelated process, two processes may write the same database.
+	// On windows, where the LOCK file itself is the lock, it replaces a LOCK file left
+	// behind by a dead process.
+	StealStaleLock bool
+
+	// Called when an entry cannot be read while replaying log files on Open,
+	// the returned action decides how to recover. Nil means Abort.
+	OnReplayError func(fid uint32, offset uint64, err error) ReplayAction
+
+	// Stop replaying on Open after this many entries, hint file indexes included, which
+	// loads a part of the keys quickly to inspect a large database. The index misses the
+	// later entries, so the database is read only: writes, Merge and the like fail with
+	// ErrReadOnly. Zero replays everything.
+	ReplayLimit int
+
+	// Open the database for reading only, so that several processes may query it at once.
+	// The directory lock is shared with other read-only opens, and excludes a writer. No
+	// file is created, modified or removed: writes, Merge and the like fail with
+	// ErrReadOnly, and the database must have been opened for writing first. Interrupted
+	// maintenance, which Open would otherwise finish, makes it fail instead. It is not
+	// supported on windows.
+	ReadOnly bool
+
+	// Keep zero-size sealed log files and their hint files on Open instead of deleting them.
+	// Without it, an empty file is deleted along with its hint file, if it has one.
+	PreserveEmptyFiles bool
+
+	// Called with the key before Put and Delete write it, a non-nil error is returned
+	// to the caller and nothing is written. Keys replayed on Open are not checked.
+	KeyValidator func(key []byte) error
+
+	// Max bytes per second Merge, MergeWait and CompactWhere read from and write to the
+	// log files they rewrite, so that compaction does not starve the other operations of
+	// disk I/O. Zero means unlimited.
+	MergeRateLimit int64
+
+	// Merge in the background whenever the dead entries make up more than MergeRatio of
+	// the sealed log files, as estimated by Stats. The check is skipped while a merge is
+	// running, and a failed merge is logged and reported by LastError.
+	AutoMerge bool
+
+	// Ratio of dead bytes to the bytes of the sealed log files beyond which AutoMerge
+	// merges, it must be between 0 and 1.
+	MergeRatio float64
+
+	// Chooses the fids of the sealed log files Merge compacts, given their stats in
+	// fid order. Nil means all of them. Tombstones are only dropped from a file if
+	// every older file is compacted as well, so skipping old files costs space.
+	MergePolicy func(files []FileStat) []uint32
+
+	// Write tombstones which refer to the deleted entry by its position and a key hash
+	// instead of storing the key, which saves space when deleting long keys. It makes
+	// Merge compact every file older than those chosen by MergePolicy as well. While a
+	// merge is running, which may move the deleted entry, tombstones store the key.
+	CompactTombstones bool
+
+	// Called with the time every operation waits for the database locks, which tells
+	// lock contention apart from disk latency. Operations which lock the database more
+	// than once report every wait. The time is only measured when it is set. It is
+	// called with the lock held, so it must be fast and must not use the database.
+	LockWaitObserver func(op LockOp, wait time.Duration)
+
+	// Interval to check a small sample of keys in the background, by reading their
+	// entries and comparing the stored key. Problems are logged and passed to
+	// OnScrubError. Zero disables the check.
+	ScrubInterval time.Duration
+
+	// Called with the key and the problem found by the background check.
+	OnScrubError func(key []byte, err error)
+
+	// Repair the keys failing the background check by replaying the log files for
+	// them and pointing keyDir at their latest entry, or dropping them if deleted.
+	ScrubRepair bool
+
+	// Interval to delete the keys which have expired, see PutWithTTL, in the background
+	// by writing a tombstone for each. The keys are kept ordered by expiry in memory, so
+	// a sweep only looks at those which have expired. Zero leaves expired keys until they
+	// are read or merged.
+	TTLSweepInterval time.Duration
+
+	// Append the indexes of the entries in the active log file to a checkpoint file each
+	// time this many bytes of entries are written, so that Open only replays the entries
+	// after the last checkpoint. The log file is synced before each checkpoint. Zero
+	// disables it.
+	ActiveCheckpointBytes uint32
+
+	// Make Delete of a missing key fail with ErrKeyNotFound instead of doing nothing.
+	StrictDelete bool
+
+	// Store the write time in the header of each new entry, which costs 8 bytes per
+	// entry. GetFresh and EntryMeta.Timestamp rely on it.
+	EntryTimestamps bool
+
+	// Merge drops the entries written longer ago than this, which needs EntryTimestamps;
+	// entries without a timestamp are kept. The latest version of a key is dropped as
+	// well, which deletes the key, so keys meant to outlive the period must be written
+	// again within it, unless RetentionKeepLatest is set. Only the files Merge compacts
+	// are checked, so expired keys stay readable until then. Zero keeps entries
+	// regardless of their age.
+	RetentionPeriod time.Duration
+
+	// Keep the latest version of each key however old when RetentionPeriod is set, so
+	// that no key is deleted for its age. Only the versions a newer one replaced are
+	// dropped then.
+	RetentionKeepLatest bool
+
+	// Returns the shard of the in-memory index holding key, which lets related keys,
+	// e.g. those sharing a prefix, be kept together. It must return the same value
+	// for the same key every time, or keys get lost. Writes fail if it returns two
+	// different values for the key written, which catches a function depending on
+	// a counter or the time, though not every unstable one. Defaults to a hash of the
+	// whole key.
+	ShardFunc func(key []byte) uint32
+
+	// Store the prefix of each key up to its last KeyPrefixDelimiter once in the in-memory
+	// index, shared by the keys having it, which saves memory when many keys share long
+	// prefixes, e.g. "tenant:abc:" with ":". Looking keys up costs a little more and
+	// listing them allocates every key, so it is best left empty for flat keys.
+	KeyPrefixDelimiter string
+
+	// Size of the pooled buffers entries are read into before their key and value are
+	// copied out, which saves an allocation per read. Larger entries are read into a
+	// buffer allocated for them. Zero disables the pool.
+	ReadBufferSize int
+
+	// Max bytes of keys and values read by Get, GetWithMeta and GetFresh to keep in
+	// memory, so that repeated reads of hot keys skip the disk. The least recently read
+	// ones are evicted past it, and all of them when Merge and the like move entries.
+	// Zero disables the cache.
+	CacheSize int
+
+	// Map the sealed log files into memory and serve reads from the mapping, which saves
+	// the read syscalls of every Get. The mappings take address space, but not memory,
+	// as large as the sealed files. The active log file is read through its descriptor.
+	// Where a file cannot be mapped, e.g. on windows, it is read as usual.
+	UseMmap bool
+
+	// Number of times a failed write of entries to the active log file is retried, from
+	// where it stopped, before the error is returned, which rides out transient errors
+	// of network filesystems. A write which still fails leaves no partial entry behind
+	// for the next write to follow.
+	WriteRetries int
+
+	// Sync the active log file after every write, so that a write is on disk once it
+	// returns, at the cost of a sync per write. The writes queued by PutAsync are synced
+	// once per batch. Without it, writes are only synced by Sync and when their log file
+	// is sealed or closed.
+	SyncWrites bool
+
+	// Sync primitive used when log files are sealed, merged, closed or, with SyncWrites,
+	// written.
+	SyncMode SyncMode
+
+	// Allocate the blocks of each new log file upfront with fallocate, instead of leaving
+	// it sparse, which avoids fragmentation and running out of space in the middle of a
+	// log file. Only linux supports it; elsewhere, or on filesystems lacking fallocate,
+	// log files stay sparse.
+	Fallocate bool
+
+	// Skip syncing the directory after creating a log file, before a merge and on Close.
+	// It saves a directory sync on every log file rollover, but after a crash a log file
+	// created shortly before may be missing from the directory, losing the writes it
+	// holds although they were synced. Renames, such as those of merged files, hint files
+	// and the manifest, are synced regardless.
+	NoSyncDir bool
+
+	// Tell nil values apart from empty ones: Put of a nil value marks the entry, so that
+	// Get returns nil for it rather than the empty slice it returns for empty values.
+	// Without it both are read back as empty. Only new entries are marked, and once it
+	// has been set the database cannot be opened by versions which do not know the mark.
+	NilValues bool
+
+	// Skip the CRC32 checksum otherwise stored in the header of each new entry, which
+	// saves 4 bytes per entry. Reads of whole entries, such as Get, verify the checksum
+	// and fail with ErrChecksumMismatch on a mismatch, rather than returning corrupt data;
+	// WriteValueTo streams the value unchecked. Replay treats a mismatching entry as
+	// unreadable, see OnReplayError, except at the end of the active log file where it was
+	// torn by a crash. Once a checksum has been stored the database cannot be opened by
+	// versions which do not know it.
+	NoChecksums bool
+
+	// Compress the values of new entries with it, which suits large values such as JSON
+	// documents. Only the value is compressed, and kept as is where that does not shrink
+	// it. Each entry records how its value is compressed, so the option may be changed
+	// between opens, and Merge keeps the compression of the entries it moves. Sizes of
+	// values on disk, such as those counted by MaxTotalValueBytes and reported by
+	// KeysBySize, are the compressed ones. Once it has been set the database cannot be
+	// opened by versions which do not know the compression.
+	Compression Compression
+
+	// Store a hash of the value in the header of each new entry, which GetWithMeta
+	// returns as EntryMeta.ContentHash. Unlike a checksum it identifies the content,
+	// so equal values have equal hashes.
+	ContentHash bool
+
+	// Secondary store which Get falls back to for keys missing from the database, and
+	// which Demote moves values into. Delete only removes the value kept by the database,
+	// so a deleted key is still read from Overflow if it has been demoted.
+	Overflow Overflow
+
+	// Write the values Get reads from Overflow back into the database, so that later
+	// reads of the same keys are served locally.
+	OverflowCache bool
+
+	// Receives the messages logged by the database, such as those of Open and Close and
+	// the problems it recovers from. Nil means github.com/ngaut/log.
+	Logger Logger
 }
 
+// SyncMode decides how files are flushed to disk.
+type SyncMode int
+
+const (
+	// SyncDefault uses fdatasync when the database is closed and fsync elsewhere.
+	SyncDefault SyncMode = iota
+	// SyncFull uses fsync, which flushes the data and all the file metadata.
+	SyncFull
+	// SyncData uses fdatasync, which is faster since it skips metadata that is not
+	// needed to read the data back, such as modification time. A crash may lose
+	// such metadata, but never the data or the file size.
+	SyncData
+)
+
+// LockOp tells which operation waited for the database lock.
+type LockOp int
+
+const (
+	LockOpPut LockOp = iota
+	// Get, GetWithMeta, GetShared, SnapshotGet, WriteValueTo, Exists, Len, FileOf,
+	// Demote, Snapshot.Get and Txn.Get.
+	LockOpGet
+	// Delete and the TTL sweeper.
+	LockOpDelete
+	// The writes queued by PutAsync and PutSequenced, and the batches of ImportFrom and
+	// Restore.
+	LockOpPutAsync
+	LockOpReplacePrefix
+	// ReadRaw and AppendRaw.
+	LockOpRaw
+	// Operations reading many keys or entries, such as GetOldest, VersionCount,
+	// KeysBySize, Keys, ListKeys, ScanWithDelimiter, Scan, Fold, Stats, Digest, DumpIndex,
+	// RawIterateReverse, IterateRange, FileTimeRange, Verify, Backup and the scrubber.
+	LockOpScan
+	// Merge, MergeDryRun, Defragment, SealActive, CompactIndex, DropFilesOlderThan,
+	// NewSnapshot, PhysicalBackup and Sync.
+	LockOpMaintenance
+	// Txn.Commit.
+	LockOpCommit
+)
+
+// ReplayAction tells how to recover from an unreadable entry during replay.
+type ReplayAction int
+
+const (
+	// Abort fails Open with the error.
+	Abort ReplayAction = iota
+	// SkipEntry skips the entry and continues with the next one. If the entry
+	// header is unreadable its size is unknown, and it behaves like StopFile.
+	SkipEntry
+	// StopFile ignores the rest of the log file. New writes to the active
+	// log file start from the unreadable entry.
+	StopFile
+)
+
 // DefaultOptions sets a list of recommended options for good performance.
 // Feel free to modify these to suit your needs.
 func DefaultOptions(dir string) Options {
 	return Options{
-		Dir:         dir,
-		LogFileSize: 256 << 20,
+		Dir:            dir,
+		LogFileSize:    256 << 20,
+		AsyncQueueSize: 1024,
+		ReadBufferSize: 64 << 10,
+	}
+}
+
+// Option sets an option of the Options built by New.
+type Option func(*Options)
+
+// New returns the DefaultOptions of dir with opts applied in order, so a later
+// option overrides an earlier one setting the same field. The result is checked
+// by Open like any other Options.
+func New(dir string, opts ...Option) Options {
+	o := DefaultOptions(dir)
+	for _, opt := range opts {
+		opt(&o)
 	}
+	return o
+}
+
+// WithLogFileSize sets Options.LogFileSize.
+func WithLogFileSize(size int64) Option {
+	return func(o *Options) { o.LogFileSize = size }
+}
+
+// WithMaxEntriesPerFile sets Options.MaxEntriesPerFile.
+func WithMaxEntriesPerFile(n int) Option {
+	return func(o *Options) { o.MaxEntriesPerFile = n }
+}
+
+// WithMaxTotalValueBytes sets Options.MaxTotalValueBytes.
+func WithMaxTotalValueBytes(n int64) Option {
+	return func(o *Options) { o.MaxTotalValueBytes = n }
+}
+
+// WithCodec sets Options.Codec.
+func WithCodec(codec Codec) Option {
+	return func(o *Options) { o.Codec = codec }
+}
+
+// WithCompression sets Options.Compression.
+func WithCompression(c Compression) Option {
+	return func(o *Options) { o.Compression = c }
+}
+
+// WithSyncMode sets Options.SyncMode.
+func WithSyncMode(mode SyncMode) Option {
+	return func(o *Options) { o.SyncMode = mode }
+}
+
+// WithSyncWrites sets Options.SyncWrites.
+func WithSyncWrites(sync bool) Option {
+	return func(o *Options) { o.SyncWrites = sync }
+}
+
+// WithSyncDir clears Options.NoSyncDir if sync is set, and sets it otherwise.
+func WithSyncDir(sync bool) Option {
+	return func(o *Options) { o.NoSyncDir = !sync }
+}
+
+// WithLogger sets Options.Logger.
+func WithLogger(logger Logger) Option {
+	return func(o *Options) { o.Logger = logger }
 }
@@ -0,0 +1,96 @@
+package minidb
+
+import (
+	"github.com/pingcap/errors"
+)
+
+// Overflow is a secondary store behind the database, such as a slower or remote
+// cold tier. Get falls back to it for keys missing from the database, and Demote
+// moves values into it. It must be safe for concurrent use.
+type Overflow interface {
+	// Get returns the value of key and whether it was found.
+	Get(key []byte) ([]byte, bool, error)
+	// Put stores the value of key.
+	Put(key, val []byte) error
+}
+
+// getOverflow looks for key, which is missing from the database, in Overflow.
+func (db *DB) getOverflow(key []byte) ([]byte, error) {
+	val, ok, err := db.opt.Overflow.Get(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to read key %q from overflow", key)
+	}
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	if db.opt.OverflowCache {
+		db.cacheOverflow(key, val)
+	}
+	return val, nil
+}
+
+// cacheOverflow writes the value of key read from Overflow back into the database,
+// unless key has been written meanwhile. The value is returned to the reader anyway,
+// so a failure is only logged.
+func (db *DB) cacheOverflow(key, val []byte) {
+	if db.writable() != nil || db.checkKey(key) != nil {
+		return
+	}
+	if db.lockWriteOpen(LockOpPut) != nil {
+		return
+	}
+	defer db.unlockWrite()
+	if _, ok := db.keyDir.get(key); ok {
+		return
+	}
+	if err := db.put(key, val); err != nil {
+		db.opt.Logger.Warnf("Unable to cache key %q read from overflow: %v", key, err)
+		db.recordError(err)
+	}
+}
+
+// Demote moves key to Overflow: it puts the value into Overflow, then deletes key from
+// the database, so that later reads of key are served by Overflow. Overflow is written
+// without holding the database lock, so if key is written meanwhile, the newer value is
+// kept in the database and shadows the demoted one. It fails with ErrNoOverflow if
+// Options.Overflow is not set.
+func (db *DB) Demote(key []byte) error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	if db.opt.Overflow == nil {
+		return ErrNoOverflow
+	}
+	if err := db.checkKey(key); err != nil {
+		return err
+	}
+
+	if err := db.rlockOpen(LockOpGet); err != nil {
+		return err
+	}
+	lo, ok := db.keyDir.get(key)
+	if !ok {
+		db.mu.RUnlock()
+		return ErrKeyNotFound
+	}
+	e, err := db.dbFile.Read(lo)
+	db.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if err = db.opt.Overflow.Put(key, e.value); err != nil {
+		return errors.Wrapf(err, "Unable to write key %q into overflow", key)
+	}
+
+	if err = db.lockWriteOpen(LockOpDelete); err != nil {
+		return err
+	}
+	defer db.unlockWrite()
+	// Compare the position rather than the pointer, a merge may have moved the entry.
+	cur, ok := db.keyDir.get(key)
+	if !ok || cur.fid != lo.fid || cur.offset != lo.offset {
+		return nil
+	}
+	return db.delete(key, cur)
+}
@@ -0,0 +1,128 @@
+package minidb
+
+import (
+	"github.com/pingcap/errors"
+	"time"
+)
+
+// IterateRange calls fn for the entries of log file fid which start from startOffset
+// up to endOffset, including overwritten entries and tombstones, which lets tools
+// inspect a part of a file, e.g. around a corrupted entry. startOffset must be the
+// start of an entry, such as one returned by ReadRaw or RawIterateReverse; since
+// entries carry no marker, a startOffset in the middle of an entry is only detected
+// when what it points at does not decode as an entry, and fails with an error then.
+// The offsets must be within the file, that is the written part of the active file.
+// Merge fails with ErrGcWorking during the iteration.
+func (db *DB) IterateRange(fid uint32, startOffset, endOffset uint64, fn func(offset uint64, e *Entry) error) error {
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+
+	// Hold gcLock so that the file is not replaced during reading.
+	db.gcLock.Lock()
+	defer db.gcLock.Unlock()
+	// The database may be closed while waiting.
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+
+	lf, size, err := db.writtenFile(fid)
+	if err != nil {
+		return err
+	}
+	if startOffset > endOffset || endOffset > size {
+		return errors.Errorf("Invalid range [%d, %d) of %q whose size is %d", startOffset, endOffset, lf.path, size)
+	}
+	return lf.iterateRange(startOffset, endOffset, size, fn)
+}
+
+// FileTimeRange returns the oldest and newest write timestamps of the entries in log
+// file fid, tombstones included, which lets a retention policy tell whether a whole
+// file is older than a cutoff. The timestamps require Options.EntryTimestamps; entries
+// without one are ignored, and ErrNoTimestamps is returned if no entry has one. Entries
+// are mostly in write order, but AppendRaw keeps the timestamps of the source, so the
+// headers of all entries are read rather than only the first and last ones. Merge fails
+// with ErrGcWorking meanwhile.
+func (db *DB) FileTimeRange(fid uint32) (oldest, newest time.Time, err error) {
+	if db.isClosed() {
+		return time.Time{}, time.Time{}, ErrDatabaseClosed
+	}
+
+	// Hold gcLock so that the file is not replaced during reading.
+	db.gcLock.Lock()
+	defer db.gcLock.Unlock()
+	// The database may be closed while waiting.
+	if db.isClosed() {
+		return time.Time{}, time.Time{}, ErrDatabaseClosed
+	}
+
+	lf, size, err := db.writtenFile(fid)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	var oldestNs, newestNs int64
+	found := false
+	for offset := uint64(0); offset < size; {
+		e, err := lf.readHeader(offset)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.Wrapf(err, "Unable to read entry header at offset %d of %q", offset, lf.path)
+		}
+		if e.flags&flagTimestamp != 0 {
+			if !found || e.timestamp < oldestNs {
+				oldestNs = e.timestamp
+			}
+			if !found || e.timestamp > newestNs {
+				newestNs = e.timestamp
+			}
+			found = true
+		}
+		offset += e.Size()
+	}
+	if !found {
+		return time.Time{}, time.Time{}, ErrNoTimestamps
+	}
+	return time.Unix(0, oldestNs), time.Unix(0, newestNs), nil
+}
+
+// writtenFile returns log file fid and the size of its entries, which for the active
+// file is the part written so far.
+func (db *DB) writtenFile(fid uint32) (*logFile, uint64, error) {
+	db.rlock(LockOpScan)
+	defer db.mu.RUnlock()
+	lf, err := db.dbFile.getFile(fid)
+	if err != nil {
+		return nil, 0, err
+	}
+	if lf == db.dbFile.activeLogFile() {
+		return lf, db.dbFile.writableOffset(), nil
+	}
+	return lf, lf.size, nil
+}
+
+// iterateRange calls fn for the entries starting from start up to end, each of which
+// must lie within size.
+func (lf *logFile) iterateRange(start, end, size uint64, fn func(offset uint64, e *Entry) error) error {
+	for offset := start; offset < end; {
+		e, err := lf.read(offset)
+		switch {
+		case err != nil:
+		case e.mark != Normal && e.mark != Tombstone:
+			err = errors.Errorf("Invalid entry mark %d", e.mark)
+		case e.kLen == 0 && e.flags&flagRef == 0:
+			err = errors.New("Empty key")
+		case offset+e.Size() > size:
+			err = errors.Errorf("Entry size %d exceeds the end of file", e.Size())
+		}
+		if err != nil {
+			if offset == start {
+				return errors.Wrapf(err, "Offset %d of %q is not the start of an entry", offset, lf.path)
+			}
+			return errors.Wrapf(err, "Unable to read entry at offset %d of %q", offset, lf.path)
+		}
+		if err = fn(offset, e); err != nil {
+			return err
+		}
+		offset += e.Size()
+	}
+	return nil
+}
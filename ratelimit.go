@@ -0,0 +1,38 @@
+package minidb
+
+import "time"
+
+// rateLimitBurst is how far ahead of the rate rateLimiter lets the bytes go before it
+// sleeps, which saves sleeping for every small entry.
+const rateLimitBurst = 10 * time.Millisecond
+
+// sleepFunc sleeps for rateLimiter, replaced in tests along with nowFunc.
+var sleepFunc = time.Sleep
+
+// rateLimiter is a token bucket throttling a single goroutine to rate bytes per second.
+// Instead of counting tokens, it tracks the time by which the bytes passed so far are
+// paid for at the rate, and sleeps once that time gets more than rateLimitBurst ahead.
+type rateLimiter struct {
+	rate int64
+	paid time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate}
+}
+
+// wait sleeps as long as needed for n more bytes to stay within the rate.
+func (rl *rateLimiter) wait(n int64) {
+	if n <= 0 {
+		return
+	}
+	now := nowFunc()
+	if rl.paid.Before(now) {
+		// Time spent idle is not saved up beyond the burst.
+		rl.paid = now
+	}
+	rl.paid = rl.paid.Add(time.Duration(float64(n) / float64(rl.rate) * float64(time.Second)))
+	if ahead := rl.paid.Sub(now); ahead > rateLimitBurst {
+		sleepFunc(ahead)
+	}
+}
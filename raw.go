@@ -0,0 +1,119 @@
+package minidb
+
+import (
+	"github.com/pingcap/errors"
+	"io"
+)
+
+// ReadRaw returns the encoded bytes of the entry at offset of log file fid and its size,
+// so that the entry can be shipped to a replica and appended there by AppendRaw.
+// The size is that of the entry on disk, so offset plus size is where the next entry
+// starts. io.EOF is returned at the end of the file, which for the active log file is
+// where the next write goes. A tombstone referring to the deleted entry is returned
+// storing the key instead, or as nil bytes if that entry is gone, as nothing is left
+// to delete then.
+func (db *DB) ReadRaw(fid uint32, offset uint64) ([]byte, uint64, error) {
+	if db.isClosed() {
+		return nil, 0, ErrDatabaseClosed
+	}
+
+	if err := db.rlockOpen(LockOpRaw); err != nil {
+		return nil, 0, err
+	}
+	defer db.mu.RUnlock()
+	lf, err := db.dbFile.getFile(fid)
+	if err != nil {
+		return nil, 0, err
+	}
+	// The active log file may hold a partial write, or stale bytes, past its end.
+	if fid == db.dbFile.activeLogFile().fid && offset >= db.dbFile.writableOffset() {
+		return nil, 0, io.EOF
+	}
+	e, err := lf.readHeader(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	size := e.Size()
+	buf := make([]byte, size)
+	if _, err = lf.fd.ReadAt(buf, int64(offset)); err != nil {
+		return nil, 0, errors.Wrapf(err, "Unable to read entry at offset %d of %q", offset, lf.path)
+	}
+	if e.mark != Tombstone || e.flags&flagRef == 0 {
+		return buf, size, nil
+	}
+
+	// The referenced position is only meaningful in this database.
+	if e, err = decodeEntry(buf, db.opt.Codec); err != nil {
+		return nil, 0, err
+	}
+	if e = db.dbFile.expandRefTombstone(e); e == nil {
+		return nil, size, nil
+	}
+	if buf, err = encodeEntry(e, db.opt.Codec); err != nil {
+		return nil, 0, err
+	}
+	return buf, size, nil
+}
+
+// AppendRaw appends the encoded bytes of an entry returned by ReadRaw to the active
+// log file as is, and applies the entry to the index. Both databases must use the
+// same codec. The entry keeps the write sequence and timestamp it got on the source,
+// so a replica should not take writes of its own.
+func (db *DB) AppendRaw(b []byte) (fid uint32, offset uint64, err error) {
+	if err = db.writable(); err != nil {
+		return 0, 0, err
+	}
+	e, err := decodeEntry(b, db.opt.Codec)
+	if err != nil {
+		return 0, 0, err
+	}
+	switch {
+	case e.Size() != uint64(len(b)):
+		return 0, 0, errors.Errorf("Entry size %d does not match %d bytes", e.Size(), len(b))
+	case e.mark != Normal && e.mark != Tombstone:
+		return 0, 0, errors.Errorf("Invalid entry mark %d", e.mark)
+	case e.flags&flagRef != 0:
+		// The referenced position is only meaningful in the source database.
+		return 0, 0, errors.New("Tombstone referring to an entry cannot be appended")
+	}
+	if err = db.checkKey(e.key); err != nil {
+		return 0, 0, err
+	}
+
+	if err = db.lockWriteOpen(LockOpRaw); err != nil {
+		return 0, 0, err
+	}
+	defer db.unlockWrite()
+	if err = db.addCompression(e.compression); err != nil {
+		return 0, 0, err
+	}
+	old, ok := db.keyDir.get(e.key)
+	valueBytes := db.valueBytes
+	if ok {
+		valueBytes -= int64(old.vLen)
+	}
+	if e.mark == Normal {
+		valueBytes += int64(e.vLen)
+		if db.opt.MaxTotalValueBytes > 0 && valueBytes > db.opt.MaxTotalValueBytes {
+			return 0, 0, ErrQuotaExceeded
+		}
+	}
+	lo, err := db.dbFile.WriteRaw(e, b)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Update index
+	if e.mark == Tombstone {
+		db.keyDir.remove(e.key)
+	} else {
+		db.keyDir.set(e.key, lo)
+		db.ttlSweep.add(e.key, lo.expiry)
+		db.waiters.notify()
+		if n := db.keyDir.len(); n > db.keyDirPeak {
+			db.keyDirPeak = n
+		}
+	}
+	db.valueBytes = valueBytes
+	return lo.fid, lo.offset, nil
+}
@@ -0,0 +1,125 @@
+package minidb
+
+import (
+	"github.com/pingcap/errors"
+	"os"
+	"time"
+)
+
+// DropFilesOlderThan deletes the oldest sealed log files whose entries were all written
+// before t, along with their hint files, which reclaims the space of expired data far
+// more cheaply than a merge rewriting it, e.g. for append-only time series. Keys whose
+// latest version is in a dropped file are deleted. Files are dropped oldest first, and it
+// stops at the first file which holds an entry written at or after t or without a
+// timestamp, or which a snapshot pins, since the tombstones of a dropped file would no
+// longer shadow the older versions kept in older files. It needs EntryTimestamps, fails
+// with ErrGcWorking if a merge is running and returns the number of files dropped.
+func (db *DB) DropFilesOlderThan(t time.Time) (int, error) {
+	if err := db.writable(); err != nil {
+		return 0, err
+	}
+	if !db.gcLock.TryLock() {
+		return 0, ErrGcWorking
+	}
+	defer db.gcLock.Unlock()
+	// The database may have been closed since it was checked.
+	if db.isClosed() {
+		return 0, ErrDatabaseClosed
+	}
+
+	// Writes may append a new active log file meanwhile, so the files are copied under the lock.
+	db.rlock(LockOpMaintenance)
+	var sealed []*logFile
+	if n := len(db.dbFile.files); n >= 2 {
+		sealed = append(sealed, db.dbFile.files[:n-1]...)
+	}
+	db.mu.RUnlock()
+
+	cutoff := t.UnixNano()
+	dropped := 0
+	for _, lf := range sealed {
+		if lf.pinned() {
+			break
+		}
+		keys, maxSeq, ok, err := lf.expiredKeys(cutoff)
+		if err != nil {
+			return dropped, err
+		}
+		if !ok {
+			break
+		}
+		// Keep the write sequence from going backwards if every entry is dropped.
+		if err = db.advanceSeqWatermark(maxSeq); err != nil {
+			return dropped, err
+		}
+		if err = db.dropFile(lf, keys); err == ErrFilesPinned {
+			break
+		}
+		if err != nil {
+			return dropped, err
+		}
+		dropped++
+	}
+	if dropped > 0 {
+		// Otherwise a crash may bring back the keys of the dropped files.
+		if err := db.syncDir(db.dbFile.dirPath); err != nil {
+			return dropped, errors.Wrap(err, "Unable to sync log file dir")
+		}
+	}
+	return dropped, nil
+}
+
+// expiredKeys tells whether every entry of the log file was written before cutoff, and if
+// so returns the offsets of its entries by key and its max write sequence.
+func (lf *logFile) expiredKeys(cutoff int64) (map[string]uint64, uint64, bool, error) {
+	keys := make(map[string]uint64)
+	var maxSeq uint64
+	for offset := uint64(0); offset < lf.size; {
+		e, err := lf.read(offset)
+		if err != nil {
+			return nil, 0, false, errors.Wrapf(err, "Unable to read entry at offset %d of %q", offset, lf.path)
+		}
+		if e.kLen == 0 && e.flags&flagRef == 0 {
+			// The rest of the file is not filled with actual data.
+			break
+		}
+		if e.flags&flagTimestamp == 0 || e.timestamp >= cutoff {
+			return nil, 0, false, nil
+		}
+		if e.mark == Normal {
+			keys[string(e.key)] = offset
+		}
+		if e.seq > maxSeq {
+			maxSeq = e.seq
+		}
+		offset += e.Size()
+	}
+	return keys, maxSeq, true, nil
+}
+
+// dropFile deletes the keys whose latest entry is in the log file, given the offsets of
+// its entries by key, and then the log file and its hint file. The caller must hold gcLock.
+func (db *DB) dropFile(lf *logFile, keys map[string]uint64) error {
+	db.lock(LockOpMaintenance)
+	defer db.mu.Unlock()
+	if lf.pinned() {
+		// A reader pinned the file meanwhile, which it can only do while holding db.mu.
+		return ErrFilesPinned
+	}
+	db.removeExpired(lf.fid, keys)
+	df := &db.dbFile
+	for i, f := range df.files {
+		if f == lf {
+			df.files = append(df.files[:i], df.files[i+1:]...)
+			break
+		}
+	}
+	if err := df.removeFile(lf); err != nil {
+		return errors.Wrapf(err, "Unable to delete file: %q", lf.path)
+	}
+	idxFilePath := indexFilePath(df.dirPath, lf.fid)
+	if err := os.Remove(idxFilePath); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Unable to delete file: %q", idxFilePath)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package minidb
+
+import (
+	"bytes"
+	"github.com/pingcap/errors"
+	"math/rand"
+	"time"
+)
+
+// scrubSampleSize is the number of keys checked by the scrubber every interval.
+const scrubSampleSize = 16
+
+// scrubber checks sampled keys of keyDir against their entries on disk in the background.
+type scrubber struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (db *DB) startScrubber() {
+	if db.opt.ScrubInterval <= 0 {
+		return
+	}
+	db.scrub = &scrubber{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func(s *scrubber) {
+		defer close(s.done)
+		ticker := time.NewTicker(db.opt.ScrubInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				db.scrubSample(scrubSampleSize)
+			}
+		}
+	}(db.scrub)
+}
+
+// stopScrubber stops the scrubber and waits for it to exit.
+func (db *DB) stopScrubber() {
+	if db.scrub == nil {
+		return
+	}
+	close(db.scrub.stop)
+	<-db.scrub.done
+}
+
+// scrubSample reads the entries of up to n keys, picked by the random order of map
+// iteration from a random shard on, and reports those whose entry cannot be read or
+// holds another key. They are repaired afterwards if opt.ScrubRepair is set.
+func (db *DB) scrubSample(n int) {
+	db.rlock(LockOpScan)
+	var bad []string
+	start := rand.Intn(keyDirShards)
+	for i := 0; i < keyDirShards && n > 0; i++ {
+		n, bad = db.scrubShard((start+i)%keyDirShards, n, bad)
+	}
+	db.mu.RUnlock()
+
+	if !db.opt.ScrubRepair || db.readOnly {
+		return
+	}
+	for _, key := range bad {
+		if err := db.repairKey([]byte(key)); err != nil {
+			db.opt.Logger.Errorf("Repairing key %q: %v", key, err)
+			db.recordError(err)
+		}
+	}
+}
+
+// scrubShard checks up to n keys of the i-th shard, appends those failing the check
+// to bad, and returns how many keys are left to check.
+func (db *DB) scrubShard(i, n int, bad []string) (int, []string) {
+	db.keyDir.forEachInShard(i, func(key string, lo *logOffset) bool {
+		if n == 0 {
+			return false
+		}
+		n--
+		if err := db.checkEntry([]byte(key), lo); err != nil {
+			db.opt.Logger.Errorf("Scrubbing key %q: %v", key, err)
+			if db.opt.OnScrubError != nil {
+				db.opt.OnScrubError([]byte(key), err)
+			}
+			bad = append(bad, key)
+		}
+		return true
+	})
+	return n, bad
+}
+
+// checkEntry returns an error if the entry at lo cannot be read or holds another key.
+func (db *DB) checkEntry(key []byte, lo *logOffset) error {
+	e, err := db.dbFile.Read(lo)
+	if err == nil && !bytes.Equal(e.key, key) {
+		err = errors.Errorf("Entry at fid %d offset %d holds key %q", lo.fid, lo.offset, e.key)
+	}
+	return err
+}
+
+// repairKey finds the latest entry of key by replaying every log file, like Open
+// does, and points keyDir at it, or removes key if it is deleted. Nothing is done
+// if the entry of key has been fixed or rewritten meanwhile.
+func (db *DB) repairKey(key []byte) error {
+	// Writers are held off, since the active log file is read to its end.
+	db.lockWrite(LockOpScan)
+	defer db.unlockWrite()
+	old, ok := db.keyDir.get(key)
+	if !ok || db.checkEntry(key, old) == nil {
+		return nil
+	}
+
+	var latest *logOffset
+	for _, lf := range db.dbFile.files {
+		_, err := db.dbFile.iterate(lf, func(k []byte, lo *logOffset, _ uint64) error {
+			if string(k) == string(key) {
+				latest = lo
+			}
+			return nil
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	if latest == nil {
+		db.keyDir.remove(key)
+		db.valueBytes -= int64(old.vLen)
+		db.opt.Logger.Warnf("Repaired key %q by removing it, as it is deleted", key)
+		return nil
+	}
+	if err := db.checkEntry(key, latest); err != nil {
+		return err
+	}
+	db.keyDir.set(key, latest)
+	db.valueBytes += int64(latest.vLen) - int64(old.vLen)
+	db.opt.Logger.Warnf("Repaired key %q to point at fid %d offset %d", key, latest.fid, latest.offset)
+	return nil
+}
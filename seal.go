@@ -0,0 +1,162 @@
+package minidb
+
+import (
+	"github.com/pingcap/errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// SealActive seals the active log file, that is, truncates and syncs it, writes a hint
+// file for it and starts a new active log file. It does nothing if the active log file
+// is empty, so calling it repeatedly never leaves empty files behind. It is useful to
+// turn the recent writes into an immutable, hint indexed file, e.g. before a backup.
+// It waits for a running merge to finish.
+func (db *DB) SealActive() error {
+	if err := db.writable(); err != nil {
+		return err
+	}
+	// Hold gcLock so that the sealed file is not rewritten while its hint is written.
+	db.gcLock.Lock()
+	defer db.gcLock.Unlock()
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+
+	db.lockWrite(LockOpMaintenance)
+	alf, err := db.dbFile.sealActive()
+	db.unlockWrite()
+	if err != nil || alf == nil {
+		return err
+	}
+	// The hint file is written once the file is no longer active, since the hint
+	// of the active log file is never read and would be stale after it grows.
+	// Reading the whole file takes a while, so it is done without the lock.
+	return alf.writeHint()
+}
+
+// sealActive seals the active log file if it is not empty and returns it.
+// The caller must hold db.writeMu and db.mu.
+func (df *dbFile) sealActive() (*logFile, error) {
+	alf := df.activeLogFile()
+	end := df.writableOffset()
+	if alf == nil || end == 0 {
+		return nil, nil
+	}
+	if err := alf.doneWriting(end); err != nil {
+		return nil, err
+	}
+	if err := df.dropCheckpoint(alf.fid); err != nil {
+		return nil, err
+	}
+	if err := df.createLogFile(alf.fid + 1); err != nil {
+		return nil, err
+	}
+	return alf, nil
+}
+
+// writeHint writes a hint file indexing all entries of the sealed log file.
+func (lf *logFile) writeHint() error {
+	hw, err := newHintWriter(lf)
+	if err != nil {
+		return err
+	}
+	defer hw.abort()
+
+	db := lf.db
+	var offset uint64
+	for {
+		e, err := lf.read(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return errors.Wrapf(err, "Unable to read entry at offset %d of %q", offset, lf.path)
+		}
+		size := e.Size()
+		if e.mark == Tombstone && e.flags&flagRef != 0 {
+			// Like replay, drop the tombstone if the entry it refers to is gone.
+			db.rlock(LockOpMaintenance)
+			e.key = db.dbFile.resolveRef(e)
+			db.mu.RUnlock()
+			if e.key == nil {
+				offset += size
+				continue
+			}
+			e.kLen = uint32(len(e.key))
+			e.flags &^= flagRef
+		}
+		if err = hw.add(e, offset); err != nil {
+			return err
+		}
+		offset += size
+	}
+
+	if err = hw.close(db.opt.SyncMode); err != nil {
+		return err
+	}
+	if err = hw.commit(); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(lf.path))
+}
+
+// hintWriter writes the hint file of a log file into a temp file, which replaces
+// the hint file once committed, so that a partial hint file is never read.
+type hintWriter struct {
+	hf   *hintFile
+	path string
+	done bool
+}
+
+// newHintWriter creates the temp hint file of lf, replacing one left behind by a crash.
+func newHintWriter(lf *logFile) (*hintWriter, error) {
+	idxFilePath := indexFilePath(filepath.Dir(lf.path), lf.fid)
+	tempIndexPath := idxFilePath + tempFileNameSuffix
+	if err := os.Remove(tempIndexPath); err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "Unable to remove file: %q", tempIndexPath)
+	}
+	hf := &hintFile{fid: lf.fid, path: tempIndexPath}
+	if err := hf.openWriteOnly(); err != nil {
+		return nil, err
+	}
+	return &hintWriter{hf: hf, path: idxFilePath}, nil
+}
+
+// add writes the index of e, which is at offset of the log file.
+func (hw *hintWriter) add(e *Entry, offset uint64) error {
+	idx := &Index{entryExt: e.entryExt, mark: e.mark, fid: hw.hf.fid, offset: offset, kLen: e.kLen, key: e.key}
+	// The checksum covers the entry, not the index.
+	idx.flags &^= flagChecksum
+	if e.mark == Normal {
+		idx.flags |= flagValueSize
+		idx.valueSize = e.vLen
+	}
+	if err := hw.hf.write(idx); err != nil {
+		return errors.Wrapf(err, "Unable to write into hint file: %q", hw.hf.path)
+	}
+	return nil
+}
+
+// close flushes and syncs the temp hint file.
+func (hw *hintWriter) close(mode SyncMode) error {
+	return hw.hf.close(hw.hf.size, mode)
+}
+
+// commit replaces the hint file by the closed temp hint file.
+func (hw *hintWriter) commit() error {
+	if err := os.Rename(hw.hf.path, hw.path); err != nil {
+		return errors.Wrapf(err, "Unable to rename file: %q", hw.hf.path)
+	}
+	hw.done = true
+	return nil
+}
+
+// abort removes the temp hint file unless it is committed.
+func (hw *hintWriter) abort() {
+	if hw.done {
+		return
+	}
+	hw.hf.fd.Close()
+	os.Remove(hw.hf.path)
+}
@@ -0,0 +1,89 @@
+package minidb
+
+import (
+	"github.com/pingcap/errors"
+	"io"
+)
+
+// sharedBufMaxSize is the size of the largest buffer which ReleaseShared pools,
+// so that a few large values are not kept in memory.
+const sharedBufMaxSize = 1 << 20
+
+// GetShared is like Get, but reads the value into a buffer taken from a pool, which
+// saves the allocations of Get when values are read at a high rate. The caller must
+// not modify the value, and should hand it back with ReleaseShared once done, after
+// which neither the caller nor anyone it passed the value to may use it, since the
+// buffer is reused by other reads. A value which is not released is garbage collected.
+func (db *DB) GetShared(key []byte) ([]byte, error) {
+	if db.isClosed() {
+		return nil, ErrDatabaseClosed
+	}
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+
+	db.counters.gets.Add(1)
+	if err := db.rlockOpen(LockOpGet); err != nil {
+		return nil, err
+	}
+	defer db.mu.RUnlock()
+	lo, ok := db.keyDir.get(key)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	lf, err := db.dbFile.getFile(lo.fid)
+	if err != nil {
+		return nil, err
+	}
+
+	var hdr [varintEntryHeaderMaxSize + entryExtMaxSize]byte
+	n, err := lf.fd.ReadAt(hdr[:maxEntryHeaderSize(db.opt.Codec)], int64(lo.offset))
+	if err != nil && (err != io.EOF || n == 0) {
+		return nil, errors.Wrapf(err, "Unable to read entry at offset %d of %q", lo.offset, lf.path)
+	}
+	var e Entry
+	if err = decodeHeader(hdr[:n], db.opt.Codec, &e); err != nil {
+		return nil, err
+	}
+	if e.flags&flagNilValue != 0 {
+		return nil, nil
+	}
+	val := db.sharedBuf(int(e.vLen))
+	if _, err = lf.fd.ReadAt(val, int64(lo.offset)+int64(e.hLen)+int64(e.kLen)); err != nil {
+		return nil, errors.Wrapf(err, "Unable to read entry at offset %d of %q", lo.offset, lf.path)
+	}
+	// The key is not read back, the one looked for is the one stored unless corrupted.
+	if err = e.verifyChecksum(key, val); err != nil {
+		db.ReleaseShared(val)
+		return nil, errors.Wrapf(err, "Entry at offset %d of %q", lo.offset, lf.path)
+	}
+	if e.compression != NoCompression {
+		// The decompressed value is allocated anew, releasing it still pools its buffer.
+		plain, err := decompress(e.compression, val)
+		db.ReleaseShared(val)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Entry at offset %d of %q", lo.offset, lf.path)
+		}
+		val = plain
+	}
+	db.counters.bytesRead.Add(uint64(len(val)))
+	return val, nil
+}
+
+// ReleaseShared hands a value returned by GetShared back to the pool.
+func (db *DB) ReleaseShared(val []byte) {
+	if cap(val) == 0 || cap(val) > sharedBufMaxSize {
+		return
+	}
+	val = val[:cap(val)]
+	db.sharedBufs.Put(&val)
+}
+
+// sharedBuf returns a buffer of n bytes from the pool of GetShared, or a new one
+// if the pooled buffer is too small.
+func (db *DB) sharedBuf(n int) []byte {
+	if bp, _ := db.sharedBufs.Get().(*[]byte); bp != nil && cap(*bp) >= n {
+		return (*bp)[:n]
+	}
+	return make([]byte, n)
+}
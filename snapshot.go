@@ -0,0 +1,156 @@
+package minidb
+
+import (
+	"github.com/pingcap/errors"
+	"sync/atomic"
+)
+
+// Snapshot is a read-only view of the database at the time it is taken. It pins
+// the log files it refers to, so Merge leaves them alone and Defragment fails with
+// ErrFilesPinned until every snapshot referring to them is closed.
+type Snapshot struct {
+	db     *DB
+	keyDir *keyDir
+	files  []*logFile
+	closed int32
+}
+
+// NewSnapshot takes a snapshot of the database. It copies the index, so it takes
+// time and memory in proportion to the number of keys, and waits for a running
+// merge to finish. The snapshot must be closed to let Merge reclaim its files.
+func (db *DB) NewSnapshot() (*Snapshot, error) {
+	if db.isClosed() {
+		return nil, ErrDatabaseClosed
+	}
+	// Hold gcLock so that no file is being rewritten while it gets pinned.
+	db.gcLock.Lock()
+	defer db.gcLock.Unlock()
+	// The database may be closed while waiting.
+	if db.isClosed() {
+		return nil, ErrDatabaseClosed
+	}
+
+	db.rlock(LockOpMaintenance)
+	defer db.mu.RUnlock()
+	s := &Snapshot{
+		db:     db,
+		keyDir: db.keyDir.clone(),
+		files:  make([]*logFile, len(db.dbFile.files)),
+	}
+	copy(s.files, db.dbFile.files)
+	for _, lf := range s.files {
+		atomic.AddInt32(&lf.refs, 1)
+	}
+	return s, nil
+}
+
+// SnapshotGet looks for keys and returns the values of those found, by key, as of the
+// same instant: the positions of all the values are taken under one lock acquisition,
+// so no write lands in between. The values are read afterwards without holding the lock,
+// while their log files are pinned, like by a snapshot, so that a merge running meanwhile
+// leaves them alone, and within an epoch, so that Close waits for them. Missing keys are
+// left out.
+func (db *DB) SnapshotGet(keys [][]byte) (map[string][]byte, error) {
+	if db.isClosed() {
+		return nil, ErrDatabaseClosed
+	}
+	for _, key := range keys {
+		if len(key) == 0 {
+			return nil, ErrEmptyKey
+		}
+	}
+
+	type position struct {
+		key    []byte
+		lf     *logFile
+		offset uint64
+	}
+	epoch, err := db.enterRead()
+	if err != nil {
+		return nil, err
+	}
+	defer db.epochs.exit(epoch)
+	positions := make([]position, 0, len(keys))
+	defer func() {
+		for _, p := range positions {
+			atomic.AddInt32(&p.lf.refs, -1)
+		}
+	}()
+	db.counters.gets.Add(uint64(len(keys)))
+	db.rlock(LockOpGet)
+	for _, key := range keys {
+		lo, ok := db.keyDir.get(key)
+		if !ok {
+			continue
+		}
+		lf, err := db.dbFile.getFile(lo.fid)
+		if err != nil {
+			db.mu.RUnlock()
+			return nil, err
+		}
+		atomic.AddInt32(&lf.refs, 1)
+		positions = append(positions, position{key: key, lf: lf, offset: lo.offset})
+	}
+	db.mu.RUnlock()
+
+	vals := make(map[string][]byte, len(positions))
+	for _, p := range positions {
+		e, err := p.lf.read(p.offset)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to read entry at offset %d of %q", p.offset, p.lf.path)
+		}
+		vals[string(p.key)] = e.value
+		db.counters.bytesRead.Add(uint64(len(e.value)))
+	}
+	return vals, nil
+}
+
+// Get looks for key in the snapshot and returns its value.
+// If key is not found, ErrKeyNotFound is returned.
+func (s *Snapshot) Get(key []byte) ([]byte, error) {
+	if atomic.LoadInt32(&s.closed) == 1 || s.db.isClosed() {
+		return nil, ErrDatabaseClosed
+	}
+	lo, ok := s.keyDir.get(key)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	var lf *logFile
+	for _, f := range s.files {
+		if f.fid == lo.fid {
+			lf = f
+			break
+		}
+	}
+	if lf == nil {
+		return nil, ErrFileNotFound
+	}
+
+	// The snapshot keeps Merge from closing the file, but not DB.Close, which waits
+	// for the reads within an epoch instead.
+	epoch, err := s.db.enterRead()
+	if err != nil {
+		return nil, err
+	}
+	defer s.db.epochs.exit(epoch)
+	e, err := lf.read(lo.offset)
+	if err != nil {
+		return nil, err
+	}
+	return e.value, nil
+}
+
+// Close releases the files pinned by the snapshot. It is safe to call more than once.
+func (s *Snapshot) Close() {
+	if !atomic.CompareAndSwapInt32(&s.closed, 0, 1) {
+		return
+	}
+	for _, lf := range s.files {
+		atomic.AddInt32(&lf.refs, -1)
+	}
+}
+
+// pinned tells whether a snapshot refers to the log file.
+func (lf *logFile) pinned() bool {
+	return atomic.LoadInt32(&lf.refs) > 0
+}
@@ -1,8 +1,41 @@
 package minidb
 
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"hash/fnv"
+	"time"
+)
+
 const (
 	entryHeaderSize = 9
-	indexHeaderSize = 12
+	// wideEntryHeaderSize is the size of a FixedCodec header with markWideValue set.
+	wideEntryHeaderSize = 13
+	indexHeaderSize     = 17
+
+	// varintEntryHeaderMaxSize is mark + kLen + vLen with both lengths as uvarint.
+	varintEntryHeaderMaxSize = 1 + binary.MaxVarintLen32 + binary.MaxVarintLen64
+
+	// entryExtMaxSize is the max size of the flags byte and the optional fields.
+	entryExtMaxSize = 1 + 8 + 8 + 8 + 16 + 8 + 8 + 4
+
+	// maxLogFileSize is the largest Options.LogFileSize.
+	maxLogFileSize = 1 << 40
+	// maxEntrySize is the max size of the key and value of an entry, far more than a
+	// value read back into memory can take, so that larger lengths in a header are
+	// known to be corrupt.
+	maxEntrySize = 1 << 40
+)
+
+// Codec decides how the lengths in entry header are encoded.
+type Codec byte
+
+const (
+	// FixedCodec encodes kLen and vLen as fixed 4 bytes each, or vLen as 8 bytes for a
+	// value of 4GB or more.
+	FixedCodec Codec = iota
+	// VarintCodec encodes kLen and vLen as uvarint, which shrinks the header of small entries.
+	VarintCodec
 )
 
 type EntryMark byte
@@ -10,48 +43,324 @@ type EntryMark byte
 const (
 	Normal EntryMark = iota
 	Tombstone
+
+	// markExtended is set in the mark byte when a flags byte follows it.
+	markExtended EntryMark = 1 << 7
+	// markCompression are the bits of the mark byte which hold the Compression of the
+	// value, zero if it is stored as is.
+	markCompression EntryMark = 0x07 << markCompressionShift
+	// markWideValue is set in the mark byte of a FixedCodec header whose vLen takes 8
+	// bytes, see wideEntryHeaderSize.
+	markWideValue EntryMark = 1 << 3
+
+	markCompressionShift = 4
+)
+
+// entryFlag tells which optional fields are present in entry or index header.
+// Entries written before the flags were introduced have none of them.
+type entryFlag byte
+
+const (
+	// flagSeq means an 8 bytes write sequence is present.
+	flagSeq entryFlag = 1 << iota
+	// flagValueSize means an 8 bytes value size is present, only used in index.
+	flagValueSize
+	// flagTimestamp means an 8 bytes write time in unix nanoseconds is present.
+	flagTimestamp
+	// flagRef means the tombstone stores no key but refers to the entry it deletes,
+	// with a 4 bytes fid, 4 bytes offset and 8 bytes key hash. Entries past 4GB into
+	// a log file are deleted by tombstones storing their key instead.
+	flagRef
+	// flagContentHash means an 8 bytes hash of the value is present.
+	flagContentHash
+	// flagNilValue means the value was nil rather than empty, it has no field.
+	flagNilValue
+	// flagChecksum means a 4 bytes CRC32 (IEEE) of the entry is present. It is the last
+	// field, and covers the header before it along with the key and value.
+	flagChecksum
+	// flagExpiry means an 8 bytes expiry time in unix nanoseconds is present. It takes the
+	// last bit, so another field needs a second flags byte.
+	flagExpiry
 )
 
+// knownEntryFlags are the flags this version can read. Others are written by a
+// newer version, and the size of their fields is unknown.
+const knownEntryFlags = flagSeq | flagValueSize | flagTimestamp | flagRef | flagContentHash | flagNilValue |
+	flagChecksum | flagExpiry
+
+// defaultEntryFlags are the optional fields written for every new entry.
+const defaultEntryFlags = flagSeq
+
+// extSize returns the size of the flags byte and the optional fields.
+func (f entryFlag) extSize() uint32 {
+	if f == 0 {
+		return 0
+	}
+	size := uint32(1)
+	if f&flagSeq != 0 {
+		size += 8
+	}
+	if f&flagValueSize != 0 {
+		size += 8
+	}
+	if f&flagTimestamp != 0 {
+		size += 8
+	}
+	if f&flagRef != 0 {
+		size += 16
+	}
+	if f&flagContentHash != 0 {
+		size += 8
+	}
+	if f&flagExpiry != 0 {
+		size += 8
+	}
+	if f&flagChecksum != 0 {
+		size += 4
+	}
+	return size
+}
+
+// entryExt holds the optional fields of entry or index header.
+type entryExt struct {
+	flags     entryFlag
+	seq       uint64
+	valueSize uint64
+	timestamp int64
+	refFid    uint32
+	refOffset uint32
+	keyHash   uint64
+	valueHash uint64
+	expiry    int64
+	checksum  uint32
+}
+
 // Entry provides key size, value size, key, value.
 type Entry struct {
+	entryExt
+	hLen  uint32
 	mark  EntryMark
 	kLen  uint32
-	vLen  uint32
+	vLen  uint64
 	key   []byte
 	value []byte
+
+	// compression is how the value is compressed on disk, vLen is the compressed length
+	// while value holds it decompressed.
+	compression Compression
+
+	// headerCRC is the CRC32 of the header before the checksum, set on decoding.
+	headerCRC uint32
 }
 
 func NewEntry(key, val []byte, mark EntryMark) *Entry {
 	e := &Entry{
-		mark:  mark,
-		kLen:  uint32(len(key)),
-		vLen:  uint32(len(val)),
-		key:   key,
-		value: val,
+		entryExt: entryExt{flags: defaultEntryFlags},
+		hLen:     entryHeaderSize + defaultEntryFlags.extSize(),
+		mark:     mark,
+		kLen:     uint32(len(key)),
+		vLen:     uint64(len(val)),
+		key:      key,
+		value:    val,
 	}
 	return e
 }
 
+// newRefTombstone returns a tombstone which refers to the entry of key at lo instead of storing key.
+// The key is kept in memory only, kLen stays zero so it is not encoded.
+func newRefTombstone(key []byte, lo *logOffset) *Entry {
+	e := NewEntry(nil, nil, Tombstone)
+	e.key = key
+	e.flags |= flagRef
+	e.refFid, e.refOffset, e.keyHash = lo.fid, uint32(lo.offset), hashKey(key)
+	e.hLen = entryHeaderSize + e.flags.extSize()
+	return e
+}
+
+// hashKey returns the hash of key stored in a tombstone which refers to an entry.
+// It is the content hash of values as well.
+func hashKey(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return h.Sum64()
+}
+
+// expiresAt returns the expiry time in unix nanoseconds, or zero if there is none.
+func (ext *entryExt) expiresAt() int64 {
+	if ext.flags&flagExpiry == 0 {
+		return 0
+	}
+	return ext.expiry
+}
+
+// expired tells whether the entry has an expiry time which is not after now,
+// in unix nanoseconds.
+func (e *Entry) expired(now int64) bool {
+	return e.flags&flagExpiry != 0 && e.expiry <= now
+}
+
+// clone returns a copy of the entry which shares no memory with it.
+func (e *Entry) clone() *Entry {
+	c := *e
+	c.key = append([]byte(nil), e.key...)
+	if e.value != nil {
+		c.value = append([]byte{}, e.value...)
+	}
+	return &c
+}
+
 // Size returns the size of the bytes occupied.
-func (e *Entry) Size() uint32 {
-	return entryHeaderSize + e.kLen + e.vLen
+func (e *Entry) Size() uint64 {
+	return uint64(e.hLen) + uint64(e.kLen) + e.vLen
+}
+
+// Key returns the key of the entry.
+func (e *Entry) Key() []byte {
+	return e.key
+}
+
+// Value returns the value of the entry, it is empty for a tombstone.
+func (e *Entry) Value() []byte {
+	return e.value
+}
+
+// restoreNilValue sets the value read back to nil if it was nil when written.
+func (e *Entry) restoreNilValue() {
+	if e.flags&flagNilValue != 0 {
+		e.value = nil
+	}
+}
+
+// verifyChecksum returns ErrChecksumMismatch if the entry has a checksum which does not
+// match its decoded header and kv, the key and value read back as they are encoded.
+func (e *Entry) verifyChecksum(kv ...[]byte) error {
+	if e.flags&flagChecksum == 0 {
+		return nil
+	}
+	crc := e.headerCRC
+	for _, b := range kv {
+		crc = crc32.Update(crc, crc32.IEEETable, b)
+	}
+	if crc != e.checksum {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// Mark returns whether the entry is a normal entry or a tombstone.
+func (e *Entry) Mark() EntryMark {
+	return e.mark
+}
+
+// meta returns the metadata of the entry.
+func (e *Entry) meta() EntryMeta {
+	meta := EntryMeta{Seq: e.seq}
+	if e.flags&flagTimestamp != 0 {
+		meta.Timestamp = time.Unix(0, e.timestamp)
+	}
+	if e.flags&flagContentHash != 0 {
+		meta.ContentHash = e.valueHash
+	}
+	if e.flags&flagExpiry != 0 {
+		meta.ExpiresAt = time.Unix(0, e.expiry)
+	}
+	return meta
+}
+
+// EntryMeta provides the metadata of an entry.
+type EntryMeta struct {
+	// Seq is the global write sequence of the entry, which never decreases.
+	// It is zero for entries written before the sequence was introduced.
+	Seq uint64
+	// Timestamp is the write time of the entry, see Options.EntryTimestamps.
+	// It is zero for entries written without it.
+	Timestamp time.Time
+	// ContentHash is the hash of the value, see Options.ContentHash.
+	// It is zero for entries written without it.
+	ContentHash uint64
+	// ExpiresAt is when the entry expires, see PutWithTTL. It is zero for entries
+	// which never expire.
+	ExpiresAt time.Time
+}
+
+// FileStat provides the stats of a sealed log file.
+type FileStat struct {
+	Fid uint32
+	// Size is the size of the log file in bytes.
+	Size int64
+	// LiveKeys is the number of keys whose current value is in the log file.
+	LiveKeys int
+	// LiveBytes is the key and value bytes of the live keys, entry headers excluded.
+	LiveBytes int64
+}
+
+// Stats provides the disk usage of the database, as reported by Stats.
+type Stats struct {
+	// LogFiles is the number of log files, the active one included.
+	LogFiles int
+	// TotalBytes is the size of the entries in the log files, which is the size of the
+	// sealed log files plus the bytes written to the active one.
+	TotalBytes int64
+	// LiveKeys is the number of live keys, those expired but not yet dropped included.
+	LiveKeys int
+	// ExpiredPending is the number of keys which have expired, see PutWithTTL, but are
+	// still in the index since they have been neither read nor merged away.
+	ExpiredPending int
+	// LiveWithTTL is the number of keys which have not expired yet but will.
+	LiveWithTTL int
+	// ReclaimableBytes is an estimate of the bytes of dead entries, that is overwritten
+	// and deleted ones along with tombstones, which Merge may reclaim.
+	ReclaimableBytes int64
+}
+
+// MergePlan is what Merge would do, as reported by MergeDryRun.
+type MergePlan struct {
+	// Files are the log files Merge would compact, in fid order.
+	Files []FileMergePlan
+	// ReclaimableBytes is the sum of the bytes reclaimed from Files.
+	ReclaimableBytes int64
+}
+
+// FileMergePlan is what Merge would do to a log file.
+type FileMergePlan struct {
+	Fid uint32
+	// Size is the size of the log file in bytes.
+	Size int64
+	// LiveEntries is the number of entries Merge would keep, tombstones included.
+	LiveEntries int
+	// DeadEntries is the number of entries Merge would drop.
+	DeadEntries int
+	// ReclaimableBytes is the number of bytes the log file would shrink by.
+	ReclaimableBytes int64
+}
+
+// IndexEntry is the position of the latest entry of a key, as written by DumpIndex.
+type IndexEntry struct {
+	Key    []byte
+	Fid    uint32
+	Offset uint64
 }
 
 // logOffset is used in keyDir
 type logOffset struct {
 	fid    uint32
-	offset uint32
+	offset uint64
+	vLen   uint64
+	// expiry is when the entry expires in unix nanoseconds, zero if it never does.
+	expiry int64
 }
 
 // Index is used in hint file.
 type Index struct {
+	entryExt
+	mark   EntryMark
 	fid    uint32
-	offset uint32
+	offset uint64
 	kLen   uint32
 	key    []byte
 }
 
 // Size returns the size of the bytes occupied.
 func (idx *Index) Size() uint32 {
-	return indexHeaderSize + idx.kLen
+	return indexHeaderSize + idx.flags.extSize() + idx.kLen
 }
@@ -0,0 +1,110 @@
+package minidb
+
+import (
+	"container/heap"
+	"time"
+)
+
+// expiryItem is a key written with PutWithTTL and when it expires.
+type expiryItem struct {
+	expiry int64
+	key    string
+}
+
+// expiryHeap orders the keys by expiry, soonest first.
+type expiryHeap []expiryItem
+
+func (h expiryHeap) Len() int            { return len(h) }
+func (h expiryHeap) Less(i, j int) bool  { return h[i].expiry < h[j].expiry }
+func (h expiryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(expiryItem)) }
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// ttlSweeper deletes the expired keys in the background, see Options.TTLSweepInterval.
+// Its heap is guarded by db.mu. Entries are not removed from the heap when their key is
+// overwritten or deleted, they are skipped once popped if the key no longer has the
+// same expiry.
+type ttlSweeper struct {
+	expiries expiryHeap
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// add records that key expires at expiry, the caller must hold db.mu. It does nothing
+// if the sweeper is off or the key never expires.
+func (s *ttlSweeper) add(key []byte, expiry int64) {
+	if s == nil || expiry == 0 {
+		return
+	}
+	heap.Push(&s.expiries, expiryItem{expiry: expiry, key: string(key)})
+}
+
+func (db *DB) startTTLSweeper() {
+	if db.opt.TTLSweepInterval <= 0 || db.readOnly {
+		return
+	}
+	s := &ttlSweeper{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	db.keyDir.forEach(func(key string, lo *logOffset) bool {
+		if lo.expiry != 0 {
+			s.expiries = append(s.expiries, expiryItem{expiry: lo.expiry, key: key})
+		}
+		return true
+	})
+	heap.Init(&s.expiries)
+	db.ttlSweep = s
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(db.opt.TTLSweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				db.sweepExpired()
+			}
+		}
+	}()
+}
+
+// stopTTLSweeper stops the sweeper and waits for it to exit.
+func (db *DB) stopTTLSweeper() {
+	if db.ttlSweep == nil {
+		return
+	}
+	close(db.ttlSweep.stop)
+	<-db.ttlSweep.done
+}
+
+// sweepExpired writes a tombstone for every key which has expired by now, popping them
+// from the heap soonest first, so keys which have not expired yet are not looked at.
+func (db *DB) sweepExpired() {
+	s := db.ttlSweep
+	now := nowFunc().UnixNano()
+	db.lockWrite(LockOpDelete)
+	defer db.unlockWrite()
+	for len(s.expiries) > 0 && s.expiries[0].expiry <= now {
+		item := heap.Pop(&s.expiries).(expiryItem)
+		key := []byte(item.key)
+		// The key was overwritten or deleted since
+		lo, ok := db.keyDir.get(key)
+		if !ok || lo.expiry != item.expiry {
+			continue
+		}
+		if err := db.delete(key, lo); err != nil {
+			// Try again on the next sweep
+			heap.Push(&s.expiries, item)
+			db.opt.Logger.Errorf("TTL sweep: %v", err)
+			db.recordError(err)
+			return
+		}
+	}
+}
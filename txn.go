@@ -0,0 +1,191 @@
+package minidb
+
+import "sort"
+
+// Txn is an optimistic transaction. It reads from the database as it goes and buffers
+// its writes, which Commit applies only if none of the keys read has been written
+// since, so transactions committed concurrently behave as if run one after another.
+// A Txn is not safe for concurrent use, and cannot be used once committed.
+type Txn struct {
+	db     *DB
+	reads  map[string]txnRead
+	writes map[string]txnWrite
+	done   bool
+}
+
+// txnRead is what a Txn saw of a key the first time it read it.
+type txnRead struct {
+	found bool
+	lo    *logOffset
+	seq   uint64
+}
+
+// txnWrite is a buffered write of a Txn.
+type txnWrite struct {
+	val    []byte
+	delete bool
+}
+
+// NewTxn starts a transaction.
+func (db *DB) NewTxn() *Txn {
+	return &Txn{db: db, reads: make(map[string]txnRead), writes: make(map[string]txnWrite)}
+}
+
+// Get looks for key, in the writes of the transaction first, and returns ErrKeyNotFound
+// if it is missing. Keys read from the database, found or not, are checked by Commit.
+// Unlike DB.Get, Options.Overflow is not looked into.
+func (txn *Txn) Get(key []byte) ([]byte, error) {
+	if txn.done {
+		return nil, ErrTxnDone
+	}
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	if w, ok := txn.writes[string(key)]; ok {
+		if w.delete {
+			return nil, ErrKeyNotFound
+		}
+		return w.val, nil
+	}
+
+	db := txn.db
+	if db.isClosed() {
+		return nil, ErrDatabaseClosed
+	}
+	db.counters.gets.Add(1)
+	if err := db.rlockOpen(LockOpGet); err != nil {
+		return nil, err
+	}
+	lo, ok := db.keyDir.get(key)
+	var e *Entry
+	var err error
+	if ok {
+		e, err = db.dbFile.Read(lo)
+	}
+	db.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if _, seen := txn.reads[string(key)]; !seen {
+		r := txnRead{found: ok}
+		if ok {
+			r.lo, r.seq = lo, e.seq
+		}
+		txn.reads[string(key)] = r
+	}
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	db.counters.bytesRead.Add(uint64(len(e.value)))
+	return e.value, nil
+}
+
+// Put buffers the write of a key-value pair until Commit.
+func (txn *Txn) Put(key, val []byte) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	if err := txn.db.checkKey(key); err != nil {
+		return err
+	}
+	if err := checkEntrySize(key, val); err != nil {
+		return err
+	}
+	txn.writes[string(key)] = txnWrite{val: val}
+	return nil
+}
+
+// Delete buffers the deletion of a key until Commit. Deleting a missing key does nothing.
+func (txn *Txn) Delete(key []byte) error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	if err := txn.db.checkKey(key); err != nil {
+		return err
+	}
+	txn.writes[string(key)] = txnWrite{delete: true}
+	return nil
+}
+
+// Commit applies the writes of the transaction, in key order, if none of the keys it
+// read has been written or deleted since, and returns ErrConflict otherwise, in which
+// case nothing is written and the caller may run the transaction again. A merge moving
+// the entries read is no conflict. Like ReplacePrefix, the database is locked while
+// the writes are applied, and if a write fails in the middle the keys written so far
+// stay written. The transaction is done either way.
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return ErrTxnDone
+	}
+	txn.done = true
+	db := txn.db
+	if err := db.writable(); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(txn.writes))
+	for key := range txn.writes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if err := db.lockWriteOpen(LockOpCommit); err != nil {
+		return err
+	}
+	defer db.unlockWrite()
+	if err := txn.validate(); err != nil {
+		return err
+	}
+
+	// Check quota up front, so that the commit is not stopped halfway by it
+	valueBytes := db.valueBytes
+	for key, w := range txn.writes {
+		if lo, ok := db.keyDir.get([]byte(key)); ok {
+			valueBytes -= int64(lo.vLen)
+		}
+		valueBytes += int64(len(w.val))
+	}
+	if db.opt.MaxTotalValueBytes > 0 && valueBytes > db.opt.MaxTotalValueBytes {
+		return ErrQuotaExceeded
+	}
+
+	for _, key := range keys {
+		w := txn.writes[key]
+		if !w.delete {
+			if err := db.put([]byte(key), w.val); err != nil {
+				return err
+			}
+			continue
+		}
+		if lo, ok := db.keyDir.get([]byte(key)); ok {
+			if err := db.delete([]byte(key), lo); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validate returns ErrConflict if a key read by the transaction has been written since.
+// An entry moved by a merge keeps its write sequence, which tells it apart from a new
+// one. The caller must hold db.mu.
+func (txn *Txn) validate() error {
+	db := txn.db
+	for key, r := range txn.reads {
+		lo, ok := db.keyDir.get([]byte(key))
+		if ok != r.found {
+			return ErrConflict
+		}
+		if !ok || lo == r.lo {
+			continue
+		}
+		e, err := db.dbFile.ReadHeader(lo)
+		if err != nil {
+			return err
+		}
+		// Entries written without a sequence cannot be told apart.
+		if r.seq == 0 || e.seq != r.seq {
+			return ErrConflict
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package minidb
+
+import (
+	"github.com/pingcap/errors"
+	"sync"
+)
+
+// Verify reads every entry of the log files and checks that it can be decoded.
+// Log files are independent of each other, so up to concurrency of them are
+// checked in parallel, values less than 1 mean 1. The workers read through the
+// file descriptors the database already holds and open no new files.
+// It returns the error of the corrupted file with the smallest fid, if any.
+// Merge fails with ErrGcWorking during the verification.
+func (db *DB) Verify(concurrency int) error {
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	// Hold gcLock so that sealed files are not replaced during reading.
+	db.gcLock.Lock()
+	defer db.gcLock.Unlock()
+	// The database may be closed while waiting.
+	if db.isClosed() {
+		return ErrDatabaseClosed
+	}
+
+	// Snapshot the files, the active file is only verified up to its current end offset.
+	db.rlock(LockOpScan)
+	files := make([]*logFile, len(db.dbFile.files))
+	copy(files, db.dbFile.files)
+	endOffset := db.dbFile.writableOffset()
+	db.mu.RUnlock()
+
+	errs := make([]error, len(files))
+	ch := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range ch {
+				end := files[i].size
+				if i == len(files)-1 {
+					end = endOffset
+				}
+				errs[i] = files[i].verify(end)
+			}
+		}()
+	}
+	for i := range files {
+		ch <- i
+	}
+	close(ch)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify checks that the log file holds well-formed entries up to end.
+func (lf *logFile) verify(end uint64) error {
+	var offset uint64
+	for offset < end {
+		e, err := lf.read(offset)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to read entry at offset %d of %q", offset, lf.path)
+		}
+		switch {
+		case e.mark != Normal && e.mark != Tombstone:
+			return errors.Errorf("Invalid entry mark %d at offset %d of %q", e.mark, offset, lf.path)
+		case e.mark == Normal && e.kLen == 0:
+			return errors.Errorf("Empty key at offset %d of %q", offset, lf.path)
+		case offset+e.Size() > end:
+			return errors.Errorf("Entry at offset %d of %q exceeds the end of file", offset, lf.path)
+		}
+		offset += e.Size()
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package minidb
+
+import (
+	"context"
+	"sync"
+)
+
+// keyWaiters wakes up the callers of WaitGet when keys are put.
+type keyWaiters struct {
+	mu sync.Mutex
+	// ch is closed, and dropped for a new one, when keys are put. It is nil if no one waits.
+	ch chan struct{}
+}
+
+// wait returns a channel closed on the next notify.
+func (kw *keyWaiters) wait() <-chan struct{} {
+	kw.mu.Lock()
+	defer kw.mu.Unlock()
+	if kw.ch == nil {
+		kw.ch = make(chan struct{})
+	}
+	return kw.ch
+}
+
+// notify wakes up every waiter, which looks for its key again.
+func (kw *keyWaiters) notify() {
+	kw.mu.Lock()
+	defer kw.mu.Unlock()
+	if kw.ch != nil {
+		close(kw.ch)
+		kw.ch = nil
+	}
+}
+
+// WaitGet is like Get, but if key is not found it waits until key is put, e.g. by
+// another goroutine handing a value over, and returns its value. It returns ctx.Err()
+// if ctx is done first, or ErrDatabaseClosed if the database is closed meanwhile.
+// Every put wakes up all waiters to look for their key again.
+func (db *DB) WaitGet(ctx context.Context, key []byte) ([]byte, error) {
+	for {
+		// The channel is taken before looking, so a put after the look closes it.
+		woken := db.waiters.wait()
+		val, err := db.Get(key)
+		if err != ErrKeyNotFound {
+			return val, err
+		}
+		select {
+		case <-woken:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}